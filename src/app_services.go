@@ -3,14 +3,24 @@ package main
 import (
 	"arc/internal/app"
 	"arc/internal/workflow"
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"os"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
 )
 
-type runtimeServices struct{}
+type runtimeServices struct {
+	sessions *sshSessionManager
+}
 
-type stepExecutor func(req app.SetupStepRequest, wg wgConfig, res *app.SetupStepResult) error
+type stepExecutor func(ctx infraRunContext, req app.SetupStepRequest, res *app.SetupStepResult) error
 
 var (
 	validateExecutorsOnce sync.Once
@@ -30,6 +40,7 @@ var runtimeStepExecutors = map[workflow.StepID]stepExecutor{
 	workflow.StepOpenServerFirewall:         execInfraStep,
 	workflow.StepEnableServerWG:             execInfraStep,
 	workflow.StepApplyServerNFTables:        execInfraStep,
+	workflow.StepInstallServerRelay:         execInfraStep,
 	workflow.StepAddLocalHostsAliases:       execAddLocalHostsAliases,
 	workflow.StepEnsureArcSSHAccess:         execEnsureArcSSHAccess,
 	workflow.StepInstallLocalArcPrompt:      execInstallLocalArcPrompt,
@@ -37,6 +48,8 @@ var runtimeStepExecutors = map[workflow.StepID]stepExecutor{
 	workflow.StepInstallLocalWireGuard:      execInfraStep,
 	workflow.StepWriteLocalWGConf:           execInfraStep,
 	workflow.StepEnableLocalWG:              execInfraStep,
+	workflow.StepInstallLocalRelay:          execInfraStep,
+	workflow.StepInstallLocalEndpointWatch:  execInfraStep,
 	workflow.StepVerifyArcSSHLogin:          execVerifyArcSSHLogin,
 	workflow.StepVerifyTunnelConnectivity:   execVerifyTunnelConnectivity,
 	workflow.StepResolveArcUIDGID:           execInfraStep,
@@ -52,10 +65,12 @@ var runtimeStepExecutors = map[workflow.StepID]stepExecutor{
 	workflow.StepConfigureImageClipboard:    execInfraStep,
 }
 
-func newRuntimeServices() app.Services { return runtimeServices{} }
+func newRuntimeServices() app.Services {
+	return runtimeServices{sessions: newSSHSessionManager()}
+}
 
 func (runtimeServices) CheckLocalSudo() error {
-	_, err := execLocal("sudo", "-n", "true")
+	_, err := execLocal(context.Background(), "sudo", "-n", "true")
 	return err
 }
 
@@ -63,6 +78,37 @@ func (runtimeServices) ParseSSHDeviceTarget(target string) (user, host, addr str
 	return parseSSHDeviceTarget(target)
 }
 
+func (runtimeServices) ScanHostKey(addr string) (app.HostKey, error) {
+	key, err := scanSSHHostKey(addr)
+	if err != nil {
+		return app.HostKey{}, err
+	}
+	pinned, err := lookupPinnedHostKey(addr)
+	if err != nil {
+		return app.HostKey{}, err
+	}
+	if pinned != nil && !bytes.Equal(pinned.Marshal(), key.Marshal()) {
+		return app.HostKey{}, hostKeyMismatchError(addr, pinned, key)
+	}
+	return app.HostKey{
+		Addr:        addr,
+		Fingerprint: sshHostKeyFingerprint(key),
+		Line:        strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key))),
+		Pinned:      pinned != nil,
+	}, nil
+}
+
+func (runtimeServices) TrustHostKey(hk app.HostKey) error {
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(hk.Line))
+	if err != nil {
+		return fmt.Errorf("parse host key for %s: %w", hk.Addr, err)
+	}
+	if sshHostKeyFingerprint(key) != hk.Fingerprint {
+		return fmt.Errorf("host key for %s does not match the confirmed fingerprint", hk.Addr)
+	}
+	return pinHostKey(hk.Addr, key)
+}
+
 func (runtimeServices) SetupDefinition() []workflow.Step {
 	if err := validateRuntimeStepRegistry(); err != nil {
 		return []workflow.Step{{
@@ -75,7 +121,33 @@ func (runtimeServices) SetupDefinition() []workflow.Step {
 	return workflow.DefaultSetupSteps()
 }
 
-func (runtimeServices) RunSetupStep(req app.SetupStepRequest) (app.SetupStepResult, error) {
+// SetupConcurrency is the number of setup steps that may run at once (ARC_SETUP_JOBS).
+func (runtimeServices) SetupConcurrency() int {
+	if raw := strings.TrimSpace(os.Getenv("ARC_SETUP_JOBS")); raw != "" {
+		if n, err := strconv.Atoi(raw); err == nil && n > 0 {
+			return n
+		}
+	}
+	return workflow.DefaultSetupConcurrency
+}
+
+func (s runtimeServices) RunPreflight(ctx context.Context, req app.PreflightRequest) (app.PreflightReport, error) {
+	return runPreflight(ctx, s.sessions, req)
+}
+
+func (runtimeServices) BeginSetupRun(run app.SetupRun) (app.SetupRun, error) {
+	return beginSetupRun(run)
+}
+
+func (runtimeServices) SaveSetupRun(run app.SetupRun) error {
+	return saveSetupRun(run)
+}
+
+func (runtimeServices) LatestSetupRun(addr string) (app.SetupRun, bool, error) {
+	return latestSetupRun(addr)
+}
+
+func (s runtimeServices) RunSetupStep(ctx context.Context, req app.SetupStepRequest) (app.SetupStepResult, error) {
 	if err := validateRuntimeStepRegistry(); err != nil {
 		return app.SetupStepResult{}, err
 	}
@@ -91,19 +163,55 @@ func (runtimeServices) RunSetupStep(req app.SetupStepRequest) (app.SetupStepResu
 	res := app.SetupStepResult{}
 	wg := fromAppWG(req.WG)
 	if wg.Endpoint == "" && strings.TrimSpace(req.Host) != "" {
-		cfg, err := buildWGConfig(req.Host)
+		cfg, err := buildWGConfig(req.Host, wg.Net)
 		if err != nil {
 			return res, err
 		}
 		wg = cfg
 	}
 
-	if err := executor(req, wg, &res); err != nil {
-		return res, err
+	if req.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, req.Timeout)
+		defer cancel()
+	}
+	if err := ctx.Err(); err != nil {
+		return res, stepContextError(ctx, req.Timeout, err)
+	}
+
+	ctx = withStepOutput(ctx, req.Output)
+	runCtx := infraRunContext{Context: ctx, Addr: req.Addr, Host: req.Host, WG: wg, SSH: s.sessions, RunID: req.RunID}
+	if err := executor(runCtx, req, &res); err != nil {
+		return res, stepContextError(ctx, req.Timeout, err)
 	}
 	return res, nil
 }
 
+// stepContextError reports why an interrupted step stopped. Helpers often flatten the
+// underlying error, so the step context decides: a cancelled run always wraps
+// context.Canceled, an expired step deadline names the timeout.
+func stepContextError(ctx context.Context, timeout time.Duration, err error) error {
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		return fmt.Errorf("timed out after %s: %w", timeout, err)
+	case errors.Is(ctx.Err(), context.Canceled) && !errors.Is(err, context.Canceled):
+		return fmt.Errorf("%w: %v", context.Canceled, err)
+	}
+	return err
+}
+
+// CloseConnections closes the SSH clients shared by setup steps.
+func (s runtimeServices) CloseConnections() error {
+	if s.sessions == nil {
+		return nil
+	}
+	return s.sessions.Close()
+}
+
+func (s runtimeServices) CollectStatus(ctx context.Context) (app.StatusReport, error) {
+	return collectArcStatus(ctx, s.sessions)
+}
+
 func (runtimeServices) BuildMobilePayload(host string, wg app.WGConfig) (string, error) {
 	return buildMobilePayload(host, fromAppWG(wg))
 }
@@ -143,13 +251,13 @@ func attachWG(res *app.SetupStepResult, wg wgConfig) {
 	res.WG = &appWG
 }
 
-func execDetectPrivilegedMode(req app.SetupStepRequest, _ wgConfig, res *app.SetupStepResult) error {
-	client, err := dialWithPassword(req.BootstrapUser, req.Addr, req.Password)
+func execDetectPrivilegedMode(ctx infraRunContext, req app.SetupStepRequest, res *app.SetupStepResult) error {
+	client, release, err := bootstrapClientFor(ctx, req.BootstrapUser, req.Password)
 	if err != nil {
 		return err
 	}
-	sudoOK, err := canRunPrivileged(req.BootstrapUser, client, req.Password)
-	_ = client.Close()
+	sudoOK, err := canRunPrivileged(ctx, req.BootstrapUser, client, req.Password)
+	release()
 	if err != nil {
 		return err
 	}
@@ -157,58 +265,54 @@ func execDetectPrivilegedMode(req app.SetupStepRequest, _ wgConfig, res *app.Set
 	return nil
 }
 
-func execCreateArcUser(req app.SetupStepRequest, _ wgConfig, _ *app.SetupStepResult) error {
-	client, err := dialWithPassword(req.BootstrapUser, req.Addr, req.Password)
+func execCreateArcUser(ctx infraRunContext, req app.SetupStepRequest, _ *app.SetupStepResult) error {
+	client, release, err := bootstrapClientFor(ctx, req.BootstrapUser, req.Password)
 	if err != nil {
 		return err
 	}
-	err = ensureArcUser(client, req.UseSudo, req.Password)
-	_ = client.Close()
-	return err
+	defer release()
+	return ensureArcUser(ctx, client, req.UseSudo, req.Password)
 }
 
-func execAddArcToSudoers(req app.SetupStepRequest, _ wgConfig, _ *app.SetupStepResult) error {
-	client, err := dialWithPassword(req.BootstrapUser, req.Addr, req.Password)
+func execAddArcToSudoers(ctx infraRunContext, req app.SetupStepRequest, _ *app.SetupStepResult) error {
+	client, release, err := bootstrapClientFor(ctx, req.BootstrapUser, req.Password)
 	if err != nil {
 		return err
 	}
-	err = ensureArcSudoers(client, req.UseSudo, req.Password)
-	_ = client.Close()
-	return err
+	defer release()
+	return ensureArcSudoers(ctx, client, req.UseSudo, req.Password)
 }
 
-func execCreateArcHushlogin(req app.SetupStepRequest, _ wgConfig, _ *app.SetupStepResult) error {
-	client, err := dialWithPassword(req.BootstrapUser, req.Addr, req.Password)
+func execCreateArcHushlogin(ctx infraRunContext, req app.SetupStepRequest, _ *app.SetupStepResult) error {
+	client, release, err := bootstrapClientFor(ctx, req.BootstrapUser, req.Password)
 	if err != nil {
 		return err
 	}
-	err = ensureArcHushLogin(client, req.UseSudo, req.Password)
-	_ = client.Close()
-	return err
+	defer release()
+	return ensureArcHushLogin(ctx, client, req.UseSudo, req.Password)
 }
 
-func execInstallServerArcZshPrompt(req app.SetupStepRequest, _ wgConfig, _ *app.SetupStepResult) error {
-	return ensureArcZshPrompt(req.Addr)
+func execInstallServerArcZshPrompt(ctx infraRunContext, _ app.SetupStepRequest, _ *app.SetupStepResult) error {
+	return ensureArcZshPrompt(ctx)
 }
 
-func execInstallServerArcTmux(req app.SetupStepRequest, _ wgConfig, _ *app.SetupStepResult) error {
-	return ensureArcTmuxConfig(req.Addr)
+func execInstallServerArcTmux(ctx infraRunContext, _ app.SetupStepRequest, _ *app.SetupStepResult) error {
+	return ensureArcTmuxConfig(ctx)
 }
 
-func execInfraStep(req app.SetupStepRequest, wg wgConfig, res *app.SetupStepResult) error {
-	ctx := infraRunContext{Addr: req.Addr, Host: req.Host, WG: wg}
+func execInfraStep(ctx infraRunContext, req app.SetupStepRequest, res *app.SetupStepResult) error {
 	if err := runInfraStep(ctx, req.StepID); err != nil {
 		return err
 	}
-	attachWG(res, wg)
+	attachWG(res, ctx.WG)
 	return nil
 }
 
-func execAddLocalHostsAliases(req app.SetupStepRequest, _ wgConfig, _ *app.SetupStepResult) error {
-	return ensureLocalArcHostsAliases(req.Host)
+func execAddLocalHostsAliases(ctx infraRunContext, _ app.SetupStepRequest, _ *app.SetupStepResult) error {
+	return ensureLocalArcHostsAliases(ctx, ctx.Host)
 }
 
-func execEnsureArcSSHAccess(req app.SetupStepRequest, wg wgConfig, res *app.SetupStepResult) error {
+func execEnsureArcSSHAccess(ctx infraRunContext, req app.SetupStepRequest, res *app.SetupStepResult) error {
 	if err := ensureLocalSSHKeyPair(); err != nil {
 		return err
 	}
@@ -223,59 +327,60 @@ func execEnsureArcSSHAccess(req app.SetupStepRequest, wg wgConfig, res *app.Setu
 	if err != nil {
 		return err
 	}
-	client, err := dialWithPassword(req.BootstrapUser, req.Addr, req.Password)
+	client, release, err := bootstrapClientFor(ctx, req.BootstrapUser, req.Password)
 	if err != nil {
 		return err
 	}
-	if err := ensureArcAuthorizedKey(client, req.UseSudo, req.Password, desktopPubKeyLine); err != nil {
-		_ = client.Close()
+	defer release()
+	if err := ensureArcAuthorizedKey(ctx, client, req.UseSudo, req.Password, desktopPubKeyLine); err != nil {
 		return err
 	}
-	if err := ensureArcAuthorizedKey(client, req.UseSudo, req.Password, mobilePubKeyLine); err != nil {
-		_ = client.Close()
+	if err := ensureArcAuthorizedKey(ctx, client, req.UseSudo, req.Password, mobilePubKeyLine); err != nil {
 		return err
 	}
-	_ = client.Close()
-	attachWG(res, wg)
+	attachWG(res, ctx.WG)
 	return nil
 }
 
-func execInstallLocalArcPrompt(_ app.SetupStepRequest, wg wgConfig, res *app.SetupStepResult) error {
-	if err := ensureLocalArcZshPrompt(); err != nil {
+func execInstallLocalArcPrompt(ctx infraRunContext, _ app.SetupStepRequest, res *app.SetupStepResult) error {
+	if err := ensureLocalArcZshPrompt(ctx.WG.Net); err != nil {
 		return err
 	}
-	attachWG(res, wg)
+	attachWG(res, ctx.WG)
 	return nil
 }
 
-func execVerifyArcSSHLogin(req app.SetupStepRequest, wg wgConfig, res *app.SetupStepResult) error {
-	if err := syncLocalKnownHostsForBootstrap(req.Host, req.Addr); err != nil {
+func execVerifyArcSSHLogin(ctx infraRunContext, _ app.SetupStepRequest, res *app.SetupStepResult) error {
+	if err := syncLocalKnownHostsForBootstrap(ctx, ctx.Host, ctx.Addr); err != nil {
 		return err
 	}
-	if err := verifyArcKeyLogin(req.Host, req.Addr); err != nil {
+	if err := verifyArcKeyLogin(ctx); err != nil {
 		return err
 	}
-	if err := syncRemoteArcHelper(req.Addr, req.Host, wg); err != nil {
+	if err := syncRemoteArcHelper(ctx); err != nil {
 		return err
 	}
-	if err := ensureArcZshPrompt(req.Addr); err != nil {
+	if err := ensureArcZshPrompt(ctx); err != nil {
 		return err
 	}
-	attachWG(res, wg)
+	attachWG(res, ctx.WG)
 	return nil
 }
 
-func execVerifyTunnelConnectivity(req app.SetupStepRequest, wg wgConfig, res *app.SetupStepResult) error {
-	if err := execInfraStep(req, wg, res); err != nil {
+func execVerifyTunnelConnectivity(ctx infraRunContext, req app.SetupStepRequest, res *app.SetupStepResult) error {
+	if err := execInfraStep(ctx, req, res); err != nil {
 		return err
 	}
-	if err := syncLocalKnownHostsForArcRemote(); err != nil {
+	if err := syncLocalKnownHostsForArcRemote(ctx, ctx.Addr, ctx.WG.Net); err != nil {
 		return err
 	}
-	if err := syncRemoteArcHelper(req.Addr, req.Host, wg); err != nil {
+	if err := syncLocalSSHConfigForArcRemote(ctx.WG.Net); err != nil {
 		return err
 	}
-	res.ReadyAs = arcUser + "@" + req.Host
+	if err := syncRemoteArcHelper(ctx); err != nil {
+		return err
+	}
+	res.ReadyAs = arcUser + "@" + ctx.Host
 	return nil
 }
 
@@ -291,9 +396,22 @@ func toAppWG(c wgConfig) app.WGConfig {
 		ClientConf:       c.ClientConf,
 		MobileClientConf: c.MobileClientConf,
 		Endpoint:         c.Endpoint,
+		Net: app.WGSettings{
+			Interface:  c.Net.Interface,
+			Port:       c.Net.Port,
+			Subnet:     c.Net.Subnet,
+			ServerIP:   c.Net.ServerIP,
+			DesktopIP:  c.Net.DesktopIP,
+			MobileIP:   c.Net.MobileIP,
+			Subnet6:    c.Net.Subnet6,
+			Mode:       c.Net.Mode,
+			Relay:      c.Net.Relay,
+			Rendezvous: c.Net.Rendezvous,
+		},
 	}
 }
 
+// fromAppWG converts c, filling in the default network for runs that predate it.
 func fromAppWG(c app.WGConfig) wgConfig {
 	return wgConfig{
 		ServerPriv:       c.ServerPriv,
@@ -306,5 +424,21 @@ func fromAppWG(c app.WGConfig) wgConfig {
 		ClientConf:       c.ClientConf,
 		MobileClientConf: c.MobileClientConf,
 		Endpoint:         c.Endpoint,
+		Net:              wgNetworkFromSettings(c.Net).withDefaults(),
+	}
+}
+
+func wgNetworkFromSettings(s app.WGSettings) wgNetwork {
+	return wgNetwork{
+		Interface:  s.Interface,
+		Port:       s.Port,
+		Subnet:     s.Subnet,
+		ServerIP:   s.ServerIP,
+		DesktopIP:  s.DesktopIP,
+		MobileIP:   s.MobileIP,
+		Subnet6:    s.Subnet6,
+		Mode:       s.Mode,
+		Relay:      s.Relay,
+		Rendezvous: s.Rendezvous,
 	}
 }
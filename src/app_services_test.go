@@ -3,8 +3,11 @@ package main
 import (
 	"arc/internal/app"
 	"arc/internal/workflow"
+	"context"
+	"errors"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestRuntimeStepRegistryMatchesDefinitions(t *testing.T) {
@@ -36,7 +39,7 @@ func TestRuntimeServicesSetupDefinitionMatchesWorkflow(t *testing.T) {
 
 func TestRunSetupStep_RequiresStepID(t *testing.T) {
 	svc := newRuntimeServices()
-	_, err := svc.RunSetupStep(app.SetupStepRequest{})
+	_, err := svc.RunSetupStep(context.Background(), app.SetupStepRequest{})
 	if err == nil {
 		t.Fatalf("expected error for missing step ID")
 	}
@@ -44,3 +47,30 @@ func TestRunSetupStep_RequiresStepID(t *testing.T) {
 		t.Fatalf("unexpected error: %v", err)
 	}
 }
+
+func TestRunSetupStep_CancelledContextReportsCancellation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	svc := newRuntimeServices()
+	_, err := svc.RunSetupStep(ctx, app.SetupStepRequest{StepID: workflow.StepAddLocalHostsAliases, Timeout: time.Minute})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
+
+func TestStepContextError_NamesTimeoutAndKeepsCancellation(t *testing.T) {
+	expired, cancel := context.WithTimeout(context.Background(), time.Nanosecond)
+	defer cancel()
+	<-expired.Done()
+	err := stepContextError(expired, 30*time.Second, errors.New("apt-get interrupted"))
+	if !strings.Contains(err.Error(), "timed out after 30s") || errors.Is(err, context.Canceled) {
+		t.Fatalf("unexpected timeout error: %v", err)
+	}
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = stepContextError(cancelled, 0, errors.New("remote command failed"))
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected flattened error to wrap context.Canceled, got %v", err)
+	}
+}
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"arc/internal/workflow"
 	"bytes"
+	"context"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -11,15 +13,13 @@ import (
 )
 
 func configureRemoteClipboardCompositor(ctx infraRunContext) error {
-	return withArcClient(ctx.Addr, func(client *ssh.Client) error {
-		id, err := readRemoteOSID(client)
+	return withArcClient(ctx, func(client *ssh.Client) error {
+		id, err := readRemoteOSID(ctx, client)
 		if err != nil {
 			return err
 		}
-		if err := installRemotePackages(client, id,
-			[]string{"wl-clipboard", "libwayland-dev", "pkg-config"},
-			[]string{"wl-clipboard", "wayland", "pkgconf"},
-		); err != nil {
+		pkgs := stepPackages[workflow.StepConfigureClipboardComp]
+		if err := installRemotePackages(ctx, client, id, pkgs.Debian, pkgs.Arch); err != nil {
 			return err
 		}
 
@@ -116,32 +116,43 @@ cat > "$HOME/.config/systemd/user/arc-clipd.service" <<'EOF'
 %sEOF
 chmod 644 "$HOME/.config/systemd/user/arc-clipd.service"
 `, clipdService)
-		if _, err := runRemoteCommand(client, script, false, ""); err != nil {
+		if _, err := runRemoteCommand(ctx, client, script, false, ""); err != nil {
 			return err
 		}
-		return activateRemoteClipboardCompositor(client)
+		return activateRemoteClipboardCompositor(ctx, client)
 	})
 }
 
-func activateRemoteClipboardCompositor(client *ssh.Client) error {
+func activateRemoteClipboardCompositor(ctx context.Context, client *ssh.Client) error {
 	for _, cmd := range []string{
 		"systemctl --user daemon-reload",
 		"systemctl --user enable arc-clipd.service",
 		"systemctl --user restart arc-clipd.service",
 	} {
-		if _, err := runRemoteCommand(client, cmd, false, ""); err != nil {
+		if _, err := runRemoteCommand(ctx, client, cmd, false, ""); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-func configureLocalImageClipboardSync() error {
+func removeRemoteClipboardCompositor(ctx infraRunContext) error {
+	return runRemoteUndoScript(ctx, "set -eu\n"+
+		disableUnitScript("systemctl --user", remoteClipdUnit)+
+		`rm -f "$HOME/.config/systemd/user/arc-clipd.service" "$HOME/.local/bin/arc-clipd" \
+	"$HOME/.local/bin/arc-remote-clipboard-put-image" "$HOME/.local/bin/codex-wayland" \
+	"$HOME/.config/arc/clipd.env"
+systemctl --user daemon-reload >/dev/null 2>&1 || true
+`)
+}
+
+func configureLocalImageClipboardSync(ctx context.Context) error {
 	id, err := localOSID()
 	if err != nil {
 		return err
 	}
-	if err := installLocalPackages(id, []string{"wl-clipboard"}, []string{"wl-clipboard"}); err != nil {
+	pkgs := stepPackages[workflow.StepConfigureImageClipboard]
+	if err := installLocalPackages(ctx, id, pkgs.Debian, pkgs.Arch); err != nil {
 		return err
 	}
 
@@ -242,23 +253,35 @@ done
 		return err
 	}
 
-	return activateLocalClipboardSyncService(execLocal)
+	return activateLocalClipboardSyncService(ctx, execLocal)
 }
 
-func activateLocalClipboardSyncService(execFn localExecFunc) error {
-	_, _ = execFn("systemctl", "--user", "import-environment", "WAYLAND_DISPLAY", "XDG_RUNTIME_DIR", "DBUS_SESSION_BUS_ADDRESS")
-	if _, err := execFn("systemctl", "--user", "daemon-reload"); err != nil {
+func activateLocalClipboardSyncService(ctx context.Context, execFn localExecFunc) error {
+	_, _ = execFn(ctx, "systemctl", "--user", "import-environment", "WAYLAND_DISPLAY", "XDG_RUNTIME_DIR", "DBUS_SESSION_BUS_ADDRESS")
+	if _, err := execFn(ctx, "systemctl", "--user", "daemon-reload"); err != nil {
 		return err
 	}
-	if _, err := execFn("systemctl", "--user", "enable", "arc-clipboard-sync.service"); err != nil {
+	if _, err := execFn(ctx, "systemctl", "--user", "enable", "arc-clipboard-sync.service"); err != nil {
 		return err
 	}
-	if _, err := execFn("systemctl", "--user", "restart", "arc-clipboard-sync.service"); err != nil {
+	if _, err := execFn(ctx, "systemctl", "--user", "restart", "arc-clipboard-sync.service"); err != nil {
 		return err
 	}
 	return nil
 }
 
+func removeLocalImageClipboardSync(ctx infraRunContext) error {
+	configDir, systemdDir, localBinDir, err := arcConfigPaths()
+	if err != nil {
+		return err
+	}
+	return removeLocalUserService(ctx, clipboardSyncUnit,
+		filepath.Join(systemdDir, clipboardSyncUnit),
+		filepath.Join(localBinDir, "arc-clipboard-sync"),
+		filepath.Join(configDir, "clipboard-sync.env"),
+	)
+}
+
 func buildArcClipdBinary() ([]byte, error) {
 	return embeddedArcClipdBinary()
 }
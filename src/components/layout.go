@@ -25,9 +25,11 @@ func ButtonRect(cardR Rect, label string) (Rect, bool) {
 	return Rect{X: btnX, Y: btnY, W: btnW, H: btnH}, true
 }
 
-func InputRectsFromCard(cardR Rect) (Rect, Rect, bool) {
+// InputRectsFromCard returns the text areas of the target, password and network inputs.
+func InputRectsFromCard(cardR Rect) (Rect, Rect, Rect, bool) {
 	ipY := cardR.Y + 5
 	passY := ipY + cardInputBoxH + 1
+	netY := passY + cardInputBoxH + 1
 	boxX := cardR.X + 2 + cardInputLabelW
 	boxW := cardR.W - 4 - cardInputLabelW
 	if boxW < 16 {
@@ -37,12 +39,13 @@ func InputRectsFromCard(cardR Rect) (Rect, Rect, bool) {
 		boxW = (cardR.X + cardR.W - 2) - boxX
 	}
 	if boxW < 4 {
-		return Rect{}, Rect{}, false
+		return Rect{}, Rect{}, Rect{}, false
 	}
 
 	ipRect := Rect{X: boxX + 1, Y: ipY + 1, W: boxW - 2, H: 1}
 	passRect := Rect{X: boxX + 1, Y: passY + 1, W: boxW - 2, H: 1}
-	return ipRect, passRect, true
+	netRect := Rect{X: boxX + 1, Y: netY + 1, W: boxW - 2, H: 1}
+	return ipRect, passRect, netRect, true
 }
 
 func logoSize() (int, int) {
@@ -88,9 +91,9 @@ func ComputeLayout(w, h int, phase Phase) (Layout, bool) {
 		cx0 = 0
 	}
 
-	cardH := 17
+	cardH := 21
 	maxH := h - 8
-	if phase == PhaseLog {
+	if phase == PhaseLog || phase == PhasePreflight {
 		cardH = 22
 		maxH = h - 6
 	}
@@ -1,5 +1,7 @@
 package components
 
+import "fmt"
+
 func drawLogCard(state ViewState, b [][]cell, x, y, w, h int) {
 	border := cGrid2
 	drawBox(b, x, y, w, h, border)
@@ -9,7 +11,7 @@ func drawLogCard(state ViewState, b [][]cell, x, y, w, h int) {
 	barW := w - 2
 	if barW > 0 {
 		fillRect(b, barX, hdrY, barW, 1, cBG, cLime, ' ')
-		drawText(b, barX+1, hdrY, cBG, cLime, " 2 - ONBOARD LOG")
+		drawText(b, barX+1, hdrY, cBG, cLime, " 3 - ONBOARD LOG")
 	}
 
 	if w > 2 && h > 3 {
@@ -23,12 +25,26 @@ func drawLogCard(state ViewState, b [][]cell, x, y, w, h int) {
 	drawText(b, x+2, y+3, cText, cBG, "ARC target: "+target)
 
 	baseY := y + 5
+	var running []string
 	for _, step := range state.Steps {
 		if step.State == StepRunning {
-			drawText(b, x+2, y+4, cSub, cBG, "Current: "+step.Label)
-			baseY = y + 6
-			break
+			running = append(running, step.Label)
+		}
+	}
+	if len(running) > 0 {
+		current := "Current: " + running[0]
+		if len(running) > 1 {
+			current += fmt.Sprintf(" (+%d more)", len(running)-1)
+		}
+		if hasStepOutput(state.Steps) {
+			if state.OutputExpanded {
+				current += " · o: less output"
+			} else {
+				current += " · o: more output"
+			}
 		}
+		drawText(b, x+2, y+4, cSub, cBG, current)
+		baseY = y + 6
 	}
 
 	cardR := Rect{X: x, Y: y, W: w, H: h}
@@ -45,16 +61,7 @@ func drawLogCard(state ViewState, b [][]cell, x, y, w, h int) {
 		contentBottom = baseY
 	}
 
-	type line struct {
-		step Step
-	}
-	var lines []line
-	for _, step := range state.Steps {
-		if step.State == StepPending {
-			continue
-		}
-		lines = append(lines, line{step: step})
-	}
+	lines := logLines(state.Steps, state.OutputExpanded)
 
 	avail := contentBottom - baseY + 1
 	if avail < 1 {
@@ -78,9 +85,17 @@ func drawLogCard(state ViewState, b [][]cell, x, y, w, h int) {
 	if !(state.Submitted && state.Err == "" && (len(state.MobileQR) > 0 || state.MobileQRErr != "")) {
 		visible := 0
 		for i := start; i < len(lines) && visible < avail; i++ {
-			step := lines[i].step
 			rowY := baseY + visible
 			visible++
+			if lines[i].output {
+				text := []rune(lines[i].text)
+				if max := w - 10; max > 0 && len(text) > max {
+					text = append(text[:max-1], '…')
+				}
+				drawText(b, x+6, rowY, cSub, cBG, "│ "+string(text))
+				continue
+			}
+			step := lines[i].step
 
 			label := step.Label
 			prefix := "[ ]"
@@ -105,6 +120,9 @@ func drawLogCard(state ViewState, b [][]cell, x, y, w, h int) {
 				if step.Err != "" {
 					label = step.Label + " (failed)"
 				}
+			case StepCancelled:
+				prefix = "[-]"
+				label = step.Label + " (cancelled)"
 			}
 
 			drawText(b, x+2, rowY, prefixFG, cBG, prefix)
@@ -125,14 +143,20 @@ func drawLogCard(state ViewState, b [][]cell, x, y, w, h int) {
 	if footerY > baseY {
 		switch {
 		case state.Err != "":
+			errY := footerY
+			if state.RetryStep > 0 {
+				hint := fmt.Sprintf("Press r to retry from step %d, Esc to start over", state.RetryStep)
+				drawText(b, x+2, footerY, cSub, cBG, hint)
+				errY = footerY - 1
+			}
 			lines := wrapText(state.Err, w-4)
-			startY := footerY - (len(lines) - 1)
+			startY := errY - (len(lines) - 1)
 			if startY < baseY {
 				startY = baseY
 			}
 			for i, ln := range lines {
 				yy := startY + i
-				if yy >= y+h-1 {
+				if yy > errY {
 					break
 				}
 				drawText(b, x+2, yy, cErr, cBG, ln)
@@ -181,6 +205,59 @@ func drawLogCard(state ViewState, b [][]cell, x, y, w, h int) {
 	}
 }
 
+const (
+	// OutputTailLines is how many output lines show under a running or failed step.
+	OutputTailLines = 3
+	// OutputTailLinesExpanded is the tail length once the output view is expanded.
+	OutputTailLinesExpanded = 12
+)
+
+type logLine struct {
+	step   Step
+	output bool
+	text   string
+}
+
+// logLines flattens the visible steps and their output tails into card rows.
+func logLines(steps []Step, expanded bool) []logLine {
+	tail := OutputTailLines
+	if expanded {
+		tail = OutputTailLinesExpanded
+	}
+	var lines []logLine
+	for _, step := range steps {
+		if step.State == StepPending {
+			continue
+		}
+		lines = append(lines, logLine{step: step})
+		if step.State != StepRunning && step.State != StepFailed {
+			continue
+		}
+		out := step.Output
+		if len(out) > tail {
+			out = out[len(out)-tail:]
+		}
+		for _, text := range out {
+			lines = append(lines, logLine{output: true, text: text})
+		}
+	}
+	return lines
+}
+
+// LogLineCount is the number of rows the log card needs for steps, used to bound scrolling.
+func LogLineCount(steps []Step, expanded bool) int {
+	return len(logLines(steps, expanded))
+}
+
+func hasStepOutput(steps []Step) bool {
+	for _, step := range steps {
+		if (step.State == StepRunning || step.State == StepFailed) && len(step.Output) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
 func drawSubmittedQRCode(state ViewState, b [][]cell, x, y, w, h int, hasButton bool, btnR Rect) {
 	headerY := y + 5
 	drawText(b, x+2, headerY, cLime, cBG, "Scan with ARC mobile")
@@ -0,0 +1,98 @@
+package components
+
+import "fmt"
+
+func drawPreflightCard(state ViewState, b [][]cell, x, y, w, h int) {
+	drawBox(b, x, y, w, h, cGrid2)
+
+	hdrY := y + 1
+	if w > 2 {
+		fillRect(b, x+1, hdrY, w-2, 1, cBG, cLime, ' ')
+		drawText(b, x+2, hdrY, cBG, cLime, " 2 - PREFLIGHT")
+	}
+	if w > 2 && h > 3 {
+		fillRect(b, x+1, y+2, w-2, h-3, cText, cBG, ' ')
+	}
+
+	if state.Working {
+		spin := state.SpinnerRune
+		if spin == 0 {
+			spin = '*'
+		}
+		drawText(b, x+2, y+3, cLime, cBG, "["+string(spin)+"]")
+		drawText(b, x+6, y+3, cText, cBG, "Checking this machine and "+state.Host+"...")
+		drawText(b, x+2, y+5, cSub, cBG, "Nothing is changed until setup starts.")
+		return
+	}
+
+	blocking, warnings := preflightCounts(state.Preflight)
+	footerY := y + h - 2
+	contentBottom := footerY - 2
+	summary, summaryFG := "All checks passed", cLime
+	switch {
+	case state.Err != "":
+		summary, summaryFG = "Preflight could not inspect the machines", cErr
+	case blocking > 0:
+		summary, summaryFG = fmt.Sprintf("%d blocking issue(s), %d warning(s); setup cannot start", blocking, warnings), cErr
+	case warnings > 0:
+		summary, summaryFG = fmt.Sprintf("%d warning(s); setup can start", warnings), cDim
+	}
+	drawText(b, x+2, y+3, summaryFG, cBG, summary)
+
+	rowY := y + 5
+	if state.Err != "" {
+		for _, ln := range wrapText(state.Err, w-4) {
+			if rowY > contentBottom {
+				break
+			}
+			drawText(b, x+2, rowY, cErr, cBG, ln)
+			rowY++
+		}
+	}
+	for _, r := range state.Preflight {
+		if rowY > contentBottom {
+			break
+		}
+		prefix, fg := statusPrefix(r.Health)
+		drawText(b, x+2, rowY, fg, cBG, prefix)
+		for i, ln := range wrapText(fmt.Sprintf("%s %s: %s", r.Where, r.Name, r.Detail), w-8) {
+			if rowY > contentBottom {
+				break
+			}
+			lineFG := cText
+			if i > 0 {
+				lineFG = cSub
+			}
+			drawText(b, x+6, rowY, lineFG, cBG, ln)
+			rowY++
+		}
+		if r.Fix == "" {
+			continue
+		}
+		for _, ln := range wrapText("fix: "+r.Fix, w-10) {
+			if rowY > contentBottom {
+				break
+			}
+			drawText(b, x+8, rowY, cSub, cBG, ln)
+			rowY++
+		}
+	}
+
+	hint := "r re-check · Esc edit settings · q quit"
+	if state.Err == "" && blocking == 0 {
+		hint = "Enter start setup · " + hint
+	}
+	drawText(b, x+2, footerY, cSub, cBG, hint)
+}
+
+func preflightCounts(rows []PreflightRow) (blocking, warnings int) {
+	for _, r := range rows {
+		switch r.Health {
+		case HealthDown:
+			blocking++
+		case HealthDegraded:
+			warnings++
+		}
+	}
+	return blocking, warnings
+}
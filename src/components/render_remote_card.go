@@ -32,11 +32,17 @@ func drawCredCard(state ViewState, b [][]cell, x, y, w, h int) {
 		return
 	}
 
-	drawText(b, x+2, y+3, cText, cBG, "Bootstrap one device over SSH.")
-	drawText(b, x+2, y+4, cSub, cBG, "Target: ssh://user@host:port or user@host[:port]")
+	if state.HostKeyFingerprint != "" {
+		drawText(b, x+2, y+3, cText, cBG, "Confirm the host key of "+state.HostKeyAddr+".")
+		drawText(b, x+2, y+4, cSub, cBG, "It is pinned under ~/.arc and checked on every dial.")
+	} else {
+		drawText(b, x+2, y+3, cText, cBG, "Bootstrap one device over SSH.")
+		drawText(b, x+2, y+4, cSub, cBG, "Target: ssh://user@host:port or user@host[:port]")
+	}
 
 	ipY := y + 5
 	passY := ipY + cardInputBoxH + 1
+	netY := passY + cardInputBoxH + 1
 
 	boxX := x + 2 + cardInputLabelW
 	boxW := w - 4 - cardInputLabelW
@@ -49,10 +55,12 @@ func drawCredCard(state ViewState, b [][]cell, x, y, w, h int) {
 
 	ipFocused := state.Focus == 0 && !state.Submitted && !state.Working
 	passFocused := state.Focus == 1 && !state.Submitted && !state.Working
-	connectFocused := (state.Focus == 2 || state.BtnHover) && !state.Submitted && !state.Working
+	netFocused := state.Focus == 2 && !state.Submitted && !state.Working
+	connectFocused := (state.Focus == 3 || state.BtnHover) && !state.Submitted && !state.Working
 
 	drawText(b, x+2, ipY+1, cDim, cBG, "SSH")
 	drawText(b, x+2, passY+1, cDim, cBG, "Password")
+	drawText(b, x+2, netY+1, cDim, cBG, "Network")
 
 	ipBorder := cGrid2
 	if ipFocused {
@@ -77,10 +85,29 @@ func drawCredCard(state ViewState, b [][]cell, x, y, w, h int) {
 		pass.drawInto(b, boxX+1, passY+1, boxW-2, passFocused)
 	}
 
+	if boxW >= 4 {
+		netBorder := cGrid2
+		if netFocused {
+			netBorder = cLime
+		}
+		drawBox(b, boxX, netY, boxW, cardInputBoxH, netBorder)
+		fillRect(b, boxX+1, netY+1, boxW-2, 1, cText, cBG, ' ')
+		net := state.Net
+		net.drawInto(b, boxX+1, netY+1, boxW-2, netFocused)
+	}
+
+	label := ConnectLabel
+	if state.HostKeyFingerprint != "" {
+		label = TrustLabel
+	}
+
 	cardR := Rect{X: x, Y: y, W: w, H: h}
-	if btnR, ok := ButtonRect(cardR, ConnectLabel); ok {
+	if btnR, ok := ButtonRect(cardR, label); ok {
 		msgY := btnR.Y - 1
-		if msgY > passY+1 && msgY < btnR.Y {
+		if msgY > netY+1 && msgY < btnR.Y {
+			if state.Err == "" && state.HostKeyFingerprint != "" {
+				drawText(b, x+2, msgY, cLime, cBG, "Key: "+state.HostKeyFingerprint)
+			}
 			if state.Err != "" {
 				for i, ln := range wrapText(state.Err, w-4) {
 					yy := msgY + i
@@ -116,10 +143,10 @@ func drawCredCard(state ViewState, b [][]cell, x, y, w, h int) {
 			fillRect(b, btnR.X, btnR.Y, btnR.W, btnR.H, cText, bgMain, ' ')
 		}
 
-		labelX := btnR.X + (btnR.W-len(ConnectLabel))/2
+		labelX := btnR.X + (btnR.W-len(label))/2
 		if labelX < btnR.X {
 			labelX = btnR.X
 		}
-		drawText(b, labelX, midY, fg, bgMain, ConnectLabel)
+		drawText(b, labelX, midY, fg, bgMain, label)
 	}
 }
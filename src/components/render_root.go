@@ -37,6 +37,8 @@ func Render(state ViewState) string {
 	switch state.Phase {
 	case PhaseLog:
 		drawLogCard(state, b, layout.Card.X, layout.Card.Y, layout.Card.W, layout.Card.H)
+	case PhasePreflight:
+		drawPreflightCard(state, b, layout.Card.X, layout.Card.Y, layout.Card.W, layout.Card.H)
 	default:
 		drawCredCard(state, b, layout.Card.X, layout.Card.Y, layout.Card.W, layout.Card.H)
 	}
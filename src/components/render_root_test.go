@@ -1,6 +1,10 @@
 package components
 
-import "testing"
+import (
+	"regexp"
+	"strings"
+	"testing"
+)
 
 func TestUseSubmittedQRFullscreen(t *testing.T) {
 	if !useSubmittedQRFullscreen(ViewState{
@@ -36,3 +40,67 @@ func TestUseSubmittedQRFullscreen(t *testing.T) {
 		t.Fatalf("did not expect fullscreen QR when setup has an error")
 	}
 }
+
+func TestLogLineCount_ShowsOutputTailUnderRunningAndFailedSteps(t *testing.T) {
+	output := []string{"1", "2", "3", "4", "5"}
+	steps := []Step{
+		{Label: "done", State: StepDone, Output: output},
+		{Label: "running", State: StepRunning, Output: output},
+		{Label: "failed", State: StepFailed, Output: output[:1]},
+		{Label: "pending", State: StepPending, Output: output},
+	}
+	if got := LogLineCount(steps, false); got != 3+OutputTailLines+1 {
+		t.Fatalf("collapsed line count = %d", got)
+	}
+	if got := LogLineCount(steps, true); got != 3+len(output)+1 {
+		t.Fatalf("expanded line count = %d", got)
+	}
+
+	lines := logLines(steps, false)
+	if !lines[2].output || lines[2].text != "3" {
+		t.Fatalf("expected the tail to start at the oldest visible line: %#v", lines)
+	}
+}
+
+func TestRenderStatus_DrawsComponentsAndSummary(t *testing.T) {
+	out := RenderStatus(StatusView{
+		W:      100,
+		H:      20,
+		Target: "arc@example.com",
+		Rows: []StatusRow{
+			{Name: "wg-quick@wg0", Where: "local", Health: HealthOK},
+			{Name: "arc-clipd.service", Where: "remote", Health: HealthDown, Detail: "failed"},
+		},
+	})
+	for _, want := range []string{"ARC STATUS", "arc@example.com", "arc-clipd.service", "1/2 healthy"} {
+		if !strings.Contains(stripANSI(out), want) {
+			t.Fatalf("status screen is missing %q", want)
+		}
+	}
+}
+
+func TestRender_PreflightCardShowsIssuesAndFixes(t *testing.T) {
+	out := stripANSI(Render(ViewState{
+		W:     140,
+		H:     40,
+		Phase: PhasePreflight,
+		Host:  "example.com",
+		Preflight: []PreflightRow{
+			{Name: "wireguard port", Where: "remote", Health: HealthDown, Detail: "UDP 51820 is already bound", Fix: "choose another port"},
+		},
+	}))
+	for _, want := range []string{"2 - PREFLIGHT", "1 blocking issue(s)", "remote wireguard port: UDP 51820 is already bound", "fix: choose another port"} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("preflight card is missing %q", want)
+		}
+	}
+	if strings.Contains(out, "Enter start setup") {
+		t.Fatalf("a blocked preflight must not offer to start setup")
+	}
+}
+
+var ansiPattern = regexp.MustCompile("\x1b\\[[0-9;]*m")
+
+func stripANSI(s string) string {
+	return ansiPattern.ReplaceAllString(s, "")
+}
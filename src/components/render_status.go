@@ -0,0 +1,103 @@
+package components
+
+import "fmt"
+
+const statusNameW = 30
+
+// RenderStatus draws the `arc status` screen: one row per component, then the WireGuard peers.
+func RenderStatus(state StatusView) string {
+	if state.W <= 0 || state.H <= 0 {
+		return ""
+	}
+
+	b := newBuf(state.W, state.H)
+	drawGrid(b, 6, 3)
+
+	x, y, w, h := 2, 1, state.W-4, state.H-2
+	if w < cardMinW || h < 8 {
+		drawText(b, 0, 0, cText, cBG, "Terminal too small for arc status")
+		return renderBuf(b)
+	}
+	drawBox(b, x, y, w, h, cGrid2)
+	fillRect(b, x+1, y+1, w-2, 1, cBG, cLime, ' ')
+	drawText(b, x+2, y+1, cBG, cLime, " ARC STATUS")
+	fillRect(b, x+1, y+2, w-2, h-3, cText, cBG, ' ')
+
+	target := state.Target
+	if target == "" {
+		target = "(no setup run recorded)"
+	}
+	drawText(b, x+2, y+3, cText, cBG, "ARC target: "+target)
+	updated := state.Updated
+	if state.Loading {
+		updated = "refreshing..."
+	}
+	if updated != "" {
+		drawText(b, x+w-2-len([]rune(updated)), y+3, cSub, cBG, updated)
+	}
+
+	bottom := y + h - 3
+	row := y + 5
+	for _, r := range state.Rows {
+		if row > bottom {
+			break
+		}
+		prefix, fg := statusPrefix(r.Health)
+		drawText(b, x+2, row, fg, cBG, prefix)
+		drawText(b, x+6, row, cText, cBG, r.Name)
+		drawText(b, x+6+statusNameW, row, cSub, cBG, r.Where)
+		if r.Detail != "" {
+			detailX := x + 6 + statusNameW + 8
+			text := []rune(r.Detail)
+			if max := x + w - 2 - detailX; max > 0 && len(text) > max {
+				text = append(text[:max-1], '…')
+			}
+			drawText(b, detailX, row, fg, cBG, string(text))
+		}
+		row++
+	}
+
+	if len(state.Peers) > 0 && row+1 <= bottom {
+		row++
+		drawText(b, x+2, row, cLime, cBG, "WireGuard peers")
+		row++
+		for _, p := range state.Peers {
+			if row > bottom {
+				break
+			}
+			drawText(b, x+4, row, cSub, cBG, p)
+			row++
+		}
+	}
+
+	footerY := y + h - 2
+	if state.Err != "" {
+		lines := wrapText(state.Err, w-4)
+		drawText(b, x+2, footerY-1, cErr, cBG, lines[0])
+	}
+	drawText(b, x+2, footerY, cSub, cBG, fmt.Sprintf("%s   r refresh · q quit", healthSummary(state.Rows)))
+	return renderBuf(b)
+}
+
+func statusPrefix(h Health) (string, rgb) {
+	switch h {
+	case HealthOK:
+		return "[✓]", cLime
+	case HealthDegraded:
+		return "[!]", cDim
+	case HealthDown:
+		return "[✗]", cErr
+	default:
+		return "[?]", cSub
+	}
+}
+
+func healthSummary(rows []StatusRow) string {
+	ok := 0
+	for _, r := range rows {
+		if r.Health == HealthOK {
+			ok++
+		}
+	}
+	return fmt.Sprintf("%d/%d healthy", ok, len(rows))
+}
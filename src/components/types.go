@@ -2,6 +2,7 @@ package components
 
 const (
 	ConnectLabel = "Onboard"
+	TrustLabel   = "Trust key"
 	FinishLabel  = "Done"
 )
 
@@ -9,6 +10,7 @@ type Phase int
 
 const (
 	PhaseRemote Phase = iota
+	PhasePreflight
 	PhaseLog
 )
 
@@ -19,12 +21,14 @@ const (
 	StepRunning
 	StepDone
 	StepFailed
+	StepCancelled
 )
 
 type Step struct {
-	Label string
-	State StepState
-	Err   string
+	Label  string
+	State  StepState
+	Err    string
+	Output []string // most recent command output lines, oldest first
 }
 
 type Rect struct {
@@ -64,10 +68,59 @@ type ViewState struct {
 
 	Steps       []Step
 	SpinnerRune rune
+	RetryStep   int // 1-based failed step that can be retried; 0 when retry is unavailable
+
+	OutputExpanded bool
+
+	HostKeyAddr        string
+	HostKeyFingerprint string
 
 	Target Field
 	Pass   Field
+	Net    Field
 
 	MobileQR    []string
 	MobileQRErr string
+
+	// Preflight holds the preflight issues, or every check when none was found.
+	Preflight []PreflightRow
+}
+
+type Health int
+
+const (
+	HealthUnknown Health = iota
+	HealthOK
+	HealthDegraded
+	HealthDown
+)
+
+type StatusRow struct {
+	Name   string
+	Where  string
+	Health Health
+	Detail string
+}
+
+// PreflightRow is one preflight check; Fix says how to clear a warning or blocking issue.
+type PreflightRow struct {
+	Name   string
+	Where  string
+	Health Health
+	Detail string
+	Fix    string
+}
+
+// StatusView is everything the `arc status` screen draws. Text is preformatted by the caller.
+type StatusView struct {
+	W int
+	H int
+
+	Target  string
+	Updated string
+	Loading bool
+	Err     string
+
+	Rows  []StatusRow
+	Peers []string
 }
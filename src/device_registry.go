@@ -0,0 +1,306 @@
+package main
+
+import (
+	"arc/internal/wgconf"
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"regexp"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// deviceRegistryPath records on the server which device holds which tunnel address.
+const deviceRegistryPath = "/etc/arc/devices.json"
+
+// Names of the two peers every setup creates, used when seeding the registry.
+const (
+	deviceDesktop = "desktop"
+	deviceMobile  = "mobile"
+)
+
+// arcDevice is one machine that reaches the server over the tunnel.
+type arcDevice struct {
+	Name        string    `json:"name"`
+	IP          string    `json:"ip"`
+	WGPublicKey string    `json:"wgPublicKey"`
+	SSHKey      string    `json:"sshKey,omitempty"`
+	AddedAt     time.Time `json:"addedAt"`
+}
+
+type deviceRegistry struct {
+	Devices []arcDevice `json:"devices"`
+}
+
+// deviceNamePattern keeps device names usable in file names and ufw comments.
+var deviceNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,31}$`)
+
+func validDeviceName(name string) error {
+	if !deviceNamePattern.MatchString(name) {
+		return fmt.Errorf("invalid device name %q (1-32 of a-z, 0-9 and -, starting with a letter or digit)", name)
+	}
+	return nil
+}
+
+// deviceExportsFile is the NFS export of one joined device.
+func deviceExportsFile(name string) string {
+	return "/etc/exports.d/arc-" + name + ".exports"
+}
+
+func parseDeviceRegistry(raw string) (deviceRegistry, error) {
+	var reg deviceRegistry
+	if strings.TrimSpace(raw) == "" {
+		return reg, nil
+	}
+	if err := json.Unmarshal([]byte(raw), &reg); err != nil {
+		return reg, fmt.Errorf("parse %s: %w", deviceRegistryPath, err)
+	}
+	return reg, nil
+}
+
+func (r deviceRegistry) find(name string) int {
+	for i, d := range r.Devices {
+		if d.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// seedDeviceRegistry describes the peers of a server that has no registry yet: the desktop
+// and mobile peers setup wrote, and any peer added by hand under its address.
+func seedDeviceRegistry(conf *wgconf.Config, n wgNetwork) deviceRegistry {
+	var reg deviceRegistry
+	for _, p := range conf.Peers {
+		if len(p.AllowedIPs) == 0 {
+			continue
+		}
+		ip, _, _ := strings.Cut(p.AllowedIPs[0], "/")
+		name := "peer-" + strings.ReplaceAll(ip, ".", "-")
+		switch ip {
+		case n.DesktopIP:
+			name = deviceDesktop
+		case n.MobileIP:
+			name = deviceMobile
+		}
+		reg.Devices = append(reg.Devices, arcDevice{Name: name, IP: ip, WGPublicKey: p.PublicKey})
+	}
+	return reg
+}
+
+// nextFreeDeviceIP is the lowest host address of the subnet that no peer of conf routes and
+// no registered or reserved device holds.
+func nextFreeDeviceIP(n wgNetwork, reg deviceRegistry, conf *wgconf.Config) (string, error) {
+	prefix, err := netip.ParsePrefix(n.Subnet)
+	if err != nil {
+		return "", fmt.Errorf("invalid WireGuard subnet %q", n.Subnet)
+	}
+	used := map[string]bool{n.ServerIP: true, n.DesktopIP: true, n.MobileIP: true}
+	for _, d := range reg.Devices {
+		used[d.IP] = true
+	}
+	var routed []netip.Prefix
+	for _, p := range conf.Peers {
+		for _, a := range p.AllowedIPs {
+			if pfx, err := netip.ParsePrefix(a); err == nil {
+				routed = append(routed, pfx)
+			}
+		}
+	}
+	last := lastAddr(prefix)
+	for addr := prefix.Addr().Next(); addr.IsValid() && addr != last; addr = addr.Next() {
+		if used[addr.String()] {
+			continue
+		}
+		taken := false
+		for _, pfx := range routed {
+			if pfx.Contains(addr) {
+				taken = true
+				break
+			}
+		}
+		if !taken {
+			return addr.String(), nil
+		}
+	}
+	return "", fmt.Errorf("no free tunnel address left in %s", prefix)
+}
+
+// planDeviceJoin adds req to the registry and gives it a [Peer] in the server config. Approving
+// the same request again keeps its address, so an interrupted approval can be repeated.
+func planDeviceJoin(reg deviceRegistry, conf *wgconf.Config, n wgNetwork, req joinRequest, now time.Time) (deviceRegistry, arcDevice, error) {
+	if i := reg.find(req.Name); i >= 0 {
+		dev := reg.Devices[i]
+		if dev.WGPublicKey != req.WGPublicKey {
+			return reg, arcDevice{}, fmt.Errorf("a device named %q has already joined; pick another name", req.Name)
+		}
+		dev.SSHKey = req.SSHKey
+		reg.Devices[i] = dev
+		if err := ensureDevicePeer(conf, n, dev); err != nil {
+			return reg, arcDevice{}, err
+		}
+		return reg, dev, nil
+	}
+	for _, d := range reg.Devices {
+		if d.WGPublicKey == req.WGPublicKey {
+			return reg, arcDevice{}, fmt.Errorf("this WireGuard key already belongs to device %q", d.Name)
+		}
+	}
+	if i := conf.PeerByPublicKey(req.WGPublicKey); i >= 0 {
+		return reg, arcDevice{}, fmt.Errorf("this WireGuard key is already a peer on %s", n.Interface)
+	}
+
+	ip, err := nextFreeDeviceIP(n, reg, conf)
+	if err != nil {
+		return reg, arcDevice{}, err
+	}
+	dev := arcDevice{Name: req.Name, IP: ip, WGPublicKey: req.WGPublicKey, SSHKey: req.SSHKey, AddedAt: now.UTC()}
+	if err := ensureDevicePeer(conf, n, dev); err != nil {
+		return reg, arcDevice{}, err
+	}
+	reg.Devices = append(reg.Devices, dev)
+	return reg, dev, nil
+}
+
+// ensureDevicePeer gives dev a [Peer] with its own PresharedKey, and a PresharedKey to a peer
+// approved before arc used them.
+func ensureDevicePeer(conf *wgconf.Config, n wgNetwork, dev arcDevice) error {
+	i := conf.PeerByPublicKey(dev.WGPublicKey)
+	if i >= 0 && conf.Peers[i].PresharedKey != "" {
+		return nil
+	}
+	psk, err := genWGPresharedKey()
+	if err != nil {
+		return fmt.Errorf("generate preshared key: %w", err)
+	}
+	if i >= 0 {
+		conf.Peers[i].PresharedKey = psk
+		return nil
+	}
+	conf.Peers = append(conf.Peers, wgconf.Peer{
+		Comments:     []string{"arc device " + dev.Name},
+		PublicKey:    dev.WGPublicKey,
+		PresharedKey: psk,
+		AllowedIPs:   n.CIDRs(dev.IP),
+	})
+	return nil
+}
+
+// readServerDevices reads the server's wg config and device registry. A server set up before
+// the registry existed gets one seeded from its peers; on the machine that ran setup the
+// desktop and mobile entries also get the SSH keys setup authorized.
+func readServerDevices(ctx infraRunContext, client *ssh.Client) (*wgconf.Config, deviceRegistry, error) {
+	n := ctx.WG.Net
+	rawConf, err := runRemoteCommand(withoutStepOutput(ctx), client, "sudo -n cat "+n.ConfPath(), false, "")
+	if err != nil {
+		return nil, deviceRegistry{}, fmt.Errorf("read server wg config: %w", err)
+	}
+	conf, err := wgconf.Parse(rawConf)
+	if err != nil {
+		return nil, deviceRegistry{}, fmt.Errorf("parse server wg config: %w", err)
+	}
+	rawReg, err := runRemoteCommand(ctx, client, "sudo -n cat "+deviceRegistryPath+" 2>/dev/null || true", false, "")
+	if err != nil {
+		return nil, deviceRegistry{}, fmt.Errorf("read device registry: %w", err)
+	}
+	reg, err := parseDeviceRegistry(rawReg)
+	if err != nil {
+		return nil, deviceRegistry{}, err
+	}
+	if len(reg.Devices) > 0 {
+		return conf, reg, nil
+	}
+	reg = seedDeviceRegistry(conf, n)
+	if ctx.Device == "" {
+		setupKeys := map[string]string{deviceDesktop: userSSHPublicKeyPath(), deviceMobile: userMobileSSHPublicKeyPath()}
+		for i, d := range reg.Devices {
+			path, ok := setupKeys[d.Name]
+			if !ok {
+				continue
+			}
+			if line, err := readPublicKeyLine(path); err == nil {
+				reg.Devices[i].SSHKey = line
+			}
+		}
+	}
+	return conf, reg, nil
+}
+
+// addServerDevice approves req on the server: it records the device, adds its peer to the
+// running interface and its config, authorizes its SSH key, and exports /home/arc to it. Other
+// peers keep their sessions; the interface is never restarted. It returns the server's public
+// key and the PresharedKey of the device's link.
+func addServerDevice(ctx infraRunContext, req joinRequest) (arcDevice, string, string, error) {
+	n := ctx.WG.Net
+	var dev arcDevice
+	var serverPub, psk string
+	err := withArcClient(ctx, func(client *ssh.Client) error {
+		conf, reg, err := readServerDevices(ctx, client)
+		if err != nil {
+			return err
+		}
+		if serverPub, err = wgPublicKeyFromPrivateKeyB64(conf.Interface.PrivateKey); err != nil {
+			return fmt.Errorf("derive server wg public key: %w", err)
+		}
+		reg, dev, err = planDeviceJoin(reg, conf, n, req, time.Now())
+		if err != nil {
+			return err
+		}
+		psk = conf.Peers[conf.PeerByPublicKey(dev.WGPublicKey)].PresharedKey
+		if err := conf.Validate(); err != nil {
+			return fmt.Errorf("server wg config would be invalid: %w", err)
+		}
+		regJSON, err := json.MarshalIndent(reg, "", "  ")
+		if err != nil {
+			return fmt.Errorf("marshal device registry: %w", err)
+		}
+
+		arcUID, arcGID, err := readRemoteArcUIDGID(ctx, client)
+		if err != nil {
+			return err
+		}
+		exportsFile := deviceExportsFile(dev.Name)
+		if err := backupRemoteFiles(ctx, client, n.ConfPath(), deviceRegistryPath, exportsFile); err != nil {
+			return err
+		}
+		if err := ensureArcAuthorizedKey(ctx, client, true, "", dev.SSHKey); err != nil {
+			return err
+		}
+
+		script := fmt.Sprintf(`set -eu
+umask 077
+cat > %[1]s.arc.tmp <<'EOF'
+%[2]sEOF
+mv %[1]s.arc.tmp %[1]s
+install -d -m 0755 /etc/arc
+cat > %[3]s.arc.tmp <<'EOF'
+%[4]s
+EOF
+mv %[3]s.arc.tmp %[3]s
+psk="$(mktemp)"
+cat > "$psk" <<'EOF'
+%[11]s
+EOF
+wg set %[5]s peer %[6]s allowed-ips %[12]s preshared-key "$psk"
+rm -f "$psk"
+umask 022
+install -d -m 0755 /etc/exports.d
+cat > %[8]s <<'EOF'
+%[9]sEOF
+exportfs -ra
+if command -v ufw >/dev/null 2>&1; then
+	if ufw status 2>/dev/null | grep -q 'Status: active'; then
+		ufw allow in on %[5]s proto tcp from %[7]s to any port 2049 comment 'arc device %[10]s' >/dev/null
+	fi
+fi
+`, n.ConfPath(), conf.String(), deviceRegistryPath, regJSON, n.Interface, dev.WGPublicKey, dev.IP,
+			exportsFile, renderArcExportLine(dev.IP+"/32", arcUID, arcGID), dev.Name, psk, strings.Join(n.CIDRs(dev.IP), ","))
+		if _, err := runRemoteCommand(ctx, client, "sudo -n sh -c "+shSingleQuote(script), false, ""); err != nil {
+			return fmt.Errorf("add device %s on server: %w", dev.Name, err)
+		}
+		return nil
+	})
+	return dev, serverPub, psk, err
+}
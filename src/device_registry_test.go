@@ -0,0 +1,132 @@
+package main
+
+import (
+	"arc/internal/wgconf"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testServerConf(t *testing.T) (*wgconf.Config, wgNetwork) {
+	t.Helper()
+	wg, err := buildWGConfig("example.com", defaultWGNetwork())
+	if err != nil {
+		t.Fatalf("buildWGConfig: %v", err)
+	}
+	conf, err := wgconf.Parse(wg.ServerConf)
+	if err != nil {
+		t.Fatalf("wgconf.Parse: %v", err)
+	}
+	return conf, wg.Net
+}
+
+func testJoinRequest(t *testing.T, name string) joinRequest {
+	t.Helper()
+	_, pub, err := genWGKeyPair()
+	if err != nil {
+		t.Fatalf("genWGKeyPair: %v", err)
+	}
+	return joinRequest{Name: name, WGPublicKey: pub, SSHKey: "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl " + name}
+}
+
+func TestSeedDeviceRegistry_NamesSetupPeers(t *testing.T) {
+	conf, n := testServerConf(t)
+	reg := seedDeviceRegistry(conf, n)
+	if len(reg.Devices) != 2 {
+		t.Fatalf("expected desktop and mobile, got %+v", reg.Devices)
+	}
+	if reg.Devices[0].Name != deviceDesktop || reg.Devices[0].IP != wgDesktopIP || reg.Devices[0].WGPublicKey != conf.Peers[0].PublicKey {
+		t.Fatalf("unexpected desktop entry: %+v", reg.Devices[0])
+	}
+	if reg.Devices[1].Name != deviceMobile || reg.Devices[1].IP != wgMobileIP {
+		t.Fatalf("unexpected mobile entry: %+v", reg.Devices[1])
+	}
+}
+
+func TestPlanDeviceJoin_AllocatesNextFreeAddressAndPeer(t *testing.T) {
+	conf, n := testServerConf(t)
+	reg := seedDeviceRegistry(conf, n)
+	now := time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+
+	laptop := testJoinRequest(t, "laptop")
+	reg, dev, err := planDeviceJoin(reg, conf, n, laptop, now)
+	if err != nil {
+		t.Fatalf("planDeviceJoin: %v", err)
+	}
+	if dev.IP != "10.0.0.4" || !dev.AddedAt.Equal(now) {
+		t.Fatalf("unexpected device: %+v", dev)
+	}
+	if i := conf.PeerByPublicKey(laptop.WGPublicKey); i < 0 || conf.Peers[i].AllowedIPs[0] != "10.0.0.4/32" {
+		t.Fatalf("laptop peer missing from server config:\n%s", conf.String())
+	}
+	if err := conf.Validate(); err != nil {
+		t.Fatalf("server config invalid after join: %v", err)
+	}
+	psk := conf.Peers[conf.PeerByPublicKey(laptop.WGPublicKey)].PresharedKey
+	if psk == "" {
+		t.Fatalf("laptop peer has no preshared key")
+	}
+
+	// A peer added by hand holds .5, so the next device skips it.
+	_, stray, _ := genWGKeyPair()
+	conf.Peers = append(conf.Peers, wgconf.Peer{PublicKey: stray, AllowedIPs: []string{"10.0.0.5/32"}})
+	reg, dev, err = planDeviceJoin(reg, conf, n, testJoinRequest(t, "workstation"), now)
+	if err != nil {
+		t.Fatalf("planDeviceJoin: %v", err)
+	}
+	if dev.IP != "10.0.0.6" {
+		t.Fatalf("expected 10.0.0.6, got %s", dev.IP)
+	}
+
+	// Approving the same request again keeps the address and adds no second peer.
+	peers := len(conf.Peers)
+	_, again, err := planDeviceJoin(reg, conf, n, laptop, now.Add(time.Hour))
+	if err != nil {
+		t.Fatalf("repeat planDeviceJoin: %v", err)
+	}
+	if again.IP != "10.0.0.4" || len(conf.Peers) != peers {
+		t.Fatalf("repeat approval changed the device: %+v, %d peers", again, len(conf.Peers))
+	}
+	if conf.Peers[conf.PeerByPublicKey(laptop.WGPublicKey)].PresharedKey != psk {
+		t.Fatalf("repeat approval changed the preshared key")
+	}
+
+	other := testJoinRequest(t, "laptop")
+	if _, _, err := planDeviceJoin(reg, conf, n, other, now); err == nil || !strings.Contains(err.Error(), "already joined") {
+		t.Fatalf("expected a name conflict, got %v", err)
+	}
+	dup := laptop
+	dup.Name = "laptop-2"
+	if _, _, err := planDeviceJoin(reg, conf, n, dup, now); err == nil {
+		t.Fatalf("expected a reused WireGuard key to be rejected")
+	}
+}
+
+func TestNextFreeDeviceIP_FullSubnet(t *testing.T) {
+	n, err := resolveWGNetwork(wgNetwork{Subnet: "10.9.0.0/29"})
+	if err != nil {
+		t.Fatalf("resolveWGNetwork: %v", err)
+	}
+	conf := &wgconf.Config{}
+	reg := deviceRegistry{}
+	for _, ip := range []string{"10.9.0.4", "10.9.0.5", "10.9.0.6"} {
+		reg.Devices = append(reg.Devices, arcDevice{Name: ip, IP: ip})
+	}
+	if _, err := nextFreeDeviceIP(n, reg, conf); err == nil {
+		t.Fatalf("expected a full /29 to have no free address")
+	}
+	reg.Devices = reg.Devices[:2]
+	if ip, err := nextFreeDeviceIP(n, reg, conf); err != nil || ip != "10.9.0.6" {
+		t.Fatalf("expected 10.9.0.6, got %q (%v)", ip, err)
+	}
+}
+
+func TestRenderArcExportLine_PerDevice(t *testing.T) {
+	got := renderArcExportLine("10.0.0.4/32", "1001", "1001")
+	if !strings.HasPrefix(got, nfsMountTarget+" 10.0.0.4/32(") || !strings.HasSuffix(got, "\n") {
+		t.Fatalf("unexpected export line: %q", got)
+	}
+	if deviceExportsFile("laptop") != "/etc/exports.d/arc-laptop.exports" {
+		t.Fatalf("unexpected exports file: %s", deviceExportsFile("laptop"))
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+// devicesTimeout bounds one `arc devices` command.
+const devicesTimeout = time.Minute
+
+// deviceJSON is one entry of `arc devices list --json`.
+type deviceJSON struct {
+	Name           string     `json:"name"`
+	IP             string     `json:"ip"`
+	WGPublicKey    string     `json:"wgPublicKey"`
+	SSHFingerprint string     `json:"sshFingerprint,omitempty"`
+	LastHandshake  *time.Time `json:"lastHandshake,omitempty"`
+	LastLogin      *time.Time `json:"lastLogin,omitempty"`
+	ThisMachine    bool       `json:"thisMachine"`
+}
+
+func runDevicesCLI(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	if len(args) == 0 {
+		fmt.Fprintln(stderr, "arc devices: want a subcommand: list or revoke")
+		return 2
+	}
+	var asJSON, yes bool
+	fs := flag.NewFlagSet("arc devices "+args[0], flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	switch args[0] {
+	case "list":
+		fs.BoolVar(&asJSON, "json", false, "print the devices as JSON")
+	case "revoke":
+		fs.BoolVar(&yes, "yes", false, "do not ask for confirmation")
+	default:
+		fmt.Fprintf(stderr, "arc devices: unknown subcommand %q (want list or revoke)\n", args[0])
+		return 2
+	}
+	// Flags may come before or after the device name.
+	var rest []string
+	for remaining := args[1:]; ; {
+		if err := fs.Parse(remaining); err != nil {
+			if !errors.Is(err, flag.ErrHelp) {
+				fmt.Fprintf(stderr, "arc devices: %v\n", err)
+			}
+			return 2
+		}
+		if fs.NArg() == 0 {
+			break
+		}
+		rest = append(rest, fs.Arg(0))
+		remaining = fs.Args()[1:]
+	}
+	name := ""
+	switch {
+	case args[0] == "list" && len(rest) > 0:
+		fmt.Fprintf(stderr, "arc devices: unexpected arguments: %s\n", strings.Join(rest, " "))
+		return 2
+	case args[0] == "revoke" && len(rest) != 1:
+		fmt.Fprintln(stderr, "arc devices: usage: arc devices revoke <name> [--yes]")
+		return 2
+	case args[0] == "revoke":
+		name = rest[0]
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	ctx, cancel := context.WithTimeout(ctx, devicesTimeout)
+	defer cancel()
+
+	sessions := newSSHSessionManager()
+	defer func() { _ = sessions.Close() }()
+
+	runCtx, err := latestRunContext(ctx, sessions)
+	if err != nil {
+		fmt.Fprintf(stderr, "arc devices: %v\n", err)
+		return 1
+	}
+	target := arcUser + "@" + runCtx.Host
+
+	if name != "" && !yes && !promptConfirmation(stdin, stderr, fmt.Sprintf("Revoke device %q from %s?", name, target)) {
+		fmt.Fprintln(stderr, "arc devices: aborted")
+		return 1
+	}
+	if err := pickServerRoute(&runCtx); err != nil {
+		fmt.Fprintf(stderr, "arc devices: %v\n", err)
+		return 1
+	}
+
+	if name != "" {
+		dev, err := revokeServerDevice(runCtx, name)
+		if err != nil {
+			fmt.Fprintf(stderr, "arc devices: %v\n", err)
+			return 1
+		}
+		fmt.Fprintf(stdout, "revoked %s (%s): WireGuard peer, SSH key and NFS export removed from %s\n", dev.Name, dev.IP, target)
+		return 0
+	}
+
+	devices, err := listServerDevices(runCtx)
+	if err != nil {
+		fmt.Fprintf(stderr, "arc devices: %v\n", err)
+		return 1
+	}
+	if asJSON {
+		enc := json.NewEncoder(stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(toDevicesJSON(devices)); err != nil {
+			fmt.Fprintf(stderr, "arc devices: %v\n", err)
+			return 1
+		}
+		return 0
+	}
+	printDevices(stdout, devices, time.Now())
+	return 0
+}
+
+func toDevicesJSON(devices []deviceStatus) []deviceJSON {
+	out := []deviceJSON{}
+	for _, d := range devices {
+		entry := deviceJSON{
+			Name:           d.Name,
+			IP:             d.IP,
+			WGPublicKey:    d.WGPublicKey,
+			SSHFingerprint: d.SSHFingerprint,
+			ThisMachine:    d.ThisMachine,
+		}
+		if !d.LastHandshake.IsZero() {
+			at := d.LastHandshake.UTC()
+			entry.LastHandshake = &at
+		}
+		if !d.LastLogin.IsZero() {
+			at := d.LastLogin.UTC()
+			entry.LastLogin = &at
+		}
+		out = append(out, entry)
+	}
+	return out
+}
+
+func printDevices(w io.Writer, devices []deviceStatus, now time.Time) {
+	if len(devices) == 0 {
+		fmt.Fprintln(w, "no devices")
+		return
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tIP\tWG KEY\tSSH KEY\tHANDSHAKE\tLAST LOGIN")
+	for _, d := range devices {
+		name := d.Name
+		if d.ThisMachine {
+			name += " *"
+		}
+		fp := d.SSHFingerprint
+		if fp == "" {
+			fp = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", name, d.IP, d.WGPublicKey, fp, deviceAge(d.LastHandshake, now), deviceAge(d.LastLogin, now))
+	}
+	_ = tw.Flush()
+	fmt.Fprintln(w, "* this machine")
+}
+
+func deviceAge(at, now time.Time) string {
+	if at.IsZero() {
+		return "never"
+	}
+	return now.Sub(at).Round(time.Second).String() + " ago"
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"arc/internal/app"
+	"arc/internal/wgconf"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// deviceLoginLookback bounds how far back `arc devices list` searches sshd's journal.
+const deviceLoginLookback = "90 days ago"
+
+// deviceStatus is one row of `arc devices list`.
+type deviceStatus struct {
+	arcDevice
+	SSHFingerprint string
+	LastHandshake  time.Time // zero when the peer never completed a handshake
+	LastLogin      time.Time // zero when no login with the device's key was found
+	ThisMachine    bool
+}
+
+// listServerDevices reports every registered device and every peer of the server config, with
+// its latest handshake and the latest arc login with its SSH key.
+func listServerDevices(ctx infraRunContext) ([]deviceStatus, error) {
+	n := ctx.WG.Net
+	var out []deviceStatus
+	err := withArcClient(ctx, func(client *ssh.Client) error {
+		conf, reg, err := readServerDevices(ctx, client)
+		if err != nil {
+			return err
+		}
+		dump, err := runRemoteCommand(ctx, client, "sudo -n wg show "+n.Interface+" dump", false, "")
+		if err != nil {
+			return fmt.Errorf("read server wg peers: %w", err)
+		}
+		logins, _ := runRemoteCommand(ctx, client, fmt.Sprintf(
+			"sudo -n journalctl --no-pager -o short-iso -t sshd -t sshd-session --since %s 2>/dev/null | grep -F %s || true",
+			shSingleQuote(deviceLoginLookback), shSingleQuote("Accepted publickey for "+arcUser+" "),
+		), false, "")
+		out = deviceStatuses(withUnregisteredPeers(reg, conf, n), parseWGDump(dump), parseSSHLogins(logins), n.DesktopIP)
+		return nil
+	})
+	return out, err
+}
+
+// withUnregisteredPeers adds the peers of conf that no device holds, named as seeding would.
+func withUnregisteredPeers(reg deviceRegistry, conf *wgconf.Config, n wgNetwork) deviceRegistry {
+	out := deviceRegistry{Devices: slices.Clone(reg.Devices)}
+	for _, d := range seedDeviceRegistry(conf, n).Devices {
+		known := false
+		for _, r := range reg.Devices {
+			if r.WGPublicKey == d.WGPublicKey {
+				known = true
+				break
+			}
+		}
+		if !known {
+			out.Devices = append(out.Devices, d)
+		}
+	}
+	return out
+}
+
+func deviceStatuses(reg deviceRegistry, peers []app.WGPeerStatus, logins map[string]time.Time, thisIP string) []deviceStatus {
+	handshakes := map[string]time.Time{}
+	for _, p := range peers {
+		handshakes[p.PublicKey] = p.LatestHandshake
+	}
+	out := make([]deviceStatus, 0, len(reg.Devices))
+	for _, d := range reg.Devices {
+		st := deviceStatus{arcDevice: d, LastHandshake: handshakes[d.WGPublicKey], ThisMachine: d.IP == thisIP}
+		if key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(d.SSHKey)); err == nil {
+			st.SSHFingerprint = ssh.FingerprintSHA256(key)
+			st.LastLogin = logins[st.SSHFingerprint]
+		}
+		out = append(out, st)
+	}
+	return out
+}
+
+// parseSSHLogins maps each key fingerprint to its latest "Accepted publickey" line in sshd's
+// journal, printed with `journalctl -o short-iso`.
+func parseSSHLogins(out string) map[string]time.Time {
+	logins := map[string]time.Time{}
+	for _, ln := range strings.Split(out, "\n") {
+		fields := strings.Fields(ln)
+		if len(fields) < 2 || !strings.Contains(ln, "Accepted publickey for ") {
+			continue
+		}
+		at, err := parseJournalTime(fields[0])
+		if err != nil {
+			continue
+		}
+		fp := fields[len(fields)-1]
+		if !strings.HasPrefix(fp, "SHA256:") {
+			continue
+		}
+		if at.After(logins[fp]) {
+			logins[fp] = at
+		}
+	}
+	return logins
+}
+
+// parseJournalTime reads a short-iso timestamp; systemd switched its offset from +0000 to
+// +00:00 at some point, so both are accepted.
+func parseJournalTime(s string) (time.Time, error) {
+	if t, err := time.Parse("2006-01-02T15:04:05-0700", s); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// planDeviceRevoke drops the device from the registry and its peer from the server config.
+func planDeviceRevoke(reg deviceRegistry, conf *wgconf.Config, name, thisIP string) (deviceRegistry, arcDevice, error) {
+	i := reg.find(name)
+	if i < 0 {
+		var names []string
+		for _, d := range reg.Devices {
+			names = append(names, d.Name)
+		}
+		return reg, arcDevice{}, fmt.Errorf("no device named %q (devices: %s)", name, strings.Join(names, ", "))
+	}
+	dev := reg.Devices[i]
+	if dev.IP == thisIP {
+		return reg, arcDevice{}, fmt.Errorf("%q is this machine; revoke it from another device", name)
+	}
+	reg.Devices = slices.Delete(slices.Clone(reg.Devices), i, i+1)
+	conf.Peers = slices.DeleteFunc(conf.Peers, func(p wgconf.Peer) bool {
+		return p.PublicKey == dev.WGPublicKey || slices.Contains(p.AllowedIPs, dev.IP+"/32")
+	})
+	return reg, dev, nil
+}
+
+// revokeServerDevice removes a device's access to the server: its peer from the running
+// interface and the config, its authorized_keys line and its NFS export. Every file is
+// staged first and then moved into place, so a failure leaves the server as it was.
+func revokeServerDevice(ctx infraRunContext, name string) (arcDevice, error) {
+	n := ctx.WG.Net
+	var dev arcDevice
+	err := withArcClient(ctx, func(client *ssh.Client) error {
+		conf, reg, err := readServerDevices(ctx, client)
+		if err != nil {
+			return err
+		}
+		reg, dev, err = planDeviceRevoke(reg, conf, name, n.DesktopIP)
+		if err != nil {
+			return err
+		}
+		if err := conf.Validate(); err != nil {
+			return fmt.Errorf("server wg config would be invalid: %w", err)
+		}
+		regJSON, err := json.MarshalIndent(reg, "", "  ")
+		if err != nil {
+			return fmt.Errorf("marshal device registry: %w", err)
+		}
+		exportsFile := deviceExportsFile(dev.Name)
+		if err := backupRemoteFiles(ctx, client, n.ConfPath(), deviceRegistryPath, exportsFile, nfsExportsFile); err != nil {
+			return err
+		}
+
+		keys := ""
+		if dev.SSHKey != "" {
+			keys = fmt.Sprintf(`keys="$(getent passwd %[1]s | cut -d: -f6)/.ssh/authorized_keys"
+if [ -f "$keys" ]; then
+	grep -vxF %[2]s "$keys" > "$keys.arc.tmp" || true
+	chown %[1]s:%[1]s "$keys.arc.tmp"
+	chmod 600 "$keys.arc.tmp"
+fi
+`, arcUser, shSingleQuote(dev.SSHKey))
+		}
+		script := fmt.Sprintf(`set -eu
+umask 077
+cat > %[1]s.arc.tmp <<'EOF'
+%[2]sEOF
+cat > %[3]s.arc.tmp <<'EOF'
+%[4]s
+EOF
+%[5]sif [ -f %[6]s ]; then
+	grep -vF %[7]s %[6]s > %[6]s.arc.tmp || true
+	chmod 644 %[6]s.arc.tmp
+fi
+mv %[1]s.arc.tmp %[1]s
+mv %[3]s.arc.tmp %[3]s
+if [ -n "${keys:-}" ] && [ -f "$keys.arc.tmp" ]; then mv "$keys.arc.tmp" "$keys"; fi
+if [ -f %[6]s.arc.tmp ]; then mv %[6]s.arc.tmp %[6]s; fi
+rm -f %[8]s
+wg set %[9]s peer %[10]s remove
+if command -v exportfs >/dev/null 2>&1; then
+	exportfs -ra
+fi
+if command -v ufw >/dev/null 2>&1; then
+	if ufw status 2>/dev/null | grep -q 'Status: active'; then
+		ufw delete allow in on %[9]s proto tcp from %[11]s to any port 2049 >/dev/null 2>&1 || true
+	fi
+fi
+`, n.ConfPath(), conf.String(), deviceRegistryPath, regJSON, keys, nfsExportsFile, shSingleQuote(" "+dev.IP+"/32("),
+			exportsFile, n.Interface, dev.WGPublicKey, dev.IP)
+		if _, err := runRemoteCommand(ctx, client, "sudo -n sh -c "+shSingleQuote(script), false, ""); err != nil {
+			return fmt.Errorf("revoke device %s on server: %w", dev.Name, err)
+		}
+		return nil
+	})
+	return dev, err
+}
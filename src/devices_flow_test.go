@@ -0,0 +1,99 @@
+package main
+
+import (
+	"arc/internal/app"
+	"arc/internal/wgconf"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSSHLogins_KeepsLatestPerKey(t *testing.T) {
+	out := strings.Join([]string{
+		"2026-10-15T08:01:02+0000 server sshd[812]: Accepted publickey for arc from 10.0.0.2 port 50122 ssh2: ED25519 SHA256:desktopkey",
+		"2026-10-16T09:30:00+02:00 server sshd-session[990]: Accepted publickey for arc from 10.0.0.4 port 40100 ssh2: ED25519 SHA256:laptopkey",
+		"2026-10-17T10:00:00+0000 server sshd[1200]: Accepted publickey for arc from 10.0.0.2 port 50200 ssh2: ED25519 SHA256:desktopkey",
+		"2026-10-17T11:00:00+0000 server sshd[1300]: Accepted password for arc from 10.0.0.2 port 50300 ssh2",
+		"-- No entries --",
+	}, "\n")
+	logins := parseSSHLogins(out)
+	if len(logins) != 2 {
+		t.Fatalf("expected two keys, got %v", logins)
+	}
+	if want := time.Date(2026, 10, 17, 10, 0, 0, 0, time.UTC); !logins["SHA256:desktopkey"].Equal(want) {
+		t.Fatalf("expected the latest desktop login, got %v", logins["SHA256:desktopkey"])
+	}
+	if want := time.Date(2026, 10, 16, 7, 30, 0, 0, time.UTC); !logins["SHA256:laptopkey"].Equal(want) {
+		t.Fatalf("unexpected laptop login %v", logins["SHA256:laptopkey"])
+	}
+}
+
+func TestDeviceStatuses_JoinsHandshakesAndLogins(t *testing.T) {
+	conf, n := testServerConf(t)
+	reg := seedDeviceRegistry(conf, n)
+	laptop := testJoinRequest(t, "laptop")
+	reg, _, err := planDeviceJoin(reg, conf, n, laptop, time.Now())
+	if err != nil {
+		t.Fatalf("planDeviceJoin: %v", err)
+	}
+	// A peer added by hand shows up even though the registry does not know it.
+	_, stray, _ := genWGKeyPair()
+	conf.Peers = append(conf.Peers, wgconf.Peer{PublicKey: stray, AllowedIPs: []string{"10.0.0.9/32"}})
+	all := withUnregisteredPeers(reg, conf, n)
+	if len(all.Devices) != 4 || all.Devices[3].Name != "peer-10-0-0-9" {
+		t.Fatalf("expected the stray peer to be listed, got %+v", all.Devices)
+	}
+
+	handshake := time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+	statuses := deviceStatuses(all, []app.WGPeerStatus{{PublicKey: laptop.WGPublicKey, LatestHandshake: handshake}}, nil, n.DesktopIP)
+	if !statuses[0].ThisMachine || statuses[2].ThisMachine {
+		t.Fatalf("only the desktop should be this machine: %+v", statuses)
+	}
+	st := statuses[2]
+	if st.Name != "laptop" || !st.LastHandshake.Equal(handshake) || !strings.HasPrefix(st.SSHFingerprint, "SHA256:") {
+		t.Fatalf("unexpected laptop status: %+v", st)
+	}
+
+	login := handshake.Add(-time.Hour)
+	statuses = deviceStatuses(all, nil, map[string]time.Time{st.SSHFingerprint: login}, n.DesktopIP)
+	if !statuses[2].LastLogin.Equal(login) || !statuses[2].LastHandshake.IsZero() {
+		t.Fatalf("unexpected laptop status: %+v", statuses[2])
+	}
+	if statuses[3].SSHFingerprint != "" || !statuses[3].LastLogin.IsZero() {
+		t.Fatalf("a peer without an SSH key has no login: %+v", statuses[3])
+	}
+}
+
+func TestPlanDeviceRevoke_RemovesPeerAndEntry(t *testing.T) {
+	conf, n := testServerConf(t)
+	reg := seedDeviceRegistry(conf, n)
+	laptop := testJoinRequest(t, "laptop")
+	reg, _, err := planDeviceJoin(reg, conf, n, laptop, time.Now())
+	if err != nil {
+		t.Fatalf("planDeviceJoin: %v", err)
+	}
+
+	if _, _, err := planDeviceRevoke(reg, conf, deviceDesktop, n.DesktopIP); err == nil || !strings.Contains(err.Error(), "this machine") {
+		t.Fatalf("expected revoking this machine to be refused, got %v", err)
+	}
+	if _, _, err := planDeviceRevoke(reg, conf, "tablet", n.DesktopIP); err == nil || !strings.Contains(err.Error(), "laptop") {
+		t.Fatalf("expected an unknown device to list the known ones, got %v", err)
+	}
+
+	reg, dev, err := planDeviceRevoke(reg, conf, "laptop", n.DesktopIP)
+	if err != nil {
+		t.Fatalf("planDeviceRevoke: %v", err)
+	}
+	if dev.IP != "10.0.0.4" || dev.SSHKey != laptop.SSHKey {
+		t.Fatalf("unexpected revoked device: %+v", dev)
+	}
+	if reg.find("laptop") >= 0 || len(reg.Devices) != 2 {
+		t.Fatalf("laptop still registered: %+v", reg.Devices)
+	}
+	if conf.PeerByPublicKey(laptop.WGPublicKey) >= 0 || len(conf.Peers) != 2 {
+		t.Fatalf("laptop peer still in server config:\n%s", conf.String())
+	}
+	if err := conf.Validate(); err != nil {
+		t.Fatalf("server config invalid after revoke: %v", err)
+	}
+}
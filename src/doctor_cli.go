@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// doctorTimeout bounds a whole `arc doctor` run; fixes may reinstall configs and restart
+// services on both machines.
+const doctorTimeout = 5 * time.Minute
+
+// doctorJSON is the `arc doctor --json` document.
+type doctorJSON struct {
+	Target  string            `json:"target"`
+	Fix     bool              `json:"fix"`
+	Healthy bool              `json:"healthy"`
+	Checks  []doctorCheckJSON `json:"checks"`
+}
+
+type doctorCheckJSON struct {
+	Name   string `json:"name"`
+	Where  string `json:"where"`
+	State  string `json:"state"`
+	Detail string `json:"detail,omitempty"`
+}
+
+func runDoctorCLI(args []string, stdout, stderr io.Writer) int {
+	var fix, asJSON bool
+	fs := flag.NewFlagSet("arc doctor", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.BoolVar(&fix, "fix", false, "repair drifted items with the setup handlers")
+	fs.BoolVar(&asJSON, "json", false, "print results as JSON")
+	if err := fs.Parse(args); err != nil {
+		if !errors.Is(err, flag.ErrHelp) {
+			fmt.Fprintf(stderr, "arc doctor: %v\n", err)
+		}
+		return 2
+	}
+	if fs.NArg() > 0 {
+		fmt.Fprintf(stderr, "arc doctor: unexpected arguments: %s\n", strings.Join(fs.Args(), " "))
+		return 2
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	ctx, cancel := context.WithTimeout(ctx, doctorTimeout)
+	defer cancel()
+
+	sessions := newSSHSessionManager()
+	defer func() { _ = sessions.Close() }()
+
+	runCtx, err := latestRunContext(ctx, sessions)
+	if err != nil {
+		fmt.Fprintf(stderr, "arc doctor: %v\n", err)
+		return 1
+	}
+	remoteErr := pickServerRoute(&runCtx)
+	results := runDoctorChecks(runCtx, arcDoctorChecks(runCtx.WG), fix, remoteErr)
+	target := arcUser + "@" + runCtx.Host
+
+	if asJSON {
+		enc := json.NewEncoder(stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(toDoctorJSON(target, fix, results)); err != nil {
+			fmt.Fprintf(stderr, "arc doctor: %v\n", err)
+			return 1
+		}
+	} else {
+		printDoctorResults(stdout, target, fix, results)
+	}
+	if !doctorHealthy(results) {
+		return 1
+	}
+	return 0
+}
+
+// doctorHealthy is true when every item is in sync, either already or after a fix.
+func doctorHealthy(results []doctorResult) bool {
+	for _, r := range results {
+		if r.State != doctorOK && r.State != doctorFixed {
+			return false
+		}
+	}
+	return true
+}
+
+func printDoctorResults(w io.Writer, target string, fix bool, results []doctorResult) {
+	fmt.Fprintf(w, "arc doctor: %s\n", target)
+	drifted := 0
+	for _, r := range results {
+		line := fmt.Sprintf("%-9s %s (%s)", "["+string(r.State)+"]", r.Name, r.Where)
+		if r.Detail != "" {
+			line += ": " + r.Detail
+		}
+		fmt.Fprintln(w, line)
+		if r.State == doctorDrift || r.State == doctorFailed {
+			drifted++
+		}
+	}
+	switch {
+	case drifted > 0 && !fix:
+		fmt.Fprintf(w, "%d item(s) drifted; run `arc doctor --fix` to repair\n", drifted)
+	case drifted > 0:
+		fmt.Fprintf(w, "%d item(s) still drifted after --fix\n", drifted)
+	case !doctorHealthy(results):
+		fmt.Fprintln(w, "some checks could not run")
+	default:
+		fmt.Fprintln(w, "everything matches setup")
+	}
+}
+
+func toDoctorJSON(target string, fix bool, results []doctorResult) doctorJSON {
+	doc := doctorJSON{Target: target, Fix: fix, Healthy: doctorHealthy(results), Checks: []doctorCheckJSON{}}
+	for _, r := range results {
+		doc.Checks = append(doc.Checks, doctorCheckJSON{
+			Name:   r.Name,
+			Where:  r.Where,
+			State:  string(r.State),
+			Detail: r.Detail,
+		})
+	}
+	return doc
+}
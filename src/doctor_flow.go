@@ -0,0 +1,324 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+type doctorState string
+
+const (
+	doctorOK    doctorState = "ok"
+	doctorDrift doctorState = "drift"
+	doctorFixed doctorState = "fixed"
+	// doctorFailed means a fix was applied but the item still drifts, or the fix errored.
+	doctorFailed doctorState = "failed"
+	// doctorSkipped means the check could not run, e.g. the server is unreachable.
+	doctorSkipped doctorState = "skipped"
+)
+
+// doctorBoth marks checks that compare state across both machines.
+const doctorBoth = "local+remote"
+
+// doctorCheck re-runs one verify-style check from setup. Check returns one line per mismatch;
+// none means the item matches what setup configured. Fix is the setup handler that reconciles
+// it, or nil when the item can only be reported.
+type doctorCheck struct {
+	Name   string
+	Where  string
+	Remote bool
+	Check  func(ctx infraRunContext) ([]string, error)
+	Fix    func(ctx infraRunContext) error
+}
+
+type doctorResult struct {
+	Name   string
+	Where  string
+	State  doctorState
+	Detail string
+}
+
+// runDoctorChecks runs every check in order. With fix set, only drifted items are repaired and
+// each repair is confirmed by checking again. Remote checks are skipped when remoteErr is set.
+func runDoctorChecks(ctx infraRunContext, checks []doctorCheck, fix bool, remoteErr error) []doctorResult {
+	results := make([]doctorResult, 0, len(checks))
+	for _, c := range checks {
+		res := doctorResult{Name: c.Name, Where: c.Where}
+		if c.Remote && remoteErr != nil {
+			res.State = doctorSkipped
+			res.Detail = remoteErr.Error()
+			results = append(results, res)
+			continue
+		}
+
+		drift, err := c.Check(ctx)
+		switch {
+		case err != nil:
+			res.State = doctorSkipped
+			res.Detail = err.Error()
+		case len(drift) == 0:
+			res.State = doctorOK
+		case !fix:
+			res.State = doctorDrift
+			res.Detail = strings.Join(drift, "; ")
+		case c.Fix == nil:
+			res.State = doctorDrift
+			res.Detail = strings.Join(drift, "; ") + " (no automatic fix)"
+		default:
+			res.State, res.Detail = fixDoctorDrift(ctx, c, drift)
+		}
+		results = append(results, res)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return results
+}
+
+func fixDoctorDrift(ctx infraRunContext, c doctorCheck, drift []string) (doctorState, string) {
+	if err := c.Fix(ctx); err != nil {
+		return doctorFailed, fmt.Sprintf("%s; fix failed: %v", strings.Join(drift, "; "), err)
+	}
+	remaining, err := c.Check(ctx)
+	if err != nil {
+		return doctorFailed, fmt.Sprintf("%s; re-check after fix failed: %v", strings.Join(drift, "; "), err)
+	}
+	if len(remaining) > 0 {
+		return doctorFailed, "still drifting after fix: " + strings.Join(remaining, "; ")
+	}
+	return doctorFixed, strings.Join(drift, "; ")
+}
+
+// latestRunContext rebuilds the run context of the latest setup run.
+func latestRunContext(ctx context.Context, sessions *sshSessionManager) (infraRunContext, error) {
+	run, ok, err := latestSetupRun("")
+	if err != nil {
+		return infraRunContext{}, err
+	}
+	if !ok {
+		return infraRunContext{}, fmt.Errorf("no setup run recorded; run `arc setup` first")
+	}
+	return infraRunContext{Context: ctx, Addr: run.Addr, Host: run.Host, WG: fromAppWG(run.WG), SSH: sessions, RunID: run.ID, Device: run.Device}, nil
+}
+
+// pickServerRoute sets ctx.Tunnel to the first route that reaches the server as arc: the
+// tunnel, since hardening locks down public SSH, then the public address. It returns an error
+// when neither works.
+func pickServerRoute(ctx *infraRunContext) error {
+	ctx.Tunnel = true
+	_, release, tunnelErr := arcClientFor(*ctx)
+	if tunnelErr == nil {
+		release()
+		return nil
+	}
+	ctx.Tunnel = false
+	_, release, publicErr := arcClientFor(*ctx)
+	if publicErr == nil {
+		release()
+		return nil
+	}
+	return fmt.Errorf("server unreachable (tunnel: %v; public: %v)", tunnelErr, publicErr)
+}
+
+// serverCommandRunner connects the way setup would at this point: as arc once its key works,
+// otherwise as the bootstrap user. The returned func runs a command on the server, as root
+// when asRoot is set. The caller calls release once it is done with the server.
+func serverCommandRunner(ctx *infraRunContext, user, password string, asRoot bool) (run func(string) (string, error), release func(), err error) {
+	if err := pickServerRoute(ctx); err == nil {
+		client, release, err := arcClientFor(*ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		return func(cmd string) (string, error) {
+			if asRoot {
+				cmd = "sudo -n sh -c " + shSingleQuote(cmd)
+			}
+			return runRemoteCommand(ctx, client, cmd, false, "")
+		}, release, nil
+	}
+	client, release, err := bootstrapClientFor(*ctx, user, password)
+	if err != nil {
+		return nil, nil, err
+	}
+	useSudo := asRoot && user != "root"
+	return func(cmd string) (string, error) {
+		return runRemoteCommand(ctx, client, cmd, useSudo, password)
+	}, release, nil
+}
+
+// arcDoctorChecks lists the checks in repair order: keys and name resolution before the
+// services that depend on them. Unit names follow the run's WireGuard config wg.
+func arcDoctorChecks(wg wgConfig) []doctorCheck {
+	n := wg.Net
+	checks := []doctorCheck{
+		{Name: "wireguard peer keys", Where: doctorBoth, Remote: true, Check: checkWireGuardPeerKeys, Fix: fixWireGuardPeerKeys},
+		{Name: "tunnel ping", Where: statusLocal, Check: checkTunnelPing},
+		{Name: "hosts aliases", Where: statusLocal, Check: checkLocalHostsAliases, Fix: func(ctx infraRunContext) error {
+			return ensureLocalArcHostsAliases(ctx, ctx.Host)
+		}},
+		{Name: "known_hosts", Where: statusLocal, Check: func(ctx infraRunContext) ([]string, error) {
+			return arcRemoteKnownHostsDrift(ctx.Addr, ctx.WG.Net)
+		}, Fix: func(ctx infraRunContext) error {
+			return syncLocalKnownHostsForArcRemote(ctx, ctx.Addr, ctx.WG.Net)
+		}},
+		{Name: "ssh config", Where: statusLocal, Check: func(ctx infraRunContext) ([]string, error) {
+			return arcSSHConfigDrift(ctx.WG.Net)
+		}, Fix: func(ctx infraRunContext) error {
+			return syncLocalSSHConfigForArcRemote(ctx.WG.Net)
+		}},
+		{Name: "fstab", Where: statusLocal, Check: checkLocalArcFstab, Fix: func(ctx infraRunContext) error {
+			return configureLocalArcAutomount(ctx)
+		}},
+	}
+	checks = append(checks, localUnitDoctorCheck(n.LocalUnit(), n.Userspace()))
+	localUnits, remoteUnits := []string{homeArcAutomountUnit}, []string{remoteClipdUnit, lhRedirectServiceName, publicLockdownUnit}
+	if n.Relay != "" {
+		localUnits = append(localUnits, localRelayUnit(n))
+		remoteUnits = append(remoteUnits, arcRelayServerUnit)
+	}
+	if endpointHostname(wg) != "" {
+		localUnits = append(localUnits, localEndpointTimer(n))
+	}
+	for _, unit := range localUnits {
+		checks = append(checks, localUnitDoctorCheck(unit, false))
+	}
+	for _, unit := range []string{waypipeUnit, clipboardSyncUnit} {
+		checks = append(checks, localUnitDoctorCheck(unit, true))
+	}
+	checks = append(checks, doctorCheck{Name: "nfs mount", Where: statusLocal, Check: func(ctx infraRunContext) ([]string, error) {
+		if err := checkLocalArcNFSMount(ctx, ctx.WG.Net); err != nil {
+			return []string{err.Error()}, nil
+		}
+		return nil, nil
+	}})
+	for _, unit := range remoteUnits {
+		checks = append(checks, remoteUnitDoctorCheck(unit))
+	}
+	return checks
+}
+
+func checkWireGuardPeerKeys(ctx infraRunContext) ([]string, error) {
+	client, release, err := arcClientFor(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	plan, err := planWireGuardPeerSync(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+	var drift []string
+	if plan.LocalChanged {
+		drift = append(drift, "local peer "+ctx.WG.Net.ServerCIDR()+" does not match the server key, endpoint or preshared key")
+	}
+	if plan.RemoteChanged {
+		drift = append(drift, "server peer "+ctx.WG.Net.DesktopCIDR()+" does not match the local key or preshared key")
+	}
+	return drift, nil
+}
+
+func fixWireGuardPeerKeys(ctx infraRunContext) error {
+	_, err := autoSyncWireGuardPeerKeys(ctx)
+	return err
+}
+
+func checkTunnelPing(ctx infraRunContext) ([]string, error) {
+	if err := probeTunnel(ctx); err != nil {
+		return []string{fmt.Sprintf("no reply from %s: %v", ctx.WG.Net.ServerIP, err)}, nil
+	}
+	return nil, nil
+}
+
+func checkLocalHostsAliases(ctx infraRunContext) ([]string, error) {
+	hostsRaw, err := execLocal(ctx, "sudo", "-n", "cat", "/etc/hosts")
+	if err != nil {
+		return nil, fmt.Errorf("cannot read /etc/hosts: %w", err)
+	}
+	if localArcHostsDrift(hostsRaw, ctx.WG.Net.LocalServerIP()) {
+		return []string{"lh/rh/remotehost aliases missing or stale in /etc/hosts"}, nil
+	}
+	return nil, nil
+}
+
+func checkLocalArcFstab(ctx infraRunContext) ([]string, error) {
+	fstabRaw, err := execLocal(ctx, "sudo", "-n", "cat", "/etc/fstab")
+	if err != nil {
+		return nil, fmt.Errorf("read /etc/fstab: %w", err)
+	}
+	_, changed, err := upsertFstabEntry(fstabRaw, nfsMountTarget, renderArcFstabLine(ctx.WG.Net))
+	if err != nil {
+		return nil, err
+	}
+	if changed {
+		return []string{nfsMountTarget + " entry missing or stale in /etc/fstab"}, nil
+	}
+	return nil, nil
+}
+
+func localUnitDoctorCheck(unit string, user bool) doctorCheck {
+	return doctorCheck{
+		Name:  unit,
+		Where: statusLocal,
+		Check: func(ctx infraRunContext) ([]string, error) {
+			return unitDrift(unit, localUnitStates(ctx, user, unit)[unit]), nil
+		},
+		Fix: func(ctx infraRunContext) error {
+			var err error
+			if user {
+				_, err = execLocal(ctx, "systemctl", "--user", "restart", unit)
+			} else {
+				_, err = execLocal(ctx, "sudo", "-n", "systemctl", "restart", unit)
+			}
+			if err != nil {
+				return fmt.Errorf("restart %s: %w", unit, err)
+			}
+			return nil
+		},
+	}
+}
+
+func remoteUnitDoctorCheck(unit string) doctorCheck {
+	restart := "sudo -n systemctl restart " + shSingleQuote(unit)
+	if unit == remoteClipdUnit {
+		restart = "systemctl --user restart " + shSingleQuote(unit)
+	}
+	return doctorCheck{
+		Name:   unit,
+		Where:  statusRemote,
+		Remote: true,
+		Check: func(ctx infraRunContext) ([]string, error) {
+			client, release, err := arcClientFor(ctx)
+			if err != nil {
+				return nil, err
+			}
+			defer release()
+			states, err := readRemoteUnitStates(ctx, client, []string{unit})
+			if err != nil {
+				return nil, err
+			}
+			return unitDrift(unit, states[unit]), nil
+		},
+		Fix: func(ctx infraRunContext) error {
+			client, release, err := arcClientFor(ctx)
+			if err != nil {
+				return err
+			}
+			defer release()
+			if _, err := runRemoteCommand(ctx, client, restart, false, ""); err != nil {
+				return fmt.Errorf("restart %s: %w", unit, err)
+			}
+			return nil
+		},
+	}
+}
+
+func unitDrift(unit, state string) []string {
+	if state == "active" {
+		return nil
+	}
+	if state == "" {
+		state = "in an unknown state"
+	}
+	return []string{unit + " is " + state}
+}
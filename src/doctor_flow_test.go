@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func TestRunDoctorChecks_FixesOnlyDriftedItems(t *testing.T) {
+	var fixed []string
+	synced := map[string]bool{"in-sync": true}
+	check := func(name string) doctorCheck {
+		return doctorCheck{
+			Name:  name,
+			Where: statusLocal,
+			Check: func(infraRunContext) ([]string, error) {
+				if synced[name] {
+					return nil, nil
+				}
+				return []string{name + " is stale"}, nil
+			},
+			Fix: func(infraRunContext) error {
+				fixed = append(fixed, name)
+				synced[name] = true
+				return nil
+			},
+		}
+	}
+	checks := []doctorCheck{check("in-sync"), check("stale")}
+	ctx := infraRunContext{Context: context.Background()}
+
+	report := runDoctorChecks(ctx, checks, false, nil)
+	if report[0].State != doctorOK || report[1].State != doctorDrift || report[1].Detail != "stale is stale" {
+		t.Fatalf("unexpected report without --fix: %#v", report)
+	}
+	if len(fixed) != 0 {
+		t.Fatalf("report-only run must not fix anything, fixed %v", fixed)
+	}
+
+	results := runDoctorChecks(ctx, checks, true, nil)
+	if results[0].State != doctorOK || results[1].State != doctorFixed {
+		t.Fatalf("unexpected results with --fix: %#v", results)
+	}
+	if len(fixed) != 1 || fixed[0] != "stale" {
+		t.Fatalf("expected only the drifted item to be fixed, fixed %v", fixed)
+	}
+	if !doctorHealthy(results) {
+		t.Fatalf("fixed results should count as healthy")
+	}
+}
+
+func TestRunDoctorChecks_ReportsFailedFixAndSkipsUnreachableRemote(t *testing.T) {
+	stubborn := doctorCheck{
+		Name:  "stubborn",
+		Where: statusLocal,
+		Check: func(infraRunContext) ([]string, error) { return []string{"still wrong"}, nil },
+		Fix:   func(infraRunContext) error { return nil },
+	}
+	broken := doctorCheck{
+		Name:  "broken",
+		Where: statusLocal,
+		Check: func(infraRunContext) ([]string, error) { return []string{"wrong"}, nil },
+		Fix:   func(infraRunContext) error { return errors.New("sudo refused") },
+	}
+	remoteCalled := false
+	remote := doctorCheck{
+		Name:   "remote",
+		Where:  statusRemote,
+		Remote: true,
+		Check: func(infraRunContext) ([]string, error) {
+			remoteCalled = true
+			return nil, nil
+		},
+	}
+
+	results := runDoctorChecks(infraRunContext{Context: context.Background()}, []doctorCheck{stubborn, broken, remote}, true, errors.New("server unreachable"))
+	if results[0].State != doctorFailed || !strings.Contains(results[0].Detail, "still drifting after fix") {
+		t.Fatalf("unexpected stubborn result: %#v", results[0])
+	}
+	if results[1].State != doctorFailed || !strings.Contains(results[1].Detail, "sudo refused") {
+		t.Fatalf("unexpected broken result: %#v", results[1])
+	}
+	if results[2].State != doctorSkipped || results[2].Detail != "server unreachable" || remoteCalled {
+		t.Fatalf("remote check should be skipped without running: %#v", results[2])
+	}
+	if doctorHealthy(results) {
+		t.Fatalf("failed and skipped results must not count as healthy")
+	}
+}
+
+func TestLocalArcHostsDrift_DetectsMissingAndPublicAliases(t *testing.T) {
+	base := "127.0.0.1\tlocalhost\n"
+	synced := rewriteHostsMappings(base, arcHostsMappings(wgServerIP))
+	if localArcHostsDrift(synced, wgServerIP) {
+		t.Fatalf("hosts written by setup should not drift:\n%s", synced)
+	}
+	if !localArcHostsDrift(base, wgServerIP) {
+		t.Fatalf("hosts without arc aliases should drift")
+	}
+	if !localArcHostsDrift(synced+"203.0.113.7\tpub.rh\n", wgServerIP) {
+		t.Fatalf("public alias should drift")
+	}
+	if !localArcHostsDrift(strings.Replace(synced, wgServerIP+"\trh", "10.9.9.9\trh", 1), wgServerIP) {
+		t.Fatalf("rh pointing elsewhere should drift")
+	}
+}
+
+func TestKnownHostsMissing_RequiresMatchingKey(t *testing.T) {
+	key := testHostKey(t)
+	other := testHostKey(t)
+	targets := []knownHostTarget{{Host: "rh", Port: "22"}, {Host: "remotehost", Port: "22"}}
+
+	raw := knownhosts.Line([]string{"rh"}, key) + "\n" +
+		"not a known_hosts line\n" +
+		knownhosts.Line([]string{"remotehost"}, other) + "\n"
+
+	missing := knownHostsMissing([]byte(raw), key, targets...)
+	if len(missing) != 1 || missing[0].Host != "remotehost" {
+		t.Fatalf("expected only remotehost to be missing, got %#v", missing)
+	}
+}
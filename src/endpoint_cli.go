@@ -0,0 +1,65 @@
+package main
+
+import (
+	"arc/internal/wgconf"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// runEndpointCLI runs `arc endpoint IFACE`: one check that the server peer of IFACE is at
+// the address its DNS name resolves to now. The arc-endpoint timer runs it every minute.
+// The config is only rewritten where it holds an address; setup writes the name there.
+func runEndpointCLI(args []string, stdout, stderr io.Writer) int {
+	var host string
+	fs := flag.NewFlagSet("arc endpoint", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.StringVar(&host, "host", "", "the server's DNS name (default the host of the peer's Endpoint)")
+	if err := fs.Parse(args); err != nil {
+		if !errors.Is(err, flag.ErrHelp) {
+			fmt.Fprintf(stderr, "arc endpoint: %v\n", err)
+		}
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fmt.Fprintln(stderr, "arc endpoint: usage: arc endpoint [--host NAME] IFACE")
+		fmt.Fprintln(stderr, "Moves the live server peer of IFACE to the address NAME resolves to. The config keeps")
+		fmt.Fprintln(stderr, "a DNS name as it is, for wg-quick to resolve; only an address there is rewritten.")
+		return 2
+	}
+	iface := fs.Arg(0)
+	if !wgInterfacePattern.MatchString(iface) {
+		fmt.Fprintf(stderr, "arc endpoint: invalid interface name %q\n", iface)
+		return 2
+	}
+	if host != "" && !dnsNamePattern.MatchString(host) {
+		fmt.Fprintf(stderr, "arc endpoint: invalid --host %q\n", host)
+		return 2
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	t := &endpointTracker{
+		iface:    iface,
+		host:     host,
+		loadConf: func() (*wgconf.Config, error) { return loadWGQuickConf(iface) },
+		saveConf: func(c *wgconf.Config) error { return saveWGQuickConf(iface, c) },
+		resolve: func(ctx context.Context, host string) ([]netip.Addr, error) {
+			return net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+		},
+		wg:   runWG,
+		logf: func(format string, a ...any) { fmt.Fprintf(stdout, "arc endpoint: "+format+"\n", a...) },
+	}
+	if err := t.check(ctx); err != nil {
+		fmt.Fprintf(stderr, "arc endpoint: %v\n", err)
+		return 1
+	}
+	return 0
+}
@@ -2,18 +2,26 @@ package main
 
 import (
 	"fmt"
-	"os"
 	"strings"
 )
 
-func ensureLocalHostsMappings(m map[string]string) error {
-	hostsRaw, err := execLocal("sudo", "-n", "cat", "/etc/hosts")
+func ensureLocalHostsMappings(ctx infraRunContext, m map[string]string) error {
+	hostsRaw, err := execLocal(ctx, "sudo", "-n", "cat", localHostsPath)
 	if err != nil {
 		return fmt.Errorf("cannot read /etc/hosts: %w", err)
 	}
+	newHosts := rewriteHostsMappings(hostsRaw, m)
+	if err := installLocalManagedFile(ctx, localHostsPath, []byte(newHosts), 0o644); err != nil {
+		return fmt.Errorf("cannot update /etc/hosts (sudo install): %w", err)
+	}
+	return nil
+}
 
+// rewriteHostsMappings drops every alias in m from hostsRaw and appends the managed mappings
+// (aliases with an empty address are only removed). Rewriting its own output is a no-op.
+func rewriteHostsMappings(hostsRaw string, m map[string]string) string {
 	var out []string
-	for _, ln := range strings.Split(hostsRaw, "\n") {
+	for _, ln := range strings.Split(strings.TrimRight(hostsRaw, "\n"), "\n") {
 		trim := strings.TrimSpace(ln)
 		if trim == "" || strings.HasPrefix(trim, "#") {
 			out = append(out, ln)
@@ -59,31 +67,38 @@ func ensureLocalHostsMappings(m map[string]string) error {
 	if !strings.HasSuffix(newHosts, "\n") {
 		newHosts += "\n"
 	}
-
-	tmp, err := os.CreateTemp("/tmp", "arc-hosts-*.tmp")
-	if err != nil {
-		return fmt.Errorf("create temp file: %w", err)
-	}
-	tmpPath := tmp.Name()
-	_ = tmp.Close()
-	defer os.Remove(tmpPath)
-
-	if err := os.WriteFile(tmpPath, []byte(newHosts), 0o644); err != nil {
-		return fmt.Errorf("write temp hosts file: %w", err)
-	}
-	if _, err := execLocal("sudo", "-n", "install", "-m", "0644", tmpPath, "/etc/hosts"); err != nil {
-		return fmt.Errorf("cannot update /etc/hosts (sudo install): %w", err)
-	}
-	return nil
+	return newHosts
 }
 
-func ensureLocalArcHostsAliases(_ string) error {
-	// "remotehost" should point at the server's WG/LAN address.
-	return ensureLocalHostsMappings(map[string]string{
+// arcHostsMappings are the aliases ARC manages in /etc/hosts. "remotehost" should point at
+// the server's WG/LAN address, or where the userspace tunnel publishes it
+// (wgNetwork.LocalServerIP).
+func arcHostsMappings(serverIP string) map[string]string {
+	return map[string]string{
 		"lh":             "127.0.0.1",
-		"rh":             wgServerIP,
+		"rh":             serverIP,
 		"pub.rh":         "",
-		"remotehost":     wgServerIP,
+		"remotehost":     serverIP,
 		"pub.remotehost": "",
-	})
+	}
+}
+
+func ensureLocalArcHostsAliases(ctx infraRunContext, _ string) error {
+	return ensureLocalHostsMappings(ctx, arcHostsMappings(ctx.WG.Net.LocalServerIP()))
+}
+
+// localArcHostsDrift reports whether /etc/hosts differs from what ensureLocalArcHostsAliases
+// would write.
+func localArcHostsDrift(hostsRaw, serverIP string) bool {
+	want := rewriteHostsMappings(hostsRaw, arcHostsMappings(serverIP))
+	return strings.TrimSpace(want) != strings.TrimSpace(hostsRaw)
+}
+
+// removeLocalArcHostsAliases drops every alias ensureLocalArcHostsAliases manages.
+func removeLocalArcHostsAliases(ctx infraRunContext) error {
+	m := arcHostsMappings(ctx.WG.Net.ServerIP)
+	for alias := range m {
+		m[alias] = ""
+	}
+	return ensureLocalHostsMappings(ctx, m)
 }
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"arc/internal/workflow"
+	"context"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -15,63 +17,143 @@ const (
 	aptLockRetryDelay    = 2 * time.Second
 )
 
-func withArcClient(addr string, fn func(*ssh.Client) error) error {
-	client, err := dialArcWithKey(addr)
+// osPackages are the packages one step installs, per distribution family.
+type osPackages struct {
+	Debian []string
+	Arch   []string
+}
+
+// forOS returns the packages for an /etc/os-release ID, or nil on unsupported systems.
+func (p osPackages) forOS(id string) []string {
+	switch id {
+	case "ubuntu", "debian":
+		return p.Debian
+	case "arch", "manjaro":
+		return p.Arch
+	}
+	return nil
+}
+
+// stepPackages lists the packages each setup step installs; `arc setup --plan` reports them.
+var stepPackages = map[workflow.StepID]osPackages{
+	workflow.StepConfigureServerZsh: {
+		Debian: []string{"zsh", "waypipe", "libwayland-client0", "wayland-protocols"},
+		Arch:   []string{"zsh", "waypipe", "wayland"},
+	},
+	workflow.StepInstallServerWireGuard: {
+		Debian: []string{"wireguard", "wireguard-tools"},
+		Arch:   []string{"wireguard-tools", "nftables"},
+	},
+	workflow.StepApplyServerNFTables: {Debian: []string{"nftables"}, Arch: []string{"nftables"}},
+	workflow.StepConfigureLocalZsh:   {Debian: []string{"zsh", "waypipe"}, Arch: []string{"zsh", "waypipe"}},
+	workflow.StepInstallLocalWireGuard: {
+		Debian: []string{"wireguard", "wireguard-tools"},
+		Arch:   []string{"wireguard-tools"},
+	},
+	workflow.StepInstallRemoteNFS:      {Debian: []string{"nfs-kernel-server"}},
+	workflow.StepInstallLocalNFSClient: {Debian: []string{"nfs-common"}, Arch: []string{"nfs-utils"}},
+	workflow.StepConfigureRemoteWaypipe: {
+		Debian: []string{"waypipe", "libwayland-client0", "wayland-protocols"},
+		Arch:   []string{"waypipe", "wayland"},
+	},
+	workflow.StepConfigureClipboardComp: {
+		Debian: []string{"wl-clipboard", "libwayland-dev", "pkg-config"},
+		Arch:   []string{"wl-clipboard", "wayland", "pkgconf"},
+	},
+	workflow.StepConfigureImageClipboard: {Debian: []string{"wl-clipboard"}, Arch: []string{"wl-clipboard"}},
+}
+
+// arcClientFor returns an arc client for ctx and a release func. Clients from the session
+// manager stay open for later steps; directly dialed ones are closed on release.
+func arcClientFor(ctx infraRunContext) (*ssh.Client, func(), error) {
+	if ctx.SSH != nil {
+		if ctx.Tunnel {
+			client, err := ctx.SSH.tunnelClient(ctx.Addr, ctx.WG.Net.TunnelSSHAddr(ctx.Addr))
+			return client, func() {}, err
+		}
+		client, err := ctx.SSH.arcClient(ctx.Addr)
+		return client, func() {}, err
+	}
+	dialAddr := ctx.Addr
+	if ctx.Tunnel {
+		dialAddr = ctx.WG.Net.TunnelSSHAddr(ctx.Addr)
+	}
+	client, err := dialArcWithKeyVia(dialAddr, ctx.Addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	return client, func() { _ = client.Close() }, nil
+}
+
+func bootstrapClientFor(ctx infraRunContext, user, password string) (*ssh.Client, func(), error) {
+	if ctx.SSH != nil {
+		client, err := ctx.SSH.bootstrapClient(user, ctx.Addr, password)
+		return client, func() {}, err
+	}
+	client, err := dialWithPassword(user, ctx.Addr, password)
+	if err != nil {
+		return nil, nil, err
+	}
+	return client, func() { _ = client.Close() }, nil
+}
+
+func withArcClient(ctx infraRunContext, fn func(*ssh.Client) error) error {
+	client, release, err := arcClientFor(ctx)
 	if err != nil {
 		return err
 	}
-	defer client.Close()
+	defer release()
 	return fn(client)
 }
 
-func readRemoteOSID(client *ssh.Client) (string, error) {
-	out, err := runRemoteCommand(client, "cat /etc/os-release", false, "")
+func readRemoteOSID(ctx context.Context, client *ssh.Client) (string, error) {
+	out, err := runRemoteCommand(ctx, client, "cat /etc/os-release", false, "")
 	if err != nil {
 		return "", err
 	}
 	return strings.TrimSpace(parseOSRelease(out)["ID"]), nil
 }
 
-func installRemotePackages(client *ssh.Client, osID string, debianPkgs, archPkgs []string) error {
+func installRemotePackages(ctx context.Context, client *ssh.Client, osID string, debianPkgs, archPkgs []string) error {
 	switch osID {
 	case "ubuntu", "debian":
-		if _, err := runRemoteAPTCommand(client, "sudo -n apt-get update"); err != nil {
+		if _, err := runRemoteAPTCommand(ctx, client, "sudo -n apt-get update"); err != nil {
 			return err
 		}
 		if len(debianPkgs) == 0 {
 			return nil
 		}
-		_, err := runRemoteAPTCommand(client, "sudo -n apt-get install -y "+strings.Join(debianPkgs, " "))
+		_, err := runRemoteAPTCommand(ctx, client, "sudo -n apt-get install -y "+strings.Join(debianPkgs, " "))
 		return err
 	case "arch", "manjaro":
 		if len(archPkgs) == 0 {
 			return nil
 		}
-		_, err := runRemoteCommand(client, "sudo -n pacman -Sy --noconfirm "+strings.Join(archPkgs, " "), false, "")
+		_, err := runRemoteCommand(ctx, client, "sudo -n pacman -Sy --noconfirm "+strings.Join(archPkgs, " "), false, "")
 		return err
 	default:
 		return fmt.Errorf("unsupported remote OS ID=%q (supported: ubuntu, debian, arch, manjaro)", osID)
 	}
 }
 
-func installLocalPackages(osID string, debianPkgs, archPkgs []string) error {
+func installLocalPackages(ctx context.Context, osID string, debianPkgs, archPkgs []string) error {
 	switch osID {
 	case "ubuntu", "debian":
-		if _, err := runLocalAPTCommand("sudo", "-n", "apt-get", "update"); err != nil {
+		if _, err := runLocalAPTCommand(ctx, "sudo", "-n", "apt-get", "update"); err != nil {
 			return err
 		}
 		if len(debianPkgs) == 0 {
 			return nil
 		}
 		args := append([]string{"-n", "apt-get", "install", "-y"}, debianPkgs...)
-		_, err := runLocalAPTCommand("sudo", args...)
+		_, err := runLocalAPTCommand(ctx, "sudo", args...)
 		return err
 	case "arch", "manjaro":
 		if len(archPkgs) == 0 {
 			return nil
 		}
 		args := append([]string{"-n", "pacman", "-Sy", "--noconfirm"}, archPkgs...)
-		_, err := execLocal("sudo", args...)
+		_, err := execLocal(ctx, "sudo", args...)
 		return err
 	default:
 		return fmt.Errorf("unsupported local OS ID=%q (supported: ubuntu, debian, arch, manjaro)", osID)
@@ -98,7 +180,7 @@ func isAPTLockError(err error) bool {
 	return false
 }
 
-func runWithAPTRetry(run func() (string, error)) (string, error) {
+func runWithAPTRetry(ctx context.Context, run func() (string, error)) (string, error) {
 	var out string
 	var err error
 	for attempt := 1; attempt <= aptLockRetryAttempts; attempt++ {
@@ -106,20 +188,24 @@ func runWithAPTRetry(run func() (string, error)) (string, error) {
 		if err == nil || !isAPTLockError(err) || attempt == aptLockRetryAttempts {
 			return out, err
 		}
-		time.Sleep(aptLockRetryDelay)
+		select {
+		case <-ctx.Done():
+			return out, fmt.Errorf("waiting for apt lock interrupted: %w", ctx.Err())
+		case <-time.After(aptLockRetryDelay):
+		}
 	}
 	return out, err
 }
 
-func runRemoteAPTCommand(client *ssh.Client, cmd string) (string, error) {
-	return runWithAPTRetry(func() (string, error) {
-		return runRemoteCommand(client, cmd, false, "")
+func runRemoteAPTCommand(ctx context.Context, client *ssh.Client, cmd string) (string, error) {
+	return runWithAPTRetry(ctx, func() (string, error) {
+		return runRemoteCommand(ctx, client, cmd, false, "")
 	})
 }
 
-func runLocalAPTCommand(name string, args ...string) (string, error) {
-	return runWithAPTRetry(func() (string, error) {
-		return execLocal(name, args...)
+func runLocalAPTCommand(ctx context.Context, name string, args ...string) (string, error) {
+	return runWithAPTRetry(ctx, func() (string, error) {
+		return execLocal(ctx, name, args...)
 	})
 }
 
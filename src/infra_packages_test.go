@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"testing"
 )
@@ -44,7 +45,7 @@ func TestIsAPTLockError(t *testing.T) {
 
 func TestRunWithAPTRetry_RetriesLockErrors(t *testing.T) {
 	attempts := 0
-	out, err := runWithAPTRetry(func() (string, error) {
+	out, err := runWithAPTRetry(context.Background(), func() (string, error) {
 		attempts++
 		if attempts < 3 {
 			return "", errors.New("E: Could not get lock /var/lib/dpkg/lock-frontend. It is held by process 4820 (unattended-upgr)")
@@ -65,7 +66,7 @@ func TestRunWithAPTRetry_RetriesLockErrors(t *testing.T) {
 func TestRunWithAPTRetry_DoesNotRetryNonLockErrors(t *testing.T) {
 	attempts := 0
 	wantErr := errors.New("E: Unable to locate package wireguard")
-	_, err := runWithAPTRetry(func() (string, error) {
+	_, err := runWithAPTRetry(context.Background(), func() (string, error) {
 		attempts++
 		return "", wantErr
 	})
@@ -76,3 +77,19 @@ func TestRunWithAPTRetry_DoesNotRetryNonLockErrors(t *testing.T) {
 		t.Fatalf("expected 1 attempt, got %d", attempts)
 	}
 }
+
+func TestRunWithAPTRetry_StopsWhenCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	attempts := 0
+	_, err := runWithAPTRetry(ctx, func() (string, error) {
+		attempts++
+		return "", errors.New("E: Could not get lock /var/lib/dpkg/lock-frontend")
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected cancellation error, got %v", err)
+	}
+	if attempts != 1 {
+		t.Fatalf("expected 1 attempt, got %d", attempts)
+	}
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"arc/internal/workflow"
+	"context"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -10,15 +12,13 @@ import (
 )
 
 func configureServerZsh(ctx infraRunContext) error {
-	return withArcClient(ctx.Addr, func(client *ssh.Client) error {
-		id, err := readRemoteOSID(client)
+	return withArcClient(ctx, func(client *ssh.Client) error {
+		id, err := readRemoteOSID(ctx, client)
 		if err != nil {
 			return err
 		}
-		if err := installRemotePackages(client, id,
-			[]string{"zsh", "waypipe", "libwayland-client0", "wayland-protocols"},
-			[]string{"zsh", "waypipe", "wayland"},
-		); err != nil {
+		pkgs := stepPackages[workflow.StepConfigureServerZsh]
+		if err := installRemotePackages(ctx, client, id, pkgs.Debian, pkgs.Arch); err != nil {
 			return err
 		}
 
@@ -29,17 +29,18 @@ current_shell="$(getent passwd %s | cut -d: -f7)"
 [ "$current_shell" = "$zsh_bin" ] && exit 0
 sudo -n chsh -s "$zsh_bin" %s || sudo -n usermod -s "$zsh_bin" %s
 `, arcUser, arcUser, arcUser)
-		_, err = runRemoteCommand(client, script, false, "")
+		_, err = runRemoteCommand(ctx, client, script, false, "")
 		return err
 	})
 }
 
-func configureLocalZsh(_ infraRunContext) error {
+func configureLocalZsh(ctx infraRunContext) error {
 	id, err := localOSID()
 	if err != nil {
 		return err
 	}
-	if err := installLocalPackages(id, []string{"zsh", "waypipe"}, []string{"zsh", "waypipe"}); err != nil {
+	pkgs := stepPackages[workflow.StepConfigureLocalZsh]
+	if err := installLocalPackages(ctx, id, pkgs.Debian, pkgs.Arch); err != nil {
 		return err
 	}
 
@@ -54,20 +55,18 @@ current_shell="$(getent passwd %s | cut -d: -f7)"
 [ "$current_shell" = "$zsh_bin" ] && exit 0
 sudo -n chsh -s "$zsh_bin" %s || sudo -n usermod -s "$zsh_bin" %s
 `, shSingleQuote(targetUser), shSingleQuote(targetUser), shSingleQuote(targetUser))
-	_, err = execLocal("sh", "-lc", script)
+	_, err = execLocal(ctx, "sh", "-lc", script)
 	return err
 }
 
 func configureRemoteWaypipe(ctx infraRunContext) error {
-	return withArcClient(ctx.Addr, func(client *ssh.Client) error {
-		id, err := readRemoteOSID(client)
+	return withArcClient(ctx, func(client *ssh.Client) error {
+		id, err := readRemoteOSID(ctx, client)
 		if err != nil {
 			return err
 		}
-		if err := installRemotePackages(client, id,
-			[]string{"waypipe", "libwayland-client0", "wayland-protocols"},
-			[]string{"waypipe", "wayland"},
-		); err != nil {
+		pkgs := stepPackages[workflow.StepConfigureRemoteWaypipe]
+		if err := installRemotePackages(ctx, client, id, pkgs.Debian, pkgs.Arch); err != nil {
 			return err
 		}
 
@@ -86,12 +85,12 @@ fi
 EOF
 chmod 600 "$HOME/.config/arc/waypipe.env"
 `
-		_, err = runRemoteCommand(client, script, false, "")
+		_, err = runRemoteCommand(ctx, client, script, false, "")
 		return err
 	})
 }
 
-func configureLocalWaypipeService() error {
+func configureLocalWaypipeService(ctx context.Context) error {
 	configDir, systemdDir, localBinDir, err := arcConfigPaths()
 	if err != nil {
 		return err
@@ -146,19 +145,35 @@ done
 		return err
 	}
 
-	return activateLocalWaypipeService(execLocal)
+	return activateLocalWaypipeService(ctx, execLocal)
 }
 
-func activateLocalWaypipeService(execFn localExecFunc) error {
-	_, _ = execFn("systemctl", "--user", "import-environment", "WAYLAND_DISPLAY", "XDG_RUNTIME_DIR", "DBUS_SESSION_BUS_ADDRESS")
-	if _, err := execFn("systemctl", "--user", "daemon-reload"); err != nil {
+func activateLocalWaypipeService(ctx context.Context, execFn localExecFunc) error {
+	_, _ = execFn(ctx, "systemctl", "--user", "import-environment", "WAYLAND_DISPLAY", "XDG_RUNTIME_DIR", "DBUS_SESSION_BUS_ADDRESS")
+	if _, err := execFn(ctx, "systemctl", "--user", "daemon-reload"); err != nil {
 		return err
 	}
-	if _, err := execFn("systemctl", "--user", "enable", "arc-waypipe.service"); err != nil {
+	if _, err := execFn(ctx, "systemctl", "--user", "enable", "arc-waypipe.service"); err != nil {
 		return err
 	}
-	if _, err := execFn("systemctl", "--user", "restart", "arc-waypipe.service"); err != nil {
+	if _, err := execFn(ctx, "systemctl", "--user", "restart", "arc-waypipe.service"); err != nil {
 		return err
 	}
 	return nil
 }
+
+func removeRemoteWaypipe(ctx infraRunContext) error {
+	return runRemoteUndoScript(ctx, `rm -f "$HOME/.config/arc/waypipe.env"`)
+}
+
+func removeLocalWaypipeService(ctx infraRunContext) error {
+	configDir, systemdDir, localBinDir, err := arcConfigPaths()
+	if err != nil {
+		return err
+	}
+	return removeLocalUserService(ctx, waypipeUnit,
+		filepath.Join(systemdDir, waypipeUnit),
+		filepath.Join(localBinDir, "arc-waypipe-forward"),
+		filepath.Join(configDir, "waypipe-client.env"),
+	)
+}
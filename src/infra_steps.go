@@ -12,22 +12,81 @@ var infraStepHandlers = map[workflow.StepID]infraStepFunc{
 	workflow.StepOpenServerFirewall:         openServerFirewall,
 	workflow.StepEnableServerWG:             enableServerWireGuard,
 	workflow.StepApplyServerNFTables:        ensureRemoteLHRedirectNftablesService,
+	workflow.StepInstallServerRelay:         installServerRelay,
 	workflow.StepConfigureLocalZsh:          configureLocalZsh,
 	workflow.StepInstallLocalWireGuard:      installLocalWireGuard,
 	workflow.StepWriteLocalWGConf:           writeLocalWireGuardConfig,
 	workflow.StepEnableLocalWG:              enableLocalWireGuard,
+	workflow.StepInstallLocalRelay:          installLocalRelay,
+	workflow.StepInstallLocalEndpointWatch:  installLocalEndpointWatch,
 	workflow.StepVerifyTunnelConnectivity:   verifyTunnelConnectivity,
 	workflow.StepResolveArcUIDGID:           verifyRemoteArcIdentity,
 	workflow.StepInstallRemoteNFS:           installRemoteNFS,
 	workflow.StepExportRemoteArcNFS:         configureRemoteArcNFS,
-	workflow.StepInstallLocalNFSClient:      func(infraRunContext) error { return installLocalNFSClient() },
-	workflow.StepConfigureLocalArcAutomount: func(infraRunContext) error { return configureLocalArcAutomount() },
-	workflow.StepVerifyLocalArcNFSMount:     func(infraRunContext) error { return verifyLocalArcNFSMount() },
+	workflow.StepInstallLocalNFSClient:      func(ctx infraRunContext) error { return installLocalNFSClient(ctx) },
+	workflow.StepConfigureLocalArcAutomount: func(ctx infraRunContext) error { return configureLocalArcAutomount(ctx) },
+	workflow.StepVerifyLocalArcNFSMount:     func(ctx infraRunContext) error { return verifyLocalArcNFSMount(ctx) },
 	workflow.StepConfigureRemoteWaypipe:     configureRemoteWaypipe,
-	workflow.StepConfigureLocalWaypipe:      func(infraRunContext) error { return configureLocalWaypipeService() },
+	workflow.StepConfigureLocalWaypipe:      func(ctx infraRunContext) error { return configureLocalWaypipeService(ctx) },
 	workflow.StepConfigureClipboardComp:     configureRemoteClipboardCompositor,
 	workflow.StepHardenServerSSH:            hardenServerSSH,
-	workflow.StepConfigureImageClipboard:    func(infraRunContext) error { return configureLocalImageClipboardSync() },
+	workflow.StepConfigureImageClipboard:    func(ctx infraRunContext) error { return configureLocalImageClipboardSync(ctx) },
+}
+
+// infraUndo reverses one setup step. Local and Remote undo what the step changed on each
+// machine; either may be nil. Undo handlers must succeed when there is nothing left to remove.
+type infraUndo struct {
+	Local  infraStepFunc
+	Remote infraStepFunc
+}
+
+var infraUndoHandlers = map[workflow.StepID]infraUndo{
+	workflow.StepCreateArcUser:              {Remote: removeArcUser},
+	workflow.StepAddArcToSudoers:            {Remote: removeArcSudoers},
+	workflow.StepCreateArcHushlogin:         {Remote: removeArcHushLogin},
+	workflow.StepInstallServerArcZshPrompt:  {Remote: removeArcZshPrompt},
+	workflow.StepInstallServerArcTmux:       {Remote: removeArcTmuxConfig},
+	workflow.StepWriteServerWGConf:          {Remote: removeServerWireGuardConfig},
+	workflow.StepOpenServerFirewall:         {Remote: closeServerFirewall},
+	workflow.StepEnableServerWG:             {Remote: disableServerWireGuard},
+	workflow.StepApplyServerNFTables:        {Remote: removeRemoteLHRedirectNftablesService},
+	workflow.StepInstallServerRelay:         {Remote: removeServerRelay},
+	workflow.StepAddLocalHostsAliases:       {Local: removeLocalArcHostsAliases},
+	workflow.StepEnsureArcSSHAccess:         {Remote: removeArcAuthorizedKeys},
+	workflow.StepInstallLocalArcPrompt:      {Local: removeLocalArcZshPrompt},
+	workflow.StepWriteLocalWGConf:           {Local: removeLocalWireGuardConfig},
+	workflow.StepEnableLocalWG:              {Local: disableLocalWireGuard},
+	workflow.StepInstallLocalRelay:          {Local: removeLocalRelay},
+	workflow.StepInstallLocalEndpointWatch:  {Local: removeLocalEndpointWatch},
+	workflow.StepVerifyArcSSHLogin:          {Local: removeLocalKnownHostsForBootstrap, Remote: removeArcHelperAndPrompt},
+	workflow.StepVerifyTunnelConnectivity:   {Local: removeLocalKnownHostsForArcRemote, Remote: removeRemoteArcHelper},
+	workflow.StepExportRemoteArcNFS:         {Remote: removeRemoteArcNFS},
+	workflow.StepConfigureLocalArcAutomount: {Local: removeLocalArcAutomount},
+	workflow.StepConfigureRemoteWaypipe:     {Remote: removeRemoteWaypipe},
+	workflow.StepConfigureLocalWaypipe:      {Local: removeLocalWaypipeService},
+	workflow.StepConfigureClipboardComp:     {Remote: removeRemoteClipboardCompositor},
+	workflow.StepHardenServerSSH:            {Remote: unhardenServerSSH},
+	workflow.StepConfigureImageClipboard:    {Local: removeLocalImageClipboardSync},
+}
+
+// infraStepsWithoutUndo are steps that change nothing uninstall should reverse.
+var infraStepsWithoutUndo = map[workflow.StepID]string{
+	workflow.StepDetectPrivilegedMode:   "read-only check",
+	workflow.StepConfigureServerZsh:     "packages and login shell are left as they are",
+	workflow.StepInstallServerWireGuard: "packages are left installed",
+	workflow.StepConfigureLocalZsh:      "packages and login shell are left as they are",
+	workflow.StepInstallLocalWireGuard:  "packages are left installed",
+	workflow.StepResolveArcUIDGID:       "read-only check",
+	workflow.StepInstallRemoteNFS:       "packages are left installed",
+	workflow.StepInstallLocalNFSClient:  "packages are left installed",
+	workflow.StepVerifyLocalArcNFSMount: "read-only check",
+}
+
+// arcUserSteps own the arc account and its access; `arc uninstall --keep-user` leaves them.
+var arcUserSteps = map[workflow.StepID]bool{
+	workflow.StepCreateArcUser:      true,
+	workflow.StepAddArcToSudoers:    true,
+	workflow.StepEnsureArcSSHAccess: true,
 }
 
 func runInfraStep(ctx infraRunContext, stepID workflow.StepID) error {
@@ -28,3 +28,16 @@ func TestInfraStepHandlersCoverInfraWorkflowSteps(t *testing.T) {
 		}
 	}
 }
+
+func TestInfraUndoHandlersCoverEverySetupStep(t *testing.T) {
+	for _, def := range workflow.SetupStepDefinitions() {
+		undo, hasUndo := infraUndoHandlers[def.ID]
+		_, noUndo := infraStepsWithoutUndo[def.ID]
+		if hasUndo == noUndo {
+			t.Fatalf("step %q must have exactly one of an undo handler or a no-undo reason", def.ID)
+		}
+		if hasUndo && undo.Local == nil && undo.Remote == nil {
+			t.Fatalf("undo handler for %q has neither a local nor a remote side", def.ID)
+		}
+	}
+}
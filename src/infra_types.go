@@ -1,14 +1,30 @@
 package main
 
-import "bytes"
+import (
+	"bytes"
+	"context"
+)
 
+// infraRunContext carries a step's inputs. It embeds the step's context, so handlers pass it
+// straight to execLocal and runRemoteCommand to make commands cancellable.
 type infraRunContext struct {
+	context.Context
+
 	Addr string
 	Host string
 	WG   wgConfig
+	// SSH shares authenticated clients across steps; nil dials a fresh client per use.
+	SSH *sshSessionManager
+	// Tunnel reaches the server at its WireGuard address instead of Addr, for use after the
+	// public SSH port has been locked down.
+	Tunnel bool
+	// RunID names the setup run whose backups system file writes are recorded under.
+	RunID string
+	// Device is the name this machine joined the server as; empty on the machine that ran setup.
+	Device string
 }
 
-type localExecFunc func(name string, args ...string) (string, error)
+type localExecFunc func(ctx context.Context, name string, args ...string) (string, error)
 
 type remoteFileSession interface {
 	SetStdin(reader *bytes.Reader)
@@ -1,81 +1,126 @@
 package main
 
 import (
+	"arc/internal/workflow"
+	"context"
 	"fmt"
+	"io"
+	"net"
 	"os"
 	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
 
 	"golang.org/x/crypto/ssh"
 )
 
 func installServerWireGuard(ctx infraRunContext) error {
-	return withArcClient(ctx.Addr, func(client *ssh.Client) error {
-		id, err := readRemoteOSID(client)
+	return withArcClient(ctx, func(client *ssh.Client) error {
+		id, err := readRemoteOSID(ctx, client)
 		if err != nil {
 			return err
 		}
-		if err := installRemotePackages(client, id,
-			[]string{"wireguard", "wireguard-tools"},
-			[]string{"wireguard-tools", "nftables"},
-		); err != nil {
+		pkgs := stepPackages[workflow.StepInstallServerWireGuard]
+		if err := installRemotePackages(ctx, client, id, pkgs.Debian, pkgs.Arch); err != nil {
 			return err
 		}
-		return ensureWireGuardKernelRemote(client, id)
+		return ensureWireGuardKernelRemote(ctx, client, id)
 	})
 }
 
 func writeServerWireGuardConfig(ctx infraRunContext) error {
-	return withArcClient(ctx.Addr, func(client *ssh.Client) error {
-		_, _ = runRemoteCommand(client, "sudo -n systemctl stop wg-quick@"+wgInterface+" || true", false, "")
+	n := ctx.WG.Net
+	return withArcClient(ctx, func(client *ssh.Client) error {
+		_, _ = runRemoteCommand(ctx, client, "sudo -n systemctl stop "+n.QuickUnit()+" || true", false, "")
+		if err := backupRemoteFiles(ctx, client, n.ConfPath()); err != nil {
+			return err
+		}
 
 		userCopy := fmt.Sprintf(
 			"set -eu\ninstall -d -m 0700 ~/.arc/wireguard\ncat > ~/.arc/wireguard/server-%s.conf <<'EOF'\n%sEOF\nchmod 600 ~/.arc/wireguard/server-%s.conf\n",
-			wgInterface, ctx.WG.ServerConf, wgInterface,
+			n.Interface, ctx.WG.ServerConf, n.Interface,
 		)
-		if _, err := runRemoteCommand(client, userCopy, false, ""); err != nil {
+		if _, err := runRemoteCommand(ctx, client, userCopy, false, ""); err != nil {
 			return err
 		}
 
 		script := fmt.Sprintf(
-			"umask 077\ninstall -d -m 0700 /etc/wireguard\nrm -f /etc/wireguard/%s.conf\ncat > /etc/wireguard/%s.conf <<'EOF'\n%sEOF\nchmod 600 /etc/wireguard/%s.conf\n",
-			wgInterface, wgInterface, ctx.WG.ServerConf, wgInterface,
+			"umask 077\ninstall -d -m 0700 /etc/wireguard\nrm -f %s\ncat > %s <<'EOF'\n%sEOF\nchmod 600 %s\n",
+			n.ConfPath(), n.ConfPath(), ctx.WG.ServerConf, n.ConfPath(),
 		)
-		_, err := runRemoteCommand(client, "sudo -n sh -lc "+shSingleQuote(script), false, "")
+		_, err := runRemoteCommand(ctx, client, "sudo -n sh -lc "+shSingleQuote(script), false, "")
 		return err
 	})
 }
 
+func removeServerWireGuardConfig(ctx infraRunContext) error {
+	n := ctx.WG.Net
+	backup, err := remoteBackupCommand(ctx, n.ConfPath())
+	if err != nil {
+		return err
+	}
+	return runRemoteUndoScript(ctx, fmt.Sprintf(
+		"set -eu\n%ssudo -n rm -f %s\nrm -f ~/.arc/wireguard/server-%s.conf\n",
+		backup, n.ConfPath(), n.Interface,
+	))
+}
+
 func openServerFirewall(ctx infraRunContext) error {
+	// A server that dials a rendezvous only sees replies, which ufw lets in already.
+	if ctx.WG.Net.Reverse() {
+		return nil
+	}
 	script := fmt.Sprintf(`set -eu
 if command -v ufw >/dev/null 2>&1; then
 	if sudo -n ufw status 2>/dev/null | grep -q 'Status: active'; then
 		sudo -n ufw allow %d/udp >/dev/null
 	fi
 fi
-`, wgPort)
-	return withArcClient(ctx.Addr, func(client *ssh.Client) error {
-		_, err := runRemoteCommand(client, script, false, "")
+`, ctx.WG.Net.Port)
+	return withArcClient(ctx, func(client *ssh.Client) error {
+		_, err := runRemoteCommand(ctx, client, script, false, "")
 		return err
 	})
 }
 
+func closeServerFirewall(ctx infraRunContext) error {
+	return runRemoteUndoScript(ctx, fmt.Sprintf(`set -eu
+if command -v ufw >/dev/null 2>&1; then
+	if sudo -n ufw status 2>/dev/null | grep -q 'Status: active'; then
+		sudo -n ufw delete allow %d/udp >/dev/null 2>&1 || true
+	fi
+fi
+`, ctx.WG.Net.Port))
+}
+
 func enableServerWireGuard(ctx infraRunContext) error {
-	cmd := fmt.Sprintf("sudo -n systemctl enable wg-quick@%s && sudo -n systemctl restart wg-quick@%s && sudo -n systemctl is-active --quiet wg-quick@%s", wgInterface, wgInterface, wgInterface)
-	return withArcClient(ctx.Addr, func(client *ssh.Client) error {
-		_, err := runRemoteCommand(client, cmd, false, "")
+	unit := ctx.WG.Net.QuickUnit()
+	cmd := fmt.Sprintf("sudo -n systemctl enable %s && sudo -n systemctl restart %s && sudo -n systemctl is-active --quiet %s", unit, unit, unit)
+	return withArcClient(ctx, func(client *ssh.Client) error {
+		_, err := runRemoteCommand(ctx, client, cmd, false, "")
 		return err
 	})
 }
 
-func installLocalWireGuard(_ infraRunContext) error {
+func disableServerWireGuard(ctx infraRunContext) error {
+	return runRemoteUndoScript(ctx, disableUnitScript("sudo -n systemctl", ctx.WG.Net.QuickUnit()))
+}
+
+func installLocalWireGuard(ctx infraRunContext) error {
+	// The userspace tunnel is built into arc and needs nothing installed.
+	if ctx.WG.Net.Userspace() {
+		return nil
+	}
 	id, err := localOSID()
 	if err != nil {
 		return err
 	}
-	if err := installLocalPackages(id, []string{"wireguard", "wireguard-tools"}, []string{"wireguard-tools"}); err != nil {
+	pkgs := stepPackages[workflow.StepInstallLocalWireGuard]
+	if err := installLocalPackages(ctx, id, pkgs.Debian, pkgs.Arch); err != nil {
 		return err
 	}
-	return ensureWireGuardKernelLocal(id)
+	return ensureWireGuardKernelLocal(ctx, id)
 }
 
 func writeLocalWireGuardConfig(ctx infraRunContext) error {
@@ -88,49 +133,396 @@ func writeLocalWireGuardConfig(ctx infraRunContext) error {
 		return err
 	}
 
-	clientCopyPath := filepath.Join(dir, "client-"+wgInterface+".conf")
-	serverCopyPath := filepath.Join(dir, "server-"+wgInterface+".conf")
+	n := ctx.WG.Net
+	clientCopyPath := filepath.Join(dir, "client-"+n.Interface+".conf")
+	serverCopyPath := filepath.Join(dir, "server-"+n.Interface+".conf")
 	if err := writeFile0600(clientCopyPath, []byte(ctx.WG.ClientConf)); err != nil {
 		return err
 	}
-	if err := writeFile0600(serverCopyPath, []byte(ctx.WG.ServerConf)); err != nil {
-		return err
+	// A joined device never sees the server's private key, so it has no server copy.
+	if ctx.WG.ServerConf != "" {
+		if err := writeFile0600(serverCopyPath, []byte(ctx.WG.ServerConf)); err != nil {
+			return err
+		}
 	}
 
-	_, _ = execLocal("sudo", "-n", "systemctl", "stop", "wg-quick@"+wgInterface)
+	_, _ = localWGSystemctl(ctx, n, "stop", n.LocalUnit())
 
-	tmp := filepath.Join(dir, "."+wgInterface+".conf.tmp")
-	if err := writeFile0600(tmp, []byte(ctx.WG.ClientConf)); err != nil {
-		return err
+	// The userspace tunnel reads its config from ~/.arc, which needs no root.
+	if n.Userspace() {
+		path, err := userspaceWGConfPath(n.Interface)
+		if err != nil {
+			return err
+		}
+		return installLocalManagedFile(ctx, path, []byte(ctx.WG.ClientConf), 0o600)
 	}
-	if _, err := execLocal("sudo", "-n", "install", "-d", "-m", "0700", "/etc/wireguard"); err != nil {
+	if _, err := execLocal(ctx, "sudo", "-n", "install", "-d", "-m", "0700", "/etc/wireguard"); err != nil {
 		return fmt.Errorf("sudo required to install system config; config saved to %s", clientCopyPath)
 	}
-	_, _ = execLocal("sudo", "-n", "rm", "-f", "/etc/wireguard/"+wgInterface+".conf")
-	if _, err := execLocal("sudo", "-n", "install", "-m", "0600", tmp, "/etc/wireguard/"+wgInterface+".conf"); err != nil {
+	if err := installLocalManagedFile(ctx, n.ConfPath(), []byte(ctx.WG.ClientConf), 0o600); err != nil {
 		return fmt.Errorf("sudo required to install system config; config saved to %s", clientCopyPath)
 	}
-	_ = os.Remove(tmp)
 	return nil
 }
 
-func enableLocalWireGuard(_ infraRunContext) error {
-	unit := "wg-quick@" + wgInterface
-	if _, err := execLocal("sudo", "-n", "systemctl", "enable", unit); err != nil {
+func removeLocalWireGuardConfig(ctx infraRunContext) error {
+	n := ctx.WG.Net
+	path, err := localWGConfPath(n)
+	if err != nil {
+		return err
+	}
+	if err := removeLocalManagedFile(ctx, path); err != nil {
+		return fmt.Errorf("remove local wg conf: %w", err)
+	}
+	home, err := os.UserHomeDir()
+	if err != nil || home == "" {
+		return fmt.Errorf("cannot resolve home dir")
+	}
+	dir := filepath.Join(home, ".arc", "wireguard")
+	return removeLocalFiles(
+		filepath.Join(dir, "client-"+n.Interface+".conf"),
+		filepath.Join(dir, "server-"+n.Interface+".conf"),
+	)
+}
+
+func enableLocalWireGuard(ctx infraRunContext) error {
+	n := ctx.WG.Net
+	unit := n.LocalUnit()
+	if n.Userspace() {
+		if err := installUserspaceWGUnit(ctx); err != nil {
+			return err
+		}
+	}
+	if _, err := localWGSystemctl(ctx, n, "enable", unit); err != nil {
+		return err
+	}
+	if _, err := localWGSystemctl(ctx, n, "restart", unit); err != nil {
+		return localWGUnitError(ctx, n, err)
+	}
+	if _, err := localWGSystemctl(ctx, n, "is-active", "--quiet", unit); err != nil {
+		return localWGUnitError(ctx, n, err)
+	}
+	return nil
+}
+
+func disableLocalWireGuard(ctx infraRunContext) error {
+	n := ctx.WG.Net
+	if !n.Userspace() {
+		if _, err := execLocal(ctx, "sh", "-c", disableUnitScript("sudo -n systemctl", n.LocalUnit())); err != nil {
+			return fmt.Errorf("disable local wg: %w", err)
+		}
+		return nil
+	}
+	if _, err := execLocal(ctx, "sh", "-c", disableUnitScript("systemctl --user", n.LocalUnit())); err != nil {
+		return fmt.Errorf("disable local wg: %w", err)
+	}
+	unitPath, err := userspaceWGUnitPath(n)
+	if err != nil {
+		return err
+	}
+	binPath, err := userspaceWGBinPath()
+	if err != nil {
+		return err
+	}
+	for _, path := range []string{unitPath, binPath} {
+		if err := removeLocalManagedFile(ctx, path); err != nil {
+			return fmt.Errorf("remove %s: %w", path, err)
+		}
+	}
+	if _, err := execLocal(ctx, "systemctl", "--user", "daemon-reload"); err != nil {
+		return err
+	}
+	return nil
+}
+
+// installUserspaceWGUnit installs a copy of this arc binary in ~/.local/bin and the user unit
+// that runs its userspace tunnel.
+func installUserspaceWGUnit(ctx infraRunContext) error {
+	n := ctx.WG.Net
+	binPath, err := userspaceWGBinPath()
+	if err != nil {
+		return err
+	}
+	if err := installLocalArcCopy(ctx, binPath); err != nil {
+		return err
+	}
+	unit, err := renderUserspaceWGUnit(n, sshPortOf(ctx.Addr))
+	if err != nil {
+		return err
+	}
+	unitPath, err := userspaceWGUnitPath(n)
+	if err != nil {
+		return err
+	}
+	if err := installLocalManagedFile(ctx, unitPath, []byte(unit), 0o644); err != nil {
+		return fmt.Errorf("install %s: %w", unitPath, err)
+	}
+	if _, err := execLocal(ctx, "systemctl", "--user", "daemon-reload"); err != nil {
 		return err
 	}
-	if _, err := execLocal("sudo", "-n", "systemctl", "restart", unit); err != nil {
-		return localWGServiceError(unit, err)
+	return nil
+}
+
+// installLocalArcCopy installs this arc binary at path, for a unit to run. Paths in the
+// user's home are written without sudo.
+func installLocalArcCopy(ctx infraRunContext, path string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("locate the arc binary: %w", err)
+	}
+	if homeFile(path) {
+		content, err := os.ReadFile(exe)
+		if err != nil {
+			return fmt.Errorf("read the arc binary: %w", err)
+		}
+		if err := installLocalManagedFile(ctx, path, content, 0o755); err != nil {
+			return fmt.Errorf("install %s: %w", path, err)
+		}
+		return nil
+	}
+	if err := backupLocalFile(ctx, path); err != nil {
+		return err
 	}
-	if _, err := execLocal("sudo", "-n", "systemctl", "is-active", "--quiet", unit); err != nil {
-		return localWGServiceError(unit, err)
+	if _, err := execLocal(ctx, "sudo", "-n", "install", "-D", "-m", "0755", exe, path); err != nil {
+		return fmt.Errorf("install %s: %w", path, err)
 	}
 	return nil
 }
 
-func localWGServiceError(unit string, cause error) error {
-	status, _ := execLocal("sudo", "-n", "systemctl", "status", "--no-pager", "-l", unit)
-	journal, _ := execLocal("sudo", "-n", "journalctl", "-u", unit, "-b", "--no-pager", "-n", "120")
+// installServerRelay runs the server end of the UDP-over-TCP relay from a copy of this arc
+// binary, and opens its port like openServerFirewall opens WireGuard's. Without --wg-relay
+// there is nothing to do.
+func installServerRelay(ctx infraRunContext) error {
+	n := ctx.WG.Net
+	if n.Relay == "" {
+		return nil
+	}
+	unit, err := renderServerRelayUnit(n)
+	if err != nil {
+		return err
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("locate the arc binary: %w", err)
+	}
+	bin, err := os.ReadFile(exe)
+	if err != nil {
+		return fmt.Errorf("read the arc binary: %w", err)
+	}
+	return withArcClient(ctx, func(client *ssh.Client) error {
+		out, err := runRemoteCommand(ctx, client, "uname -m", false, "")
+		if err != nil {
+			return err
+		}
+		if arch := goarchOfUname(out); arch != runtime.GOARCH {
+			return fmt.Errorf("the server is %s but this arc is built for %s; rebuild it with GOARCH=%s to install the relay", strings.TrimSpace(out), runtime.GOARCH, arch)
+		}
+		if err := backupRemoteFiles(ctx, client, arcRelayBinPath, arcRelayServerUnitPath); err != nil {
+			return err
+		}
+		const upload = ".cache/arc/arc-relay"
+		if err := uploadRemoteFile(client, upload, bin, 0o755); err != nil {
+			return err
+		}
+		script := fmt.Sprintf(`set -eu
+sudo -n install -D -m 0755 "$HOME/%[1]s" %[2]s
+rm -f "$HOME/%[1]s"
+tmp="$(mktemp)"
+cat > "$tmp" <<'EOF'
+%[3]sEOF
+sudo -n install -m 0644 "$tmp" %[4]s
+rm -f "$tmp"
+if command -v ufw >/dev/null 2>&1; then
+	if sudo -n ufw status 2>/dev/null | grep -q 'Status: active'; then
+		sudo -n ufw allow %[5]d/tcp >/dev/null
+	fi
+fi
+sudo -n systemctl daemon-reload
+sudo -n systemctl enable %[6]s
+sudo -n systemctl restart %[6]s
+sudo -n systemctl is-active --quiet %[6]s
+`, upload, arcRelayBinPath, unit, arcRelayServerUnitPath, n.RelayPort(), arcRelayServerUnit)
+		_, err = runRemoteCommand(ctx, client, script, false, "")
+		return err
+	})
+}
+
+// removeServerRelay stops the relay and removes it with its firewall rule.
+func removeServerRelay(ctx infraRunContext) error {
+	backup, err := remoteBackupCommand(ctx, arcRelayBinPath, arcRelayServerUnitPath)
+	if err != nil {
+		return err
+	}
+	script := "set -eu\n" + disableUnitScript("sudo -n systemctl", arcRelayServerUnit) +
+		fmt.Sprintf("sudo -n rm -f %s %s\nsudo -n systemctl daemon-reload\n", arcRelayServerUnitPath, arcRelayBinPath)
+	if port := ctx.WG.Net.RelayPort(); port > 0 {
+		script += fmt.Sprintf(`if command -v ufw >/dev/null 2>&1; then
+	if sudo -n ufw status 2>/dev/null | grep -q 'Status: active'; then
+		sudo -n ufw delete allow %d/tcp >/dev/null 2>&1 || true
+	fi
+fi
+`, port)
+	}
+	return runRemoteUndoScript(ctx, backup+script)
+}
+
+// installLocalRelay runs the local end of the relay, which also moves the server peer onto
+// it when the direct tunnel stalls.
+func installLocalRelay(ctx infraRunContext) error {
+	n := ctx.WG.Net
+	if n.Relay == "" {
+		return nil
+	}
+	unit, err := renderLocalRelayUnit(ctx.WG)
+	if err != nil {
+		return err
+	}
+	if err := installLocalArcCopy(ctx, arcRelayBinPath); err != nil {
+		return err
+	}
+	if err := installLocalManagedFile(ctx, localRelayUnitPath(n), []byte(unit), 0o644); err != nil {
+		return fmt.Errorf("install %s: %w", localRelayUnitPath(n), err)
+	}
+	name := localRelayUnit(n)
+	for _, args := range [][]string{{"daemon-reload"}, {"enable", name}, {"restart", name}} {
+		if _, err := execLocal(ctx, "sudo", append([]string{"-n", "systemctl"}, args...)...); err != nil {
+			return err
+		}
+	}
+	if _, err := execLocal(ctx, "sudo", "-n", "systemctl", "is-active", "--quiet", name); err != nil {
+		return localWGServiceError(ctx, name, err)
+	}
+	return nil
+}
+
+// removeLocalRelay stops the local end of the relay and removes its unit and binary.
+func removeLocalRelay(ctx infraRunContext) error {
+	n := ctx.WG.Net
+	if _, err := execLocal(ctx, "sh", "-c", disableUnitScript("sudo -n systemctl", localRelayUnit(n))); err != nil {
+		return fmt.Errorf("disable local relay: %w", err)
+	}
+	for _, path := range []string{localRelayUnitPath(n), arcRelayBinPath} {
+		if err := removeLocalManagedFile(ctx, path); err != nil {
+			return fmt.Errorf("remove %s: %w", path, err)
+		}
+	}
+	_, err := execLocal(ctx, "sudo", "-n", "systemctl", "daemon-reload")
+	return err
+}
+
+// installLocalEndpointWatch installs the timer that keeps the server peer at the address
+// of the server's DNS name. A server set up by address has no name to follow.
+func installLocalEndpointWatch(ctx infraRunContext) error {
+	if endpointHostname(ctx.WG) == "" {
+		return nil
+	}
+	n := ctx.WG.Net
+	unit, timer, err := renderLocalEndpointUnits(ctx.WG)
+	if err != nil {
+		return err
+	}
+	if err := installLocalArcCopy(ctx, arcEndpointBinPath); err != nil {
+		return err
+	}
+	for _, f := range []struct{ path, content string }{{localEndpointUnitPath(n), unit}, {localEndpointTimerPath(n), timer}} {
+		if err := installLocalManagedFile(ctx, f.path, []byte(f.content), 0o644); err != nil {
+			return fmt.Errorf("install %s: %w", f.path, err)
+		}
+	}
+	// One check now, so a broken resolver or wg fails the step rather than the timer.
+	check := localEndpointUnit(n)
+	for _, args := range [][]string{{"daemon-reload"}, {"start", check}, {"enable", localEndpointTimer(n)}, {"restart", localEndpointTimer(n)}} {
+		if _, err := execLocal(ctx, "sudo", append([]string{"-n", "systemctl"}, args...)...); err != nil {
+			if args[0] == "start" {
+				return localWGServiceError(ctx, check, err)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// removeLocalEndpointWatch stops the endpoint timer and removes its units and binary.
+func removeLocalEndpointWatch(ctx infraRunContext) error {
+	n := ctx.WG.Net
+	if _, err := execLocal(ctx, "sh", "-c", disableUnitScript("sudo -n systemctl", localEndpointTimer(n))); err != nil {
+		return fmt.Errorf("disable the endpoint timer: %w", err)
+	}
+	for _, path := range []string{localEndpointTimerPath(n), localEndpointUnitPath(n), arcEndpointBinPath} {
+		if err := removeLocalManagedFile(ctx, path); err != nil {
+			return fmt.Errorf("remove %s: %w", path, err)
+		}
+	}
+	_, err := execLocal(ctx, "sudo", "-n", "systemctl", "daemon-reload")
+	return err
+}
+
+// goarchOfUname is the GOARCH of a `uname -m` machine name, or the name itself when Go has
+// no other name for it.
+func goarchOfUname(machine string) string {
+	machine = strings.TrimSpace(machine)
+	switch machine {
+	case "x86_64":
+		return "amd64"
+	case "aarch64", "arm64":
+		return "arm64"
+	case "i386", "i686":
+		return "386"
+	}
+	if strings.HasPrefix(machine, "armv") {
+		return "arm"
+	}
+	return machine
+}
+
+// probeTunnel checks that the server answers over the tunnel: a ping over the kernel
+// interface, or the server's SSH banner through the userspace tunnel's forward, since
+// nothing but arc can send packets into its network stack.
+func probeTunnel(ctx infraRunContext) error {
+	n := ctx.WG.Net
+	if !n.Userspace() {
+		_, err := execLocal(ctx, "ping", "-c", "1", "-W", "2", n.ServerIP)
+		return err
+	}
+	dialCtx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	var d net.Dialer
+	c, err := d.DialContext(dialCtx, "tcp", n.TunnelSSHAddr(ctx.Addr))
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if deadline, ok := dialCtx.Deadline(); ok {
+		_ = c.SetReadDeadline(deadline)
+	}
+	banner := make([]byte, 4)
+	if _, err := io.ReadFull(c, banner); err != nil {
+		return fmt.Errorf("no SSH banner from %s through the userspace tunnel: %w", n.ServerIP, err)
+	}
+	if string(banner) != "SSH-" {
+		return fmt.Errorf("unexpected reply from %s through the userspace tunnel: %q", n.ServerIP, banner)
+	}
+	return nil
+}
+
+// localWGUnitError adds the status and journal of n's local tunnel unit to cause.
+func localWGUnitError(ctx context.Context, n wgNetwork, cause error) error {
+	if !n.Userspace() {
+		return localWGServiceError(ctx, n.LocalUnit(), cause)
+	}
+	unit := n.LocalUnit()
+	status, _ := execLocal(ctx, "systemctl", "--user", "status", "--no-pager", "-l", unit)
+	journal, _ := execLocal(ctx, "journalctl", "--user", "-u", unit, "-b", "--no-pager", "-n", "120")
+	return unitLogsError(cause, status, journal)
+}
+
+func localWGServiceError(ctx context.Context, unit string, cause error) error {
+	status, _ := execLocal(ctx, "sudo", "-n", "systemctl", "status", "--no-pager", "-l", unit)
+	journal, _ := execLocal(ctx, "sudo", "-n", "journalctl", "-u", unit, "-b", "--no-pager", "-n", "120")
+	return unitLogsError(cause, status, journal)
+}
+
+func unitLogsError(cause error, status, journal string) error {
 	if status == "" {
 		return cause
 	}
@@ -140,23 +532,47 @@ func localWGServiceError(unit string, cause error) error {
 	return fmt.Errorf("%v; status:\n%s", cause, status)
 }
 
+// nudgeServerHandshake pings this machine's tunnel address from the server, which makes the
+// server's WireGuard handshake with it. A failed ping is expected until it has.
+func nudgeServerHandshake(ctx infraRunContext) {
+	_ = withArcClient(ctx, func(client *ssh.Client) error {
+		_, err := runRemoteCommand(ctx, client, "ping -c 1 -W 2 "+ctx.WG.Net.DesktopIP, false, "")
+		return err
+	})
+}
+
 func verifyTunnelConnectivity(ctx infraRunContext) error {
-	_, err := execLocal("ping", "-c", "1", "-W", "2", wgServerIP)
+	serverIP := ctx.WG.Net.ServerIP
+	err := probeTunnel(ctx)
 	if err == nil {
 		return nil
 	}
+	// Where UDP is blocked, the tunnel comes up once the relay client has given up on it.
+	if ctx.WG.Net.Relay != "" {
+		if err = waitForTunnel(ctx, time.Now().Add(relayDefaultStall+2*relayCheckInterval)); err == nil {
+			return nil
+		}
+	}
+	// Behind a rendezvous only the server starts handshakes; a ping from its end starts one
+	// now rather than at its next keepalive.
+	if ctx.WG.Net.Reverse() {
+		nudgeServerHandshake(ctx)
+		if err = waitForTunnel(ctx, time.Now().Add(wgKeepalive*time.Second)); err == nil {
+			return nil
+		}
+	}
 
 	changed, syncErr := autoSyncWireGuardPeerKeys(ctx)
 	if changed {
-		if _, retryErr := execLocal("ping", "-c", "1", "-W", "2", wgServerIP); retryErr == nil {
+		if retryErr := probeTunnel(ctx); retryErr == nil {
 			return nil
 		}
 	}
 
-	localDiag, _ := wgDiagLocal()
+	localDiag, _ := wgDiagLocal(ctx)
 	remoteDiag, _ := wgDiagRemote(ctx)
 	if syncErr != nil {
-		return fmt.Errorf("tunnel verification failed (ping %s): %v\n\nauto-sync error: %v\n\nlocal wg diag:\n%s\n\nremote wg diag:\n%s", wgServerIP, err, syncErr, localDiag, remoteDiag)
+		return fmt.Errorf("tunnel verification failed (ping %s): %v\n\nauto-sync error: %v\n\nlocal wg diag:\n%s\n\nremote wg diag:\n%s", serverIP, err, syncErr, localDiag, remoteDiag)
 	}
-	return fmt.Errorf("tunnel verification failed (ping %s): %v\n\nlocal wg diag:\n%s\n\nremote wg diag:\n%s", wgServerIP, err, localDiag, remoteDiag)
+	return fmt.Errorf("tunnel verification failed (ping %s): %v\n\nlocal wg diag:\n%s\n\nremote wg diag:\n%s", serverIP, err, localDiag, remoteDiag)
 }
@@ -1,6 +1,10 @@
 package app
 
-import "arc/internal/workflow"
+import (
+	"arc/internal/workflow"
+	"context"
+	"time"
+)
 
 type WGConfig struct {
 	ServerPriv       string
@@ -14,9 +18,34 @@ type WGConfig struct {
 	ClientConf       string
 	MobileClientConf string
 	Endpoint         string
+
+	Net WGSettings
+}
+
+// WGSettings is the tunnel addressing of a setup run. Empty fields take the defaults: wg0,
+// UDP 51820 and 10.0.0.0/24 with the server, desktop and mobile on .1, .2 and .3 of the
+// subnet. Subnet6 is empty for an IPv4-only tunnel, or an IPv6 ULA prefix (or "auto") that
+// gives every peer a second address. Mode is "kernel" (or empty) or "userspace", how this
+// machine runs its end of the tunnel. Relay is empty, or "tcp[:PORT]" or "ws[:PORT]" for a
+// fallback that carries the tunnel over TCP when UDP is blocked. Rendezvous is empty, or the
+// HOST[:PORT] a server behind NAT dials to reach the desktop, which then listens on Port.
+type WGSettings struct {
+	Interface  string
+	Port       int
+	Subnet     string
+	ServerIP   string
+	DesktopIP  string
+	MobileIP   string
+	Subnet6    string
+	Mode       string
+	Relay      string
+	Rendezvous string
 }
 
 type SetupStepRequest struct {
+	// RunID is the setup run the step belongs to; system files it changes are backed up
+	// under it.
+	RunID         string
 	BootstrapUser string
 	Host          string
 	Addr          string
@@ -24,6 +53,10 @@ type SetupStepRequest struct {
 	UseSudo       bool
 	WG            WGConfig
 	StepID        workflow.StepID
+	Timeout       time.Duration // zero runs the step without a deadline
+	// Output receives command output line by line while the step runs. It may be called
+	// from several goroutines.
+	Output func(line string)
 }
 
 type SetupStepResult struct {
@@ -32,10 +65,138 @@ type SetupStepResult struct {
 	WG      *WGConfig
 }
 
+// HostKey is the SSH host key a server presented, shown to the user for trust-on-first-use.
+type HostKey struct {
+	Addr        string
+	Fingerprint string
+	Line        string
+	Pinned      bool
+}
+
+// SetupRun is the persisted state of one setup attempt. WireGuard keys are generated once
+// per run so a resumed run keeps the tunnel it already configured.
+type SetupRun struct {
+	ID            string
+	Target        string
+	BootstrapUser string
+	Host          string
+	Addr          string
+	UseSudo       bool
+	WG            WGConfig
+	Steps         []workflow.Step
+	// Device names the device a run joined an existing server as (`arc join`); it is empty
+	// for the run that set the server up.
+	Device string
+}
+
+// HealthState is the coarse health of one ARC component in a StatusReport.
+type HealthState string
+
+const (
+	HealthOK       HealthState = "ok"
+	HealthDegraded HealthState = "degraded"
+	HealthDown     HealthState = "down"
+	HealthUnknown  HealthState = "unknown"
+)
+
+// ComponentStatus is the state of one service, unit or mount on either side of the tunnel.
+type ComponentStatus struct {
+	Name   string
+	Where  string // "local" or "remote"
+	State  HealthState
+	Detail string
+}
+
+// WGPeerStatus is one peer of the local wg0 interface.
+type WGPeerStatus struct {
+	PublicKey       string
+	Endpoint        string
+	LatestHandshake time.Time // zero when no handshake has happened yet
+	RxBytes         int64
+	TxBytes         int64
+}
+
+type StatusReport struct {
+	Target     string
+	Collected  time.Time
+	Components []ComponentStatus
+	Peers      []WGPeerStatus
+}
+
+// PreflightSeverity says whether a preflight finding stops setup.
+type PreflightSeverity string
+
+const (
+	PreflightPass  PreflightSeverity = "pass"
+	PreflightWarn  PreflightSeverity = "warn"
+	PreflightBlock PreflightSeverity = "block"
+)
+
+// PreflightCheck is one check of a machine before setup changes anything. Fix tells the user
+// how to clear a warning or blocking issue.
+type PreflightCheck struct {
+	Name     string
+	Where    string // "local" or "remote"
+	Severity PreflightSeverity
+	Detail   string
+	Fix      string
+}
+
+// PreflightRequest is what the preflight needs to reach the server and judge the tunnel
+// settings of the run about to start.
+type PreflightRequest struct {
+	BootstrapUser string
+	Host          string
+	Addr          string
+	Password      string
+	WG            WGSettings
+}
+
+type PreflightReport struct {
+	Checks []PreflightCheck
+}
+
+// Issues returns the checks that did not pass, blocking ones first.
+func (r PreflightReport) Issues() []PreflightCheck {
+	var blocking, warnings []PreflightCheck
+	for _, c := range r.Checks {
+		switch c.Severity {
+		case PreflightBlock:
+			blocking = append(blocking, c)
+		case PreflightWarn:
+			warnings = append(warnings, c)
+		}
+	}
+	return append(blocking, warnings...)
+}
+
+// Blocked reports whether any check stops setup from starting.
+func (r PreflightReport) Blocked() bool {
+	for _, c := range r.Checks {
+		if c.Severity == PreflightBlock {
+			return true
+		}
+	}
+	return false
+}
+
 type Services interface {
 	CheckLocalSudo() error
 	ParseSSHDeviceTarget(target string) (user, host, addr string, err error)
+	ScanHostKey(addr string) (HostKey, error)
+	TrustHostKey(key HostKey) error
 	SetupDefinition() []workflow.Step
-	RunSetupStep(req SetupStepRequest) (SetupStepResult, error)
+	SetupConcurrency() int
+	// RunPreflight inspects both machines without changing them. It returns an error only when
+	// a machine cannot be inspected at all.
+	RunPreflight(ctx context.Context, req PreflightRequest) (PreflightReport, error)
+	BeginSetupRun(run SetupRun) (SetupRun, error)
+	SaveSetupRun(run SetupRun) error
+	LatestSetupRun(addr string) (SetupRun, bool, error)
+	// RunSetupStep runs one step until it finishes or ctx is done. A step stopped by
+	// cancelling ctx returns an error wrapping context.Canceled.
+	RunSetupStep(ctx context.Context, req SetupStepRequest) (SetupStepResult, error)
+	CloseConnections() error
+	CollectStatus(ctx context.Context) (StatusReport, error)
 	BuildMobilePayload(host string, wg WGConfig) (string, error)
 }
@@ -3,17 +3,8 @@ package app
 import "arc/components"
 
 func (m model) maxLogScroll() int {
-	lines := 0
-	hasRunning := false
-	for _, step := range m.steps {
-		if step.State == stepPending {
-			continue
-		}
-		lines++
-		if step.State == stepRunning {
-			hasRunning = true
-		}
-	}
+	lines := components.LogLineCount(toComponentSteps(m.steps, m.stepOutput), m.outputExpanded)
+	hasRunning := m.runningSteps() > 0
 	if lines <= 0 {
 		return 0
 	}
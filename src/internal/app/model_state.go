@@ -3,6 +3,7 @@ package app
 import (
 	"arc/components"
 	"arc/internal/workflow"
+	"context"
 	"strings"
 
 	tea "github.com/charmbracelet/bubbletea"
@@ -13,15 +14,17 @@ type stepState = workflow.StepState
 type setupStep = workflow.Step
 
 const (
-	phaseRemote = workflow.PhaseRemote
-	phaseLog    = workflow.PhaseLog
+	phaseRemote    = workflow.PhaseRemote
+	phasePreflight = workflow.PhasePreflight
+	phaseLog       = workflow.PhaseLog
 )
 
 const (
-	stepPending = workflow.StepPending
-	stepRunning = workflow.StepRunning
-	stepDone    = workflow.StepDone
-	stepFailed  = workflow.StepFailed
+	stepPending   = workflow.StepPending
+	stepRunning   = workflow.StepRunning
+	stepDone      = workflow.StepDone
+	stepFailed    = workflow.StepFailed
+	stepCancelled = workflow.StepCancelled
 )
 
 type setupStepDoneMsg struct {
@@ -33,6 +36,22 @@ type setupStepDoneMsg struct {
 	wg      *WGConfig
 }
 
+// stepOutputMsg is one line of command output from a running step.
+type stepOutputMsg struct {
+	index int
+	line  string
+}
+
+type hostKeyScannedMsg struct {
+	key HostKey
+	err error
+}
+
+type preflightDoneMsg struct {
+	report PreflightReport
+	err    error
+}
+
 type spinnerTickMsg struct{}
 type connectReleaseMsg struct{}
 
@@ -44,7 +63,7 @@ type model struct {
 	w int
 	h int
 
-	focus     int // 0=ssh-target, 1=password, 2=onboard
+	focus     int // 0=ssh-target, 1=password, 2=network, 3=onboard
 	phase     setupPhase
 	logScroll int
 	working   bool
@@ -61,16 +80,36 @@ type model struct {
 
 	target components.Field
 	pass   components.Field
+	net    components.Field
 
 	bootstrapUser string
 	host          string
 	addr          string
 	password      string
 	useSudo       bool
+	wgSettings    WGSettings
+
+	hostKey        HostKey
+	hostKeyPending bool
+
+	preflight PreflightReport
+
+	runID string
+	jobs  int
+
+	// runCtx is cancelled by the first ctrl+c while setup steps are running.
+	runCtx     context.Context
+	cancelRun  context.CancelFunc
+	cancelling bool
 
 	steps       []setupStep
 	spinnerTick int
 
+	// output carries stepOutputMsg from running steps; stepOutput keeps each step's tail.
+	output         chan stepOutputMsg
+	stepOutput     [][]string
+	outputExpanded bool
+
 	mobilePayload string
 	mobileQR      []string
 	mobileQRErr   string
@@ -80,6 +119,7 @@ func NewModel(svc Services) tea.Model {
 	m := model{svc: svc}
 	m.target = components.Field{Placeholder: "ssh://root@192.168.1.10:22"}
 	m.pass = components.Field{Placeholder: "optional password", Mask: true}
+	m.net = components.Field{Placeholder: "iface=wg0 port=51820 subnet=10.0.0.0/24"}
 	m.phase = phaseRemote
 	return m
 }
@@ -139,6 +179,12 @@ func (m *model) attemptSubmit() tea.Cmd {
 	}
 
 	password := strings.TrimSpace(m.pass.ValueString())
+	wgSettings, err := ParseWGSettings(m.net.ValueString())
+	if err != nil {
+		m.err = err.Error()
+		m.setFocus(2)
+		return nil
+	}
 
 	m.readyAs = ""
 	m.bootstrapUser = ""
@@ -163,6 +209,31 @@ func (m *model) attemptSubmit() tea.Cmd {
 	m.host = host
 	m.addr = addr
 	m.password = password
+	m.wgSettings = wgSettings
+
+	if m.hostKeyPending && m.hostKey.Addr == addr {
+		if err := m.svc.TrustHostKey(m.hostKey); err != nil {
+			m.err = err.Error()
+			m.clearHostKey()
+			return nil
+		}
+		m.clearHostKey()
+		return m.startPreflight()
+	}
+
+	m.clearHostKey()
+	m.working = true
+	return m.scanHostKeyCmd(addr)
+}
+
+func (m model) scanHostKeyCmd(addr string) tea.Cmd {
+	return func() tea.Msg {
+		key, err := m.svc.ScanHostKey(addr)
+		return hostKeyScannedMsg{key: key, err: err}
+	}
+}
 
-	return m.startSetupWorkflow()
+func (m *model) clearHostKey() {
+	m.hostKey = HostKey{}
+	m.hostKeyPending = false
 }
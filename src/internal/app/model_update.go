@@ -12,8 +12,14 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		return m.handleConnectRelease()
 	case spinnerTickMsg:
 		return m.handleSpinnerTick()
+	case hostKeyScannedMsg:
+		return m.handleHostKeyScanned(msg)
+	case preflightDoneMsg:
+		return m.handlePreflightDone(msg)
 	case setupStepDoneMsg:
 		return m.handleSetupStepDone(msg)
+	case stepOutputMsg:
+		return m.handleStepOutput(msg)
 	case tea.MouseMsg:
 		return m.handleMouseMsg(tea.MouseEvent(msg))
 	case tea.KeyMsg:
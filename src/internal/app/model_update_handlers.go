@@ -1,6 +1,8 @@
 package app
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"time"
 
@@ -23,31 +25,80 @@ func (m model) handleLocalSudoCheck(msg localSudoCheckMsg) (tea.Model, tea.Cmd)
 func (m model) handleConnectRelease() (tea.Model, tea.Cmd) {
 	wasDown := m.btnDown
 	m.btnDown = false
-	if m.phase == phaseRemote && wasDown && !m.submitted && !m.working && m.focus == 2 {
+	if m.phase == phaseRemote && wasDown && !m.submitted && !m.working && m.focus == 3 {
 		return m, m.attemptSubmit()
 	}
 	return m, nil
 }
 
 func (m model) handleSpinnerTick() (tea.Model, tea.Cmd) {
-	if m.phase == phaseLog && m.working {
+	if (m.phase == phaseLog || m.phase == phasePreflight) && m.working {
 		m.spinnerTick = (m.spinnerTick + 1) % len(spinnerFrames)
 		return m, spinnerCmd()
 	}
 	return m, nil
 }
 
+func (m model) handleHostKeyScanned(msg hostKeyScannedMsg) (tea.Model, tea.Cmd) {
+	m.working = false
+	if msg.err != nil {
+		m.err = msg.err.Error()
+		m.setFocus(0)
+		return m, nil
+	}
+	if msg.key.Pinned {
+		return m, m.startPreflight()
+	}
+	m.hostKey = msg.key
+	m.hostKeyPending = true
+	m.setFocus(3)
+	return m, nil
+}
+
+func (m model) handlePreflightDone(msg preflightDoneMsg) (tea.Model, tea.Cmd) {
+	if m.phase != phasePreflight {
+		return m, nil
+	}
+	m.working = false
+	if msg.err != nil {
+		m.err = msg.err.Error()
+		return m, nil
+	}
+	m.preflight = msg.report
+	// A clean report goes straight on; issues wait on the preflight card until the user
+	// continues past warnings or fixes what blocks.
+	if len(msg.report.Issues()) == 0 {
+		return m, m.startSetupWorkflow()
+	}
+	return m, nil
+}
+
 func (m model) handleSetupStepDone(msg setupStepDoneMsg) (tea.Model, tea.Cmd) {
 	if m.phase != phaseLog || msg.index < 0 || msg.index >= len(m.steps) {
 		return m, nil
 	}
 	if msg.err != nil {
-		m.steps[msg.index].State = stepFailed
-		m.steps[msg.index].Err = msg.err.Error()
-		m.err = fmt.Sprintf("Step %d failed: %v", msg.index+1, msg.err)
-		m.working = false
+		if errors.Is(msg.err, context.Canceled) {
+			m.steps[msg.index].State = stepCancelled
+			m.steps[msg.index].Err = "cancelled"
+			if m.err == "" || m.err == cancellingNotice {
+				m.err = fmt.Sprintf("Setup cancelled at step %d", msg.index+1)
+			}
+		} else {
+			m.steps[msg.index].State = stepFailed
+			m.steps[msg.index].Err = msg.err.Error()
+			if m.err == "" || m.err == cancellingNotice {
+				m.err = fmt.Sprintf("Step %d failed: %v", msg.index+1, msg.err)
+			}
+		}
+		// Steps already in flight are allowed to finish; nothing new starts.
+		m.working = m.runningSteps() > 0
 		m.submitted = false
+		m.saveSetupRun()
 		m.clampLogScroll()
+		if !m.working {
+			return m, m.finishRun()
+		}
 		return m, nil
 	}
 
@@ -63,15 +114,21 @@ func (m model) handleSetupStepDone(msg setupStepDoneMsg) (tea.Model, tea.Cmd) {
 
 	m.steps[msg.index].State = stepDone
 	m.clampLogScroll()
-	next := msg.index + 1
-	if next >= len(m.steps) {
-		m.working = false
-		m.submitted = true
-		m.buildMobileQRCode()
+	if m.err != "" {
+		m.working = m.runningSteps() > 0
+		m.saveSetupRun()
+		if !m.working {
+			return m, m.finishRun()
+		}
 		return m, nil
 	}
-	m.steps[next].State = stepRunning
-	return m, m.runSetupStepCmd(next)
+	return m, m.scheduleSetupSteps()
+}
+
+func (m model) handleStepOutput(msg stepOutputMsg) (tea.Model, tea.Cmd) {
+	m.appendStepOutput(msg.index, msg.line)
+	m.clampLogScroll()
+	return m, listenStepOutputCmd(m.output)
 }
 
 func (m model) handleMouseMsg(me tea.MouseEvent) (tea.Model, tea.Cmd) {
@@ -114,7 +171,7 @@ func (m model) handleMouseRemote(me tea.MouseEvent) (tea.Model, tea.Cmd) {
 						m.err = "Local sudo is required. Run: sudo -v  (then retry)"
 						return m, nil
 					}
-					m.setFocus(2)
+					m.setFocus(3)
 					m.btnDown = true
 					m.btnHover = true
 					return m, nil
@@ -131,7 +188,7 @@ func (m model) handleMouseRemote(me tea.MouseEvent) (tea.Model, tea.Cmd) {
 		}
 
 		if me.Action == tea.MouseActionPress {
-			ipR, passR, ok := m.inputRects()
+			ipR, passR, netR, ok := m.inputRects()
 			if ok {
 				switch {
 				case ipR.Contains(me.X, me.Y):
@@ -140,6 +197,9 @@ func (m model) handleMouseRemote(me tea.MouseEvent) (tea.Model, tea.Cmd) {
 				case passR.Contains(me.X, me.Y):
 					m.setFocus(1)
 					return m, nil
+				case netR.Contains(me.X, me.Y):
+					m.setFocus(2)
+					return m, nil
 				}
 			}
 		}
@@ -190,6 +250,11 @@ func (m model) handleMouseLog(me tea.MouseEvent) (tea.Model, tea.Cmd) {
 func (m model) handleKeyMsg(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
 	k := msg.String()
 	if k == "ctrl+c" {
+		// The first ctrl+c during setup cancels the running steps; the second quits.
+		if m.phase == phaseLog && m.working && !m.cancelling {
+			m.cancelSetup()
+			return m, nil
+		}
 		return m, tea.Quit
 	}
 	if m.phase == phaseRemote && (!m.localSudoChecked || !m.localSudoOK) {
@@ -201,6 +266,9 @@ func (m model) handleKeyMsg(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
 	if m.phase == phaseLog {
 		return m.handleLogKey(k)
 	}
+	if m.phase == phasePreflight {
+		return m.handlePreflightKey(k)
+	}
 	if m.working {
 		return m, nil
 	}
@@ -221,10 +289,10 @@ func (m model) handleKeyMsg(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
 
 	switch k {
 	case "tab", "down":
-		m.setFocus((m.focus + 1) % 3)
+		m.setFocus((m.focus + 1) % 4)
 		return m, nil
 	case "shift+tab", "up":
-		m.setFocus((m.focus + 3 - 1) % 3)
+		m.setFocus((m.focus + 4 - 1) % 4)
 		return m, nil
 	case "enter":
 		if m.focus == 0 {
@@ -236,6 +304,10 @@ func (m model) handleKeyMsg(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
 			return m, nil
 		}
 		if m.focus == 2 {
+			m.setFocus(3)
+			return m, nil
+		}
+		if m.focus == 3 {
 			if !m.localSudoChecked {
 				m.err = "Checking local sudo..."
 				return m, nil
@@ -253,9 +325,15 @@ func (m model) handleKeyMsg(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
 	}
 
 	if m.focus == 0 {
+		before := m.target.ValueString()
 		m.target.HandleKey(msg)
+		if m.target.ValueString() != before {
+			m.clearHostKey()
+		}
 	} else if m.focus == 1 {
 		m.pass.HandleKey(msg)
+	} else if m.focus == 2 {
+		m.net.HandleKey(msg)
 	}
 	return m, nil
 }
@@ -281,6 +359,12 @@ func (m model) handleLogKey(k string) (tea.Model, tea.Cmd) {
 	case "end":
 		m.logScroll = 0
 		return m, nil
+	case "o":
+		m.outputExpanded = !m.outputExpanded
+		m.clampLogScroll()
+		return m, nil
+	case "r":
+		return m, m.retryFromFailedStep()
 	case "esc":
 		if m.working {
 			return m, nil
@@ -306,6 +390,31 @@ func (m model) handleLogKey(k string) (tea.Model, tea.Cmd) {
 	}
 }
 
+func (m model) handlePreflightKey(k string) (tea.Model, tea.Cmd) {
+	if m.working {
+		return m, nil
+	}
+	switch k {
+	case "r":
+		return m, m.startPreflight()
+	case "esc":
+		m.phase = phaseRemote
+		m.err = ""
+		m.preflight = PreflightReport{}
+		m.setFocus(2)
+		return m, nil
+	case "enter":
+		if m.err != "" || m.preflight.Blocked() {
+			return m, nil
+		}
+		return m, m.startSetupWorkflow()
+	case "q":
+		return m, tea.Quit
+	default:
+		return m, nil
+	}
+}
+
 func (m *model) resetRemotePhaseState() {
 	m.phase = phaseRemote
 	m.submitted = false
@@ -317,8 +426,17 @@ func (m *model) resetRemotePhaseState() {
 	m.addr = ""
 	m.password = ""
 	m.useSudo = false
+	m.wgSettings = WGSettings{}
+	m.preflight = PreflightReport{}
+	m.wg = WGConfig{}
+	m.runID = ""
+	m.stepOutput = nil
+	m.cancelRun = nil
+	m.runCtx = nil
+	m.cancelling = false
 	m.mobilePayload = ""
 	m.mobileQR = nil
 	m.mobileQRErr = ""
+	m.clearHostKey()
 	m.setFocus(0)
 }
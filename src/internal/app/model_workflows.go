@@ -2,6 +2,9 @@ package app
 
 import (
 	"arc/components"
+	"arc/internal/workflow"
+	"context"
+	"strings"
 	"time"
 
 	tea "github.com/charmbracelet/bubbletea"
@@ -12,9 +15,23 @@ func spinnerCmd() tea.Cmd {
 }
 
 func (m model) runSetupStepCmd(index int) tea.Cmd {
+	ctx := m.runCtx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	var output func(string)
+	if ch := m.output; ch != nil {
+		output = func(line string) {
+			select {
+			case ch <- stepOutputMsg{index: index, line: line}:
+			case <-ctx.Done():
+			}
+		}
+	}
 	return func() tea.Msg {
 		msg := setupStepDoneMsg{index: index}
-		res, err := m.svc.RunSetupStep(SetupStepRequest{
+		res, err := m.svc.RunSetupStep(ctx, SetupStepRequest{
+			RunID:         m.runID,
 			BootstrapUser: m.bootstrapUser,
 			Host:          m.host,
 			Addr:          m.addr,
@@ -22,6 +39,8 @@ func (m model) runSetupStepCmd(index int) tea.Cmd {
 			UseSudo:       m.useSudo,
 			WG:            m.wg,
 			StepID:        m.steps[index].ID,
+			Timeout:       m.steps[index].Timeout,
+			Output:        output,
 		})
 		if err != nil {
 			msg.err = err
@@ -34,6 +53,30 @@ func (m model) runSetupStepCmd(index int) tea.Cmd {
 	}
 }
 
+// startPreflight inspects both machines before the setup run begins.
+func (m *model) startPreflight() tea.Cmd {
+	m.phase = phasePreflight
+	m.spinnerTick = 0
+	m.working = true
+	m.err = ""
+	m.preflight = PreflightReport{}
+	return tea.Batch(m.preflightCmd(), spinnerCmd())
+}
+
+func (m model) preflightCmd() tea.Cmd {
+	req := PreflightRequest{
+		BootstrapUser: m.bootstrapUser,
+		Host:          m.host,
+		Addr:          m.addr,
+		Password:      m.password,
+		WG:            m.wgSettings,
+	}
+	return func() tea.Msg {
+		report, err := m.svc.RunPreflight(context.Background(), req)
+		return preflightDoneMsg{report: report, err: err}
+	}
+}
+
 func (m *model) startSetupWorkflow() tea.Cmd {
 	m.phase = phaseLog
 	m.spinnerTick = 0
@@ -47,26 +90,217 @@ func (m *model) startSetupWorkflow() tea.Cmd {
 		m.submitted = true
 		return nil
 	}
-	m.steps[0].State = stepRunning
+	for _, step := range m.steps {
+		if step.State == stepFailed {
+			m.working = false
+			m.err = step.Err
+			return nil
+		}
+	}
+
+	run, err := m.svc.BeginSetupRun(SetupRun{
+		Target:        strings.TrimSpace(m.target.ValueString()),
+		BootstrapUser: m.bootstrapUser,
+		Host:          m.host,
+		Addr:          m.addr,
+		Steps:         m.steps,
+		WG:            WGConfig{Net: m.wgSettings},
+	})
+	if err != nil {
+		m.working = false
+		m.err = err.Error()
+		return nil
+	}
+	m.runID = run.ID
+	m.wg = run.WG
+	m.jobs = m.svc.SetupConcurrency()
+	m.newRunContext()
+	m.stepOutput = make([][]string, len(m.steps))
+
+	cmds := []tea.Cmd{m.scheduleSetupSteps(), spinnerCmd()}
+	if m.output == nil {
+		m.output = make(chan stepOutputMsg, stepOutputBuffer)
+		cmds = append(cmds, listenStepOutputCmd(m.output))
+	}
+	return tea.Batch(cmds...)
+}
+
+const (
+	// stepOutputBuffer absorbs output bursts between UI updates.
+	stepOutputBuffer = 256
+	// stepOutputKeep is how many output lines are kept per step.
+	stepOutputKeep = 200
+)
+
+// listenStepOutputCmd waits for the next output line. The handler re-arms it, so one
+// listener serves every run of the model.
+func listenStepOutputCmd(ch <-chan stepOutputMsg) tea.Cmd {
+	return func() tea.Msg { return <-ch }
+}
+
+func (m *model) appendStepOutput(index int, line string) {
+	if index < 0 || index >= len(m.stepOutput) {
+		return
+	}
+	out := append(m.stepOutput[index], line)
+	if len(out) > stepOutputKeep {
+		out = out[len(out)-stepOutputKeep:]
+	}
+	m.stepOutput[index] = out
+}
+
+// scheduleSetupSteps starts every step whose requirements are met, up to the concurrency
+// limit, and finishes the workflow once nothing is running or left to run.
+func (m *model) scheduleSetupSteps() tea.Cmd {
+	var cmds []tea.Cmd
+	for _, i := range workflow.RunnableSteps(m.steps, m.jobs) {
+		m.steps[i].State = stepRunning
+		cmds = append(cmds, m.runSetupStepCmd(i))
+	}
+	if len(cmds) == 0 && m.runningSteps() == 0 {
+		m.working = false
+		if m.pendingSteps() > 0 {
+			m.err = "No runnable setup steps left; check step dependencies"
+			m.saveSetupRun()
+			return m.finishRun()
+		}
+		m.submitted = true
+		m.saveSetupRun()
+		m.buildMobileQRCode()
+		return m.finishRun()
+	}
+	m.saveSetupRun()
+	return tea.Batch(cmds...)
+}
+
+const cancellingNotice = "Cancelling setup... press ctrl+c again to quit"
+
+func (m *model) newRunContext() {
+	if m.cancelRun != nil {
+		m.cancelRun()
+	}
+	m.runCtx, m.cancelRun = context.WithCancel(context.Background())
+	m.cancelling = false
+}
+
+// cancelSetup stops the running steps. Steps in flight report back as cancelled and
+// nothing new starts; the run can be continued with r or `arc setup --resume`.
+func (m *model) cancelSetup() {
+	if m.cancelRun != nil {
+		m.cancelRun()
+	}
+	m.cancelling = true
+	m.err = cancellingNotice
+}
+
+// finishRun ends a run once nothing is running: it cancels the run's context, which only
+// abort or the next run would otherwise release, and closes the shared SSH clients.
+func (m *model) finishRun() tea.Cmd {
+	if m.cancelRun != nil {
+		m.cancelRun()
+	}
+	return m.closeConnectionsCmd()
+}
+
+// closeConnectionsCmd releases the SSH clients shared by setup steps once nothing is running.
+func (m model) closeConnectionsCmd() tea.Cmd {
+	return func() tea.Msg {
+		_ = m.svc.CloseConnections()
+		return nil
+	}
+}
+
+func (m model) runningSteps() int {
+	n := 0
+	for _, step := range m.steps {
+		if step.State == stepRunning {
+			n++
+		}
+	}
+	return n
+}
+
+func (m model) pendingSteps() int {
+	n := 0
+	for _, step := range m.steps {
+		if step.State == stepPending {
+			n++
+		}
+	}
+	return n
+}
+
+// retryFromFailedStep continues the current run from its failed or cancelled steps, keeping the
+// WireGuard keys and sudo mode gathered so far.
+func (m *model) retryFromFailedStep() tea.Cmd {
+	if m.failedStepIndex() < 0 {
+		return nil
+	}
+	for i := range m.steps {
+		if m.steps[i].State == stepFailed || m.steps[i].State == stepCancelled {
+			m.steps[i].State = stepPending
+			m.steps[i].Err = ""
+			if i < len(m.stepOutput) {
+				m.stepOutput[i] = nil
+			}
+		}
+	}
+	m.err = ""
+	m.newRunContext()
+	m.working = true
+	m.submitted = false
+	m.spinnerTick = 0
 	return tea.Batch(
-		m.runSetupStepCmd(0),
+		m.scheduleSetupSteps(),
 		spinnerCmd(),
 	)
 }
 
+func (m model) failedStepIndex() int {
+	if m.working || m.runID == "" {
+		return -1
+	}
+	for i, step := range m.steps {
+		if step.State == stepFailed || step.State == stepCancelled {
+			return i
+		}
+	}
+	return -1
+}
+
+// saveSetupRun persists progress so a failed run can be resumed with `arc setup --resume`.
+// Persistence is best-effort and never interrupts the setup itself.
+func (m model) saveSetupRun() {
+	if m.runID == "" {
+		return
+	}
+	_ = m.svc.SaveSetupRun(SetupRun{
+		ID:            m.runID,
+		Target:        strings.TrimSpace(m.target.ValueString()),
+		BootstrapUser: m.bootstrapUser,
+		Host:          m.host,
+		Addr:          m.addr,
+		UseSudo:       m.useSudo,
+		WG:            m.wg,
+		Steps:         m.steps,
+	})
+}
+
 func (m model) viewPhase() components.Phase {
 	switch m.phase {
 	case phaseLog:
 		return components.PhaseLog
+	case phasePreflight:
+		return components.PhasePreflight
 	default:
 		return components.PhaseRemote
 	}
 }
 
-func (m model) inputRects() (components.Rect, components.Rect, bool) {
+func (m model) inputRects() (components.Rect, components.Rect, components.Rect, bool) {
 	cardR, ok := m.credCardRect()
 	if !ok {
-		return components.Rect{}, components.Rect{}, false
+		return components.Rect{}, components.Rect{}, components.Rect{}, false
 	}
 	return components.InputRectsFromCard(cardR)
 }
@@ -84,7 +318,14 @@ func (m model) connectRect() (components.Rect, bool) {
 	if !ok {
 		return components.Rect{}, false
 	}
-	return components.ButtonRect(cardR, components.ConnectLabel)
+	return components.ButtonRect(cardR, m.connectLabel())
+}
+
+func (m model) connectLabel() string {
+	if m.hostKeyPending {
+		return components.TrustLabel
+	}
+	return components.ConnectLabel
 }
 
 func (m model) nextRect() (components.Rect, bool) {
@@ -2,12 +2,25 @@ package app
 
 import (
 	"arc/internal/workflow"
+	"context"
+	"errors"
 	"testing"
+
+	tea "github.com/charmbracelet/bubbletea"
 )
 
 type fakeServices struct {
 	lastReq SetupStepRequest
 	steps   []workflow.Step
+	trusted []HostKey
+	saved   []SetupRun
+
+	status    StatusReport
+	statusErr error
+
+	preflight     PreflightReport
+	preflightErr  error
+	preflightReqs []PreflightRequest
 }
 
 func (f *fakeServices) CheckLocalSudo() error { return nil }
@@ -16,17 +29,55 @@ func (f *fakeServices) ParseSSHDeviceTarget(string) (string, string, string, err
 	return "", "", "", nil
 }
 
+func (f *fakeServices) ScanHostKey(addr string) (HostKey, error) {
+	return HostKey{Addr: addr, Fingerprint: "SHA256:test"}, nil
+}
+
+func (f *fakeServices) TrustHostKey(key HostKey) error {
+	f.trusted = append(f.trusted, key)
+	return nil
+}
+
 func (f *fakeServices) SetupDefinition() []workflow.Step {
 	out := make([]workflow.Step, len(f.steps))
 	copy(out, f.steps)
 	return out
 }
 
-func (f *fakeServices) RunSetupStep(req SetupStepRequest) (SetupStepResult, error) {
+func (f *fakeServices) SetupConcurrency() int { return workflow.DefaultSetupConcurrency }
+
+func (f *fakeServices) RunPreflight(_ context.Context, req PreflightRequest) (PreflightReport, error) {
+	f.preflightReqs = append(f.preflightReqs, req)
+	return f.preflight, f.preflightErr
+}
+
+func (f *fakeServices) BeginSetupRun(run SetupRun) (SetupRun, error) {
+	run.ID = "run-1"
+	run.WG = WGConfig{ServerPriv: "server-priv", Endpoint: "example.com:51820"}
+	return run, nil
+}
+
+func (f *fakeServices) SaveSetupRun(run SetupRun) error {
+	run.Steps = append([]workflow.Step(nil), run.Steps...)
+	f.saved = append(f.saved, run)
+	return nil
+}
+
+func (f *fakeServices) LatestSetupRun(string) (SetupRun, bool, error) {
+	return SetupRun{}, false, nil
+}
+
+func (f *fakeServices) RunSetupStep(_ context.Context, req SetupStepRequest) (SetupStepResult, error) {
 	f.lastReq = req
 	return SetupStepResult{}, nil
 }
 
+func (f *fakeServices) CloseConnections() error { return nil }
+
+func (f *fakeServices) CollectStatus(context.Context) (StatusReport, error) {
+	return f.status, f.statusErr
+}
+
 func (f *fakeServices) BuildMobilePayload(string, WGConfig) (string, error) {
 	return "", nil
 }
@@ -61,3 +112,271 @@ func TestStartSetupWorkflow_UsesServiceDefinition(t *testing.T) {
 		t.Fatalf("expected first step to be running, got %v", m.steps[0].State)
 	}
 }
+
+func TestHandleHostKeyScanned_UnpinnedKeyWaitsForConfirmation(t *testing.T) {
+	fake := &fakeServices{steps: []workflow.Step{{ID: workflow.StepCreateArcUser, Label: "create"}}}
+	m := model{svc: fake, working: true}
+
+	next, cmd := m.handleHostKeyScanned(hostKeyScannedMsg{key: HostKey{Addr: "example.com:22", Fingerprint: "SHA256:test"}})
+	got := next.(model)
+	if cmd != nil {
+		t.Fatalf("expected no command while waiting for host key confirmation")
+	}
+	if !got.hostKeyPending {
+		t.Fatalf("expected host key confirmation to be pending")
+	}
+	if got.phase == phaseLog {
+		t.Fatalf("setup must not start before the host key is trusted")
+	}
+	if got.connectLabel() != "Trust key" {
+		t.Fatalf("unexpected button label: %q", got.connectLabel())
+	}
+}
+
+func TestHandleHostKeyScanned_PinnedKeyStartsSetup(t *testing.T) {
+	fake := &fakeServices{steps: []workflow.Step{{ID: workflow.StepCreateArcUser, Label: "create"}}}
+	m := model{svc: fake, working: true}
+
+	next, _ := m.handleHostKeyScanned(hostKeyScannedMsg{key: HostKey{Addr: "example.com:22", Pinned: true}})
+	got := next.(model)
+	if got.phase != phasePreflight {
+		t.Fatalf("expected preflight to run for an already pinned host key")
+	}
+	next, _ = got.handlePreflightDone(got.preflightCmd()().(preflightDoneMsg))
+	got = next.(model)
+	if got.phase != phaseLog {
+		t.Fatalf("expected setup to start for an already pinned host key")
+	}
+	if got.hostKeyPending {
+		t.Fatalf("did not expect a pending host key confirmation")
+	}
+}
+
+func TestPreflight_BlockingIssueHoldsSetupUntilRecheckPasses(t *testing.T) {
+	fake := &fakeServices{steps: []workflow.Step{{ID: workflow.StepCreateArcUser, Label: "create"}}}
+	fake.preflight = PreflightReport{Checks: []PreflightCheck{
+		{Name: "wireguard port", Where: "remote", Severity: PreflightBlock, Detail: "UDP 51820 is already bound", Fix: "choose another port"},
+	}}
+	m := model{svc: fake, addr: "example.com:22", wgSettings: WGSettings{Port: 51820}}
+
+	_ = m.startPreflight()
+	next, _ := m.handlePreflightDone(m.preflightCmd()().(preflightDoneMsg))
+	got := next.(model)
+	if got.phase != phasePreflight || got.working {
+		t.Fatalf("a blocking issue must keep the preflight card up, phase=%v working=%v", got.phase, got.working)
+	}
+	if len(fake.preflightReqs) != 1 || fake.preflightReqs[0].WG.Port != 51820 || fake.preflightReqs[0].Addr != "example.com:22" {
+		t.Fatalf("unexpected preflight requests: %#v", fake.preflightReqs)
+	}
+	rows := got.toViewState().Preflight
+	if len(rows) != 1 || rows[0].Fix != "choose another port" {
+		t.Fatalf("unexpected preflight rows: %#v", rows)
+	}
+
+	next, _ = got.handlePreflightKey("enter")
+	if got = next.(model); got.phase != phasePreflight || len(got.steps) != 0 {
+		t.Fatalf("enter must not start setup while preflight blocks")
+	}
+
+	fake.preflight = PreflightReport{Checks: []PreflightCheck{
+		{Name: "free disk space", Where: "local", Severity: PreflightWarn, Detail: "only 900 MiB free on /"},
+	}}
+	next, _ = got.handlePreflightKey("r")
+	got = next.(model)
+	if !got.working {
+		t.Fatalf("r should re-run preflight")
+	}
+	next, _ = got.handlePreflightDone(got.preflightCmd()().(preflightDoneMsg))
+	if got = next.(model); got.phase != phasePreflight {
+		t.Fatalf("warnings should wait for confirmation")
+	}
+	next, _ = got.handlePreflightKey("enter")
+	if got = next.(model); got.phase != phaseLog || len(got.steps) != 1 {
+		t.Fatalf("enter should start setup past warnings, phase=%v", got.phase)
+	}
+}
+
+func TestRetryFromFailedStep_KeepsRunWireGuardConfig(t *testing.T) {
+	fake := &fakeServices{steps: []workflow.Step{
+		{ID: workflow.StepDetectPrivilegedMode, Label: "detect"},
+		{ID: workflow.StepCreateArcUser, Label: "create"},
+	}}
+	m := model{svc: fake}
+	_ = m.startSetupWorkflow()
+
+	next, _ := m.handleSetupStepDone(setupStepDoneMsg{index: 0})
+	next, _ = next.(model).handleSetupStepDone(setupStepDoneMsg{index: 1, err: errors.New("boom")})
+	failed := next.(model)
+	if failed.toViewState().RetryStep != 2 {
+		t.Fatalf("expected retry to be offered for step 2, got %d", failed.toViewState().RetryStep)
+	}
+	if last := fake.saved[len(fake.saved)-1]; last.Steps[1].State != stepFailed || last.ID != "run-1" {
+		t.Fatalf("failed step was not persisted: %#v", last)
+	}
+
+	next, cmd := failed.handleLogKey("r")
+	retried := next.(model)
+	if cmd == nil || !retried.working || retried.err != "" {
+		t.Fatalf("expected retry to restart the workflow")
+	}
+	if retried.steps[0].State != stepDone || retried.steps[1].State != stepRunning {
+		t.Fatalf("unexpected step states after retry: %#v", retried.steps)
+	}
+
+	_ = retried.runSetupStepCmd(1)()
+	if fake.lastReq.StepID != workflow.StepCreateArcUser || fake.lastReq.WG.ServerPriv != "server-priv" {
+		t.Fatalf("retry must reuse the run's WireGuard config: %#v", fake.lastReq)
+	}
+}
+
+func TestStartSetupWorkflow_RunsIndependentStepsConcurrently(t *testing.T) {
+	fake := &fakeServices{steps: []workflow.Step{
+		{ID: workflow.StepInstallServerWireGuard, Label: "server wg", Scope: workflow.ScopeRemote},
+		{ID: workflow.StepInstallLocalWireGuard, Label: "local wg", Scope: workflow.ScopeLocal},
+		{ID: workflow.StepInstallLocalNFSClient, Label: "local nfs", Scope: workflow.ScopeLocal},
+		{ID: workflow.StepVerifyTunnelConnectivity, Label: "verify", Scope: workflow.ScopeVerify,
+			Requires: []workflow.StepID{workflow.StepInstallServerWireGuard, workflow.StepInstallLocalWireGuard}},
+	}}
+	m := model{svc: fake}
+	_ = m.startSetupWorkflow()
+
+	if m.steps[0].State != stepRunning || m.steps[1].State != stepRunning {
+		t.Fatalf("expected remote and local steps to start together: %#v", m.steps)
+	}
+	if m.steps[2].State != stepPending {
+		t.Fatalf("two local steps must not overlap: %#v", m.steps)
+	}
+
+	next, _ := m.handleSetupStepDone(setupStepDoneMsg{index: 1})
+	got := next.(model)
+	if got.steps[2].State != stepRunning || got.steps[3].State != stepPending {
+		t.Fatalf("expected next local step to start while verify waits: %#v", got.steps)
+	}
+
+	next, _ = got.handleSetupStepDone(setupStepDoneMsg{index: 0})
+	got = next.(model)
+	if got.steps[3].State != stepPending {
+		t.Fatalf("verify step must wait for running steps to drain: %#v", got.steps)
+	}
+
+	next, _ = got.handleSetupStepDone(setupStepDoneMsg{index: 2})
+	got = next.(model)
+	if got.steps[3].State != stepRunning {
+		t.Fatalf("expected verify step to run once it is alone: %#v", got.steps)
+	}
+}
+
+func TestHandleSetupStepDone_FailureLetsRunningStepsFinish(t *testing.T) {
+	fake := &fakeServices{steps: []workflow.Step{
+		{ID: workflow.StepInstallServerWireGuard, Label: "server wg", Scope: workflow.ScopeRemote},
+		{ID: workflow.StepInstallLocalWireGuard, Label: "local wg", Scope: workflow.ScopeLocal},
+		{ID: workflow.StepInstallLocalNFSClient, Label: "local nfs", Scope: workflow.ScopeLocal},
+	}}
+	m := model{svc: fake}
+	_ = m.startSetupWorkflow()
+
+	next, _ := m.handleSetupStepDone(setupStepDoneMsg{index: 0, err: errors.New("boom")})
+	got := next.(model)
+	if !got.working || got.err == "" {
+		t.Fatalf("expected workflow to keep draining after a failure")
+	}
+
+	next, _ = got.handleSetupStepDone(setupStepDoneMsg{index: 1})
+	got = next.(model)
+	if got.working || got.steps[2].State != stepPending {
+		t.Fatalf("no new step may start after a failure: %#v", got.steps)
+	}
+	if got.toViewState().RetryStep != 1 {
+		t.Fatalf("expected retry from step 1, got %d", got.toViewState().RetryStep)
+	}
+}
+
+func TestHandleSetupStepDone_FinishedRunReleasesItsContext(t *testing.T) {
+	fake := &fakeServices{steps: []workflow.Step{
+		{ID: workflow.StepDetectPrivilegedMode, Label: "detect", Scope: workflow.ScopeRemote},
+	}}
+	m := model{svc: fake}
+	_ = m.startSetupWorkflow()
+	runCtx := m.runCtx
+
+	next, _ := m.handleSetupStepDone(setupStepDoneMsg{index: 0})
+	if got := next.(model); got.working || !got.submitted {
+		t.Fatalf("expected the run to finish: %#v", got.steps)
+	}
+	if runCtx.Err() == nil {
+		t.Fatalf("a finished run must cancel its context")
+	}
+}
+
+func TestCtrlC_CancelsRunningSetupBeforeQuitting(t *testing.T) {
+	fake := &fakeServices{steps: []workflow.Step{
+		{ID: workflow.StepDetectPrivilegedMode, Label: "detect", Scope: workflow.ScopeRemote},
+		{ID: workflow.StepCreateArcUser, Label: "create", Scope: workflow.ScopeRemote,
+			Requires: []workflow.StepID{workflow.StepDetectPrivilegedMode}},
+	}}
+	m := model{svc: fake}
+	_ = m.startSetupWorkflow()
+	runCtx := m.runCtx
+
+	next, cmd := m.handleKeyMsg(tea.KeyMsg{Type: tea.KeyCtrlC})
+	cancelling := next.(model)
+	if cmd != nil || !cancelling.cancelling {
+		t.Fatalf("first ctrl+c must cancel setup instead of quitting")
+	}
+	if runCtx.Err() == nil {
+		t.Fatalf("expected the run context to be cancelled")
+	}
+
+	next, _ = cancelling.handleSetupStepDone(setupStepDoneMsg{index: 0, err: context.Canceled})
+	got := next.(model)
+	if got.working || got.steps[0].State != stepCancelled || got.steps[1].State != stepPending {
+		t.Fatalf("unexpected state after cancellation: %#v", got.steps)
+	}
+	if got.err != "Setup cancelled at step 1" || got.toViewState().RetryStep != 1 {
+		t.Fatalf("expected cancelled step to be retryable, err=%q retry=%d", got.err, got.toViewState().RetryStep)
+	}
+	if last := fake.saved[len(fake.saved)-1]; last.Steps[0].State != stepCancelled {
+		t.Fatalf("cancelled step was not persisted: %#v", last.Steps)
+	}
+
+	next, _ = got.handleLogKey("r")
+	retried := next.(model)
+	if retried.steps[0].State != stepRunning || retried.runCtx.Err() != nil {
+		t.Fatalf("retry must restart the cancelled step with a fresh context")
+	}
+
+	next, _ = retried.handleKeyMsg(tea.KeyMsg{Type: tea.KeyCtrlC})
+	if _, cmd := next.(model).handleKeyMsg(tea.KeyMsg{Type: tea.KeyCtrlC}); cmd == nil {
+		t.Fatalf("second ctrl+c must quit")
+	}
+}
+
+func TestStepOutput_StreamsIntoRunningStepTail(t *testing.T) {
+	fake := &fakeServices{steps: []workflow.Step{
+		{ID: workflow.StepInstallServerWireGuard, Label: "server wg", Scope: workflow.ScopeRemote},
+	}}
+	m := model{svc: fake}
+	_ = m.startSetupWorkflow()
+	if m.output == nil {
+		t.Fatalf("expected an output channel for the run")
+	}
+
+	_ = m.runSetupStepCmd(0)()
+	fake.lastReq.Output("Setting up wireguard-dkms")
+	msg := <-m.output
+
+	next, cmd := m.handleStepOutput(msg)
+	got := next.(model)
+	if cmd == nil {
+		t.Fatalf("expected the output listener to be re-armed")
+	}
+	steps := got.toViewState().Steps
+	if len(steps[0].Output) != 1 || steps[0].Output[0] != "Setting up wireguard-dkms" {
+		t.Fatalf("unexpected step output: %#v", steps[0].Output)
+	}
+
+	next, _ = got.handleLogKey("o")
+	if !next.(model).toViewState().OutputExpanded {
+		t.Fatalf("expected o to expand the output tail")
+	}
+}
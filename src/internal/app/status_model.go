@@ -0,0 +1,162 @@
+package app
+
+import (
+	"arc/components"
+	"context"
+	"fmt"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+const (
+	// statusRefreshInterval is how often the status screen collects a new report.
+	statusRefreshInterval = 5 * time.Second
+	// statusCollectTimeout bounds one collection; the NFS check can wait on the automount.
+	statusCollectTimeout = 20 * time.Second
+)
+
+type statusReportMsg struct {
+	report StatusReport
+	err    error
+}
+
+type statusRefreshMsg struct{}
+
+// statusModel is the `arc status` screen. It polls Services.CollectStatus and shows the
+// latest report; a failed collection keeps the previous report on screen.
+type statusModel struct {
+	svc Services
+
+	w int
+	h int
+
+	report  StatusReport
+	loaded  bool
+	loading bool
+	err     string
+}
+
+func NewStatusModel(svc Services) tea.Model {
+	return statusModel{svc: svc}
+}
+
+func (m statusModel) Init() tea.Cmd {
+	return m.collectCmd()
+}
+
+func (m statusModel) collectCmd() tea.Cmd {
+	return func() tea.Msg {
+		ctx, cancel := context.WithTimeout(context.Background(), statusCollectTimeout)
+		defer cancel()
+		report, err := m.svc.CollectStatus(ctx)
+		return statusReportMsg{report: report, err: err}
+	}
+}
+
+func (m statusModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	switch msg := msg.(type) {
+	case tea.WindowSizeMsg:
+		m.w, m.h = msg.Width, msg.Height
+		return m, nil
+	case statusReportMsg:
+		m.loading = false
+		if msg.err != nil {
+			m.err = msg.err.Error()
+		} else {
+			m.err = ""
+			m.report = msg.report
+			m.loaded = true
+		}
+		return m, tea.Tick(statusRefreshInterval, func(time.Time) tea.Msg { return statusRefreshMsg{} })
+	case statusRefreshMsg:
+		if m.loading {
+			return m, nil
+		}
+		m.loading = true
+		return m, m.collectCmd()
+	case tea.KeyMsg:
+		switch msg.String() {
+		case "q", "esc", "ctrl+c":
+			return m, tea.Quit
+		case "r":
+			if m.loading {
+				return m, nil
+			}
+			m.loading = true
+			return m, m.collectCmd()
+		}
+	}
+	return m, nil
+}
+
+func (m statusModel) View() string {
+	return components.RenderStatus(m.toStatusView(time.Now()))
+}
+
+func (m statusModel) toStatusView(now time.Time) components.StatusView {
+	view := components.StatusView{
+		W:       m.w,
+		H:       m.h,
+		Target:  m.report.Target,
+		Loading: m.loading || !m.loaded,
+		Err:     m.err,
+	}
+	if m.loaded {
+		view.Updated = "updated " + m.report.Collected.Format("15:04:05")
+	}
+	for _, c := range m.report.Components {
+		view.Rows = append(view.Rows, components.StatusRow{
+			Name:   c.Name,
+			Where:  c.Where,
+			Health: mapHealth(c.State),
+			Detail: c.Detail,
+		})
+	}
+	for _, p := range m.report.Peers {
+		view.Peers = append(view.Peers, formatPeerStatus(p, now))
+	}
+	return view
+}
+
+func mapHealth(s HealthState) components.Health {
+	switch s {
+	case HealthOK:
+		return components.HealthOK
+	case HealthDegraded:
+		return components.HealthDegraded
+	case HealthDown:
+		return components.HealthDown
+	default:
+		return components.HealthUnknown
+	}
+}
+
+func formatPeerStatus(p WGPeerStatus, now time.Time) string {
+	key := p.PublicKey
+	if len(key) > 12 {
+		key = key[:12] + "…"
+	}
+	endpoint := p.Endpoint
+	if endpoint == "" {
+		endpoint = "(no endpoint)"
+	}
+	handshake := "never"
+	if !p.LatestHandshake.IsZero() {
+		handshake = now.Sub(p.LatestHandshake).Round(time.Second).String() + " ago"
+	}
+	return fmt.Sprintf("%s  %s  handshake %s  rx %s  tx %s", key, endpoint, handshake, formatBytes(p.RxBytes), formatBytes(p.TxBytes))
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for v := n / unit; v >= unit; v /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
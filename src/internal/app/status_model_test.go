@@ -0,0 +1,51 @@
+package app
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+func TestStatusModel_ShowsReportAndKeepsItOnError(t *testing.T) {
+	now := time.Now()
+	fake := &fakeServices{status: StatusReport{
+		Target:    "arc@example.com",
+		Collected: now,
+		Components: []ComponentStatus{
+			{Name: "wg-quick@wg0", Where: "local", State: HealthOK},
+			{Name: "arc-clipd.service", Where: "remote", State: HealthDown, Detail: "failed"},
+		},
+		Peers: []WGPeerStatus{{PublicKey: "abcdefghijklmnop", Endpoint: "203.0.113.7:51820", LatestHandshake: now.Add(-5 * time.Second), RxBytes: 2048}},
+	}}
+	m := NewStatusModel(fake).(statusModel)
+
+	next, cmd := m.Update(m.Init()())
+	got := next.(statusModel)
+	if cmd == nil {
+		t.Fatalf("expected a refresh to be scheduled")
+	}
+	view := got.toStatusView(now)
+	if view.Target != "arc@example.com" || len(view.Rows) != 2 || view.Loading {
+		t.Fatalf("unexpected view: %#v", view)
+	}
+	if view.Rows[1].Health != mapHealth(HealthDown) {
+		t.Fatalf("unexpected health mapping: %#v", view.Rows[1])
+	}
+	if len(view.Peers) != 1 || !strings.Contains(view.Peers[0], "handshake 5s ago") || !strings.Contains(view.Peers[0], "rx 2.0 KiB") {
+		t.Fatalf("unexpected peer line: %#v", view.Peers)
+	}
+
+	next, _ = got.Update(statusReportMsg{err: errors.New("tunnel down")})
+	failed := next.(statusModel)
+	if failed.err != "tunnel down" || len(failed.toStatusView(now).Rows) != 2 {
+		t.Fatalf("a failed refresh must keep the previous report")
+	}
+
+	next, cmd = failed.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune("r")})
+	if cmd == nil || !next.(statusModel).loading {
+		t.Fatalf("expected r to refresh")
+	}
+}
@@ -10,22 +10,47 @@ func mapStepState(s stepState) components.StepState {
 		return components.StepDone
 	case stepFailed:
 		return components.StepFailed
+	case stepCancelled:
+		return components.StepCancelled
 	default:
 		return components.StepPending
 	}
 }
 
-func toComponentSteps(steps []setupStep) []components.Step {
+func toComponentSteps(steps []setupStep, output [][]string) []components.Step {
 	if len(steps) == 0 {
 		return nil
 	}
 	out := make([]components.Step, 0, len(steps))
-	for _, s := range steps {
-		out = append(out, components.Step{
+	for i, s := range steps {
+		step := components.Step{
 			Label: s.Label,
 			State: mapStepState(s.State),
 			Err:   s.Err,
-		})
+		}
+		if i < len(output) {
+			step.Output = output[i]
+		}
+		out = append(out, step)
+	}
+	return out
+}
+
+func toPreflightRows(report PreflightReport) []components.PreflightRow {
+	checks := report.Issues()
+	if len(checks) == 0 {
+		checks = report.Checks
+	}
+	out := make([]components.PreflightRow, 0, len(checks))
+	for _, c := range checks {
+		health := components.HealthOK
+		switch c.Severity {
+		case PreflightWarn:
+			health = components.HealthDegraded
+		case PreflightBlock:
+			health = components.HealthDown
+		}
+		out = append(out, components.PreflightRow{Name: c.Name, Where: c.Where, Health: health, Detail: c.Detail, Fix: c.Fix})
 	}
 	return out
 }
@@ -60,15 +85,38 @@ func (m model) toViewState() components.ViewState {
 		LocalSudoChecked: m.localSudoChecked,
 		LocalSudoOK:      m.localSudoOK,
 
-		Steps:       toComponentSteps(m.steps),
+		Steps:       toComponentSteps(m.steps, m.stepOutput),
 		SpinnerRune: m.spinnerRune(),
+		RetryStep:   m.failedStepIndex() + 1,
+
+		OutputExpanded: m.outputExpanded,
+
+		HostKeyAddr:        m.hostKeyAddr(),
+		HostKeyFingerprint: m.hostKeyFingerprint(),
 
 		Target: m.target,
 		Pass:   m.pass,
+		Net:    m.net,
 
 		MobileQR:    m.mobileQR,
 		MobileQRErr: m.mobileQRErr,
+
+		Preflight: toPreflightRows(m.preflight),
+	}
+}
+
+func (m model) hostKeyAddr() string {
+	if !m.hostKeyPending {
+		return ""
+	}
+	return m.hostKey.Addr
+}
+
+func (m model) hostKeyFingerprint() string {
+	if !m.hostKeyPending {
+		return ""
 	}
+	return m.hostKey.Fingerprint
 }
 
 func (m model) View() string {
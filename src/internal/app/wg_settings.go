@@ -0,0 +1,55 @@
+package app
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ParseWGSettings reads the Network field of the setup screen: space-separated key=value
+// pairs with the keys iface, port, subnet, server, desktop, mobile, subnet6, mode, relay and
+// rendezvous.
+// An empty spec keeps every default. Values are validated when the setup run begins.
+func ParseWGSettings(spec string) (WGSettings, error) {
+	var s WGSettings
+	seen := map[string]bool{}
+	for _, pair := range strings.Fields(spec) {
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok || value == "" {
+			return WGSettings{}, fmt.Errorf("network: want key=value, got %q", pair)
+		}
+		if seen[key] {
+			return WGSettings{}, fmt.Errorf("network: %s is set twice", key)
+		}
+		seen[key] = true
+		switch key {
+		case "iface":
+			s.Interface = value
+		case "port":
+			port, err := strconv.Atoi(value)
+			if err != nil {
+				return WGSettings{}, fmt.Errorf("network: invalid port %q", value)
+			}
+			s.Port = port
+		case "subnet":
+			s.Subnet = value
+		case "server":
+			s.ServerIP = value
+		case "desktop":
+			s.DesktopIP = value
+		case "mobile":
+			s.MobileIP = value
+		case "subnet6":
+			s.Subnet6 = value
+		case "mode":
+			s.Mode = value
+		case "relay":
+			s.Relay = value
+		case "rendezvous":
+			s.Rendezvous = value
+		default:
+			return WGSettings{}, fmt.Errorf("network: unknown key %q (iface, port, subnet, server, desktop, mobile, subnet6, mode, relay, rendezvous)", key)
+		}
+	}
+	return s, nil
+}
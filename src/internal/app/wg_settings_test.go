@@ -0,0 +1,25 @@
+package app
+
+import "testing"
+
+func TestParseWGSettings(t *testing.T) {
+	s, err := ParseWGSettings("")
+	if err != nil || s != (WGSettings{}) {
+		t.Fatalf("empty spec: got %+v, %v", s, err)
+	}
+
+	s, err = ParseWGSettings("  iface=wg-arc port=51821 subnet=10.8.0.0/24 server=10.8.0.1 desktop=10.8.0.10 mobile=10.8.0.11 subnet6=fd00:8::/64 mode=userspace relay=ws:8443 rendezvous=home.example.net:51821 ")
+	if err != nil {
+		t.Fatalf("ParseWGSettings: %v", err)
+	}
+	want := WGSettings{Interface: "wg-arc", Port: 51821, Subnet: "10.8.0.0/24", ServerIP: "10.8.0.1", DesktopIP: "10.8.0.10", MobileIP: "10.8.0.11", Subnet6: "fd00:8::/64", Mode: "userspace", Relay: "ws:8443", Rendezvous: "home.example.net:51821"}
+	if s != want {
+		t.Fatalf("got %+v want %+v", s, want)
+	}
+
+	for _, bad := range []string{"wg0", "port=", "port=udp", "mtu=1420", "iface=a iface=b"} {
+		if _, err := ParseWGSettings(bad); err == nil {
+			t.Fatalf("expected %q to be rejected", bad)
+		}
+	}
+}
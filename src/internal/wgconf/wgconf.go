@@ -0,0 +1,372 @@
+package wgconf
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// Config is a wg-quick configuration file.
+type Config struct {
+	Interface Interface
+	Peers     []Peer
+}
+
+// Interface is the [Interface] section. Lists hold one entry per address, server or hook,
+// whether the file repeats the key or separates the values with commas.
+type Interface struct {
+	// Comments are the comment lines of the section without their "#", written above its
+	// header. A comment belongs to the section whose header or keys follow it.
+	Comments []string
+
+	PrivateKey string
+	Address    []string
+	ListenPort int
+	DNS        []string
+	MTU        int
+	Table      string
+	FwMark     string
+	PreUp      []string
+	PostUp     []string
+	PreDown    []string
+	PostDown   []string
+	SaveConfig bool
+
+	// Extra keeps keys this package does not model, in file order.
+	Extra []Option
+}
+
+// Peer is one [Peer] section.
+type Peer struct {
+	Comments []string
+
+	PublicKey           string
+	PresharedKey        string
+	Endpoint            string
+	AllowedIPs          []string
+	PersistentKeepalive int
+
+	Extra []Option
+}
+
+// Option is a key = value line kept verbatim.
+type Option struct {
+	Key   string
+	Value string
+}
+
+// Parse reads a wg-quick config, or the output of `wg showconf`. Keys are matched
+// case-insensitively; the values are not validated, see Validate.
+func Parse(raw string) (*Config, error) {
+	c := &Config{}
+	var section *[]string // comments of the current section
+	var pending []string  // comments since the last key, kept with the next section header
+	inPeer := false
+	for i, ln := range strings.Split(raw, "\n") {
+		ln = strings.TrimSpace(ln)
+		switch {
+		case ln == "":
+			continue
+		case strings.HasPrefix(ln, "#"), strings.HasPrefix(ln, ";"):
+			pending = append(pending, strings.TrimSpace(ln[1:]))
+			continue
+		case strings.HasPrefix(ln, "[") && strings.HasSuffix(ln, "]"):
+			name := strings.TrimSpace(ln[1 : len(ln)-1])
+			switch {
+			case strings.EqualFold(name, "Interface"):
+				if section != nil {
+					return nil, fmt.Errorf("line %d: [Interface] must be the first and only interface section", i+1)
+				}
+				section = &c.Interface.Comments
+			case strings.EqualFold(name, "Peer"):
+				if section == nil {
+					return nil, fmt.Errorf("line %d: [Peer] before [Interface]", i+1)
+				}
+				c.Peers = append(c.Peers, Peer{})
+				section = &c.Peers[len(c.Peers)-1].Comments
+				inPeer = true
+			default:
+				return nil, fmt.Errorf("line %d: unknown section [%s]", i+1, name)
+			}
+			*section, pending = pending, nil
+			continue
+		}
+
+		if section == nil {
+			return nil, fmt.Errorf("line %d: %q outside a section", i+1, ln)
+		}
+		*section, pending = append(*section, pending...), nil
+		key, value, ok := strings.Cut(ln, "=")
+		if !ok {
+			return nil, fmt.Errorf("line %d: want key = value, got %q", i+1, ln)
+		}
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		var err error
+		if inPeer {
+			err = c.Peers[len(c.Peers)-1].set(key, value)
+		} else {
+			err = c.Interface.set(key, value)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", i+1, err)
+		}
+	}
+	if section == nil {
+		return nil, fmt.Errorf("missing [Interface] section")
+	}
+	*section = append(*section, pending...)
+	return c, nil
+}
+
+func (in *Interface) set(key, value string) error {
+	var err error
+	switch strings.ToLower(key) {
+	case "privatekey":
+		in.PrivateKey = value
+	case "address":
+		in.Address = append(in.Address, splitList(value)...)
+	case "listenport":
+		in.ListenPort, err = parseInt(key, value)
+	case "dns":
+		in.DNS = append(in.DNS, splitList(value)...)
+	case "mtu":
+		in.MTU, err = parseInt(key, value)
+	case "table":
+		in.Table = value
+	case "fwmark":
+		in.FwMark = value
+	case "preup":
+		in.PreUp = append(in.PreUp, value)
+	case "postup":
+		in.PostUp = append(in.PostUp, value)
+	case "predown":
+		in.PreDown = append(in.PreDown, value)
+	case "postdown":
+		in.PostDown = append(in.PostDown, value)
+	case "saveconfig":
+		in.SaveConfig, err = strconv.ParseBool(value)
+		if err != nil {
+			err = fmt.Errorf("invalid SaveConfig %q", value)
+		}
+	default:
+		in.Extra = append(in.Extra, Option{Key: key, Value: value})
+	}
+	return err
+}
+
+func (p *Peer) set(key, value string) error {
+	var err error
+	switch strings.ToLower(key) {
+	case "publickey":
+		p.PublicKey = value
+	case "presharedkey":
+		p.PresharedKey = value
+	case "endpoint":
+		p.Endpoint = value
+	case "allowedips":
+		p.AllowedIPs = append(p.AllowedIPs, splitList(value)...)
+	case "persistentkeepalive":
+		if strings.EqualFold(value, "off") {
+			p.PersistentKeepalive = 0
+			break
+		}
+		p.PersistentKeepalive, err = parseInt(key, value)
+	default:
+		p.Extra = append(p.Extra, Option{Key: key, Value: value})
+	}
+	return err
+}
+
+func splitList(value string) []string {
+	var out []string
+	for _, part := range strings.Split(value, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			out = append(out, part)
+		}
+	}
+	return out
+}
+
+func parseInt(key, value string) (int, error) {
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q", key, value)
+	}
+	return n, nil
+}
+
+// String serializes c: each section's comments, its header and its keys in a fixed order,
+// with a blank line between sections. Parsing the result gives c back.
+func (c *Config) String() string {
+	var sb strings.Builder
+	in := c.Interface
+	writeComments(&sb, in.Comments)
+	sb.WriteString("[Interface]\n")
+	writeList(&sb, "Address", in.Address)
+	writeInt(&sb, "ListenPort", in.ListenPort)
+	writeValue(&sb, "PrivateKey", in.PrivateKey)
+	writeList(&sb, "DNS", in.DNS)
+	writeInt(&sb, "MTU", in.MTU)
+	writeValue(&sb, "Table", in.Table)
+	writeValue(&sb, "FwMark", in.FwMark)
+	writeEach(&sb, "PreUp", in.PreUp)
+	writeEach(&sb, "PostUp", in.PostUp)
+	writeEach(&sb, "PreDown", in.PreDown)
+	writeEach(&sb, "PostDown", in.PostDown)
+	if in.SaveConfig {
+		writeValue(&sb, "SaveConfig", "true")
+	}
+	writeExtra(&sb, in.Extra)
+
+	for _, p := range c.Peers {
+		sb.WriteString("\n")
+		writeComments(&sb, p.Comments)
+		sb.WriteString("[Peer]\n")
+		writeValue(&sb, "PublicKey", p.PublicKey)
+		writeValue(&sb, "PresharedKey", p.PresharedKey)
+		writeValue(&sb, "Endpoint", p.Endpoint)
+		writeList(&sb, "AllowedIPs", p.AllowedIPs)
+		writeInt(&sb, "PersistentKeepalive", p.PersistentKeepalive)
+		writeExtra(&sb, p.Extra)
+	}
+	return sb.String()
+}
+
+func writeComments(sb *strings.Builder, comments []string) {
+	for _, c := range comments {
+		if c == "" {
+			sb.WriteString("#\n")
+			continue
+		}
+		sb.WriteString("# " + c + "\n")
+	}
+}
+
+func writeValue(sb *strings.Builder, key, value string) {
+	if value != "" {
+		sb.WriteString(key + " = " + value + "\n")
+	}
+}
+
+func writeInt(sb *strings.Builder, key string, value int) {
+	if value != 0 {
+		writeValue(sb, key, strconv.Itoa(value))
+	}
+}
+
+func writeList(sb *strings.Builder, key string, values []string) {
+	writeValue(sb, key, strings.Join(values, ", "))
+}
+
+func writeEach(sb *strings.Builder, key string, values []string) {
+	for _, v := range values {
+		writeValue(sb, key, v)
+	}
+}
+
+func writeExtra(sb *strings.Builder, extra []Option) {
+	for _, o := range extra {
+		sb.WriteString(o.Key + " = " + o.Value + "\n")
+	}
+}
+
+// Validate reports the first value wg-quick would reject: malformed keys, addresses, ports
+// and endpoints, a peer without a public key, or two peers with the same key.
+func (c *Config) Validate() error {
+	in := c.Interface
+	if err := validKey("PrivateKey", in.PrivateKey); err != nil {
+		return fmt.Errorf("[Interface] %w", err)
+	}
+	for _, a := range in.Address {
+		if _, err := parsePrefix(a); err != nil {
+			return fmt.Errorf("[Interface] invalid Address %q", a)
+		}
+	}
+	if in.ListenPort < 0 || in.ListenPort > 65535 {
+		return fmt.Errorf("[Interface] invalid ListenPort %d", in.ListenPort)
+	}
+	if in.MTU != 0 && (in.MTU < 576 || in.MTU > 65535) {
+		return fmt.Errorf("[Interface] invalid MTU %d", in.MTU)
+	}
+
+	seen := map[string]int{}
+	for i, p := range c.Peers {
+		where := fmt.Sprintf("[Peer] %d", i+1)
+		if err := validKey("PublicKey", p.PublicKey); err != nil {
+			return fmt.Errorf("%s: %w", where, err)
+		}
+		if j, ok := seen[p.PublicKey]; ok {
+			return fmt.Errorf("%s: same PublicKey as [Peer] %d", where, j)
+		}
+		seen[p.PublicKey] = i + 1
+		if p.PresharedKey != "" {
+			if err := validKey("PresharedKey", p.PresharedKey); err != nil {
+				return fmt.Errorf("%s: %w", where, err)
+			}
+		}
+		for _, a := range p.AllowedIPs {
+			if _, err := parsePrefix(a); err != nil {
+				return fmt.Errorf("%s: invalid AllowedIPs entry %q", where, a)
+			}
+		}
+		if p.Endpoint != "" {
+			host, port, err := net.SplitHostPort(p.Endpoint)
+			if n, perr := strconv.Atoi(port); err != nil || host == "" || perr != nil || n < 1 || n > 65535 {
+				return fmt.Errorf("%s: invalid Endpoint %q (want host:port)", where, p.Endpoint)
+			}
+		}
+		if p.PersistentKeepalive < 0 || p.PersistentKeepalive > 65535 {
+			return fmt.Errorf("%s: invalid PersistentKeepalive %d", where, p.PersistentKeepalive)
+		}
+	}
+	return nil
+}
+
+func validKey(name, value string) error {
+	if value == "" {
+		return fmt.Errorf("missing %s", name)
+	}
+	raw, err := base64.StdEncoding.DecodeString(value)
+	if err != nil || len(raw) != 32 {
+		return fmt.Errorf("invalid %s (want 32 bytes of base64)", name)
+	}
+	return nil
+}
+
+// parsePrefix accepts a CIDR or a bare address, which wg-quick treats as a host route.
+func parsePrefix(s string) (netip.Prefix, error) {
+	if !strings.Contains(s, "/") {
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+	return netip.ParsePrefix(s)
+}
+
+// PeerRouting returns the index of the first peer whose AllowedIPs contain cidr exactly,
+// or -1.
+func (c *Config) PeerRouting(cidr string) int {
+	for i, p := range c.Peers {
+		for _, a := range p.AllowedIPs {
+			if a == cidr {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// PeerByPublicKey returns the index of the peer with the public key, or -1.
+func (c *Config) PeerByPublicKey(pub string) int {
+	for i, p := range c.Peers {
+		if p.PublicKey == pub {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,123 @@
+package wgconf
+
+import (
+	"strings"
+	"testing"
+)
+
+const (
+	testKeyA = "yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk="
+	testKeyB = "xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg="
+	testKeyC = "TrMvSoP4jYQlY6RIzBgbssQqY3vxI2Pi+y71lOWWXX0="
+)
+
+func TestParseAndString_RoundTrip(t *testing.T) {
+	raw := strings.Join([]string{
+		"# managed by arc",
+		"[Interface]",
+		"Address = 10.0.0.1/32, fd00::1/128",
+		"ListenPort = 51820",
+		"PrivateKey = " + testKeyA,
+		"DNS = 1.1.1.1, example.internal",
+		"MTU = 1380",
+		"Table = off",
+		"PostUp = nft add table inet arc",
+		"PostUp = sysctl -w net.ipv4.ip_forward=1",
+		"SaveConfig = true",
+		"FooBar = kept",
+		"",
+		"# laptop",
+		"[Peer]",
+		"PublicKey = " + testKeyB,
+		"PresharedKey = " + testKeyC,
+		"Endpoint = example.com:51820",
+		"AllowedIPs = 10.0.0.2/32, 10.0.1.0/24",
+		"PersistentKeepalive = 25",
+		"",
+	}, "\n")
+
+	c, err := Parse(raw)
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	if got := c.String(); got != raw {
+		t.Fatalf("round trip changed the config:\n%s\nwant:\n%s", got, raw)
+	}
+	in := c.Interface
+	if len(in.Address) != 2 || in.ListenPort != 51820 || in.MTU != 1380 || in.Table != "off" || !in.SaveConfig {
+		t.Fatalf("unexpected interface: %#v", in)
+	}
+	if len(in.PostUp) != 2 || len(in.DNS) != 2 || len(in.Extra) != 1 || in.Extra[0].Key != "FooBar" {
+		t.Fatalf("unexpected lists: %#v", in)
+	}
+	if len(c.Peers) != 1 || c.Peers[0].Comments[0] != "laptop" || c.Peers[0].PersistentKeepalive != 25 {
+		t.Fatalf("unexpected peers: %#v", c.Peers)
+	}
+	if err := c.Validate(); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+}
+
+func TestParse_NormalizesKeysAndRepeatedLists(t *testing.T) {
+	c, err := Parse("[interface]\nprivatekey=" + testKeyA + "\naddress = 10.0.0.2/32\naddress = 10.0.0.5/32\n[peer]\npublickey = " + testKeyB + "\nallowedips = 10.0.0.1/32\nallowedips = 10.0.0.3/32\n")
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	want := "[Interface]\nAddress = 10.0.0.2/32, 10.0.0.5/32\nPrivateKey = " + testKeyA + "\n\n[Peer]\nPublicKey = " + testKeyB + "\nAllowedIPs = 10.0.0.1/32, 10.0.0.3/32\n"
+	if got := c.String(); got != want {
+		t.Fatalf("String() =\n%s\nwant:\n%s", got, want)
+	}
+	if c.PeerRouting("10.0.0.3/32") != 0 || c.PeerRouting("10.0.0.9/32") != -1 || c.PeerByPublicKey(testKeyB) != 0 {
+		t.Fatalf("peer lookup failed: %#v", c.Peers)
+	}
+}
+
+func TestParse_RejectsMalformedFiles(t *testing.T) {
+	for _, raw := range []string{
+		"",
+		"[Peer]\nPublicKey = x\n",
+		"[Interface]\n[Interface]\n",
+		"[Interface]\nPrivateKey\n",
+		"[Interface]\nListenPort = many\n",
+		"[Wat]\n",
+		"PrivateKey = x\n[Interface]\n",
+	} {
+		if _, err := Parse(raw); err == nil {
+			t.Fatalf("expected %q to be rejected", raw)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	valid := func() *Config {
+		return &Config{
+			Interface: Interface{PrivateKey: testKeyA, Address: []string{"10.0.0.1/32"}, ListenPort: 51820},
+			Peers: []Peer{
+				{PublicKey: testKeyB, AllowedIPs: []string{"10.0.0.2/32"}},
+				{PublicKey: testKeyC, AllowedIPs: []string{"10.0.0.3"}, Endpoint: "[2001:db8::1]:51820"},
+			},
+		}
+	}
+	if err := valid().Validate(); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+
+	for name, mutate := range map[string]func(*Config){
+		"private key":   func(c *Config) { c.Interface.PrivateKey = "short" },
+		"address":       func(c *Config) { c.Interface.Address = []string{"10.0.0.300/32"} },
+		"listen port":   func(c *Config) { c.Interface.ListenPort = 70000 },
+		"mtu":           func(c *Config) { c.Interface.MTU = 100 },
+		"public key":    func(c *Config) { c.Peers[0].PublicKey = "" },
+		"duplicate key": func(c *Config) { c.Peers[1].PublicKey = testKeyB },
+		"preshared key": func(c *Config) { c.Peers[0].PresharedKey = "nope" },
+		"allowed ips":   func(c *Config) { c.Peers[0].AllowedIPs = []string{"everything"} },
+		"endpoint":      func(c *Config) { c.Peers[0].Endpoint = "example.com" },
+		"keepalive":     func(c *Config) { c.Peers[0].PersistentKeepalive = -1 },
+	} {
+		c := valid()
+		mutate(c)
+		if err := c.Validate(); err == nil {
+			t.Fatalf("%s: expected Validate to fail", name)
+		}
+	}
+}
@@ -1,5 +1,14 @@
 package workflow
 
+import "time"
+
+const (
+	// DefaultStepTimeout bounds a setup step that declares no timeout of its own.
+	DefaultStepTimeout = 10 * time.Minute
+	// PackageStepTimeout covers steps that install packages or build kernel modules.
+	PackageStepTimeout = 30 * time.Minute
+)
+
 const (
 	StepDetectPrivilegedMode       StepID = "server.detect_privileged_mode"
 	StepCreateArcUser              StepID = "server.create_arc_user"
@@ -13,6 +22,7 @@ const (
 	StepOpenServerFirewall         StepID = "server.open_ufw_wireguard"
 	StepEnableServerWG             StepID = "server.enable_wg"
 	StepApplyServerNFTables        StepID = "server.apply_nftables_redirect"
+	StepInstallServerRelay         StepID = "server.install_wireguard_relay"
 	StepAddLocalHostsAliases       StepID = "local.add_hosts_aliases"
 	StepEnsureArcSSHAccess         StepID = "verify.ensure_arc_ssh_access"
 	StepInstallLocalArcPrompt      StepID = "local.install_arc_prompt"
@@ -20,6 +30,8 @@ const (
 	StepInstallLocalWireGuard      StepID = "local.install_wireguard"
 	StepWriteLocalWGConf           StepID = "local.write_wg_conf"
 	StepEnableLocalWG              StepID = "local.enable_wg"
+	StepInstallLocalRelay          StepID = "local.install_wireguard_relay"
+	StepInstallLocalEndpointWatch  StepID = "local.install_wireguard_endpoint_watch"
 	StepVerifyArcSSHLogin          StepID = "verify.verify_arc_ssh_login"
 	StepVerifyTunnelConnectivity   StepID = "verify.verify_tunnel_connectivity"
 	StepResolveArcUIDGID           StepID = "server.resolve_arc_uid_gid"
@@ -35,50 +47,107 @@ const (
 	StepConfigureImageClipboard    StepID = "local.configure_image_clipboard_sync"
 )
 
+// SetupStepDefinitions lists every setup step with its dependencies. Declaration order is
+// only a tie-breaker; the run order comes from OrderStepDefinitions.
 func SetupStepDefinitions() []StepDef {
 	return []StepDef{
-		{ID: StepDetectPrivilegedMode, Label: "Server: detect privileged mode"},
-		{ID: StepCreateArcUser, Label: "Server: create arc user"},
-		{ID: StepAddArcToSudoers, Label: "Server: add arc to sudoers"},
-		{ID: StepCreateArcHushlogin, Label: "Server: create ~/.hushlogin for arc"},
-		{ID: StepAddLocalHostsAliases, Label: "Local: add hosts aliases"},
-		{ID: StepEnsureArcSSHAccess, Label: "Verify: ensure arc SSH access"},
-		{ID: StepVerifyArcSSHLogin, Label: "Verify: verify arc SSH login"},
-		{ID: StepConfigureServerZsh, Label: "Server: install and configure zsh"},
-		{ID: StepInstallServerWireGuard, Label: "Server: install WireGuard"},
-		{ID: StepWriteServerWGConf, Label: "Server: write wg0.conf"},
-		{ID: StepOpenServerFirewall, Label: "Server: open firewall (ufw)"},
-		{ID: StepEnableServerWG, Label: "Server: enable wg0"},
-		{ID: StepApplyServerNFTables, Label: "Server: apply nftables redirect service"},
-		{ID: StepInstallServerArcZshPrompt, Label: "Server: install ARC zsh prompt"},
-		{ID: StepInstallServerArcTmux, Label: "Server: install ARC tmux config"},
-		{ID: StepInstallLocalArcPrompt, Label: "Local: install ARC local prompt"},
-		{ID: StepConfigureLocalZsh, Label: "Local: install and configure zsh"},
-		{ID: StepInstallLocalWireGuard, Label: "Local: install WireGuard"},
-		{ID: StepWriteLocalWGConf, Label: "Local: write wg0.conf"},
-		{ID: StepEnableLocalWG, Label: "Local: enable wg0"},
-		{ID: StepVerifyTunnelConnectivity, Label: "Verify: verify tunnel connectivity"},
-		{ID: StepResolveArcUIDGID, Label: "Server: resolve arc UID/GID for NFS squash"},
-		{ID: StepInstallRemoteNFS, Label: "Server: install NFS server"},
-		{ID: StepExportRemoteArcNFS, Label: "Server: export /home/arc over NFS (WireGuard only)"},
-		{ID: StepInstallLocalNFSClient, Label: "Local: install NFS client"},
-		{ID: StepConfigureLocalArcAutomount, Label: "Local: configure /home/arc automount"},
-		{ID: StepVerifyLocalArcNFSMount, Label: "Verify: verify /home/arc NFS mount"},
-		{ID: StepConfigureRemoteWaypipe, Label: "Server: configure waypipe runtime"},
-		{ID: StepConfigureLocalWaypipe, Label: "Local: configure persistent waypipe tunnel"},
-		{ID: StepConfigureClipboardComp, Label: "Server: configure clipboard compositor"},
-		{ID: StepHardenServerSSH, Label: "Server: harden SSH access"},
-		{ID: StepConfigureImageClipboard, Label: "Local: configure image clipboard sync"},
+		{ID: StepDetectPrivilegedMode, Label: "Server: detect privileged mode", Scope: ScopeRemote},
+		{ID: StepCreateArcUser, Label: "Server: create arc user", Scope: ScopeRemote,
+			Requires: []StepID{StepDetectPrivilegedMode}},
+		{ID: StepAddArcToSudoers, Label: "Server: add arc to sudoers", Scope: ScopeRemote,
+			Requires: []StepID{StepCreateArcUser}},
+		{ID: StepCreateArcHushlogin, Label: "Server: create ~/.hushlogin for arc", Scope: ScopeRemote,
+			Requires: []StepID{StepCreateArcUser}},
+		{ID: StepAddLocalHostsAliases, Label: "Local: add hosts aliases", Scope: ScopeLocal},
+		// Bootstrap key auth for arc must be in place before any remote step that dials as arc.
+		{ID: StepEnsureArcSSHAccess, Label: "Verify: ensure arc SSH access", Scope: ScopeVerify,
+			Requires: []StepID{StepCreateArcUser}},
+		{ID: StepVerifyArcSSHLogin, Label: "Verify: verify arc SSH login", Scope: ScopeVerify,
+			Requires: []StepID{StepEnsureArcSSHAccess}},
+		{ID: StepConfigureServerZsh, Label: "Server: install and configure zsh", Scope: ScopeRemote,
+			Requires: []StepID{StepEnsureArcSSHAccess, StepAddArcToSudoers}, Timeout: PackageStepTimeout},
+		{ID: StepInstallServerWireGuard, Label: "Server: install WireGuard", Scope: ScopeRemote,
+			Requires: []StepID{StepEnsureArcSSHAccess, StepAddArcToSudoers}, Timeout: PackageStepTimeout},
+		{ID: StepWriteServerWGConf, Label: "Server: write wg0.conf", Scope: ScopeRemote,
+			Requires: []StepID{StepInstallServerWireGuard}},
+		{ID: StepOpenServerFirewall, Label: "Server: open firewall (ufw)", Scope: ScopeRemote,
+			Requires: []StepID{StepEnsureArcSSHAccess, StepAddArcToSudoers}},
+		{ID: StepEnableServerWG, Label: "Server: enable wg0", Scope: ScopeRemote,
+			Requires: []StepID{StepWriteServerWGConf, StepOpenServerFirewall}},
+		{ID: StepApplyServerNFTables, Label: "Server: apply nftables redirect service", Scope: ScopeRemote,
+			Requires: []StepID{StepEnableServerWG}},
+		{ID: StepInstallServerRelay, Label: "Server: install WireGuard TCP relay", Scope: ScopeRemote,
+			Requires: []StepID{StepEnableServerWG, StepOpenServerFirewall}},
+		{ID: StepInstallServerArcZshPrompt, Label: "Server: install ARC zsh prompt", Scope: ScopeRemote,
+			Requires: []StepID{StepEnsureArcSSHAccess, StepConfigureServerZsh}},
+		{ID: StepInstallServerArcTmux, Label: "Server: install ARC tmux config", Scope: ScopeRemote,
+			Requires: []StepID{StepEnsureArcSSHAccess}},
+		{ID: StepInstallLocalArcPrompt, Label: "Local: install ARC local prompt", Scope: ScopeLocal},
+		{ID: StepConfigureLocalZsh, Label: "Local: install and configure zsh", Scope: ScopeLocal,
+			Timeout: PackageStepTimeout},
+		{ID: StepInstallLocalWireGuard, Label: "Local: install WireGuard", Scope: ScopeLocal,
+			Timeout: PackageStepTimeout},
+		{ID: StepWriteLocalWGConf, Label: "Local: write wg0.conf", Scope: ScopeLocal,
+			Requires: []StepID{StepInstallLocalWireGuard}},
+		{ID: StepEnableLocalWG, Label: "Local: enable wg0", Scope: ScopeLocal,
+			Requires: []StepID{StepWriteLocalWGConf, StepEnableServerWG}},
+		{ID: StepInstallLocalRelay, Label: "Local: install WireGuard TCP relay", Scope: ScopeLocal,
+			Requires: []StepID{StepEnableLocalWG, StepInstallServerRelay}},
+		{ID: StepInstallLocalEndpointWatch, Label: "Local: watch the server's WireGuard endpoint", Scope: ScopeLocal,
+			Requires: []StepID{StepEnableLocalWG}},
+		{ID: StepVerifyTunnelConnectivity, Label: "Verify: verify tunnel connectivity", Scope: ScopeVerify,
+			Requires: []StepID{StepEnableLocalWG, StepInstallLocalRelay, StepApplyServerNFTables, StepAddLocalHostsAliases, StepVerifyArcSSHLogin}},
+		{ID: StepResolveArcUIDGID, Label: "Server: resolve arc UID/GID for NFS squash", Scope: ScopeRemote,
+			Requires: []StepID{StepVerifyTunnelConnectivity}},
+		{ID: StepInstallRemoteNFS, Label: "Server: install NFS server", Scope: ScopeRemote,
+			Requires: []StepID{StepEnsureArcSSHAccess, StepAddArcToSudoers}, Timeout: PackageStepTimeout},
+		{ID: StepExportRemoteArcNFS, Label: "Server: export /home/arc over NFS (WireGuard only)", Scope: ScopeRemote,
+			Requires: []StepID{StepResolveArcUIDGID, StepInstallRemoteNFS, StepEnableServerWG}},
+		{ID: StepInstallLocalNFSClient, Label: "Local: install NFS client", Scope: ScopeLocal,
+			Timeout: PackageStepTimeout},
+		{ID: StepConfigureLocalArcAutomount, Label: "Local: configure /home/arc automount", Scope: ScopeLocal,
+			Requires: []StepID{StepInstallLocalNFSClient, StepExportRemoteArcNFS}},
+		{ID: StepVerifyLocalArcNFSMount, Label: "Verify: verify /home/arc NFS mount", Scope: ScopeVerify,
+			Requires: []StepID{StepConfigureLocalArcAutomount}},
+		{ID: StepConfigureRemoteWaypipe, Label: "Server: configure waypipe runtime", Scope: ScopeRemote,
+			Requires: []StepID{StepVerifyLocalArcNFSMount}, Timeout: PackageStepTimeout},
+		{ID: StepConfigureLocalWaypipe, Label: "Local: configure persistent waypipe tunnel", Scope: ScopeLocal,
+			Requires: []StepID{StepConfigureRemoteWaypipe, StepConfigureLocalZsh}},
+		{ID: StepConfigureClipboardComp, Label: "Server: configure clipboard compositor", Scope: ScopeRemote,
+			Requires: []StepID{StepConfigureLocalWaypipe}, Timeout: PackageStepTimeout},
+		// Hardening locks public SSH down to the tunnel, so every other server step goes first.
+		{ID: StepHardenServerSSH, Label: "Server: harden SSH access", Scope: ScopeRemote,
+			Requires: []StepID{
+				StepCreateArcHushlogin,
+				StepInstallServerArcZshPrompt,
+				StepInstallServerArcTmux,
+				StepConfigureClipboardComp,
+				StepInstallServerRelay,
+			}},
+		{ID: StepConfigureImageClipboard, Label: "Local: configure image clipboard sync", Scope: ScopeLocal,
+			Requires: []StepID{StepHardenServerSSH}, Timeout: PackageStepTimeout},
 	}
 }
 
+// DefaultSetupSteps returns the setup steps in dependency order. Invalid definitions fall
+// back to declaration order; ValidateStepDefinitions reports the problem.
 func DefaultSetupSteps() []Step {
 	defs := SetupStepDefinitions()
+	if ordered, err := OrderStepDefinitions(defs); err == nil {
+		defs = ordered
+	}
 	steps := make([]Step, 0, len(defs))
 	for _, def := range defs {
+		timeout := def.Timeout
+		if timeout == 0 {
+			timeout = DefaultStepTimeout
+		}
 		steps = append(steps, Step{
-			ID:    def.ID,
-			Label: def.Label,
+			ID:       def.ID,
+			Label:    def.Label,
+			Scope:    def.Scope,
+			Requires: def.Requires,
+			Timeout:  timeout,
 		})
 	}
 	return steps
@@ -4,8 +4,8 @@ import "testing"
 
 func TestDefaultSetupSteps_OrderAndCount(t *testing.T) {
 	steps := DefaultSetupSteps()
-	if len(steps) != 32 {
-		t.Fatalf("expected 32 setup steps, got %d", len(steps))
+	if len(steps) != 35 {
+		t.Fatalf("expected 35 setup steps, got %d", len(steps))
 	}
 	if steps[0].ID != StepDetectPrivilegedMode {
 		t.Fatalf("unexpected first step ID: %q", steps[0].ID)
@@ -39,6 +39,9 @@ func TestDefaultSetupSteps_OrderAndCount(t *testing.T) {
 	// Keep core workflow ordering guarantees.
 	assertBefore(StepEnableServerWG, StepEnableLocalWG)
 	assertBefore(StepEnableLocalWG, StepVerifyTunnelConnectivity)
+	assertBefore(StepInstallServerRelay, StepInstallLocalRelay)
+	assertBefore(StepInstallLocalRelay, StepVerifyTunnelConnectivity)
+	assertBefore(StepEnableLocalWG, StepInstallLocalEndpointWatch)
 	assertBefore(StepVerifyTunnelConnectivity, StepResolveArcUIDGID)
 	assertBefore(StepVerifyLocalArcNFSMount, StepConfigureRemoteWaypipe)
 	assertBefore(StepConfigureRemoteWaypipe, StepConfigureLocalWaypipe)
@@ -59,8 +62,8 @@ func TestSetupStepDefinitions_ValidAndUnique(t *testing.T) {
 		}
 		seen[def.ID] = struct{}{}
 	}
-	if len(seen) != 32 {
-		t.Fatalf("expected 32 unique step IDs, got %d", len(seen))
+	if len(seen) != 35 {
+		t.Fatalf("expected 35 unique step IDs, got %d", len(seen))
 	}
 }
 
@@ -79,3 +82,132 @@ func TestDefaultSetupSteps_MatchesDefinitions(t *testing.T) {
 		}
 	}
 }
+
+func TestDefaultSetupSteps_RespectsRequires(t *testing.T) {
+	steps := DefaultSetupSteps()
+	idx := map[StepID]int{}
+	for i, s := range steps {
+		idx[s.ID] = i
+	}
+	for _, s := range steps {
+		for _, dep := range s.Requires {
+			if idx[dep] >= idx[s.ID] {
+				t.Fatalf("step %q runs before its requirement %q", s.ID, dep)
+			}
+		}
+	}
+}
+
+func TestHardenServerSSH_RequiresEveryServerStep(t *testing.T) {
+	defs := SetupStepDefinitions()
+	byID := map[StepID]StepDef{}
+	for _, def := range defs {
+		byID[def.ID] = def
+	}
+	reach := map[StepID]bool{}
+	var walk func(StepID)
+	walk = func(id StepID) {
+		for _, dep := range byID[id].Requires {
+			if !reach[dep] {
+				reach[dep] = true
+				walk(dep)
+			}
+		}
+	}
+	walk(StepHardenServerSSH)
+
+	for _, def := range defs {
+		if def.ID == StepHardenServerSSH || def.Scope == ScopeLocal {
+			continue
+		}
+		if !reach[def.ID] {
+			t.Fatalf("%q must be a (transitive) requirement of %q", def.ID, StepHardenServerSSH)
+		}
+	}
+}
+
+func TestValidateStepDefinitions_RejectsBadDependencies(t *testing.T) {
+	cases := map[string][]StepDef{
+		"unknown": {
+			{ID: "a", Label: "A", Scope: ScopeLocal, Requires: []StepID{"missing"}},
+		},
+		"self": {
+			{ID: "a", Label: "A", Scope: ScopeLocal, Requires: []StepID{"a"}},
+		},
+		"cycle": {
+			{ID: "a", Label: "A", Scope: ScopeLocal, Requires: []StepID{"c"}},
+			{ID: "b", Label: "B", Scope: ScopeRemote, Requires: []StepID{"a"}},
+			{ID: "c", Label: "C", Scope: ScopeVerify, Requires: []StepID{"b"}},
+		},
+		"scope": {
+			{ID: "a", Label: "A"},
+		},
+	}
+	for name, defs := range cases {
+		if err := ValidateStepDefinitions(defs); err == nil {
+			t.Fatalf("%s: expected validation error", name)
+		}
+	}
+}
+
+func TestOrderStepDefinitions_StableTopologicalOrder(t *testing.T) {
+	defs := []StepDef{
+		{ID: "late", Label: "Late", Scope: ScopeLocal, Requires: []StepID{"base"}},
+		{ID: "base", Label: "Base", Scope: ScopeRemote},
+		{ID: "free", Label: "Free", Scope: ScopeLocal},
+	}
+	ordered, err := OrderStepDefinitions(defs)
+	if err != nil {
+		t.Fatalf("OrderStepDefinitions: %v", err)
+	}
+	var got []StepID
+	for _, def := range ordered {
+		got = append(got, def.ID)
+	}
+	want := []StepID{"base", "late", "free"}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("unexpected order: got %v want %v", got, want)
+		}
+	}
+}
+
+func TestRunnableSteps_ScopesAndLimit(t *testing.T) {
+	steps := []Step{
+		{ID: "r1", Scope: ScopeRemote},
+		{ID: "v1", Scope: ScopeVerify, Requires: []StepID{"r1"}},
+		{ID: "r2", Scope: ScopeRemote},
+		{ID: "l1", Scope: ScopeLocal},
+	}
+	got := RunnableSteps(steps, 2)
+	if len(got) != 2 || got[0] != 0 || got[1] != 3 {
+		t.Fatalf("expected one remote and one local step, got %v", got)
+	}
+	if got := RunnableSteps(steps, 1); len(got) != 1 || got[0] != 0 {
+		t.Fatalf("limit 1 must run steps sequentially, got %v", got)
+	}
+
+	steps[0].State = StepDone
+	steps[3].State = StepRunning
+	if got := RunnableSteps(steps, 2); len(got) != 0 {
+		t.Fatalf("ready verify step must wait for running steps and block new ones, got %v", got)
+	}
+	steps[3].State = StepDone
+	if got := RunnableSteps(steps, 2); len(got) != 1 || got[0] != 1 {
+		t.Fatalf("expected verify step to run alone, got %v", got)
+	}
+}
+
+func TestDefaultSetupSteps_AssignsTimeouts(t *testing.T) {
+	for _, step := range DefaultSetupSteps() {
+		if step.Timeout <= 0 {
+			t.Fatalf("step %q has no timeout", step.ID)
+		}
+		if step.ID == StepInstallServerWireGuard && step.Timeout != PackageStepTimeout {
+			t.Fatalf("package install step should use PackageStepTimeout, got %s", step.Timeout)
+		}
+		if step.ID == StepWriteServerWGConf && step.Timeout != DefaultStepTimeout {
+			t.Fatalf("unset timeout should default to DefaultStepTimeout, got %s", step.Timeout)
+		}
+	}
+}
@@ -1,6 +1,9 @@
 package workflow
 
-import "fmt"
+import (
+	"fmt"
+	"strings"
+)
 
 func ValidateStepDefinitions(defs []StepDef) error {
 	if len(defs) == 0 {
@@ -18,6 +21,65 @@ func ValidateStepDefinitions(defs []StepDef) error {
 			return fmt.Errorf("duplicate step id: %q", def.ID)
 		}
 		seenIDs[def.ID] = struct{}{}
+		switch def.Scope {
+		case ScopeLocal, ScopeRemote, ScopeVerify:
+		default:
+			return fmt.Errorf("step %q has invalid scope %q", def.ID, def.Scope)
+		}
+		if def.Timeout < 0 {
+			return fmt.Errorf("step %q has negative timeout %s", def.ID, def.Timeout)
+		}
+	}
+	for _, def := range defs {
+		for _, dep := range def.Requires {
+			if dep == def.ID {
+				return fmt.Errorf("step %q requires itself", def.ID)
+			}
+			if _, ok := seenIDs[dep]; !ok {
+				return fmt.Errorf("step %q requires unknown step %q", def.ID, dep)
+			}
+		}
+	}
+	_, err := OrderStepDefinitions(defs)
+	return err
+}
+
+// OrderStepDefinitions returns defs in dependency order. Among steps whose requirements are
+// met, declaration order wins, so the result is stable for a given definition list.
+func OrderStepDefinitions(defs []StepDef) ([]StepDef, error) {
+	placed := make(map[StepID]bool, len(defs))
+	used := make([]bool, len(defs))
+	out := make([]StepDef, 0, len(defs))
+	for len(out) < len(defs) {
+		progressed := false
+		for i, def := range defs {
+			if used[i] || !requirementsMet(def.Requires, placed) {
+				continue
+			}
+			used[i] = true
+			placed[def.ID] = true
+			out = append(out, def)
+			progressed = true
+			break
+		}
+		if !progressed {
+			var blocked []string
+			for i, def := range defs {
+				if !used[i] {
+					blocked = append(blocked, string(def.ID))
+				}
+			}
+			return nil, fmt.Errorf("dependency cycle or missing dependency among steps: %s", strings.Join(blocked, ", "))
+		}
+	}
+	return out, nil
+}
+
+func requirementsMet(requires []StepID, placed map[StepID]bool) bool {
+	for _, dep := range requires {
+		if !placed[dep] {
+			return false
+		}
 	}
-	return nil
+	return true
 }
@@ -0,0 +1,57 @@
+package workflow
+
+// DefaultSetupConcurrency is how many setup steps may run at once unless configured otherwise.
+const DefaultSetupConcurrency = 2
+
+// RunnableSteps returns the indices of pending steps that may start now, given the steps
+// already running. A step is runnable once all its requirements are done. At most limit
+// steps run at a time, two steps of the same scope never overlap (both sides serialize on
+// their package manager), and verify steps, or steps without a known scope, run alone.
+func RunnableSteps(steps []Step, limit int) []int {
+	if limit < 1 {
+		limit = 1
+	}
+	done := map[StepID]bool{}
+	busy := map[StepScope]bool{}
+	running := 0
+	for _, s := range steps {
+		switch s.State {
+		case StepDone:
+			done[s.ID] = true
+		case StepRunning:
+			if runsAlone(s.Scope) {
+				return nil
+			}
+			running++
+			busy[s.Scope] = true
+		}
+	}
+
+	var out []int
+	for i, s := range steps {
+		if running >= limit {
+			break
+		}
+		if s.State != StepPending || !requirementsMet(s.Requires, done) {
+			continue
+		}
+		if runsAlone(s.Scope) {
+			// Start nothing else once an exclusive step is ready so it is not starved.
+			if running == 0 {
+				out = append(out, i)
+			}
+			break
+		}
+		if busy[s.Scope] {
+			continue
+		}
+		busy[s.Scope] = true
+		running++
+		out = append(out, i)
+	}
+	return out
+}
+
+func runsAlone(scope StepScope) bool {
+	return scope != ScopeLocal && scope != ScopeRemote
+}
@@ -1,9 +1,12 @@
 package workflow
 
+import "time"
+
 type Phase int
 
 const (
 	PhaseRemote Phase = iota
+	PhasePreflight
 	PhaseLog
 )
 
@@ -14,18 +17,34 @@ const (
 	StepRunning
 	StepDone
 	StepFailed
+	StepCancelled
 )
 
 type StepID string
 
+// StepScope tells where a step runs; the scheduler uses it to decide what may overlap.
+type StepScope string
+
+const (
+	ScopeLocal  StepScope = "local"
+	ScopeRemote StepScope = "remote"
+	ScopeVerify StepScope = "verify"
+)
+
 type StepDef struct {
-	ID    StepID
-	Label string
+	ID       StepID
+	Label    string
+	Scope    StepScope
+	Requires []StepID
+	Timeout  time.Duration // zero means DefaultStepTimeout
 }
 
 type Step struct {
-	ID    StepID
-	Label string
-	State StepState
-	Err   string
+	ID       StepID
+	Label    string
+	Scope    StepScope
+	Requires []StepID
+	Timeout  time.Duration
+	State    StepState
+	Err      string
 }
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// joinApproveTimeout bounds `arc join --approve`, which only changes files on the server.
+const joinApproveTimeout = 2 * time.Minute
+
+type joinOptions struct {
+	Name    string
+	Approve string
+	Accept  string
+	Yes     bool
+	JSON    bool
+}
+
+func parseJoinOptions(args []string, stderr io.Writer) (joinOptions, error) {
+	var opts joinOptions
+	fs := flag.NewFlagSet("arc join", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.StringVar(&opts.Name, "name", "", "on the new machine: print a join request for it under this device name")
+	fs.StringVar(&opts.Approve, "approve", "", "on a machine already set up: add the device of a join request to the server")
+	fs.StringVar(&opts.Accept, "accept", "", "on the new machine: finish joining with the approval code")
+	fs.BoolVar(&opts.Yes, "yes", false, "approve without asking for confirmation")
+	fs.BoolVar(&opts.JSON, "json", false, "print --accept progress as JSON lines")
+	if err := fs.Parse(args); err != nil {
+		return opts, err
+	}
+	if fs.NArg() > 0 {
+		return opts, fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+	modes := 0
+	for _, v := range []string{opts.Name, opts.Approve, opts.Accept} {
+		if strings.TrimSpace(v) != "" {
+			modes++
+		}
+	}
+	if modes != 1 {
+		return opts, fmt.Errorf("give exactly one of --name, --approve or --accept")
+	}
+	return opts, nil
+}
+
+func runJoinCLI(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	opts, err := parseJoinOptions(args, stderr)
+	if err != nil {
+		if !errors.Is(err, flag.ErrHelp) {
+			fmt.Fprintf(stderr, "arc join: %v\n", err)
+		}
+		return 2
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	switch {
+	case opts.Name != "":
+		code, err := createJoinRequest(strings.TrimSpace(opts.Name))
+		if err != nil {
+			fmt.Fprintf(stderr, "arc join: %v\n", err)
+			return 1
+		}
+		fmt.Fprintf(stdout, "Join request for %s:\n\n%s\n\n", opts.Name, code)
+		fmt.Fprintln(stdout, "On a machine that is already set up, run:")
+		fmt.Fprintln(stdout, "  arc join --approve <code>")
+		fmt.Fprintln(stdout, "then run the `arc join --accept` command it prints on this machine.")
+		return 0
+
+	case opts.Approve != "":
+		var req joinRequest
+		if err := decodeJoinCode(joinRequestPrefix, opts.Approve, &req); err != nil {
+			fmt.Fprintf(stderr, "arc join: %v\n", err)
+			return 2
+		}
+		if err := req.validate(); err != nil {
+			fmt.Fprintf(stderr, "arc join: %v\n", err)
+			return 2
+		}
+		ctx, cancel := context.WithTimeout(ctx, joinApproveTimeout)
+		defer cancel()
+		sessions := newSSHSessionManager()
+		defer func() { _ = sessions.Close() }()
+
+		runCtx, err := latestRunContext(ctx, sessions)
+		if err != nil {
+			fmt.Fprintf(stderr, "arc join: %v\n", err)
+			return 1
+		}
+		question := fmt.Sprintf("Add device %q (SSH key %s) to %s?", req.Name, joinSSHKeyFingerprint(req.SSHKey), arcUser+"@"+runCtx.Host)
+		if !opts.Yes && !promptConfirmation(stdin, stderr, question) {
+			fmt.Fprintln(stderr, "arc join: aborted")
+			return 1
+		}
+		if err := pickServerRoute(&runCtx); err != nil {
+			fmt.Fprintf(stderr, "arc join: %v\n", err)
+			return 1
+		}
+		approval, err := approveJoinRequest(runCtx, req)
+		if err != nil {
+			fmt.Fprintf(stderr, "arc join: %v\n", err)
+			return 1
+		}
+		code, err := encodeJoinCode(joinApprovalPrefix, approval)
+		if err != nil {
+			fmt.Fprintf(stderr, "arc join: %v\n", err)
+			return 1
+		}
+		fmt.Fprintf(stdout, "Added %s at %s on %s.\n\n", approval.Name, approval.IP, runCtx.WG.Net.Interface)
+		fmt.Fprintf(stdout, "On %s, run:\n  arc join --accept %s\n", approval.Name, code)
+		return 0
+
+	default:
+		var approval joinApproval
+		if err := decodeJoinCode(joinApprovalPrefix, opts.Accept, &approval); err != nil {
+			fmt.Fprintf(stderr, "arc join: %v\n", err)
+			return 2
+		}
+		sessions := newSSHSessionManager()
+		defer func() { _ = sessions.Close() }()
+		if err := acceptJoin(ctx, sessions, approval, newSetupEventPrinter(stdout, opts.JSON)); err != nil {
+			if !opts.JSON {
+				fmt.Fprintf(stderr, "arc join: %v\n", err)
+			}
+			return 1
+		}
+		return 0
+	}
+}
+
+func joinSSHKeyFingerprint(line string) string {
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+	if err != nil {
+		return "?"
+	}
+	return ssh.FingerprintSHA256(key)
+}
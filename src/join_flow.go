@@ -0,0 +1,377 @@
+package main
+
+import (
+	"arc/internal/app"
+	"arc/internal/workflow"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Joining another device takes a round trip through a device that is already set up: public
+// SSH is locked down after setup, so only a joined device can reach the server to add a peer.
+//
+//  1. The new device creates a join request with its WireGuard and SSH public keys.
+//  2. A joined device approves it over the tunnel and hands back an approval.
+//  3. The new device accepts the approval and runs the local half of the setup workflow.
+const (
+	joinRequestPrefix  = "arc-join-request:"
+	joinApprovalPrefix = "arc-join-approval:"
+
+	// pendingJoinFile keeps the WireGuard private key of a join request until it is accepted.
+	pendingJoinFile = "join.json"
+)
+
+// joinRequest is what a new device asks to be added with. It holds no secrets.
+type joinRequest struct {
+	Name        string `json:"name"`
+	WGPublicKey string `json:"wgPublicKey"`
+	SSHKey      string `json:"sshKey"`
+}
+
+// joinApproval is what a new device needs to reach the server once its peer exists. It holds
+// the PresharedKey of the new link, so it is handed over like a password.
+type joinApproval struct {
+	Name            string         `json:"name"`
+	IP              string         `json:"ip"`
+	WGPublicKey     string         `json:"wgPublicKey"`
+	Host            string         `json:"host"`
+	Addr            string         `json:"addr"`
+	HostKey         string         `json:"hostKey"`
+	ServerPublicKey string         `json:"serverPublicKey"`
+	PresharedKey    string         `json:"presharedKey,omitempty"`
+	Endpoint        string         `json:"endpoint"`
+	Net             app.WGSettings `json:"net"`
+}
+
+type pendingJoin struct {
+	Name         string    `json:"name"`
+	WGPrivateKey string    `json:"wgPrivateKey"`
+	CreatedAt    time.Time `json:"createdAt"`
+}
+
+func encodeJoinCode(prefix string, v any) (string, error) {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return prefix + base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+func decodeJoinCode(prefix, code string, v any) error {
+	code = strings.Join(strings.Fields(code), "")
+	rest, ok := strings.CutPrefix(code, prefix)
+	if !ok {
+		return fmt.Errorf("not an %s code", strings.TrimSuffix(prefix, ":"))
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(rest)
+	if err != nil {
+		return fmt.Errorf("malformed %s code: %w", strings.TrimSuffix(prefix, ":"), err)
+	}
+	if err := json.Unmarshal(raw, v); err != nil {
+		return fmt.Errorf("malformed %s code: %w", strings.TrimSuffix(prefix, ":"), err)
+	}
+	return nil
+}
+
+func (r joinRequest) validate() error {
+	if err := validDeviceName(r.Name); err != nil {
+		return err
+	}
+	if raw, err := base64.StdEncoding.DecodeString(r.WGPublicKey); err != nil || len(raw) != 32 {
+		return fmt.Errorf("invalid WireGuard public key in join request")
+	}
+	if _, _, _, _, err := ssh.ParseAuthorizedKey([]byte(r.SSHKey)); err != nil {
+		return fmt.Errorf("invalid SSH key in join request: %w", err)
+	}
+	return nil
+}
+
+func pendingJoinPath() (string, error) {
+	dir, err := arcHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, pendingJoinFile), nil
+}
+
+func readPendingJoin() (pendingJoin, bool, error) {
+	var p pendingJoin
+	path, err := pendingJoinPath()
+	if err != nil {
+		return p, false, err
+	}
+	raw, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return p, false, nil
+	}
+	if err != nil {
+		return p, false, err
+	}
+	if err := json.Unmarshal(raw, &p); err != nil {
+		return p, false, fmt.Errorf("parse %s: %w", path, err)
+	}
+	return p, true, nil
+}
+
+// createJoinRequest returns the join request code of this machine. Asking again under the
+// same name gives the same WireGuard key, so a lost code can simply be printed again.
+func createJoinRequest(name string) (string, error) {
+	if err := validDeviceName(name); err != nil {
+		return "", err
+	}
+	pending, ok, err := readPendingJoin()
+	if err != nil {
+		return "", err
+	}
+	if !ok || pending.Name != name {
+		priv, _, err := genWGKeyPair()
+		if err != nil {
+			return "", err
+		}
+		pending = pendingJoin{Name: name, WGPrivateKey: priv, CreatedAt: time.Now().UTC()}
+		raw, err := json.MarshalIndent(pending, "", "  ")
+		if err != nil {
+			return "", err
+		}
+		path, err := pendingJoinPath()
+		if err != nil {
+			return "", err
+		}
+		if err := ensureDir0700(filepath.Dir(path)); err != nil {
+			return "", err
+		}
+		if err := atomicWriteFile(path, append(raw, '\n'), 0o600); err != nil {
+			return "", fmt.Errorf("write %s: %w", path, err)
+		}
+	}
+	pub, err := wgPublicKeyFromPrivateKeyB64(pending.WGPrivateKey)
+	if err != nil {
+		return "", err
+	}
+
+	if err := ensureLocalSSHKeyPair(); err != nil {
+		return "", err
+	}
+	sshKey, err := readPublicKeyLine(userSSHPublicKeyPath())
+	if err != nil {
+		return "", err
+	}
+	return encodeJoinCode(joinRequestPrefix, joinRequest{Name: name, WGPublicKey: pub, SSHKey: sshKey})
+}
+
+// approveJoinRequest adds the requesting device on the server of ctx and returns its approval.
+func approveJoinRequest(ctx infraRunContext, req joinRequest) (joinApproval, error) {
+	if err := req.validate(); err != nil {
+		return joinApproval{}, err
+	}
+	if ctx.WG.Net.Reverse() {
+		return joinApproval{}, fmt.Errorf("the server is behind NAT and dials only its rendezvous %s; other devices cannot join it", ctx.WG.Net.Rendezvous)
+	}
+	hostKey, err := requirePinnedHostKey(ctx.Addr)
+	if err != nil {
+		return joinApproval{}, err
+	}
+	dev, serverPub, psk, err := addServerDevice(ctx, req)
+	if err != nil {
+		return joinApproval{}, err
+	}
+	return joinApproval{
+		Name:            dev.Name,
+		IP:              dev.IP,
+		WGPublicKey:     dev.WGPublicKey,
+		Host:            ctx.Host,
+		Addr:            ctx.Addr,
+		HostKey:         strings.TrimSpace(string(ssh.MarshalAuthorizedKey(hostKey))),
+		ServerPublicKey: serverPub,
+		PresharedKey:    psk,
+		Endpoint:        ctx.WG.Endpoint,
+		Net:             toAppWG(ctx.WG).Net,
+	}, nil
+}
+
+// joinedWGConfig is the tunnel config of a joined device: the server's network with the
+// device's own address in place of the desktop's, so every local step and check follows it.
+func joinedWGConfig(a joinApproval, priv string) (wgConfig, error) {
+	pub, err := wgPublicKeyFromPrivateKeyB64(priv)
+	if err != nil {
+		return wgConfig{}, err
+	}
+	if pub != a.WGPublicKey {
+		return wgConfig{}, fmt.Errorf("approval is for another join request of %q; run `arc join --name %s` again and have it approved", a.Name, a.Name)
+	}
+	n := wgNetworkFromSettings(a.Net)
+	n.DesktopIP = a.IP
+	// The approving machine's transport says nothing about this one's.
+	n.Mode = ""
+	n, err = resolveWGNetwork(n)
+	if err != nil {
+		return wgConfig{}, err
+	}
+	if strings.TrimSpace(a.Endpoint) == "" || strings.TrimSpace(a.ServerPublicKey) == "" {
+		return wgConfig{}, fmt.Errorf("approval has no server endpoint or key")
+	}
+	clientConf := wgClientConf(n.DesktopIP, priv, a.ServerPublicKey, a.PresharedKey, a.Endpoint, n)
+	if err := clientConf.Validate(); err != nil {
+		return wgConfig{}, fmt.Errorf("approved WireGuard config is invalid: %w", err)
+	}
+	return wgConfig{
+		ClientPriv: priv,
+		ClientPub:  pub,
+		ServerPub:  a.ServerPublicKey,
+		ClientConf: clientConf.String(),
+		Endpoint:   a.Endpoint,
+		Net:        n,
+	}, nil
+}
+
+// joinSetupSteps are the steps a joining device runs: the local half of the workflow and the
+// checks that it reaches the server. Requirements on server steps are dropped; the server was
+// set up by the first device and prepared for this one when the join was approved.
+func joinSetupSteps() []workflow.Step {
+	keep := map[workflow.StepID]bool{
+		workflow.StepVerifyTunnelConnectivity: true,
+		workflow.StepVerifyLocalArcNFSMount:   true,
+	}
+	for _, def := range workflow.SetupStepDefinitions() {
+		if def.Scope == workflow.ScopeLocal {
+			keep[def.ID] = true
+		}
+	}
+	var steps []workflow.Step
+	for _, step := range workflow.DefaultSetupSteps() {
+		if !keep[step.ID] {
+			continue
+		}
+		var requires []workflow.StepID
+		for _, id := range step.Requires {
+			if keep[id] {
+				requires = append(requires, id)
+			}
+		}
+		step.Requires = requires
+		steps = append(steps, step)
+	}
+	return steps
+}
+
+// acceptJoin pins the server's host key and runs the join steps one at a time, recording them
+// as a setup run of this device. The pending request is removed once every step is done.
+func acceptJoin(ctx context.Context, sessions *sshSessionManager, a joinApproval, emit func(setupEvent)) error {
+	fail := func(err error) error {
+		emit(setupEvent{Event: setupEventError, Time: time.Now(), Error: err.Error()})
+		return err
+	}
+
+	pending, ok, err := readPendingJoin()
+	if err != nil {
+		return fail(err)
+	}
+	if !ok || pending.Name != a.Name {
+		return fail(fmt.Errorf("no join request for %q on this machine; run `arc join --name %s` first", a.Name, a.Name))
+	}
+	wg, err := joinedWGConfig(a, pending.WGPrivateKey)
+	if err != nil {
+		return fail(err)
+	}
+
+	target := arcUser + "@" + a.Addr
+	emit(setupEvent{Event: setupEventStart, Time: time.Now(), Target: target})
+	if _, err := execLocal(ctx, "sudo", "-n", "true"); err != nil {
+		return fail(fmt.Errorf("local sudo is required (run `sudo -v` first): %w", err))
+	}
+
+	hostKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(a.HostKey))
+	if err != nil {
+		return fail(fmt.Errorf("parse server host key: %w", err))
+	}
+	pinned, err := lookupPinnedHostKey(a.Addr)
+	if err != nil {
+		return fail(err)
+	}
+	if pinned != nil && !bytes.Equal(pinned.Marshal(), hostKey.Marshal()) {
+		return fail(hostKeyMismatchError(a.Addr, pinned, hostKey))
+	}
+	if err := pinHostKey(a.Addr, hostKey); err != nil {
+		return fail(err)
+	}
+	emit(setupEvent{Event: setupEventHostKey, Time: time.Now(), Target: a.Addr, Fingerprint: sshHostKeyFingerprint(hostKey)})
+
+	run, err := beginSetupRun(app.SetupRun{
+		Target: target,
+		Host:   a.Host,
+		Addr:   a.Addr,
+		WG:     toAppWG(wg),
+		Steps:  joinSetupSteps(),
+		Device: a.Name,
+	})
+	if err != nil {
+		return fail(err)
+	}
+
+	readyAs := ""
+	total := len(run.Steps)
+	for i := range run.Steps {
+		step := &run.Steps[i]
+		step.State = workflow.StepRunning
+		_ = saveSetupRun(run)
+		emit(setupEvent{Event: setupEventStepStart, Time: time.Now(), Run: run.ID, Step: string(step.ID), Label: step.Label, Index: i + 1, Total: total})
+
+		started := time.Now()
+		res, err := runJoinStep(ctx, sessions, run, *step)
+		duration := time.Since(started).Milliseconds()
+		if err != nil {
+			step.Err = err.Error()
+			step.State = workflow.StepFailed
+			event := setupEventStepFailed
+			if errors.Is(err, context.Canceled) {
+				step.State, step.Err, event = workflow.StepCancelled, "cancelled", setupEventStepCancel
+			}
+			_ = saveSetupRun(run)
+			emit(setupEvent{Event: event, Time: time.Now(), Run: run.ID, Step: string(step.ID), Label: step.Label, Index: i + 1, Total: total, DurationMS: duration, Error: step.Err})
+			return fmt.Errorf("step %d (%s) failed: %w; repeat `arc join --accept` to try again", i+1, step.Label, err)
+		}
+		if res.ReadyAs != "" {
+			readyAs = res.ReadyAs
+		}
+		step.State = workflow.StepDone
+		_ = saveSetupRun(run)
+		emit(setupEvent{Event: setupEventStepDone, Time: time.Now(), Run: run.ID, Step: string(step.ID), Label: step.Label, Index: i + 1, Total: total, DurationMS: duration})
+	}
+
+	if path, err := pendingJoinPath(); err == nil {
+		_ = os.Remove(path)
+	}
+	emit(setupEvent{Event: setupEventDone, Time: time.Now(), ReadyAs: readyAs})
+	return nil
+}
+
+// runJoinStep runs one setup step for a joining device. The server is only reachable over
+// the tunnel, so every step that talks to it goes through the tunnel.
+func runJoinStep(ctx context.Context, sessions *sshSessionManager, run app.SetupRun, step workflow.Step) (app.SetupStepResult, error) {
+	var res app.SetupStepResult
+	executor, ok := runtimeStepExecutors[step.ID]
+	if !ok {
+		return res, fmt.Errorf("unknown step ID: %q", step.ID)
+	}
+	if step.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, step.Timeout)
+		defer cancel()
+	}
+	req := app.SetupStepRequest{RunID: run.ID, Host: run.Host, Addr: run.Addr, WG: run.WG, StepID: step.ID, Timeout: step.Timeout}
+	runCtx := infraRunContext{Context: ctx, Addr: run.Addr, Host: run.Host, WG: fromAppWG(run.WG), SSH: sessions, Tunnel: true, RunID: run.ID}
+	if err := executor(runCtx, req, &res); err != nil {
+		return res, stepContextError(ctx, step.Timeout, err)
+	}
+	return res, nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"arc/internal/app"
+	"arc/internal/wgconf"
+	"arc/internal/workflow"
+	"strings"
+	"testing"
+)
+
+func TestJoinCodes_RoundTrip(t *testing.T) {
+	req := testJoinRequest(t, "laptop")
+	code, err := encodeJoinCode(joinRequestPrefix, req)
+	if err != nil {
+		t.Fatalf("encodeJoinCode: %v", err)
+	}
+	// Codes survive being wrapped by a terminal or chat client.
+	wrapped := code[:30] + "\n  " + code[30:]
+	var got joinRequest
+	if err := decodeJoinCode(joinRequestPrefix, wrapped, &got); err != nil {
+		t.Fatalf("decodeJoinCode: %v", err)
+	}
+	if got != req {
+		t.Fatalf("round trip changed the request: %+v", got)
+	}
+	if err := got.validate(); err != nil {
+		t.Fatalf("validate: %v", err)
+	}
+	var approval joinApproval
+	if err := decodeJoinCode(joinApprovalPrefix, code, &approval); err == nil {
+		t.Fatalf("a request code must not decode as an approval")
+	}
+
+	for _, bad := range []joinRequest{
+		{Name: "Laptop!", WGPublicKey: req.WGPublicKey, SSHKey: req.SSHKey},
+		{Name: "laptop", WGPublicKey: "short", SSHKey: req.SSHKey},
+		{Name: "laptop", WGPublicKey: req.WGPublicKey, SSHKey: "not a key"},
+	} {
+		if err := bad.validate(); err == nil {
+			t.Fatalf("expected %+v to be rejected", bad)
+		}
+	}
+}
+
+func TestCreateJoinRequest_KeepsKeyForSameName(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	first, err := createJoinRequest("laptop")
+	if err != nil {
+		t.Fatalf("createJoinRequest: %v", err)
+	}
+	again, err := createJoinRequest("laptop")
+	if err != nil {
+		t.Fatalf("createJoinRequest: %v", err)
+	}
+	if first != again {
+		t.Fatalf("asking again under the same name should give the same request")
+	}
+	renamed, err := createJoinRequest("workstation")
+	if err != nil {
+		t.Fatalf("createJoinRequest: %v", err)
+	}
+	var a, b joinRequest
+	_ = decodeJoinCode(joinRequestPrefix, first, &a)
+	_ = decodeJoinCode(joinRequestPrefix, renamed, &b)
+	if a.WGPublicKey == b.WGPublicKey || b.Name != "workstation" {
+		t.Fatalf("a new name should start a new request: %+v %+v", a, b)
+	}
+	if err := b.validate(); err != nil {
+		t.Fatalf("request is invalid: %v", err)
+	}
+}
+
+func TestJoinedWGConfig_UsesApprovedAddress(t *testing.T) {
+	priv, pub, err := genWGKeyPair()
+	if err != nil {
+		t.Fatalf("genWGKeyPair: %v", err)
+	}
+	_, serverPub, _ := genWGKeyPair()
+	psk, _ := genWGPresharedKey()
+	approval := joinApproval{
+		Name:            "laptop",
+		IP:              "10.8.0.7",
+		WGPublicKey:     pub,
+		ServerPublicKey: serverPub,
+		PresharedKey:    psk,
+		Endpoint:        "example.com:51821",
+		Net:             app.WGSettings{Interface: "wg-arc", Port: 51821, Subnet: "10.8.0.0/24", ServerIP: "10.8.0.1", DesktopIP: "10.8.0.2", MobileIP: "10.8.0.3"},
+	}
+	wg, err := joinedWGConfig(approval, priv)
+	if err != nil {
+		t.Fatalf("joinedWGConfig: %v", err)
+	}
+	if wg.Net.DesktopIP != "10.8.0.7" || wg.Net.Interface != "wg-arc" || wg.ServerConf != "" {
+		t.Fatalf("unexpected config: %+v", wg)
+	}
+	conf, err := wgconf.Parse(wg.ClientConf)
+	if err != nil {
+		t.Fatalf("client conf does not parse: %v", err)
+	}
+	if conf.Interface.Address[0] != "10.8.0.7/32" || conf.Peers[0].PublicKey != serverPub || conf.Peers[0].Endpoint != "example.com:51821" || conf.Peers[0].PresharedKey != psk {
+		t.Fatalf("unexpected client conf:\n%s", wg.ClientConf)
+	}
+	if nfsClientIP(wg.Net) != "10.8.0.7" {
+		t.Fatalf("NFS client should be the joined address, got %s", nfsClientIP(wg.Net))
+	}
+
+	otherPriv, _, _ := genWGKeyPair()
+	if _, err := joinedWGConfig(approval, otherPriv); err == nil || !strings.Contains(err.Error(), "another join request") {
+		t.Fatalf("expected an approval for another key to be refused, got %v", err)
+	}
+}
+
+func TestJoinSetupSteps_LocalHalfOnly(t *testing.T) {
+	steps := joinSetupSteps()
+	in := map[workflow.StepID]bool{}
+	for _, s := range steps {
+		in[s.ID] = true
+	}
+	scopes := map[workflow.StepID]workflow.StepScope{}
+	for _, def := range workflow.SetupStepDefinitions() {
+		scopes[def.ID] = def.Scope
+	}
+	for _, s := range steps {
+		if scopes[s.ID] == workflow.ScopeRemote {
+			t.Fatalf("join runs server step %q", s.ID)
+		}
+		for _, req := range s.Requires {
+			if !in[req] {
+				t.Fatalf("%q requires %q, which a join does not run", s.ID, req)
+			}
+		}
+	}
+	for _, id := range []workflow.StepID{workflow.StepWriteLocalWGConf, workflow.StepVerifyTunnelConnectivity, workflow.StepConfigureLocalArcAutomount} {
+		if !in[id] {
+			t.Fatalf("join is missing %q", id)
+		}
+	}
+	if in[workflow.StepEnsureArcSSHAccess] || in[workflow.StepVerifyArcSSHLogin] {
+		t.Fatalf("join must not use the bootstrap login")
+	}
+}
+
+func TestJoinedUninstallOptions_StaysLocal(t *testing.T) {
+	opts, err := joinedUninstallOptions(uninstallOptions{Local: true, Remote: true}, "laptop")
+	if err != nil || !opts.Local || opts.Remote {
+		t.Fatalf("expected a local-only uninstall, got %+v (%v)", opts, err)
+	}
+	if _, err := joinedUninstallOptions(uninstallOptions{Remote: true}, "laptop"); err == nil {
+		t.Fatalf("expected --remote to be refused on a joined device")
+	}
+	opts, _ = joinedUninstallOptions(uninstallOptions{Local: true, Remote: true}, "")
+	if !opts.Remote {
+		t.Fatalf("the device that ran setup keeps both sides")
+	}
+}
@@ -3,31 +3,80 @@ package main
 import (
 	"bytes"
 	"fmt"
+	"net/netip"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 )
 
 const (
 	arcPromptStart = "### ARC_PROMPT_START"
 	arcPromptEnd   = "### ARC_PROMPT_END"
+	arcTmuxStart   = "### ARC_TMUX_START"
+	arcTmuxEnd     = "### ARC_TMUX_END"
 )
 
+const (
+	arcPromptRemoteTemplate = "templates/prompt_remote.zsh"
+	arcPromptLocalTemplate  = "templates/prompt_local.zsh"
+)
+
+// The prompt blocks of the default network; setup renders them for the run's network with
+// renderArcPromptBlock.
 var (
-	arcPromptBlockRemote = mustTemplateFile("templates/prompt_remote.zsh")
-	arcPromptBlockLocal  = mustTemplateFile("templates/prompt_local.zsh")
+	arcPromptBlockRemote = mustRenderArcPromptBlock(arcPromptRemoteTemplate, defaultWGNetwork())
+	arcPromptBlockLocal  = mustRenderArcPromptBlock(arcPromptLocalTemplate, defaultWGNetwork())
 	arcTmuxBlockRemote   = mustTemplateFile("templates/tmux_remote.conf")
 )
 
+// renderArcPromptBlock renders a prompt block for the tunnel n: the local prompt probes the
+// server over n's interface (or its userspace forward), the remote one marks SSH sessions
+// from n's peers.
+func renderArcPromptBlock(path string, n wgNetwork) (string, error) {
+	return renderTemplateFile(path, map[string]string{
+		"WGInterface":    n.Interface,
+		"ServerIP":       n.LocalServerIP(),
+		"SSHPort":        strconv.Itoa(userspaceWGSSHPort),
+		"Userspace":      map[bool]string{true: "yes"}[n.Userspace()],
+		"PeerSourceGlob": wgPeerSourceGlob(n),
+	})
+}
+
+func mustRenderArcPromptBlock(path string, n wgNetwork) string {
+	block, err := renderArcPromptBlock(path, n)
+	if err != nil {
+		panic(err)
+	}
+	return block
+}
+
+// wgPeerSourceGlob is a zsh pattern matching the tunnel addresses of n's peers: the whole
+// subnet when it ends on an octet boundary, otherwise the desktop and mobile addresses.
+func wgPeerSourceGlob(n wgNetwork) string {
+	prefix, err := netip.ParsePrefix(n.Subnet)
+	if err == nil && prefix.Bits() > 0 && prefix.Bits()%8 == 0 {
+		octets := strings.Split(prefix.Addr().String(), ".")
+		return strings.Join(octets[:prefix.Bits()/8], ".") + ".*"
+	}
+	return "(" + n.DesktopIP + "|" + n.MobileIP + ")"
+}
+
 func stripArcPromptBlock(b []byte) []byte {
+	return stripManagedBlock(b, arcPromptStart, arcPromptEnd)
+}
+
+// stripManagedBlock drops the lines from start to end, inclusive.
+func stripManagedBlock(b []byte, start, end string) []byte {
 	lines := bytes.Split(b, []byte("\n"))
 	out := make([][]byte, 0, len(lines))
 	skip := false
 	for _, ln := range lines {
-		if bytes.Equal(ln, []byte(arcPromptStart)) {
+		if bytes.Equal(ln, []byte(start)) {
 			skip = true
 			continue
 		}
-		if bytes.Equal(ln, []byte(arcPromptEnd)) {
+		if bytes.Equal(ln, []byte(end)) {
 			skip = false
 			continue
 		}
@@ -71,30 +120,63 @@ func ensureArcPromptInZshrc(rcPath string, promptBlock string) error {
 	if os.IsNotExist(err) {
 		rcb = nil
 	}
+	return atomicWriteFile(rcPath, withManagedBlock(rcb, arcPromptStart, arcPromptEnd, promptBlock, true), 0o600)
+}
 
-	rcb = stripArcPromptBlock(rcb)
-	if len(rcb) > 0 && rcb[len(rcb)-1] != '\n' {
-		rcb = append(rcb, '\n')
+// withManagedBlock replaces the start..end block in content with block, moved to the end of
+// the file. With separate set, a blank line sets it apart from the user's content.
+func withManagedBlock(content []byte, start, end, block string, separate bool) []byte {
+	out := stripManagedBlock(content, start, end)
+	if len(out) > 0 && out[len(out)-1] != '\n' {
+		out = append(out, '\n')
 	}
-	if len(rcb) > 0 {
-		// Ensure a blank line before the prompt block for readability.
-		rcb = append(rcb, '\n')
+	if len(out) > 0 && separate {
+		out = append(out, '\n')
 	}
-	rcb = append(rcb, []byte(promptBlock)...)
-	rcb = append(rcb, '\n')
-
-	return atomicWriteFile(rcPath, rcb, 0o600)
+	out = append(out, []byte(block)...)
+	return append(out, '\n')
 }
 
-func ensureLocalArcZshPrompt() error {
+func ensureLocalArcZshPrompt(n wgNetwork) error {
 	home, err := os.UserHomeDir()
 	if err != nil || home == "" {
 		return fmt.Errorf("cannot resolve home dir")
 	}
 	rc := filepath.Join(home, ".zshrc")
 
-	if err := ensureArcPromptInZshrc(rc, arcPromptBlockLocal); err != nil {
+	block, err := renderArcPromptBlock(arcPromptLocalTemplate, n)
+	if err != nil {
+		return err
+	}
+	if err := ensureArcPromptInZshrc(rc, block); err != nil {
 		return err
 	}
 	return nil
 }
+
+// removeLocalArcZshPrompt strips the ARC prompt block from ~/.zshrc, leaving the rest of the
+// file as it was.
+func removeLocalArcZshPrompt(_ infraRunContext) error {
+	home, err := os.UserHomeDir()
+	if err != nil || home == "" {
+		return fmt.Errorf("cannot resolve home dir")
+	}
+	rc := filepath.Join(home, ".zshrc")
+	rcb, err := os.ReadFile(rc)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	stripped := stripArcPromptBlock(rcb)
+	if bytes.Equal(stripped, rcb) {
+		return nil
+	}
+	// Drop the blank separator line ensureArcPromptInZshrc put before the block.
+	stripped = bytes.TrimRight(stripped, "\n")
+	if len(stripped) > 0 {
+		stripped = append(stripped, '\n')
+	}
+	return atomicWriteFile(rc, stripped, 0o600)
+}
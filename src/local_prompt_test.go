@@ -11,7 +11,7 @@ func TestEnsureLocalArcZshPrompt_CreatesFiles(t *testing.T) {
 	home := t.TempDir()
 	t.Setenv("HOME", home)
 
-	if err := ensureLocalArcZshPrompt(); err != nil {
+	if err := ensureLocalArcZshPrompt(defaultWGNetwork()); err != nil {
 		t.Fatalf("ensureLocalArcZshPrompt: %v", err)
 	}
 
@@ -271,7 +271,7 @@ func TestEnsureLocalArcZshPrompt_Idempotent(t *testing.T) {
 	t.Setenv("HOME", home)
 
 	for i := 0; i < 2; i++ {
-		if err := ensureLocalArcZshPrompt(); err != nil {
+		if err := ensureLocalArcZshPrompt(defaultWGNetwork()); err != nil {
 			t.Fatalf("ensureLocalArcZshPrompt (run %d): %v", i, err)
 		}
 	}
@@ -309,7 +309,7 @@ func TestEnsureLocalArcZshPrompt_ReplacesExistingBlockAndPreservesOtherLines(t *
 		t.Fatalf("write .zshrc: %v", err)
 	}
 
-	if err := ensureLocalArcZshPrompt(); err != nil {
+	if err := ensureLocalArcZshPrompt(defaultWGNetwork()); err != nil {
 		t.Fatalf("ensureLocalArcZshPrompt: %v", err)
 	}
 
@@ -328,3 +328,59 @@ func TestEnsureLocalArcZshPrompt_ReplacesExistingBlockAndPreservesOtherLines(t *
 		t.Fatalf("expected exactly one ARC prompt block after replacement")
 	}
 }
+
+func TestRemoveLocalArcZshPrompt_RestoresUserContent(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	rc := filepath.Join(home, ".zshrc")
+	if err := os.WriteFile(rc, []byte("export EDITOR=vim\n"), 0o600); err != nil {
+		t.Fatalf("write .zshrc: %v", err)
+	}
+
+	if err := ensureLocalArcZshPrompt(defaultWGNetwork()); err != nil {
+		t.Fatalf("ensureLocalArcZshPrompt: %v", err)
+	}
+	if err := removeLocalArcZshPrompt(infraRunContext{}); err != nil {
+		t.Fatalf("removeLocalArcZshPrompt: %v", err)
+	}
+
+	rcb, err := os.ReadFile(rc)
+	if err != nil {
+		t.Fatalf("read .zshrc: %v", err)
+	}
+	if string(rcb) != "export EDITOR=vim\n" {
+		t.Fatalf("unexpected .zshrc after removal: %q", rcb)
+	}
+}
+
+func TestRenderArcPromptBlock_UsesRunNetwork(t *testing.T) {
+	n, err := resolveWGNetwork(wgNetwork{Interface: "wg-arc", Subnet: "10.8.0.0/24"})
+	if err != nil {
+		t.Fatalf("resolveWGNetwork: %v", err)
+	}
+	local, err := renderArcPromptBlock(arcPromptLocalTemplate, n)
+	if err != nil {
+		t.Fatalf("render local prompt: %v", err)
+	}
+	if !strings.Contains(local, "ip -o route get 10.8.0.1 ") || !strings.Contains(local, "wg show wg-arc latest-handshakes") {
+		t.Fatalf("local prompt does not probe the run's tunnel")
+	}
+	if strings.Contains(local, "wg0") || strings.Contains(local, "10.0.0.1") {
+		t.Fatalf("local prompt still refers to the default tunnel")
+	}
+	remote, err := renderArcPromptBlock(arcPromptRemoteTemplate, n)
+	if err != nil {
+		t.Fatalf("render remote prompt: %v", err)
+	}
+	if !strings.Contains(remote, `== 10.8.0.* ]]`) {
+		t.Fatalf("remote prompt does not match the run's peers")
+	}
+
+	n, err = resolveWGNetwork(wgNetwork{Subnet: "10.8.0.16/28"})
+	if err != nil {
+		t.Fatalf("resolveWGNetwork: %v", err)
+	}
+	if got := wgPeerSourceGlob(n); got != "(10.8.0.18|10.8.0.19)" {
+		t.Fatalf("unexpected peer glob for a /28: %q", got)
+	}
+}
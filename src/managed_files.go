@@ -0,0 +1,496 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// System files ARC rewrites go through this layer. Before the first write of a setup run, the
+// previous content is snapshotted to ~/.arc/backups/<run-id>/ locally and to
+// /var/lib/arc/backups/<run-id>/ on the server, so `arc restore <run-id>` can put it back.
+// Later writes in the same run keep that first snapshot.
+const (
+	backupsDirName     = "backups"
+	backupManifestName = "manifest.json"
+	remoteBackupsRoot  = "/var/lib/arc/backups"
+)
+
+const (
+	localHostsPath = "/etc/hosts"
+	localFstabPath = "/etc/fstab"
+)
+
+// backupRunIDPattern matches run IDs from newSetupRunID and keeps user input out of other paths.
+var backupRunIDPattern = regexp.MustCompile(`^[0-9A-Za-z][0-9A-Za-z-]*$`)
+
+// backupMu serializes manifest updates; setup runs steps concurrently.
+var backupMu sync.Mutex
+
+// backupManifest is ~/.arc/backups/<run-id>/manifest.json. Local file contents live next to it
+// under files/<path>; server files are only listed on the server.
+type backupManifest struct {
+	RunID  string        `json:"runId"`
+	Addr   string        `json:"addr,omitempty"`
+	Host   string        `json:"host,omitempty"`
+	Remote bool          `json:"remote"`
+	Files  []backupEntry `json:"files"`
+	// WGInterface, WGServerIP and WGMode record the run's tunnel so restore can reach the
+	// server through it; manifests without them use the default network.
+	WGInterface string `json:"wgInterface,omitempty"`
+	WGServerIP  string `json:"wgServerIp,omitempty"`
+	WGMode      string `json:"wgMode,omitempty"`
+}
+
+type backupEntry struct {
+	Path    string    `json:"path"`
+	Existed bool      `json:"existed"`
+	Mode    string    `json:"mode,omitempty"`
+	SavedAt time.Time `json:"savedAt"`
+}
+
+// fileSnapshot is a file as it was before ARC first wrote it.
+type fileSnapshot struct {
+	Path    string
+	Existed bool
+	Mode    os.FileMode
+	Content []byte
+}
+
+func validBackupRunID(id string) error {
+	if !backupRunIDPattern.MatchString(id) {
+		return fmt.Errorf("invalid run ID %q", id)
+	}
+	return nil
+}
+
+func backupsDir() (string, error) {
+	dir, err := arcHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, backupsDirName), nil
+}
+
+func localBackupDir(runID string) (string, error) {
+	if err := validBackupRunID(runID); err != nil {
+		return "", err
+	}
+	dir, err := backupsDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, runID), nil
+}
+
+func readBackupManifest(dir string) (backupManifest, error) {
+	var m backupManifest
+	raw, err := os.ReadFile(filepath.Join(dir, backupManifestName))
+	if err != nil {
+		return m, err
+	}
+	if err := json.Unmarshal(raw, &m); err != nil {
+		return m, fmt.Errorf("parse %s: %w", filepath.Join(dir, backupManifestName), err)
+	}
+	return m, nil
+}
+
+// wgNetwork is the tunnel of the run that took the backup, as far as restore needs it.
+func (m backupManifest) wgNetwork() wgNetwork {
+	n := defaultWGNetwork()
+	if m.WGServerIP != "" {
+		n.Interface, n.ServerIP, n.Mode = m.WGInterface, m.WGServerIP, m.WGMode
+	}
+	return n
+}
+
+// updateBackupManifest loads (or starts) the manifest of ctx's run, applies fn and saves it.
+func updateBackupManifest(ctx infraRunContext, fn func(dir string, m *backupManifest) error) error {
+	backupMu.Lock()
+	defer backupMu.Unlock()
+
+	dir, err := localBackupDir(ctx.RunID)
+	if err != nil {
+		return err
+	}
+	if err := ensureDir0700(dir); err != nil {
+		return err
+	}
+	m, err := readBackupManifest(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	m.RunID = ctx.RunID
+	if ctx.Addr != "" {
+		m.Addr, m.Host = ctx.Addr, ctx.Host
+	}
+	if ctx.WG.Net.ServerIP != "" {
+		m.WGInterface, m.WGServerIP, m.WGMode = ctx.WG.Net.Interface, ctx.WG.Net.ServerIP, ctx.WG.Net.Mode
+	}
+	if err := fn(dir, &m); err != nil {
+		return err
+	}
+	raw, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal backup manifest: %w", err)
+	}
+	return atomicWriteFile(filepath.Join(dir, backupManifestName), append(raw, '\n'), 0o600)
+}
+
+// storeLocalBackup records snap unless the run already backed up that path.
+func storeLocalBackup(ctx infraRunContext, snap fileSnapshot) error {
+	return updateBackupManifest(ctx, func(dir string, m *backupManifest) error {
+		for _, e := range m.Files {
+			if e.Path == snap.Path {
+				return nil
+			}
+		}
+		entry := backupEntry{Path: snap.Path, Existed: snap.Existed, SavedAt: time.Now().UTC()}
+		if snap.Existed {
+			entry.Mode = fmt.Sprintf("%04o", snap.Mode.Perm())
+			if err := writeFile0600(filepath.Join(dir, "files", snap.Path), snap.Content); err != nil {
+				return fmt.Errorf("back up %s: %w", snap.Path, err)
+			}
+		}
+		m.Files = append(m.Files, entry)
+		return nil
+	})
+}
+
+// snapshotFileScript prints the mode and base64 content of the file "$1", or "absent". The
+// encoding keeps command output trimming from changing the content.
+const snapshotFileScript = `if [ -e "$1" ]; then stat -c %a "$1"; base64 -w0 "$1"; else echo absent; fi`
+
+// homeFile reports whether path is under the user's home directory. ARC writes those files as
+// the user, and everything else through sudo.
+func homeFile(path string) bool {
+	home, err := os.UserHomeDir()
+	if err != nil || home == "" {
+		return false
+	}
+	rel, err := filepath.Rel(home, path)
+	return err == nil && rel != "." && rel != ".." && !strings.HasPrefix(rel, "../")
+}
+
+// snapshotLocalFile reads a file, through sudo unless it is in the user's home.
+func snapshotLocalFile(ctx context.Context, path string) (fileSnapshot, error) {
+	if homeFile(path) {
+		snap := fileSnapshot{Path: path}
+		info, err := os.Stat(path)
+		if os.IsNotExist(err) {
+			return snap, nil
+		}
+		if err != nil {
+			return snap, fmt.Errorf("read %s: %w", path, err)
+		}
+		if snap.Content, err = os.ReadFile(path); err != nil {
+			return snap, fmt.Errorf("read %s: %w", path, err)
+		}
+		snap.Existed, snap.Mode = true, info.Mode().Perm()
+		return snap, nil
+	}
+	out, err := execLocal(withoutStepOutput(ctx), "sudo", "-n", "sh", "-c", snapshotFileScript, "sh", path)
+	if err != nil {
+		return fileSnapshot{}, fmt.Errorf("read %s: %w", path, err)
+	}
+	return parseFileSnapshot(path, out)
+}
+
+func parseFileSnapshot(path, out string) (fileSnapshot, error) {
+	snap := fileSnapshot{Path: path}
+	out = strings.TrimSpace(out)
+	if out == "absent" {
+		return snap, nil
+	}
+	modeStr, encoded, _ := strings.Cut(out, "\n")
+	mode, err := strconv.ParseUint(strings.TrimSpace(modeStr), 8, 32)
+	if err != nil {
+		return snap, fmt.Errorf("parse mode of %s: %q", path, modeStr)
+	}
+	content, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return snap, fmt.Errorf("decode %s: %w", path, err)
+	}
+	snap.Existed = true
+	snap.Mode = os.FileMode(mode)
+	snap.Content = content
+	return snap, nil
+}
+
+// backupLocalFile snapshots path into the run's backups before its first change in the run.
+// Writes outside a recorded run (no RunID) are not backed up.
+func backupLocalFile(ctx infraRunContext, path string) error {
+	if ctx.RunID == "" {
+		return nil
+	}
+	dir, err := localBackupDir(ctx.RunID)
+	if err != nil {
+		return err
+	}
+	if m, err := readBackupManifest(dir); err == nil {
+		for _, e := range m.Files {
+			if e.Path == path {
+				return nil
+			}
+		}
+	}
+	snap, err := snapshotLocalFile(ctx, path)
+	if err != nil {
+		return err
+	}
+	return storeLocalBackup(ctx, snap)
+}
+
+// installLocalManagedFile backs up path, then replaces it with content via sudo install, or
+// directly when it is in the user's home.
+func installLocalManagedFile(ctx infraRunContext, path string, content []byte, mode os.FileMode) error {
+	if err := backupLocalFile(ctx, path); err != nil {
+		return err
+	}
+	if homeFile(path) {
+		if err := ensureDir0700(filepath.Dir(path)); err != nil {
+			return err
+		}
+		return atomicWriteFile(path, content, mode.Perm())
+	}
+	tmp, err := os.CreateTemp("", "arc-"+filepath.Base(path)+"-*.tmp")
+	if err != nil {
+		return fmt.Errorf("create temp file: %w", err)
+	}
+	tmpPath := tmp.Name()
+	defer os.Remove(tmpPath)
+	if _, err := tmp.Write(content); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("write temp file for %s: %w", path, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if _, err := execLocal(ctx, "sudo", "-n", "install", "-m", fmt.Sprintf("%04o", mode.Perm()), tmpPath, path); err != nil {
+		return err
+	}
+	return nil
+}
+
+// removeLocalManagedFile backs up path, then deletes it.
+func removeLocalManagedFile(ctx infraRunContext, path string) error {
+	if err := backupLocalFile(ctx, path); err != nil {
+		return err
+	}
+	if homeFile(path) {
+		return removeLocalFiles(path)
+	}
+	_, err := execLocal(ctx, "sudo", "-n", "rm", "-f", path)
+	return err
+}
+
+// remoteBackupScript is the root script that snapshots paths under
+// /var/lib/arc/backups/<run-id>: files/<path> keeps the previous content with its owner and
+// mode, absent/<path> marks a file that did not exist yet.
+func remoteBackupScript(runID string, paths ...string) string {
+	quoted := make([]string, len(paths))
+	for i, p := range paths {
+		quoted[i] = shSingleQuote(p)
+	}
+	return fmt.Sprintf(`set -eu
+d=%s
+install -d -m 0700 %s "$d"
+for p in %s; do
+	if [ -e "$d/files$p" ] || [ -e "$d/absent$p" ]; then
+		continue
+	fi
+	if [ -e "$p" ]; then
+		install -d -m 0700 "$d/files$(dirname "$p")"
+		cp -p "$p" "$d/files$p"
+	else
+		install -d -m 0700 "$d/absent$(dirname "$p")"
+		: > "$d/absent$p"
+	fi
+done
+`, shSingleQuote(remoteBackupsRoot+"/"+runID), remoteBackupsRoot, strings.Join(quoted, " "))
+}
+
+// remoteBackupCommand is the arc-side command that backs up paths on the server, for
+// prepending to scripts that change them. It is empty outside a recorded run.
+func remoteBackupCommand(ctx infraRunContext, paths ...string) (string, error) {
+	if ctx.RunID == "" || len(paths) == 0 {
+		return "", nil
+	}
+	if err := validBackupRunID(ctx.RunID); err != nil {
+		return "", err
+	}
+	if err := updateBackupManifest(ctx, func(_ string, m *backupManifest) error {
+		m.Remote = true
+		return nil
+	}); err != nil {
+		return "", err
+	}
+	return "sudo -n sh -c " + shSingleQuote(remoteBackupScript(ctx.RunID, paths...)) + "\n", nil
+}
+
+// backupRemoteFiles snapshots paths on the server before a write.
+func backupRemoteFiles(ctx infraRunContext, client *ssh.Client, paths ...string) error {
+	cmd, err := remoteBackupCommand(ctx, paths...)
+	if err != nil || cmd == "" {
+		return err
+	}
+	if _, err := runRemoteCommand(ctx, client, cmd, false, ""); err != nil {
+		return fmt.Errorf("back up %s on server: %w", strings.Join(paths, ", "), err)
+	}
+	return nil
+}
+
+// listBackups returns the recorded backups, newest first.
+func listBackups() ([]backupManifest, error) {
+	dir, err := backupsDir()
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("list %s: %w", dir, err)
+	}
+	var out []backupManifest
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		m, err := readBackupManifest(filepath.Join(dir, e.Name()))
+		if err != nil {
+			continue
+		}
+		out = append(out, m)
+	}
+	// Run IDs start with a UTC timestamp, so lexical order is chronological.
+	sort.Slice(out, func(i, j int) bool { return out[i].RunID > out[j].RunID })
+	return out, nil
+}
+
+// restoreLocalBackup puts every backed-up local file back, deleting files the run created.
+// It returns one line per file it changed.
+func restoreLocalBackup(ctx context.Context, runID string) ([]string, error) {
+	dir, err := localBackupDir(runID)
+	if err != nil {
+		return nil, err
+	}
+	m, err := readBackupManifest(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("no backups recorded for run %s", runID)
+		}
+		return nil, err
+	}
+	var done, failed []string
+	for _, e := range m.Files {
+		if !e.Existed {
+			if err := removeRestoredFile(ctx, e.Path); err != nil {
+				failed = append(failed, fmt.Sprintf("remove %s: %v", e.Path, err))
+				continue
+			}
+			done = append(done, "removed "+e.Path)
+			continue
+		}
+		mode := e.Mode
+		if mode == "" {
+			mode = "0644"
+		}
+		saved := filepath.Join(dir, "files", e.Path)
+		if err := installRestoredFile(ctx, saved, e.Path, mode); err != nil {
+			failed = append(failed, fmt.Sprintf("restore %s: %v", e.Path, err))
+			continue
+		}
+		done = append(done, "restored "+e.Path)
+	}
+	if len(failed) > 0 {
+		return done, fmt.Errorf("%s", strings.Join(failed, "; "))
+	}
+	return done, nil
+}
+
+func removeRestoredFile(ctx context.Context, path string) error {
+	if homeFile(path) {
+		return removeLocalFiles(path)
+	}
+	_, err := execLocal(ctx, "sudo", "-n", "rm", "-f", path)
+	return err
+}
+
+// installRestoredFile puts the backup saved back at path with mode, an octal string.
+func installRestoredFile(ctx context.Context, saved, path, mode string) error {
+	if !homeFile(path) {
+		_, err := execLocal(ctx, "sudo", "-n", "install", "-D", "-m", mode, saved, path)
+		return err
+	}
+	perm, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil {
+		return fmt.Errorf("parse mode %q", mode)
+	}
+	content, err := os.ReadFile(saved)
+	if err != nil {
+		return err
+	}
+	if err := ensureDir0700(filepath.Dir(path)); err != nil {
+		return err
+	}
+	return atomicWriteFile(path, content, os.FileMode(perm))
+}
+
+// remoteRestoreScript is the root script that undoes remoteBackupScript for runID.
+func remoteRestoreScript(runID string) string {
+	return fmt.Sprintf(`set -eu
+d=%s
+[ -d "$d" ] || exit 0
+if [ -d "$d/files" ]; then
+	(cd "$d/files" && find . -type f) | while IFS= read -r f; do
+		p="${f#.}"
+		install -d "$(dirname "$p")"
+		cp -p "$d/files$p" "$p"
+		echo "restored $p"
+	done
+fi
+if [ -d "$d/absent" ]; then
+	(cd "$d/absent" && find . -type f) | while IFS= read -r f; do
+		p="${f#.}"
+		rm -f "$p"
+		echo "removed $p"
+	done
+fi
+`, shSingleQuote(remoteBackupsRoot+"/"+runID))
+}
+
+// restoreRemoteBackup puts back the server files backed up during ctx's run.
+func restoreRemoteBackup(ctx infraRunContext) ([]string, error) {
+	if err := validBackupRunID(ctx.RunID); err != nil {
+		return nil, err
+	}
+	client, release, err := arcClientFor(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	out, err := runRemoteCommand(ctx, client, "sudo -n sh -c "+shSingleQuote(remoteRestoreScript(ctx.RunID)), false, "")
+	if err != nil {
+		return nil, fmt.Errorf("restore server files: %w", err)
+	}
+	var done []string
+	for _, ln := range strings.Split(strings.TrimSpace(out), "\n") {
+		if ln = strings.TrimSpace(ln); ln != "" {
+			done = append(done, ln)
+		}
+	}
+	return done, nil
+}
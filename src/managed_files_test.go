@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseFileSnapshot(t *testing.T) {
+	absent, err := parseFileSnapshot("/etc/wireguard/wg0.conf", "absent\n")
+	if err != nil || absent.Existed {
+		t.Fatalf("absent file: got %+v, %v", absent, err)
+	}
+
+	content := "127.0.0.1\tlocalhost\n\n"
+	snap, err := parseFileSnapshot("/etc/hosts", "644\n"+base64.StdEncoding.EncodeToString([]byte(content)))
+	if err != nil {
+		t.Fatalf("parseFileSnapshot: %v", err)
+	}
+	if !snap.Existed || snap.Mode != 0o644 || string(snap.Content) != content {
+		t.Fatalf("unexpected snapshot: %+v", snap)
+	}
+
+	empty, err := parseFileSnapshot("/etc/fstab", "600")
+	if err != nil || !empty.Existed || empty.Mode != 0o600 || len(empty.Content) != 0 {
+		t.Fatalf("empty file: got %+v, %v", empty, err)
+	}
+}
+
+func TestStoreLocalBackup_KeepsFirstSnapshotOfRun(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	ctx := infraRunContext{Context: context.Background(), Addr: "203.0.113.7:22", Host: "203.0.113.7", RunID: "20261017T101500Z-a1b2c3"}
+
+	if err := storeLocalBackup(ctx, fileSnapshot{Path: "/etc/fstab", Existed: true, Mode: 0o644, Content: []byte("before\n")}); err != nil {
+		t.Fatalf("first store: %v", err)
+	}
+	if err := storeLocalBackup(ctx, fileSnapshot{Path: "/etc/fstab", Existed: true, Mode: 0o644, Content: []byte("written by step\n")}); err != nil {
+		t.Fatalf("second store: %v", err)
+	}
+	if err := storeLocalBackup(ctx, fileSnapshot{Path: "/etc/wireguard/wg0.conf"}); err != nil {
+		t.Fatalf("store absent: %v", err)
+	}
+	if _, err := remoteBackupCommand(ctx, defaultWGNetwork().ConfPath()); err != nil {
+		t.Fatalf("remoteBackupCommand: %v", err)
+	}
+
+	dir, err := localBackupDir(ctx.RunID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := readBackupManifest(dir)
+	if err != nil {
+		t.Fatalf("read manifest: %v", err)
+	}
+	if len(m.Files) != 2 || !m.Remote || m.Host != ctx.Host {
+		t.Fatalf("unexpected manifest: %+v", m)
+	}
+	if m.Files[0].Path != "/etc/fstab" || m.Files[0].Mode != "0644" || m.Files[1].Existed {
+		t.Fatalf("unexpected entries: %+v", m.Files)
+	}
+	saved, err := os.ReadFile(filepath.Join(dir, "files", "etc", "fstab"))
+	if err != nil || string(saved) != "before\n" {
+		t.Fatalf("backup content = %q, %v; want the first snapshot", saved, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "files", "etc", "wireguard", "wg0.conf")); !os.IsNotExist(err) {
+		t.Fatalf("absent file must not leave content behind, stat err = %v", err)
+	}
+
+	backups, err := listBackups()
+	if err != nil || len(backups) != 1 || backups[0].RunID != ctx.RunID {
+		t.Fatalf("listBackups = %+v, %v", backups, err)
+	}
+}
+
+func TestBackupsSkippedOutsideRecordedRun(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	ctx := infraRunContext{Context: context.Background()}
+	if err := backupLocalFile(ctx, "/etc/hosts"); err != nil {
+		t.Fatalf("backupLocalFile: %v", err)
+	}
+	cmd, err := remoteBackupCommand(ctx, defaultWGNetwork().ConfPath())
+	if err != nil || cmd != "" {
+		t.Fatalf("remoteBackupCommand = %q, %v; want no command", cmd, err)
+	}
+	if backups, _ := listBackups(); len(backups) != 0 {
+		t.Fatalf("unexpected backups: %+v", backups)
+	}
+}
+
+func TestLocalManagedFile_HomePathsWithoutSudo(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	ctx := infraRunContext{Context: context.Background(), RunID: "20261017T101500Z-a1b2c3"}
+
+	conf := filepath.Join(home, ".arc", "wireguard", "wg0.conf")
+	unit := filepath.Join(home, ".config", "systemd", "user", "arc-wg-userspace-wg0.service")
+	if err := writeFile0600(conf, []byte("old\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := installLocalManagedFile(ctx, conf, []byte("new\n"), 0o600); err != nil {
+		t.Fatalf("install %s: %v", conf, err)
+	}
+	if err := installLocalManagedFile(ctx, unit, []byte("[Unit]\n"), 0o644); err != nil {
+		t.Fatalf("install %s: %v", unit, err)
+	}
+	if raw, err := os.ReadFile(conf); err != nil || string(raw) != "new\n" {
+		t.Fatalf("%s = %q, %v", conf, raw, err)
+	}
+	if info, err := os.Stat(unit); err != nil || info.Mode().Perm() != 0o644 {
+		t.Fatalf("stat %s: %v, %v", unit, info, err)
+	}
+
+	done, err := restoreLocalBackup(context.Background(), ctx.RunID)
+	if err != nil || len(done) != 2 {
+		t.Fatalf("restoreLocalBackup = %v, %v", done, err)
+	}
+	if raw, err := os.ReadFile(conf); err != nil || string(raw) != "old\n" {
+		t.Fatalf("restored %s = %q, %v", conf, raw, err)
+	}
+	if _, err := os.Stat(unit); !os.IsNotExist(err) {
+		t.Fatalf("the unit the run created must be removed, stat err = %v", err)
+	}
+}
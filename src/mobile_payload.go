@@ -20,6 +20,9 @@ type mobilePayload struct {
 }
 
 func buildMobilePayload(host string, wg wgConfig) (string, error) {
+	if wg.Net.Reverse() {
+		return "", fmt.Errorf("a phone cannot reach a server behind NAT: the tunnel runs through the rendezvous %s, so there is no mobile peer", wg.Net.Rendezvous)
+	}
 	if err := ensureLocalMobileSSHKeyPair(); err != nil {
 		return "", err
 	}
@@ -41,7 +44,7 @@ func buildMobilePayload(host string, wg wgConfig) (string, error) {
 
 	payloadHost := strings.TrimSpace(host)
 	if mobileWGConf != "" {
-		payloadHost = wgServerIP
+		payloadHost = wg.Net.withDefaults().ServerIP
 	}
 	if payloadHost == "" {
 		return "", fmt.Errorf("mobile payload host is empty")
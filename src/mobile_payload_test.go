@@ -37,7 +37,7 @@ func TestBuildMobilePayload_UsesWireGuardHostWhenConfigPresent(t *testing.T) {
 	if payload.WireGuardConfig == "" {
 		t.Fatalf("wireguard config was empty")
 	}
-	if !strings.Contains(payload.WireGuardConfig, "Address = "+wgMobileCIDR) {
+	if !strings.Contains(payload.WireGuardConfig, "Address = "+defaultWGNetwork().MobileCIDR()) {
 		t.Fatalf("expected mobile wireguard config in payload")
 	}
 	if !strings.Contains(payload.PrivateKeyPEM, "PRIVATE KEY") {
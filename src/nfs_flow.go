@@ -1,10 +1,13 @@
 package main
 
 import (
+	"arc/internal/workflow"
+	"context"
 	"fmt"
-	"os"
 	"strings"
 	"time"
+
+	"golang.org/x/crypto/ssh"
 )
 
 const (
@@ -12,23 +15,36 @@ const (
 	nfsExportsFile = "/etc/exports.d/arc.exports"
 )
 
-func nfsClientCIDR() string {
-	return wgDesktopIP + "/32"
+func nfsClientCIDR(n wgNetwork) string {
+	return n.DesktopCIDR()
 }
 
-func nfsClientIP() string {
-	return wgDesktopIP
+func nfsClientIP(n wgNetwork) string {
+	return n.DesktopIP
 }
 
-func nfsServerExportSource() string {
-	return wgServerIP + ":" + nfsMountTarget
+func nfsServerExportSource(n wgNetwork) string {
+	return n.LocalServerIP() + ":" + nfsMountTarget
 }
 
-func renderArcExports(anonUID, anonGID string) string {
-	return fmt.Sprintf("%s %s(rw,sync,all_squash,no_subtree_check,anonuid=%s,anongid=%s,sec=sys)\n", nfsMountTarget, nfsClientCIDR(), strings.TrimSpace(anonUID), strings.TrimSpace(anonGID))
+// renderArcExports exports /home/arc to the desktop. The userspace tunnel connects from
+// unprivileged source ports, which NFS refuses unless the export is insecure.
+func renderArcExports(n wgNetwork, anonUID, anonGID string) string {
+	if n.Userspace() {
+		return renderArcExportLine(nfsClientCIDR(n), anonUID, anonGID, "insecure")
+	}
+	return renderArcExportLine(nfsClientCIDR(n), anonUID, anonGID)
 }
 
-func renderArcFstabLine() string {
+// renderArcExportLine exports /home/arc to one tunnel client. Each joined device gets its own
+// line in its own file, so revoking it never rewrites another device's export.
+func renderArcExportLine(clientCIDR, anonUID, anonGID string, extraOpts ...string) string {
+	opts := append([]string{"rw"}, extraOpts...)
+	opts = append(opts, "sync", "all_squash", "no_subtree_check", "anonuid="+strings.TrimSpace(anonUID), "anongid="+strings.TrimSpace(anonGID), "sec=sys")
+	return fmt.Sprintf("%s %s(%s)\n", nfsMountTarget, clientCIDR, strings.Join(opts, ","))
+}
+
+func renderArcFstabLine(n wgNetwork) string {
 	opts := []string{
 		"rw",
 		"soft",
@@ -43,7 +59,7 @@ func renderArcFstabLine() string {
 		"timeo=10",
 		"retrans=1",
 	}
-	return fmt.Sprintf("%s %s nfs4 %s 0 0", nfsServerExportSource(), nfsMountTarget, strings.Join(opts, ","))
+	return fmt.Sprintf("%s %s nfs4 %s 0 0", nfsServerExportSource(n), nfsMountTarget, strings.Join(opts, ","))
 }
 
 func upsertFstabEntry(content, mountTarget, entry string) (string, bool, error) {
@@ -85,18 +101,36 @@ func upsertFstabEntry(content, mountTarget, entry string) (string, bool, error)
 	return out, changed, nil
 }
 
+// removeFstabEntry drops every active line that mounts mountTarget.
+func removeFstabEntry(content, mountTarget string) (string, bool) {
+	var out []string
+	changed := false
+	for _, raw := range strings.Split(content, "\n") {
+		fields := strings.Fields(strings.TrimSpace(raw))
+		if len(fields) >= 2 && !strings.HasPrefix(fields[0], "#") && fields[1] == mountTarget {
+			changed = true
+			continue
+		}
+		out = append(out, raw)
+	}
+	return strings.Join(out, "\n"), changed
+}
+
 func remoteArcUIDGID(ctx infraRunContext) (string, string, error) {
-	client, err := dialArcWithKey(ctx.Addr)
+	client, release, err := arcClientFor(ctx)
 	if err != nil {
 		return "", "", err
 	}
-	defer client.Close()
+	defer release()
+	return readRemoteArcUIDGID(ctx, client)
+}
 
-	remoteUID, err := runRemoteCommand(client, "id -u arc", false, "")
+func readRemoteArcUIDGID(ctx context.Context, client *ssh.Client) (string, string, error) {
+	remoteUID, err := runRemoteCommand(ctx, client, "id -u arc", false, "")
 	if err != nil {
 		return "", "", fmt.Errorf("resolve remote arc UID: %w", err)
 	}
-	remoteGID, err := runRemoteCommand(client, "id -g arc", false, "")
+	remoteGID, err := runRemoteCommand(ctx, client, "id -g arc", false, "")
 	if err != nil {
 		return "", "", fmt.Errorf("resolve remote arc GID: %w", err)
 	}
@@ -114,32 +148,36 @@ func verifyRemoteArcIdentity(ctx infraRunContext) error {
 }
 
 func installRemoteNFS(ctx infraRunContext) error {
-	client, err := dialArcWithKey(ctx.Addr)
+	client, release, err := arcClientFor(ctx)
 	if err != nil {
 		return err
 	}
-	defer client.Close()
-	if _, err := runRemoteAPTCommand(client, "sudo -n apt-get update"); err != nil {
+	defer release()
+	if _, err := runRemoteAPTCommand(ctx, client, "sudo -n apt-get update"); err != nil {
 		return err
 	}
-	if _, err := runRemoteAPTCommand(client, "sudo -n apt-get install -y nfs-kernel-server"); err != nil {
+	pkgs := stepPackages[workflow.StepInstallRemoteNFS]
+	if _, err := runRemoteAPTCommand(ctx, client, "sudo -n apt-get install -y "+strings.Join(pkgs.Debian, " ")); err != nil {
 		return err
 	}
 	return nil
 }
 
 func configureRemoteArcNFS(ctx infraRunContext) error {
-	client, err := dialArcWithKey(ctx.Addr)
+	client, release, err := arcClientFor(ctx)
 	if err != nil {
 		return err
 	}
-	defer client.Close()
+	defer release()
 
-	arcUID, arcGID, err := remoteArcUIDGID(ctx)
+	arcUID, arcGID, err := readRemoteArcUIDGID(ctx, client)
 	if err != nil {
 		return err
 	}
-	exports := renderArcExports(arcUID, arcGID)
+	exports := renderArcExports(ctx.WG.Net, arcUID, arcGID)
+	if err := backupRemoteFiles(ctx, client, nfsExportsFile); err != nil {
+		return err
+	}
 	script := fmt.Sprintf(`set -eu
 umask 022
 sudo -n install -d -m 0755 /etc/exports.d
@@ -153,28 +191,52 @@ else
 fi
 if command -v ufw >/dev/null 2>&1; then
 	if sudo -n ufw status 2>/dev/null | grep -q 'Status: active'; then
-		sudo -n ufw allow in on wg0 proto tcp from %s to any port 2049 >/dev/null
+		sudo -n ufw allow in on %s proto tcp from %s to any port 2049 >/dev/null
 	fi
 fi
-`, nfsExportsFile, exports, nfsClientIP())
+`, nfsExportsFile, exports, ctx.WG.Net.Interface, nfsClientIP(ctx.WG.Net))
 
-	if _, err := runRemoteCommand(client, script, false, ""); err != nil {
+	if _, err := runRemoteCommand(ctx, client, script, false, ""); err != nil {
 		return fmt.Errorf("configure remote NFS export: %w", err)
 	}
 	return nil
 }
 
-func installLocalNFSClient() error {
+func removeRemoteArcNFS(ctx infraRunContext) error {
+	backup, err := remoteBackupCommand(ctx, nfsExportsFile)
+	if err != nil {
+		return err
+	}
+	script := fmt.Sprintf(`set -eu
+%ssudo -n rm -f %s
+if command -v exportfs >/dev/null 2>&1; then
+	sudo -n exportfs -ra
+fi
+if command -v ufw >/dev/null 2>&1; then
+	if sudo -n ufw status 2>/dev/null | grep -q 'Status: active'; then
+		sudo -n ufw delete allow in on %s proto tcp from %s to any port 2049 >/dev/null 2>&1 || true
+	fi
+fi
+`, backup, nfsExportsFile, ctx.WG.Net.Interface, nfsClientIP(ctx.WG.Net))
+	if err := runRemoteUndoScript(ctx, script); err != nil {
+		return fmt.Errorf("remove remote NFS export: %w", err)
+	}
+	return nil
+}
+
+func installLocalNFSClient(ctx context.Context) error {
 	id, err := localOSID()
 	if err != nil {
 		return err
 	}
+	pkgs := stepPackages[workflow.StepInstallLocalNFSClient]
 	switch id {
 	case "ubuntu", "debian":
-		if _, err := runLocalAPTCommand("sudo", "-n", "apt-get", "update"); err != nil {
+		if _, err := runLocalAPTCommand(ctx, "sudo", "-n", "apt-get", "update"); err != nil {
 			return err
 		}
-		if _, err := runLocalAPTCommand("sudo", "-n", "apt-get", "install", "-y", "nfs-common"); err != nil {
+		args := append([]string{"-n", "apt-get", "install", "-y"}, pkgs.Debian...)
+		if _, err := runLocalAPTCommand(ctx, "sudo", args...); err != nil {
 			return err
 		}
 		return nil
@@ -182,11 +244,11 @@ func installLocalNFSClient() error {
 		// Some Arch/Manjaro systems already have NFS client binaries present
 		// (e.g. from previous/manual install). In that case, skip package install
 		// to avoid failing on unrelated local pacman file-conflict state.
-		if _, err := execLocal("sh", "-lc", "command -v mount.nfs >/dev/null 2>&1 || command -v mount.nfs4 >/dev/null 2>&1"); err == nil {
+		if _, err := execLocal(ctx, "sh", "-lc", "command -v mount.nfs >/dev/null 2>&1 || command -v mount.nfs4 >/dev/null 2>&1"); err == nil {
 			return nil
 		}
-		if _, err := execLocal("sudo", "-n", "pacman", "-S", "--needed", "--noconfirm", "nfs-utils"); err != nil {
-			if _, retryErr := execLocal("sudo", "-n", "pacman", "-Syy", "--needed", "--noconfirm", "nfs-utils"); retryErr != nil {
+		if _, err := execLocal(ctx, "sudo", append([]string{"-n", "pacman", "-S", "--needed", "--noconfirm"}, pkgs.Arch...)...); err != nil {
+			if _, retryErr := execLocal(ctx, "sudo", append([]string{"-n", "pacman", "-Syy", "--needed", "--noconfirm"}, pkgs.Arch...)...); retryErr != nil {
 				if strings.Contains(strings.ToLower(retryErr.Error()), "conflicting files") {
 					return fmt.Errorf("install nfs-utils failed due to pacman file conflicts; resolve locally with pacman (e.g. inspect conflicts via `sudo pacman -S nfs-utils`), then re-run setup: %w", retryErr)
 				}
@@ -199,8 +261,8 @@ func installLocalNFSClient() error {
 	}
 }
 
-func ensureLocalArcMountTarget() error {
-	if out, err := execLocal("findmnt", "-n", "-o", "SOURCE,FSTYPE", "-T", nfsMountTarget); err == nil {
+func ensureLocalArcMountTarget(ctx infraRunContext) error {
+	if out, err := execLocal(ctx, "findmnt", "-n", "-o", "SOURCE,FSTYPE", "-T", nfsMountTarget); err == nil {
 		fields := strings.Fields(strings.TrimSpace(out))
 		if len(fields) < 2 {
 			return fmt.Errorf("unexpected findmnt output for %s: %q", nfsMountTarget, out)
@@ -209,24 +271,24 @@ func ensureLocalArcMountTarget() error {
 		if fields[1] == "autofs" && strings.HasPrefix(fields[0], "systemd-") {
 			return nil
 		}
-		if fields[0] != nfsServerExportSource() || fields[1] != "nfs4" {
-			return fmt.Errorf("%s is already mounted as %s (%s), expected %s (nfs4)", nfsMountTarget, fields[0], fields[1], nfsServerExportSource())
+		if want := nfsServerExportSource(ctx.WG.Net); fields[0] != want || fields[1] != "nfs4" {
+			return fmt.Errorf("%s is already mounted as %s (%s), expected %s (nfs4)", nfsMountTarget, fields[0], fields[1], want)
 		}
 		return nil
 	}
 
-	if _, err := execLocal("sudo", "-n", "test", "-e", nfsMountTarget); err != nil {
-		if _, mkErr := execLocal("sudo", "-n", "install", "-d", "-m", "0755", nfsMountTarget); mkErr != nil {
+	if _, err := execLocal(ctx, "sudo", "-n", "test", "-e", nfsMountTarget); err != nil {
+		if _, mkErr := execLocal(ctx, "sudo", "-n", "install", "-d", "-m", "0755", nfsMountTarget); mkErr != nil {
 			return fmt.Errorf("create %s: %w", nfsMountTarget, mkErr)
 		}
 		return nil
 	}
 
-	if _, err := execLocal("sudo", "-n", "test", "-d", nfsMountTarget); err != nil {
+	if _, err := execLocal(ctx, "sudo", "-n", "test", "-d", nfsMountTarget); err != nil {
 		return fmt.Errorf("%s exists but is not a directory", nfsMountTarget)
 	}
 
-	out, err := execLocal("sudo", "-n", "sh", "-lc", "if [ -z \"$(ls -A /home/arc 2>/dev/null)\" ]; then echo empty; else echo nonempty; fi")
+	out, err := execLocal(ctx, "sudo", "-n", "sh", "-lc", "if [ -z \"$(ls -A /home/arc 2>/dev/null)\" ]; then echo empty; else echo nonempty; fi")
 	if err != nil {
 		return fmt.Errorf("inspect %s contents: %w", nfsMountTarget, err)
 	}
@@ -236,81 +298,99 @@ func ensureLocalArcMountTarget() error {
 	return nil
 }
 
-func configureLocalArcAutomount() error {
-	if err := ensureLocalArcMountTarget(); err != nil {
+func configureLocalArcAutomount(ctx infraRunContext) error {
+	if err := ensureLocalArcMountTarget(ctx); err != nil {
 		return err
 	}
 
-	fstabRaw, err := execLocal("sudo", "-n", "cat", "/etc/fstab")
+	fstabRaw, err := execLocal(ctx, "sudo", "-n", "cat", "/etc/fstab")
 	if err != nil {
 		return fmt.Errorf("read /etc/fstab: %w", err)
 	}
 
-	updated, changed, err := upsertFstabEntry(fstabRaw, nfsMountTarget, renderArcFstabLine())
+	updated, changed, err := upsertFstabEntry(fstabRaw, nfsMountTarget, renderArcFstabLine(ctx.WG.Net))
 	if err != nil {
 		return err
 	}
 	if changed {
-		tmp, err := os.CreateTemp("/tmp", "arc-fstab-*.tmp")
-		if err != nil {
-			return fmt.Errorf("create temp fstab: %w", err)
-		}
-		tmpPath := tmp.Name()
-		_ = tmp.Close()
-		defer os.Remove(tmpPath)
-
-		if err := os.WriteFile(tmpPath, []byte(updated), 0o644); err != nil {
-			return fmt.Errorf("write temp fstab: %w", err)
-		}
-		if _, err := execLocal("sudo", "-n", "install", "-m", "0644", tmpPath, "/etc/fstab"); err != nil {
-			return fmt.Errorf("update /etc/fstab: %w", err)
+		if err := installLocalFstab(ctx, updated); err != nil {
+			return err
 		}
 	}
 
-	if _, err := execLocal("sudo", "-n", "systemctl", "daemon-reload"); err != nil {
+	if _, err := execLocal(ctx, "sudo", "-n", "systemctl", "daemon-reload"); err != nil {
 		return err
 	}
-	if _, err := execLocal("sudo", "-n", "systemctl", "restart", "home-arc.automount"); err != nil {
-		if _, startErr := execLocal("sudo", "-n", "systemctl", "start", "home-arc.automount"); startErr != nil {
+	if _, err := execLocal(ctx, "sudo", "-n", "systemctl", "restart", "home-arc.automount"); err != nil {
+		if _, startErr := execLocal(ctx, "sudo", "-n", "systemctl", "start", "home-arc.automount"); startErr != nil {
 			return fmt.Errorf("restart home-arc.automount: %v; start fallback failed: %w", err, startErr)
 		}
 	}
 	return nil
 }
 
-func verifyLocalArcNFSMount() error {
-	const attempts = 5
-	var lastErr error
+func installLocalFstab(ctx infraRunContext, content string) error {
+	if err := installLocalManagedFile(ctx, localFstabPath, []byte(content), 0o644); err != nil {
+		return fmt.Errorf("update /etc/fstab: %w", err)
+	}
+	return nil
+}
 
-	verifyOnce := func() error {
-		if _, err := execLocal("ls", "-la", nfsMountTarget); err != nil {
-			return fmt.Errorf("trigger automount for %s: %w", nfsMountTarget, err)
-		}
+// removeLocalArcAutomount unmounts /home/arc, drops its fstab line and removes the mount
+// point if it is empty.
+func removeLocalArcAutomount(ctx infraRunContext) error {
+	_, _ = execLocal(ctx, "sudo", "-n", "systemctl", "stop", homeArcAutomountUnit, "home-arc.mount")
 
-		// Validate the real NFS mount (not the autofs trigger layer).
-		out, err := execLocal("findmnt", "-n", "-t", "nfs4", "-o", "SOURCE,TARGET", "-T", nfsMountTarget)
-		if err != nil {
-			diag, _ := execLocal("findmnt", "-n", "-o", "SOURCE,FSTYPE,TARGET", "-T", nfsMountTarget)
-			if strings.TrimSpace(diag) != "" {
-				return fmt.Errorf("nfs4 mount not active for %s (%v); current mount view: %s", nfsMountTarget, err, diag)
-			}
-			return fmt.Errorf("nfs4 mount not active for %s: %w", nfsMountTarget, err)
-		}
-		fields := strings.Fields(strings.TrimSpace(out))
-		if len(fields) < 2 {
-			return fmt.Errorf("unexpected findmnt output for %s: %q", nfsMountTarget, out)
-		}
-		if fields[0] != nfsServerExportSource() {
-			return fmt.Errorf("unexpected NFS source for %s: got %s want %s", nfsMountTarget, fields[0], nfsServerExportSource())
+	fstabRaw, err := execLocal(ctx, "sudo", "-n", "cat", "/etc/fstab")
+	if err != nil {
+		return fmt.Errorf("read /etc/fstab: %w", err)
+	}
+	if updated, changed := removeFstabEntry(fstabRaw, nfsMountTarget); changed {
+		if err := installLocalFstab(ctx, updated+"\n"); err != nil {
+			return err
 		}
-		if fields[1] != nfsMountTarget {
-			return fmt.Errorf("unexpected mount target: got %s want %s", fields[1], nfsMountTarget)
+	}
+	if _, err := execLocal(ctx, "sudo", "-n", "systemctl", "daemon-reload"); err != nil {
+		return err
+	}
+	_, _ = execLocal(ctx, "sudo", "-n", "rmdir", nfsMountTarget)
+	return nil
+}
+
+// checkLocalArcNFSMount triggers the /home/arc automount and checks that the real NFS mount
+// (not the autofs trigger layer) points at the server export.
+func checkLocalArcNFSMount(ctx context.Context, n wgNetwork) error {
+	if _, err := execLocal(ctx, "ls", "-la", nfsMountTarget); err != nil {
+		return fmt.Errorf("trigger automount for %s: %w", nfsMountTarget, err)
+	}
+
+	out, err := execLocal(ctx, "findmnt", "-n", "-t", "nfs4", "-o", "SOURCE,TARGET", "-T", nfsMountTarget)
+	if err != nil {
+		diag, _ := execLocal(ctx, "findmnt", "-n", "-o", "SOURCE,FSTYPE,TARGET", "-T", nfsMountTarget)
+		if strings.TrimSpace(diag) != "" {
+			return fmt.Errorf("nfs4 mount not active for %s (%v); current mount view: %s", nfsMountTarget, err, diag)
 		}
-		return nil
+		return fmt.Errorf("nfs4 mount not active for %s: %w", nfsMountTarget, err)
 	}
+	fields := strings.Fields(strings.TrimSpace(out))
+	if len(fields) < 2 {
+		return fmt.Errorf("unexpected findmnt output for %s: %q", nfsMountTarget, out)
+	}
+	if want := nfsServerExportSource(n); fields[0] != want {
+		return fmt.Errorf("unexpected NFS source for %s: got %s want %s", nfsMountTarget, fields[0], want)
+	}
+	if fields[1] != nfsMountTarget {
+		return fmt.Errorf("unexpected mount target: got %s want %s", fields[1], nfsMountTarget)
+	}
+	return nil
+}
+
+func verifyLocalArcNFSMount(ctx infraRunContext) error {
+	const attempts = 5
+	var lastErr error
 
 	for i := 1; i <= attempts; i++ {
-		if err := verifyOnce(); err == nil {
+		if err := checkLocalArcNFSMount(ctx, ctx.WG.Net); err == nil {
 			return nil
 		} else {
 			lastErr = err
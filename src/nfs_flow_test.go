@@ -6,15 +6,25 @@ import (
 )
 
 func TestRenderArcExports(t *testing.T) {
-	got := renderArcExports("1001", "1001")
+	got := renderArcExports(defaultWGNetwork(), "1001", "1001")
 	want := "/home/arc 10.0.0.2/32(rw,sync,all_squash,no_subtree_check,anonuid=1001,anongid=1001,sec=sys)\n"
 	if got != want {
 		t.Fatalf("unexpected exports content:\n got: %q\nwant: %q", got, want)
 	}
 }
 
+func TestRenderArcExports_UserspaceAllowsUnprivilegedPorts(t *testing.T) {
+	n := defaultWGNetwork()
+	n.Mode = wgModeUserspace
+	got := renderArcExports(n, "1001", "1001")
+	want := "/home/arc 10.0.0.2/32(rw,insecure,sync,all_squash,no_subtree_check,anonuid=1001,anongid=1001,sec=sys)\n"
+	if got != want {
+		t.Fatalf("unexpected exports content:\n got: %q\nwant: %q", got, want)
+	}
+}
+
 func TestRenderArcFstabLine(t *testing.T) {
-	got := renderArcFstabLine()
+	got := renderArcFstabLine(defaultWGNetwork())
 	for _, need := range []string{
 		"10.0.0.1:/home/arc",
 		"/home/arc",
@@ -32,7 +42,7 @@ func TestRenderArcFstabLine(t *testing.T) {
 
 func TestUpsertFstabEntry_AppendsWhenMissing(t *testing.T) {
 	in := "# /etc/fstab\nUUID=abc / ext4 defaults 0 1\n"
-	entry := renderArcFstabLine()
+	entry := renderArcFstabLine(defaultWGNetwork())
 
 	out, changed, err := upsertFstabEntry(in, "/home/arc", entry)
 	if err != nil {
@@ -52,7 +62,7 @@ func TestUpsertFstabEntry_ReplacesExistingEntry(t *testing.T) {
 		"10.0.0.1:/home/arc /home/arc nfs4 defaults 0 0",
 		"",
 	}, "\n")
-	entry := renderArcFstabLine()
+	entry := renderArcFstabLine(defaultWGNetwork())
 
 	out, changed, err := upsertFstabEntry(in, "/home/arc", entry)
 	if err != nil {
@@ -70,7 +80,7 @@ func TestUpsertFstabEntry_ReplacesExistingEntry(t *testing.T) {
 }
 
 func TestUpsertFstabEntry_NoChangeForExactEntry(t *testing.T) {
-	entry := renderArcFstabLine()
+	entry := renderArcFstabLine(defaultWGNetwork())
 	in := entry + "\n"
 
 	out, changed, err := upsertFstabEntry(in, "/home/arc", entry)
@@ -84,3 +94,23 @@ func TestUpsertFstabEntry_NoChangeForExactEntry(t *testing.T) {
 		t.Fatalf("unexpected output: got %q want %q", out, in)
 	}
 }
+
+func TestRemoveFstabEntry_DropsOnlyArcMount(t *testing.T) {
+	in := strings.Join([]string{
+		"# /home/arc was added by arc",
+		"UUID=abc / ext4 defaults 0 1",
+		renderArcFstabLine(defaultWGNetwork()),
+	}, "\n")
+
+	out, changed := removeFstabEntry(in, "/home/arc")
+	if !changed {
+		t.Fatalf("expected changed=true when the entry exists")
+	}
+	want := "# /home/arc was added by arc\nUUID=abc / ext4 defaults 0 1"
+	if out != want {
+		t.Fatalf("unexpected output:\n got %q\nwant %q", out, want)
+	}
+	if _, changed := removeFstabEntry(out, "/home/arc"); changed {
+		t.Fatalf("expected changed=false once the entry is gone")
+	}
+}
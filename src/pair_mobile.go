@@ -35,6 +35,28 @@ func runCLI(args []string, stdout, stderr io.Writer) int {
 			return 1
 		}
 		return 0
+	case "setup":
+		return runSetupCLI(args[1:], os.Stdin, stdout, stderr)
+	case "status":
+		return runStatusCLI(args[1:], stdout, stderr)
+	case "doctor":
+		return runDoctorCLI(args[1:], stdout, stderr)
+	case "uninstall":
+		return runUninstallCLI(args[1:], os.Stdin, stdout, stderr)
+	case "restore":
+		return runRestoreCLI(args[1:], os.Stdin, stdout, stderr)
+	case "join":
+		return runJoinCLI(args[1:], os.Stdin, stdout, stderr)
+	case "devices":
+		return runDevicesCLI(args[1:], os.Stdin, stdout, stderr)
+	case "rotate":
+		return runRotateCLI(args[1:], os.Stdin, stdout, stderr)
+	case "tunnel":
+		return runTunnelCLI(args[1:], stdout, stderr)
+	case "relay":
+		return runRelayCLI(args[1:], stdout, stderr)
+	case "endpoint":
+		return runEndpointCLI(args[1:], stdout, stderr)
 	case "help", "--help", "-h":
 		printArcUsage(stdout)
 		return 0
@@ -48,6 +70,19 @@ func runCLI(args []string, stdout, stderr io.Writer) int {
 func printArcUsage(w io.Writer) {
 	fmt.Fprintln(w, "Usage:")
 	fmt.Fprintln(w, "  arc pair-mobile")
+	fmt.Fprintln(w, "  arc setup --target ssh://user@host[:port] [--password-file FILE] [--yes] [--json]")
+	fmt.Fprintln(w, "  arc setup --plan --target ssh://user@host[:port] [--password-file FILE] [--yes]")
+	fmt.Fprintln(w, "  arc status [--json]")
+	fmt.Fprintln(w, "  arc doctor [--fix] [--json]")
+	fmt.Fprintln(w, "  arc uninstall [--local|--remote] [--keep-user] [--yes]")
+	fmt.Fprintln(w, "  arc restore [<run-id> [--local|--remote] [--yes]]")
+	fmt.Fprintln(w, "  arc join --name NAME | --approve CODE [--yes] | --accept CODE [--json]")
+	fmt.Fprintln(w, "  arc devices list [--json] | revoke NAME [--yes]")
+	fmt.Fprintln(w, "  arc rotate wireguard [--device NAME] [--yes]")
+	fmt.Fprintln(w, "  arc tunnel [--server-ip IP] [--ssh-port PORT] [--conf PATH] IFACE")
+	fmt.Fprintln(w, "  arc relay serve [--listen ADDR] [--websocket] [--wg-port PORT]")
+	fmt.Fprintln(w, "  arc relay connect --server HOST:PORT [--websocket] [--stall DURATION] IFACE")
+	fmt.Fprintln(w, "  arc endpoint [--host NAME] IFACE")
 }
 
 func runPairMobile(w io.Writer) error {
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"arc/internal/app"
+	"arc/internal/workflow"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// setupPlanTimeout bounds connecting to the server and reading its state for a plan.
+const setupPlanTimeout = 2 * time.Minute
+
+// runSetupPlan prints what `arc setup` would change without running any step. It connects
+// like setup does, pinning the host key, and only reads.
+func runSetupPlan(ctx context.Context, svc app.Services, opts setupCLIOptions, password string, confirm func(app.HostKey) bool, stdout io.Writer) error {
+	ctx, cancel := context.WithTimeout(ctx, setupPlanTimeout)
+	defer cancel()
+
+	target := opts.Target
+	var run app.SetupRun
+	done := map[workflow.StepID]bool{}
+	if opts.Resume {
+		resumeAddr := ""
+		if strings.TrimSpace(target) != "" {
+			_, _, addr, err := svc.ParseSSHDeviceTarget(target)
+			if err != nil {
+				return err
+			}
+			resumeAddr = addr
+		}
+		latest, ok, err := svc.LatestSetupRun(resumeAddr)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errors.New("no setup run to resume")
+		}
+		run = latest
+		target = run.Target
+		for _, step := range run.Steps {
+			if step.State == workflow.StepDone {
+				done[step.ID] = true
+			}
+		}
+	}
+
+	user, host, addr, err := svc.ParseSSHDeviceTarget(target)
+	if err != nil {
+		return err
+	}
+	key, err := svc.ScanHostKey(addr)
+	if err != nil {
+		return err
+	}
+	if !key.Pinned {
+		if !confirm(key) {
+			return errHostKeyNotConfirmed
+		}
+		if err := svc.TrustHostKey(key); err != nil {
+			return err
+		}
+	}
+
+	// A resumed run reuses its WireGuard keys; a new run generates its own, so the key lines
+	// of a fresh plan only show the shape of the configs.
+	wg := fromAppWG(run.WG)
+	if wg.Endpoint == "" {
+		if wg, err = buildWGConfig(host, wgNetworkFromSettings(opts.WG)); err != nil {
+			return err
+		}
+	}
+
+	sessions := newSSHSessionManager()
+	defer func() { _ = sessions.Close() }()
+	runCtx := infraRunContext{Context: ctx, Addr: addr, Host: host, WG: wg, SSH: sessions}
+	runRoot, release, err := serverCommandRunner(&runCtx, user, password, true)
+	if err != nil {
+		return err
+	}
+	defer release()
+	s, err := readPlanState(runCtx, runRoot)
+	if err != nil {
+		return err
+	}
+
+	defs, err := workflow.OrderStepDefinitions(workflow.SetupStepDefinitions())
+	if err != nil {
+		return err
+	}
+	plans, err := buildSetupPlan(s, defs, done)
+	if err != nil {
+		return err
+	}
+	printSetupPlan(stdout, target, run.ID, plans)
+	return nil
+}
+
+// readPlanState collects what the planners need from both machines.
+func readPlanState(ctx infraRunContext, runRoot func(string) (string, error)) (*planState, error) {
+	s := &planState{
+		WG:         ctx.WG,
+		Addr:       ctx.Addr,
+		LocalUser:  strings.TrimSpace(os.Getenv("USER")),
+		ReadLocal:  localPlanReader(ctx),
+		ReadRemote: remotePlanReader(runRoot),
+	}
+	var err error
+	if s.LocalOS, err = localOSID(); err != nil {
+		return nil, err
+	}
+	if s.LocalHome, err = os.UserHomeDir(); err != nil {
+		return nil, fmt.Errorf("cannot resolve home dir: %w", err)
+	}
+
+	osRelease, err := runRoot("cat /etc/os-release")
+	if err != nil {
+		return nil, err
+	}
+	s.RemoteOS = strings.TrimSpace(parseOSRelease(osRelease)["ID"])
+	// A missing arc user is what a fresh server looks like, not an error.
+	if uid, err := runRoot("id -u " + arcUser); err == nil {
+		s.ArcUID = uid
+		s.ArcGID, _ = runRoot("id -g " + arcUser)
+	}
+	s.ArcHome, _ = runRoot("getent passwd " + arcUser + " | cut -d: -f6")
+	if s.ArcHome == "" {
+		s.ArcHome = "/home/" + arcUser
+	}
+	if s.PublicIf, err = runRoot(detectPublicIfCommand); err != nil || s.PublicIf == "" {
+		s.PublicIf = "<public interface>"
+	}
+	if s.NFTBin, err = runRoot("command -v nft"); err != nil || s.NFTBin == "" {
+		s.NFTBin = "/usr/sbin/nft"
+	}
+	return s, nil
+}
+
+func printSetupPlan(w io.Writer, target, runID string, plans []stepPlan) {
+	if runID != "" {
+		fmt.Fprintf(w, "ARC setup plan for %s (resuming run %s); nothing has been changed\n", target, runID)
+	} else {
+		fmt.Fprintf(w, "ARC setup plan for %s; nothing has been changed\n", target)
+	}
+	files := 0
+	for _, p := range plans {
+		if p.empty() {
+			continue
+		}
+		fmt.Fprintf(w, "\n== %s\n", p.Label)
+		if len(p.Packages) > 0 {
+			fmt.Fprintf(w, "packages: %s\n", strings.Join(p.Packages, " "))
+		}
+		for _, unit := range p.Services {
+			fmt.Fprintf(w, "enable: %s\n", unit)
+		}
+		for _, action := range p.Actions {
+			fmt.Fprintf(w, "- %s\n", action)
+		}
+		for _, f := range p.Files {
+			if !f.changed() {
+				continue
+			}
+			files++
+			fmt.Fprint(w, planFileDiff(f))
+		}
+	}
+
+	packages, services := planSummary(plans)
+	fmt.Fprintf(w, "\nSummary: %d file change(s)\n", files)
+	for _, ln := range formatPlanList(packages) {
+		fmt.Fprintf(w, "packages %s\n", ln)
+	}
+	for _, ln := range formatPlanList(services) {
+		fmt.Fprintf(w, "services %s\n", ln)
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import "testing"
+
+func TestUnifiedDiff(t *testing.T) {
+	if d := unifiedDiff("a", "b", "same\n", "same\n"); d != "" {
+		t.Fatalf("equal content produced a diff: %q", d)
+	}
+
+	want := "--- /dev/null\n+++ remote:/etc/x\n@@ -0,0 +1,2 @@\n+one\n+two\n"
+	if d := unifiedDiff("/dev/null", "remote:/etc/x", "", "one\ntwo\n"); d != want {
+		t.Fatalf("new file diff:\n%s\nwant:\n%s", d, want)
+	}
+
+	old := "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12\n"
+	updated := "1\n2\nthree\n4\n5\n6\n7\n8\n9\n10\n11\n12\n13\n"
+	want = "--- a\n+++ b\n" +
+		"@@ -1,6 +1,6 @@\n 1\n 2\n-3\n+three\n 4\n 5\n 6\n" +
+		"@@ -10,3 +10,4 @@\n 10\n 11\n 12\n+13\n"
+	if d := unifiedDiff("a", "b", old, updated); d != want {
+		t.Fatalf("diff:\n%s\nwant:\n%s", d, want)
+	}
+
+	if d := unifiedDiff("a", "b", "x\n", "x"); d != "--- a\n+++ b\n(only the trailing newline differs)\n" {
+		t.Fatalf("trailing newline diff: %q", d)
+	}
+}
@@ -0,0 +1,579 @@
+package main
+
+import (
+	"arc/internal/workflow"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// planFile is a file a setup step would write, with its content before and after.
+type planFile struct {
+	Where   string // statusLocal or statusRemote
+	Path    string
+	Old     string
+	New     string
+	Existed bool
+}
+
+func (f planFile) changed() bool {
+	return !f.Existed || f.Old != f.New
+}
+
+// stepPlan is what one setup step would change.
+type stepPlan struct {
+	Step     workflow.StepID
+	Label    string
+	Where    string
+	Files    []planFile
+	Packages []string
+	Services []string
+	Actions  []string
+}
+
+func (p stepPlan) empty() bool {
+	for _, f := range p.Files {
+		if f.changed() {
+			return false
+		}
+	}
+	return len(p.Packages) == 0 && len(p.Services) == 0 && len(p.Actions) == 0
+}
+
+// planState is the read-only view of both machines the planners work from. Files written by
+// earlier planned steps are kept, so later steps diff against the planned content.
+type planState struct {
+	WG        wgConfig
+	Addr      string // the server's SSH address
+	LocalOS   string
+	LocalUser string
+	LocalHome string
+	RemoteOS  string
+	ArcUID    string // empty while the arc user does not exist
+	ArcGID    string
+	ArcHome   string
+	PublicIf  string
+	NFTBin    string
+
+	ReadLocal  func(path string) (fileSnapshot, error)
+	ReadRemote func(path string) (fileSnapshot, error)
+
+	pending map[string]string
+}
+
+func (s *planState) read(where, path string) (string, bool, error) {
+	if content, ok := s.pending[where+":"+path]; ok {
+		return content, true, nil
+	}
+	read := s.ReadLocal
+	if where == statusRemote {
+		read = s.ReadRemote
+	}
+	snap, err := read(path)
+	if err != nil {
+		return "", false, err
+	}
+	return string(snap.Content), snap.Existed, nil
+}
+
+// write records that the step writes content to path.
+func (s *planState) write(p *stepPlan, where, path, content string) error {
+	old, existed, err := s.read(where, path)
+	if err != nil {
+		return err
+	}
+	if s.pending == nil {
+		s.pending = map[string]string{}
+	}
+	s.pending[where+":"+path] = content
+	p.Files = append(p.Files, planFile{Where: where, Path: path, Old: old, New: content, Existed: existed})
+	return nil
+}
+
+// writeManagedBlock records the step replacing a managed start..end block in path.
+func (s *planState) writeManagedBlock(p *stepPlan, where, path, start, end, block string, separate bool) error {
+	old, _, err := s.read(where, path)
+	if err != nil {
+		return err
+	}
+	return s.write(p, where, path, string(withManagedBlock([]byte(old), start, end, block, separate)))
+}
+
+// setupPlanner fills in what one setup step would change. Planners only read.
+type setupPlanner func(s *planState, p *stepPlan) error
+
+var setupStepPlanners = map[workflow.StepID]setupPlanner{
+	workflow.StepDetectPrivilegedMode:       planNothing,
+	workflow.StepCreateArcUser:              planCreateArcUser,
+	workflow.StepAddArcToSudoers:            planArcSudoers,
+	workflow.StepCreateArcHushlogin:         planArcHushlogin,
+	workflow.StepAddLocalHostsAliases:       planLocalHostsAliases,
+	workflow.StepEnsureArcSSHAccess:         planArcSSHAccess,
+	workflow.StepVerifyArcSSHLogin:          planVerifyArcSSHLogin,
+	workflow.StepConfigureServerZsh:         planLoginShell(arcUser),
+	workflow.StepInstallServerWireGuard:     planNothing,
+	workflow.StepWriteServerWGConf:          planServerWGConf,
+	workflow.StepOpenServerFirewall:         planServerFirewall,
+	workflow.StepEnableServerWG:             planWGService,
+	workflow.StepApplyServerNFTables:        planLHRedirect,
+	workflow.StepInstallServerRelay:         planServerRelay,
+	workflow.StepInstallServerArcZshPrompt:  planServerZshPrompt,
+	workflow.StepInstallServerArcTmux:       planServerTmux,
+	workflow.StepInstallLocalArcPrompt:      planLocalZshPrompt,
+	workflow.StepConfigureLocalZsh:          planLocalLoginShell,
+	workflow.StepInstallLocalWireGuard:      planNothing,
+	workflow.StepWriteLocalWGConf:           planLocalWGConf,
+	workflow.StepEnableLocalWG:              planLocalWGService,
+	workflow.StepInstallLocalRelay:          planLocalRelay,
+	workflow.StepInstallLocalEndpointWatch:  planLocalEndpointWatch,
+	workflow.StepVerifyTunnelConnectivity:   planWGPeerSync,
+	workflow.StepResolveArcUIDGID:           planNothing,
+	workflow.StepInstallRemoteNFS:           planNothing,
+	workflow.StepExportRemoteArcNFS:         planArcExports,
+	workflow.StepInstallLocalNFSClient:      planNothing,
+	workflow.StepConfigureLocalArcAutomount: planArcFstab,
+	workflow.StepVerifyLocalArcNFSMount:     planNothing,
+	workflow.StepConfigureRemoteWaypipe:     planRemoteWaypipe,
+	workflow.StepConfigureLocalWaypipe:      planLocalWaypipe,
+	workflow.StepConfigureClipboardComp:     planClipboardComp,
+	workflow.StepHardenServerSSH:            planHardenServerSSH,
+	workflow.StepConfigureImageClipboard:    planImageClipboard,
+}
+
+// buildSetupPlan plans every step of defs that is not in done, in order.
+func buildSetupPlan(s *planState, defs []workflow.StepDef, done map[workflow.StepID]bool) ([]stepPlan, error) {
+	var plans []stepPlan
+	for _, def := range defs {
+		if done[def.ID] {
+			continue
+		}
+		planner, ok := setupStepPlanners[def.ID]
+		if !ok {
+			return nil, fmt.Errorf("no planner for step ID: %q", def.ID)
+		}
+		p := stepPlan{Step: def.ID, Label: def.Label, Where: statusRemote}
+		osID := s.RemoteOS
+		if def.Scope == workflow.ScopeLocal {
+			p.Where, osID = statusLocal, s.LocalOS
+		}
+		if pkgs, ok := stepPackages[def.ID]; ok {
+			p.Packages = pkgs.forOS(osID)
+		}
+		if err := planner(s, &p); err != nil {
+			return nil, fmt.Errorf("%s: %w", def.Label, err)
+		}
+		plans = append(plans, p)
+	}
+	return plans, nil
+}
+
+func planNothing(*planState, *stepPlan) error { return nil }
+
+func planServices(units ...string) setupPlanner {
+	return func(_ *planState, p *stepPlan) error {
+		p.Services = append(p.Services, units...)
+		return nil
+	}
+}
+
+func planWGService(s *planState, p *stepPlan) error {
+	return planServices(s.WG.Net.QuickUnit())(s, p)
+}
+
+func planLocalWGService(s *planState, p *stepPlan) error {
+	n := s.WG.Net
+	if n.Userspace() {
+		binPath, err := userspaceWGBinPath()
+		if err != nil {
+			return err
+		}
+		p.Actions = append(p.Actions, "install this arc binary as "+binPath)
+		unit, err := renderUserspaceWGUnit(n, sshPortOf(s.Addr))
+		if err != nil {
+			return err
+		}
+		unitPath, err := userspaceWGUnitPath(n)
+		if err != nil {
+			return err
+		}
+		if err := s.write(p, statusLocal, unitPath, unit); err != nil {
+			return err
+		}
+		return planServices(n.LocalUnit()+" (user)")(s, p)
+	}
+	return planServices(n.LocalUnit())(s, p)
+}
+
+func planServerRelay(s *planState, p *stepPlan) error {
+	n := s.WG.Net
+	if n.Relay == "" {
+		return nil
+	}
+	unit, err := renderServerRelayUnit(n)
+	if err != nil {
+		return err
+	}
+	p.Actions = append(p.Actions,
+		"upload this arc binary as "+arcRelayBinPath,
+		fmt.Sprintf("ufw allow %d/tcp (when ufw is active)", n.RelayPort()))
+	if err := s.write(p, statusRemote, arcRelayServerUnitPath, unit); err != nil {
+		return err
+	}
+	p.Services = append(p.Services, arcRelayServerUnit)
+	return nil
+}
+
+func planLocalRelay(s *planState, p *stepPlan) error {
+	n := s.WG.Net
+	if n.Relay == "" {
+		return nil
+	}
+	unit, err := renderLocalRelayUnit(s.WG)
+	if err != nil {
+		return err
+	}
+	p.Actions = append(p.Actions, "install this arc binary as "+arcRelayBinPath)
+	if err := s.write(p, statusLocal, localRelayUnitPath(n), unit); err != nil {
+		return err
+	}
+	p.Services = append(p.Services, localRelayUnit(n))
+	return nil
+}
+
+func planLocalEndpointWatch(s *planState, p *stepPlan) error {
+	if endpointHostname(s.WG) == "" {
+		return nil
+	}
+	n := s.WG.Net
+	unit, timer, err := renderLocalEndpointUnits(s.WG)
+	if err != nil {
+		return err
+	}
+	p.Actions = append(p.Actions, "install this arc binary as "+arcEndpointBinPath)
+	if err := s.write(p, statusLocal, localEndpointUnitPath(n), unit); err != nil {
+		return err
+	}
+	if err := s.write(p, statusLocal, localEndpointTimerPath(n), timer); err != nil {
+		return err
+	}
+	p.Services = append(p.Services, localEndpointTimer(n))
+	return nil
+}
+
+func planCreateArcUser(s *planState, p *stepPlan) error {
+	if s.ArcUID == "" {
+		p.Actions = append(p.Actions, fmt.Sprintf("create user %s with home %s", arcUser, s.ArcHome))
+	}
+	return nil
+}
+
+func planArcSudoers(s *planState, p *stepPlan) error {
+	return s.write(p, statusRemote, arcSudoersPath, arcSudoersRule+"\n")
+}
+
+func planArcHushlogin(s *planState, p *stepPlan) error {
+	path := s.ArcHome + "/.hushlogin"
+	_, existed, err := s.read(statusRemote, path)
+	if err != nil || existed {
+		return err
+	}
+	return s.write(p, statusRemote, path, "")
+}
+
+func planLocalHostsAliases(s *planState, p *stepPlan) error {
+	old, _, err := s.read(statusLocal, localHostsPath)
+	if err != nil {
+		return err
+	}
+	return s.write(p, statusLocal, localHostsPath, rewriteHostsMappings(old, arcHostsMappings(s.WG.Net.LocalServerIP())))
+}
+
+func planArcSSHAccess(_ *planState, p *stepPlan) error {
+	p.Actions = append(p.Actions,
+		"create the desktop and mobile SSH keys in "+userSSHDir()+" if missing",
+		"add both public keys to "+arcUser+"'s authorized_keys")
+	return nil
+}
+
+func planVerifyArcSSHLogin(s *planState, p *stepPlan) error {
+	p.Actions = append(p.Actions, "pin the server host key in ~/.ssh/known_hosts", "install the arc helper in "+s.ArcHome+"/.local/bin")
+	return planServerZshPrompt(s, p)
+}
+
+func planLoginShell(user string) setupPlanner {
+	return func(_ *planState, p *stepPlan) error {
+		p.Actions = append(p.Actions, "set the login shell of "+user+" to zsh")
+		return nil
+	}
+}
+
+func planLocalLoginShell(s *planState, p *stepPlan) error {
+	return planLoginShell(s.LocalUser)(s, p)
+}
+
+func planServerWGConf(s *planState, p *stepPlan) error {
+	return s.write(p, statusRemote, s.WG.Net.ConfPath(), s.WG.ServerConf)
+}
+
+func planLocalWGConf(s *planState, p *stepPlan) error {
+	path, err := localWGConfPath(s.WG.Net)
+	if err != nil {
+		return err
+	}
+	return s.write(p, statusLocal, path, s.WG.ClientConf)
+}
+
+func planServerFirewall(s *planState, p *stepPlan) error {
+	if s.WG.Net.Reverse() {
+		return nil
+	}
+	p.Actions = append(p.Actions, fmt.Sprintf("ufw allow %d/udp (when ufw is active)", s.WG.Net.Port))
+	return nil
+}
+
+func planLHRedirect(s *planState, p *stepPlan) error {
+	n := s.WG.Net
+	if err := s.write(p, statusRemote, lhRedirectSysctlConfPath, fmt.Sprintf(lhRedirectSysctlContentTpl, n.Interface)); err != nil {
+		return err
+	}
+	if err := s.write(p, statusRemote, lhRedirectNftPath, fmt.Sprintf(lhRedirectNftContentTpl, n.Interface, n.ServerIP)); err != nil {
+		return err
+	}
+	if err := s.write(p, statusRemote, lhRedirectServicePath, fmt.Sprintf(lhRedirectServiceContentTpl, s.NFTBin, s.NFTBin)); err != nil {
+		return err
+	}
+	p.Actions = append(p.Actions, "sysctl net.ipv4.conf.{all,"+n.Interface+"}.route_localnet=1")
+	p.Services = append(p.Services, lhRedirectServiceName)
+	return nil
+}
+
+// The remote prompt script appends its block without a blank separator line; the tmux and
+// local prompt writers add one.
+func planServerZshPrompt(s *planState, p *stepPlan) error {
+	block, err := renderArcPromptBlock(arcPromptRemoteTemplate, s.WG.Net)
+	if err != nil {
+		return err
+	}
+	return s.writeManagedBlock(p, statusRemote, s.ArcHome+"/.zshrc", arcPromptStart, arcPromptEnd, block, false)
+}
+
+func planServerTmux(s *planState, p *stepPlan) error {
+	return s.writeManagedBlock(p, statusRemote, s.ArcHome+"/.tmux.conf", arcTmuxStart, arcTmuxEnd, arcTmuxBlockRemote, true)
+}
+
+func planLocalZshPrompt(s *planState, p *stepPlan) error {
+	block, err := renderArcPromptBlock(arcPromptLocalTemplate, s.WG.Net)
+	if err != nil {
+		return err
+	}
+	return s.writeManagedBlock(p, statusLocal, filepath.Join(s.LocalHome, ".zshrc"), arcPromptStart, arcPromptEnd, block, true)
+}
+
+// planWGPeerSync shows the peer keys the tunnel check would patch into either config when
+// they do not match the other side.
+func planWGPeerSync(s *planState, p *stepPlan) error {
+	localPath, err := localWGConfPath(s.WG.Net)
+	if err != nil {
+		return err
+	}
+	localConf, localOK, err := s.read(statusLocal, localPath)
+	if err != nil {
+		return err
+	}
+	remoteConf, remoteOK, err := s.read(statusRemote, s.WG.Net.ConfPath())
+	if err != nil {
+		return err
+	}
+	if !localOK || !remoteOK {
+		return nil
+	}
+	peers, err := computeWGPeerSync(localConf, remoteConf, s.WG.Endpoint, s.WG.Net)
+	if err != nil {
+		return err
+	}
+	if peers.LocalChanged {
+		if err := s.write(p, statusLocal, localPath, peers.LocalConf); err != nil {
+			return err
+		}
+	}
+	if peers.RemoteChanged {
+		if err := s.write(p, statusRemote, s.WG.Net.ConfPath(), peers.RemoteConf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// planArcExports renders the export with placeholders while arc does not exist yet; setup
+// resolves the IDs after creating it.
+func planArcExports(s *planState, p *stepPlan) error {
+	uid, gid := s.ArcUID, s.ArcGID
+	if uid == "" {
+		uid, gid = "<arc uid>", "<arc gid>"
+	}
+	if err := s.write(p, statusRemote, nfsExportsFile, renderArcExports(s.WG.Net, uid, gid)); err != nil {
+		return err
+	}
+	p.Actions = append(p.Actions, fmt.Sprintf("ufw allow in on %s proto tcp from %s to any port 2049 (when ufw is active)", s.WG.Net.Interface, nfsClientIP(s.WG.Net)))
+	p.Services = append(p.Services, "nfs-server")
+	return nil
+}
+
+func planArcFstab(s *planState, p *stepPlan) error {
+	old, _, err := s.read(statusLocal, localFstabPath)
+	if err != nil {
+		return err
+	}
+	updated, changed, err := upsertFstabEntry(old, nfsMountTarget, renderArcFstabLine(s.WG.Net))
+	if err != nil {
+		return err
+	}
+	if changed {
+		if err := s.write(p, statusLocal, localFstabPath, updated); err != nil {
+			return err
+		}
+	}
+	p.Actions = append(p.Actions, "create the mount point "+nfsMountTarget)
+	p.Services = append(p.Services, homeArcAutomountUnit)
+	return nil
+}
+
+func planRemoteWaypipe(s *planState, p *stepPlan) error {
+	p.Actions = append(p.Actions, "write "+s.ArcHome+"/.config/arc/waypipe.env")
+	return nil
+}
+
+func planLocalWaypipe(_ *planState, p *stepPlan) error {
+	p.Actions = append(p.Actions, "install the arc-waypipe-forward runner and its user unit")
+	p.Services = append(p.Services, waypipeUnit+" (user)")
+	return nil
+}
+
+func planClipboardComp(_ *planState, p *stepPlan) error {
+	p.Actions = append(p.Actions, "upload arc-clipd and the remote clipboard helpers")
+	p.Services = append(p.Services, remoteClipdUnit+" (user)")
+	return nil
+}
+
+func planImageClipboard(_ *planState, p *stepPlan) error {
+	p.Actions = append(p.Actions, "install the arc-clipboard-sync runner and its user unit")
+	p.Services = append(p.Services, clipboardSyncUnit+" (user)")
+	return nil
+}
+
+// planHardenServerSSH renders the sshd drop-in and the public lockdown for the interface and
+// nft binary detected on the server.
+func planHardenServerSSH(s *planState, p *stepPlan) error {
+	if err := s.write(p, statusRemote, sshHardeningConfPath, sshHardeningConf); err != nil {
+		return err
+	}
+	nft, service, err := renderPublicLockdown(s.WG.Net, s.PublicIf, s.NFTBin)
+	if err != nil {
+		return err
+	}
+	if err := s.write(p, statusRemote, publicLockdownNftPath, nft); err != nil {
+		return err
+	}
+	if err := s.write(p, statusRemote, publicLockdownServicePath, service); err != nil {
+		return err
+	}
+	p.Actions = append(p.Actions,
+		"reload sshd",
+		fmt.Sprintf("ufw allow in on %s proto tcp to any port 22, allow %d/udp, deny 22/tcp (when ufw is active)", s.WG.Net.Interface, s.WG.Net.Port),
+		"public SSH on "+s.PublicIf+" is blocked afterwards; the server is only reachable as "+arcUser+" over the tunnel")
+	p.Services = append(p.Services, publicLockdownUnit)
+	return nil
+}
+
+// planFileDiff is the unified diff of f with WireGuard secrets redacted.
+func planFileDiff(f planFile) string {
+	from := f.Where + ":" + f.Path
+	if !f.Existed {
+		from = "/dev/null"
+	}
+	old, updated := redactWGSecrets(f.Old), redactWGSecrets(f.New)
+	if old == updated && f.Old != f.New {
+		return fmt.Sprintf("--- %s\n+++ %s:%s\n(only secret keys change)\n", from, f.Where, f.Path)
+	}
+	if !f.Existed && updated == "" {
+		return fmt.Sprintf("--- %s\n+++ %s:%s\n(new empty file)\n", from, f.Where, f.Path)
+	}
+	return unifiedDiff(from, f.Where+":"+f.Path, old, updated)
+}
+
+// planSummary collects the packages and services of plans per machine, sorted.
+func planSummary(plans []stepPlan) (packages, services map[string][]string) {
+	packages, services = map[string][]string{}, map[string][]string{}
+	seen := map[string]bool{}
+	add := func(m map[string][]string, kind, where, v string) {
+		if key := kind + where + v; !seen[key] {
+			seen[key] = true
+			m[where] = append(m[where], v)
+		}
+	}
+	for _, p := range plans {
+		for _, pkg := range p.Packages {
+			add(packages, "pkg", p.Where, pkg)
+		}
+		for _, unit := range p.Services {
+			add(services, "unit", p.Where, unit)
+		}
+	}
+	for _, m := range []map[string][]string{packages, services} {
+		for _, v := range m {
+			sort.Strings(v)
+		}
+	}
+	return packages, services
+}
+
+// localPlanReader reads files on this machine, going through sudo for files the user may
+// not read.
+func localPlanReader(ctx infraRunContext) func(string) (fileSnapshot, error) {
+	return func(path string) (fileSnapshot, error) {
+		b, err := os.ReadFile(path)
+		switch {
+		case err == nil:
+			info, statErr := os.Stat(path)
+			if statErr != nil {
+				return fileSnapshot{}, statErr
+			}
+			return fileSnapshot{Path: path, Existed: true, Mode: info.Mode().Perm(), Content: b}, nil
+		case os.IsNotExist(err):
+			return fileSnapshot{Path: path}, nil
+		case os.IsPermission(err):
+			return snapshotLocalFile(ctx, path)
+		}
+		return fileSnapshot{}, err
+	}
+}
+
+// remotePlanReader reads server files as root through run.
+func remotePlanReader(run func(cmd string) (string, error)) func(string) (fileSnapshot, error) {
+	return func(path string) (fileSnapshot, error) {
+		out, err := run("sh -c " + shSingleQuote(snapshotFileScript) + " sh " + shSingleQuote(path))
+		if err != nil {
+			return fileSnapshot{}, fmt.Errorf("read %s: %w", path, err)
+		}
+		return parseFileSnapshot(path, out)
+	}
+}
+
+func planWhereLabel(where string) string {
+	if where == statusRemote {
+		return "server"
+	}
+	return "local"
+}
+
+func formatPlanList(m map[string][]string) []string {
+	var out []string
+	for _, where := range []string{statusRemote, statusLocal} {
+		if len(m[where]) > 0 {
+			out = append(out, planWhereLabel(where)+": "+strings.Join(m[where], ", "))
+		}
+	}
+	return out
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"arc/internal/workflow"
+	"strings"
+	"testing"
+)
+
+func fakePlanState(t *testing.T, local, remote map[string]string) *planState {
+	t.Helper()
+	wg, err := buildWGConfig("203.0.113.7", defaultWGNetwork())
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := func(files map[string]string) func(string) (fileSnapshot, error) {
+		return func(path string) (fileSnapshot, error) {
+			content, ok := files[path]
+			if !ok {
+				return fileSnapshot{Path: path}, nil
+			}
+			return fileSnapshot{Path: path, Existed: true, Mode: 0o644, Content: []byte(content)}, nil
+		}
+	}
+	return &planState{
+		WG:         wg,
+		LocalOS:    "arch",
+		LocalUser:  "dev",
+		LocalHome:  "/home/dev",
+		RemoteOS:   "debian",
+		ArcHome:    "/home/arc",
+		PublicIf:   "eth0",
+		NFTBin:     "/usr/sbin/nft",
+		ReadLocal:  reader(local),
+		ReadRemote: reader(remote),
+	}
+}
+
+func findStepPlan(t *testing.T, plans []stepPlan, id workflow.StepID) stepPlan {
+	t.Helper()
+	for _, p := range plans {
+		if p.Step == id {
+			return p
+		}
+	}
+	t.Fatalf("no plan for %s", id)
+	return stepPlan{}
+}
+
+func TestBuildSetupPlan_FreshServer(t *testing.T) {
+	s := fakePlanState(t,
+		map[string]string{
+			localHostsPath: "127.0.0.1\tlocalhost\n",
+			localFstabPath: "UUID=abc / ext4 defaults 0 1\n",
+		},
+		map[string]string{
+			"/home/arc/.zshrc": "export EDITOR=vim\n" + arcPromptStart + "\nold prompt\n" + arcPromptEnd + "\n",
+		})
+	defs, err := workflow.OrderStepDefinitions(workflow.SetupStepDefinitions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	plans, err := buildSetupPlan(s, defs, nil)
+	if err != nil {
+		t.Fatalf("buildSetupPlan: %v", err)
+	}
+	if len(plans) != len(defs) {
+		t.Fatalf("got %d step plans, want %d", len(plans), len(defs))
+	}
+
+	hosts := findStepPlan(t, plans, workflow.StepAddLocalHostsAliases)
+	if d := planFileDiff(hosts.Files[0]); !strings.Contains(d, "+"+wgServerIP+"\trh\n") || !strings.Contains(d, " 127.0.0.1\tlocalhost\n") {
+		t.Fatalf("hosts diff:\n%s", d)
+	}
+
+	prompt := findStepPlan(t, plans, workflow.StepVerifyArcSSHLogin)
+	if d := planFileDiff(prompt.Files[0]); !strings.Contains(d, "-old prompt\n") || strings.Contains(d, "-export EDITOR=vim") {
+		t.Fatalf("remote prompt diff:\n%s", d)
+	}
+	// The prompt step diffs against the block verifyArcSSHLogin already planned.
+	if again := findStepPlan(t, plans, workflow.StepInstallServerArcZshPrompt); again.Files[0].Old != prompt.Files[0].New {
+		t.Fatalf("second prompt install diffs against %q", again.Files[0].Old)
+	}
+
+	serverWG := findStepPlan(t, plans, workflow.StepWriteServerWGConf)
+	if d := planFileDiff(serverWG.Files[0]); !strings.HasPrefix(d, "--- /dev/null\n") || !strings.Contains(d, "+PrivateKey = <redacted>\n") || strings.Contains(d, s.WG.ServerPriv) {
+		t.Fatalf("server wg0.conf diff must be a redacted new file:\n%s", d)
+	}
+	if tunnel := findStepPlan(t, plans, workflow.StepVerifyTunnelConnectivity); !tunnel.empty() {
+		t.Fatalf("matching configs need no peer sync: %+v", tunnel.Files)
+	}
+
+	exports := findStepPlan(t, plans, workflow.StepExportRemoteArcNFS)
+	if exports.Files[0].New != renderArcExports(defaultWGNetwork(), "<arc uid>", "<arc gid>") {
+		t.Fatalf("exports = %q", exports.Files[0].New)
+	}
+	fstab := findStepPlan(t, plans, workflow.StepConfigureLocalArcAutomount)
+	if !strings.Contains(fstab.Files[0].New, renderArcFstabLine(defaultWGNetwork())) {
+		t.Fatalf("fstab = %q", fstab.Files[0].New)
+	}
+
+	harden := findStepPlan(t, plans, workflow.StepHardenServerSSH)
+	if len(harden.Files) != 3 || harden.Files[0].Path != sshHardeningConfPath || !strings.Contains(harden.Files[1].New, `iifname "eth0" drop`) {
+		t.Fatalf("hardening plan: %+v", harden.Files)
+	}
+
+	if nfs := findStepPlan(t, plans, workflow.StepInstallRemoteNFS); strings.Join(nfs.Packages, " ") != "nfs-kernel-server" {
+		t.Fatalf("remote NFS packages = %v", nfs.Packages)
+	}
+	packages, services := planSummary(plans)
+	if len(packages[statusLocal]) == 0 || len(packages[statusRemote]) == 0 {
+		t.Fatalf("packages = %v", packages)
+	}
+	if !strings.Contains(strings.Join(services[statusRemote], " "), publicLockdownUnit) {
+		t.Fatalf("services = %v", services)
+	}
+}
+
+func TestBuildSetupPlan_SkipsDoneSteps(t *testing.T) {
+	s := fakePlanState(t, nil, nil)
+	defs := workflow.SetupStepDefinitions()
+	done := map[workflow.StepID]bool{}
+	for _, def := range defs {
+		if def.ID != workflow.StepHardenServerSSH {
+			done[def.ID] = true
+		}
+	}
+	plans, err := buildSetupPlan(s, defs, done)
+	if err != nil {
+		t.Fatalf("buildSetupPlan: %v", err)
+	}
+	if len(plans) != 1 || plans[0].Step != workflow.StepHardenServerSSH {
+		t.Fatalf("plans = %+v", plans)
+	}
+}
+
+func TestRedactWGSecrets(t *testing.T) {
+	got := redactWGSecrets("[Interface]\nPrivateKey = abc=\n[Peer]\nPublicKey = pub=\nPresharedKey=psk=\n")
+	want := "[Interface]\nPrivateKey = <redacted>\n[Peer]\nPublicKey = pub=\nPresharedKey=<redacted>\n"
+	if got != want {
+		t.Fatalf("redactWGSecrets = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,427 @@
+package main
+
+import (
+	"arc/internal/app"
+	"context"
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// preflightTimeout bounds inspecting both machines before setup.
+const preflightTimeout = 2 * time.Minute
+
+// Free space on / below preflightMinFreeKB blocks setup; below preflightLowFreeKB it warns.
+// Packages and, on some kernels, the WireGuard DKMS build need the room.
+const (
+	preflightMinFreeKB = 512 * 1024
+	preflightLowFreeKB = 2 * 1024 * 1024
+)
+
+// preflightSection prefixes the section headers of the facts script output.
+const preflightSection = "@@arc-preflight "
+
+// preflightFacts is what the checks need to know about one machine.
+type preflightFacts struct {
+	OSID       string
+	LinkExists bool
+	Addrs      []preflightPrefix
+	Routes     []preflightPrefix
+	UDPPorts   map[int]bool
+	// TCPListeners are the local address:port of every listening TCP socket.
+	TCPListeners []string
+	FreeKB       int64 // -1 when df could not be read
+
+	// HomeArcMounts are the "SOURCE FSTYPE" lines findmnt reports for /home/arc.
+	HomeArcMounts   []string
+	HomeArcNonEmpty bool
+}
+
+// preflightPrefix is an address or route and the device it is on.
+type preflightPrefix struct {
+	Dev    string
+	Prefix netip.Prefix
+}
+
+// runPreflight inspects this machine and the server for what would make setup fail late:
+// a busy interface name, port or subnet, /home/arc in use, an unsupported OS or a full disk.
+// It changes nothing on either side.
+func runPreflight(ctx context.Context, sessions *sshSessionManager, req app.PreflightRequest) (app.PreflightReport, error) {
+	ctx, cancel := context.WithTimeout(ctx, preflightTimeout)
+	defer cancel()
+
+	n, err := resolveWGNetwork(wgNetworkFromSettings(req.WG))
+	if err != nil {
+		return app.PreflightReport{}, err
+	}
+	// An interface ARC configured for this server in an earlier run is reconfigured, not a
+	// conflict.
+	ours := false
+	if prior, ok, err := latestSetupRun(req.Addr); err == nil && ok {
+		ours = fromAppWG(prior.WG).Net.Interface == n.Interface
+	}
+
+	localOut, err := execLocal(ctx, "sh", "-c", preflightFactsScript(n, true))
+	if err != nil {
+		return app.PreflightReport{}, fmt.Errorf("inspect local machine: %w", err)
+	}
+
+	runCtx := infraRunContext{Context: ctx, Addr: req.Addr, Host: req.Host, WG: wgConfig{Net: n}, SSH: sessions}
+	run, release, err := serverCommandRunner(&runCtx, req.BootstrapUser, req.Password, false)
+	if err != nil {
+		return app.PreflightReport{}, fmt.Errorf("inspect server: %w", err)
+	}
+	defer release()
+	remoteOut, err := run("sh -c " + shSingleQuote(preflightFactsScript(n, false)))
+	if err != nil {
+		return app.PreflightReport{}, fmt.Errorf("inspect server: %w", err)
+	}
+
+	checks := evaluatePreflight(n, ours, parsePreflightFacts(localOut), parsePreflightFacts(remoteOut))
+	return app.PreflightReport{Checks: checks}, nil
+}
+
+// preflightFactsScript prints each fact under its own section header. Every probe tolerates
+// failure, so a missing tool shows up as an empty section rather than an error.
+func preflightFactsScript(n wgNetwork, homeArc bool) string {
+	var sb strings.Builder
+	section := func(name, cmd string) {
+		fmt.Fprintf(&sb, "echo '%s%s'\n%s\n", preflightSection, name, cmd)
+	}
+	section("os", "cat /etc/os-release 2>/dev/null")
+	section("link", "ip -o link show dev "+shSingleQuote(n.Interface)+" 2>/dev/null")
+	section("addr", "ip -o addr show 2>/dev/null")
+	section("route", "ip -4 route show 2>/dev/null; ip -6 route show 2>/dev/null")
+	section("udp", "ss -Hlun 2>/dev/null")
+	section("tcp", "ss -Hltn 2>/dev/null")
+	section("df", "df -Pk / 2>/dev/null")
+	if homeArc {
+		section("home-arc", fmt.Sprintf(`findmnt -n -o SOURCE,FSTYPE --mountpoint %[1]s 2>/dev/null
+[ -n "$(ls -A %[1]s 2>/dev/null)" ] && echo nonempty`, nfsMountTarget))
+	}
+	sb.WriteString("true\n")
+	return sb.String()
+}
+
+func parsePreflightFacts(out string) preflightFacts {
+	f := preflightFacts{UDPPorts: map[int]bool{}, FreeKB: -1}
+	sections := map[string][]string{}
+	current := ""
+	for _, ln := range strings.Split(out, "\n") {
+		if name, ok := strings.CutPrefix(ln, preflightSection); ok {
+			current = strings.TrimSpace(name)
+			continue
+		}
+		if strings.TrimSpace(ln) != "" {
+			sections[current] = append(sections[current], ln)
+		}
+	}
+
+	f.OSID = strings.TrimSpace(parseOSRelease(strings.Join(sections["os"], "\n"))["ID"])
+	f.LinkExists = len(sections["link"]) > 0
+	for _, ln := range sections["addr"] {
+		// 2: eth0    inet 192.168.1.5/24 brd 192.168.1.255 scope global eth0 ...
+		// 2: eth0    inet6 fd00::5/64 scope global ...
+		fields := strings.Fields(ln)
+		if len(fields) < 4 || (fields[2] != "inet" && fields[2] != "inet6") {
+			continue
+		}
+		if p, err := netip.ParsePrefix(fields[3]); err == nil {
+			f.Addrs = append(f.Addrs, preflightPrefix{Dev: fields[1], Prefix: p})
+		}
+	}
+	for _, ln := range sections["route"] {
+		if r, ok := parsePreflightRoute(ln); ok {
+			f.Routes = append(f.Routes, r)
+		}
+	}
+	for _, ln := range sections["udp"] {
+		for _, field := range strings.Fields(ln) {
+			if i := strings.LastIndex(field, ":"); i >= 0 {
+				if port, err := strconv.Atoi(field[i+1:]); err == nil {
+					f.UDPPorts[port] = true
+					break
+				}
+			}
+		}
+	}
+	for _, ln := range sections["tcp"] {
+		// LISTEN 0      128          0.0.0.0:22          0.0.0.0:*
+		if fields := strings.Fields(ln); len(fields) >= 4 {
+			f.TCPListeners = append(f.TCPListeners, fields[3])
+		}
+	}
+	if df := sections["df"]; len(df) >= 2 {
+		if fields := strings.Fields(df[len(df)-1]); len(fields) >= 4 {
+			if kb, err := strconv.ParseInt(fields[3], 10, 64); err == nil {
+				f.FreeKB = kb
+			}
+		}
+	}
+	for _, ln := range sections["home-arc"] {
+		if strings.TrimSpace(ln) == "nonempty" {
+			f.HomeArcNonEmpty = true
+			continue
+		}
+		f.HomeArcMounts = append(f.HomeArcMounts, strings.TrimSpace(ln))
+	}
+	return f
+}
+
+// parsePreflightRoute reads one line of `ip -4 route show` or `ip -6 route show`. The default
+// route is skipped: it overlaps every subnet and more specific routes win over it. Multicast
+// routes, such as IPv6's ff00::/8, carry no unicast traffic and are skipped too.
+func parsePreflightRoute(ln string) (preflightPrefix, bool) {
+	fields := strings.Fields(ln)
+	if len(fields) > 0 {
+		switch fields[0] {
+		case "unicast", "blackhole", "unreachable", "prohibit", "throw", "local", "broadcast", "anycast":
+			fields = fields[1:]
+		case "multicast":
+			return preflightPrefix{}, false
+		}
+	}
+	if len(fields) == 0 || fields[0] == "default" {
+		return preflightPrefix{}, false
+	}
+	dst := fields[0]
+	if !strings.Contains(dst, "/") {
+		if strings.Contains(dst, ":") {
+			dst += "/128"
+		} else {
+			dst += "/32"
+		}
+	}
+	p, err := netip.ParsePrefix(dst)
+	if err != nil || p.Bits() == 0 {
+		return preflightPrefix{}, false
+	}
+	r := preflightPrefix{Prefix: p}
+	for i := 0; i+1 < len(fields); i++ {
+		if fields[i] == "dev" {
+			r.Dev = fields[i+1]
+		}
+	}
+	return r, true
+}
+
+// evaluatePreflight turns the facts of both machines into checks for the tunnel n. ours says
+// the interface belongs to an earlier ARC run for this server, so its port, addresses and
+// routes are expected.
+func evaluatePreflight(n wgNetwork, ours bool, local, remote preflightFacts) []app.PreflightCheck {
+	var checks []app.PreflightCheck
+	for _, side := range []struct {
+		where string
+		facts preflightFacts
+	}{{statusLocal, local}, {statusRemote, remote}} {
+		f := side.facts
+		checks = append(checks,
+			checkPreflightOS(side.where, f),
+			checkPreflightDisk(side.where, f),
+			checkPreflightInterface(side.where, n, ours, f),
+			checkPreflightSubnet(side.where, n, ours, f))
+		if side.where == statusLocal {
+			checks = append(checks, checkPreflightHomeArc(n, f))
+			if n.Userspace() {
+				checks = append(checks, checkPreflightForwards(n, ours, f))
+			}
+			if n.Reverse() {
+				checks = append(checks, checkPreflightPort(statusLocal, n, ours, f))
+			}
+		} else {
+			if !n.Reverse() {
+				checks = append(checks, checkPreflightPort(statusRemote, n, ours, f))
+			}
+			if n.Relay != "" {
+				checks = append(checks, checkPreflightRelayPort(n, ours, f))
+			}
+		}
+	}
+	return checks
+}
+
+func checkPreflightOS(where string, f preflightFacts) app.PreflightCheck {
+	c := app.PreflightCheck{Name: "operating system", Where: where, Severity: app.PreflightPass, Detail: f.OSID}
+	switch f.OSID {
+	case "ubuntu", "debian", "arch", "manjaro":
+	default:
+		c.Severity = app.PreflightBlock
+		c.Detail = fmt.Sprintf("unsupported OS ID=%q (supported: ubuntu, debian, arch, manjaro)", f.OSID)
+		c.Fix = "run ARC between machines with one of the supported distributions"
+	}
+	return c
+}
+
+func checkPreflightDisk(where string, f preflightFacts) app.PreflightCheck {
+	c := app.PreflightCheck{Name: "free disk space", Where: where, Severity: app.PreflightPass}
+	fix := "free space on / (e.g. `sudo apt-get clean` or `sudo pacman -Sc`), then re-check"
+	switch {
+	case f.FreeKB < 0:
+		c.Severity = app.PreflightWarn
+		c.Detail = "could not read free space on /"
+		c.Fix = "make sure `df -Pk /` works"
+	case f.FreeKB < preflightMinFreeKB:
+		c.Severity = app.PreflightBlock
+		c.Detail = fmt.Sprintf("only %d MiB free on /, need %d MiB", f.FreeKB/1024, preflightMinFreeKB/1024)
+		c.Fix = fix
+	case f.FreeKB < preflightLowFreeKB:
+		c.Severity = app.PreflightWarn
+		c.Detail = fmt.Sprintf("only %d MiB free on /", f.FreeKB/1024)
+		c.Fix = fix
+	default:
+		c.Detail = fmt.Sprintf("%d MiB free on /", f.FreeKB/1024)
+	}
+	return c
+}
+
+func checkPreflightInterface(where string, n wgNetwork, ours bool, f preflightFacts) app.PreflightCheck {
+	c := app.PreflightCheck{Name: "wireguard interface", Where: where, Severity: app.PreflightPass, Detail: n.Interface + " is free"}
+	switch {
+	case f.LinkExists && ours:
+		c.Detail = n.Interface + " is ARC's from an earlier run and will be reconfigured"
+	case f.LinkExists:
+		c.Severity = app.PreflightBlock
+		c.Detail = n.Interface + " already exists"
+		c.Fix = fmt.Sprintf("choose another interface name (--wg-interface, or iface= in the Network field), or remove it if nothing uses it: sudo ip link del %s", n.Interface)
+	}
+	return c
+}
+
+func checkPreflightSubnet(where string, n wgNetwork, ours bool, f preflightFacts) app.PreflightCheck {
+	subnets := []string{n.Subnet}
+	if n.Subnet6 != "" {
+		subnets = append(subnets, n.Subnet6)
+	}
+	c := app.PreflightCheck{Name: "tunnel subnet", Where: where, Severity: app.PreflightPass, Detail: strings.Join(subnets, " and ") + " free"}
+	if len(subnets) == 1 {
+		c.Detail = n.Subnet + " is free"
+	}
+	var clashes []string
+	for _, raw := range subnets {
+		subnet, err := netip.ParsePrefix(raw)
+		if err != nil {
+			c.Severity = app.PreflightBlock
+			c.Detail = err.Error()
+			return c
+		}
+		for _, kind := range []struct {
+			label string
+			list  []preflightPrefix
+		}{{"address", f.Addrs}, {"route", f.Routes}} {
+			for _, p := range kind.list {
+				if ours && p.Dev == n.Interface {
+					continue
+				}
+				if p.Prefix.Overlaps(subnet) {
+					clashes = append(clashes, fmt.Sprintf("%s overlaps %s %s on %s", raw, kind.label, p.Prefix, p.Dev))
+				}
+			}
+		}
+	}
+	if len(clashes) > 0 {
+		c.Severity = app.PreflightBlock
+		c.Detail = strings.Join(clashes, ", ")
+		c.Fix = "choose a subnet neither machine uses (--wg-subnet or --wg-subnet6, or subnet= and subnet6= in the Network field)"
+	}
+	return c
+}
+
+// checkPreflightPort checks WireGuard's UDP port on the machine that listens on it: the
+// server, or this machine when the server dials a rendezvous.
+func checkPreflightPort(where string, n wgNetwork, ours bool, f preflightFacts) app.PreflightCheck {
+	c := app.PreflightCheck{Name: "wireguard port", Where: where, Severity: app.PreflightPass, Detail: fmt.Sprintf("UDP %d is free", n.Port)}
+	if !f.UDPPorts[n.Port] {
+		return c
+	}
+	if ours && f.LinkExists {
+		c.Detail = fmt.Sprintf("UDP %d is held by ARC's %s", n.Port, n.Interface)
+		return c
+	}
+	c.Severity = app.PreflightBlock
+	c.Detail = fmt.Sprintf("UDP %d is already bound", n.Port)
+	c.Fix = fmt.Sprintf("choose another port (--wg-port, or port= in the Network field), or stop what listens on it (see: sudo ss -lunp 'sport = :%d')", n.Port)
+	return c
+}
+
+// checkPreflightRelayPort checks that the relay can listen on its TCP port; it listens on
+// every address, so any listener on the port is in the way.
+func checkPreflightRelayPort(n wgNetwork, ours bool, f preflightFacts) app.PreflightCheck {
+	port := strconv.Itoa(n.RelayPort())
+	c := app.PreflightCheck{Name: "relay port", Where: statusRemote, Severity: app.PreflightPass, Detail: "TCP " + port + " is free"}
+	var busy []string
+	for _, l := range f.TCPListeners {
+		if strings.HasSuffix(l, ":"+port) {
+			busy = append(busy, l)
+		}
+	}
+	if len(busy) == 0 {
+		return c
+	}
+	if ours {
+		c.Detail = "TCP " + port + " is held by ARC's relay from an earlier run"
+		return c
+	}
+	proto, _, _ := strings.Cut(n.Relay, ":")
+	c.Severity = app.PreflightBlock
+	c.Detail = "already listening on " + strings.Join(busy, ", ")
+	c.Fix = fmt.Sprintf("choose another relay port (--wg-relay %s:PORT, or relay= in the Network field), or stop what listens on it (see: sudo ss -ltnp 'sport = :%s')", proto, port)
+	return c
+}
+
+// checkPreflightForwards checks that the userspace tunnel can publish sshd and NFS on
+// userspaceWGForwardIP: a listener on the wildcard address holds the port there too.
+func checkPreflightForwards(n wgNetwork, ours bool, f preflightFacts) app.PreflightCheck {
+	c := app.PreflightCheck{Name: "userspace tunnel ports", Where: statusLocal, Severity: app.PreflightPass, Detail: fmt.Sprintf("TCP %d and %d are free on %s", userspaceWGSSHPort, nfsPort, userspaceWGForwardIP)}
+	var busy []string
+	for _, fwd := range userspaceWGForwards(22) {
+		for _, l := range f.TCPListeners {
+			i := strings.LastIndex(l, ":")
+			if i < 0 || l[i+1:] != strconv.Itoa(fwd.Local) {
+				continue
+			}
+			switch host := strings.Trim(strings.TrimSuffix(l[:i], "%lo"), "[]"); host {
+			case userspaceWGForwardIP:
+				if !ours {
+					busy = append(busy, l)
+				}
+			case "0.0.0.0", "*", "::":
+				busy = append(busy, l)
+			}
+		}
+	}
+	if len(busy) > 0 {
+		c.Severity = app.PreflightBlock
+		c.Detail = "already listening on " + strings.Join(busy, ", ")
+		c.Fix = fmt.Sprintf("bind the local service to specific addresses instead of all of them, or use --wg-mode %s", wgModeKernel)
+	}
+	return c
+}
+
+func checkPreflightHomeArc(n wgNetwork, f preflightFacts) app.PreflightCheck {
+	c := app.PreflightCheck{Name: nfsMountTarget + " mount point", Where: statusLocal, Severity: app.PreflightPass, Detail: "free"}
+	want := nfsServerExportSource(n)
+	for _, m := range f.HomeArcMounts {
+		fields := strings.Fields(m)
+		if len(fields) < 2 {
+			continue
+		}
+		// The systemd automount shows as autofs until first access, like in
+		// ensureLocalArcMountTarget.
+		if (fields[1] == "autofs" && strings.HasPrefix(fields[0], "systemd-")) || (fields[0] == want && fields[1] == "nfs4") {
+			c.Detail = "ARC's NFS mount from an earlier run"
+			continue
+		}
+		c.Severity = app.PreflightBlock
+		c.Detail = fmt.Sprintf("%s is already mounted as %s (%s)", nfsMountTarget, fields[0], fields[1])
+		c.Fix = fmt.Sprintf("unmount it (sudo umount %s) and remove its /etc/fstab entry", nfsMountTarget)
+		return c
+	}
+	if len(f.HomeArcMounts) == 0 && f.HomeArcNonEmpty {
+		c.Severity = app.PreflightBlock
+		c.Detail = nfsMountTarget + " is not empty; the NFS mount would hide its files"
+		c.Fix = fmt.Sprintf("move its contents elsewhere (e.g. sudo mv %s %s.old)", nfsMountTarget, nfsMountTarget)
+	}
+	return c
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"arc/internal/app"
+	"strings"
+	"testing"
+)
+
+const preflightFreshServer = `@@arc-preflight os
+NAME="Ubuntu"
+ID=ubuntu
+@@arc-preflight link
+@@arc-preflight addr
+1: lo    inet 127.0.0.1/8 scope host lo\       valid_lft forever preferred_lft forever
+2: eth0    inet 203.0.113.7/24 brd 203.0.113.255 scope global eth0\       valid_lft forever preferred_lft forever
+@@arc-preflight route
+default via 203.0.113.1 dev eth0 proto static
+203.0.113.0/24 dev eth0 proto kernel scope link src 203.0.113.7
+@@arc-preflight udp
+UNCONN 0      0            127.0.0.53%lo:53         0.0.0.0:*
+UNCONN 0      0                     [::]:123           [::]:*
+@@arc-preflight df
+Filesystem     1024-blocks    Used Available Capacity Mounted on
+/dev/vda1         20509264 4823124  14621180      25% /
+`
+
+func preflightChecksByKey(checks []app.PreflightCheck) map[string]app.PreflightCheck {
+	out := map[string]app.PreflightCheck{}
+	for _, c := range checks {
+		out[c.Where+" "+c.Name] = c
+	}
+	return out
+}
+
+func TestParsePreflightFacts(t *testing.T) {
+	f := parsePreflightFacts(preflightFreshServer)
+	if f.OSID != "ubuntu" || f.LinkExists || f.FreeKB != 14621180 {
+		t.Fatalf("unexpected facts: %#v", f)
+	}
+	if len(f.Addrs) != 2 || f.Addrs[1].Dev != "eth0" || f.Addrs[1].Prefix.String() != "203.0.113.7/24" {
+		t.Fatalf("unexpected addresses: %#v", f.Addrs)
+	}
+	if len(f.Routes) != 1 || f.Routes[0].Prefix.String() != "203.0.113.0/24" {
+		t.Fatalf("default route must be skipped: %#v", f.Routes)
+	}
+	if !f.UDPPorts[53] || !f.UDPPorts[123] || f.UDPPorts[wgPort] {
+		t.Fatalf("unexpected UDP ports: %#v", f.UDPPorts)
+	}
+}
+
+func TestEvaluatePreflight_FreshMachinesPass(t *testing.T) {
+	f := parsePreflightFacts(preflightFreshServer)
+	report := app.PreflightReport{Checks: evaluatePreflight(defaultWGNetwork(), false, f, f)}
+	if issues := report.Issues(); len(issues) != 0 {
+		t.Fatalf("fresh machines should pass every check, got %#v", issues)
+	}
+}
+
+func TestEvaluatePreflight_BlocksOnCollisions(t *testing.T) {
+	n := defaultWGNetwork()
+	local := parsePreflightFacts(preflightFreshServer + `@@arc-preflight link
+5: wg0: <POINTOPOINT,NOARP,UP,LOWER_UP> mtu 1420 qdisc noqueue state UNKNOWN mode DEFAULT group default qlen 1000\    link/none
+@@arc-preflight home-arc
+server:/export nfs4
+`)
+	local.Routes = append(local.Routes, parsePreflightFacts("@@arc-preflight route\n"+n.Subnet+" dev tun0 scope link\n").Routes...)
+	remote := parsePreflightFacts(strings.Replace(preflightFreshServer, "ID=ubuntu", "ID=fedora", 1) + "@@arc-preflight udp\nUNCONN 0 0 0.0.0.0:51820 0.0.0.0:*\n@@arc-preflight df\nFilesystem 1024-blocks Used Available Capacity Mounted on\n/dev/vda1 1000 900 100000 90% /\n")
+
+	checks := preflightChecksByKey(evaluatePreflight(n, false, local, remote))
+	for _, key := range []string{
+		"local wireguard interface",
+		"local tunnel subnet",
+		"local " + nfsMountTarget + " mount point",
+		"remote operating system",
+		"remote wireguard port",
+		"remote free disk space",
+	} {
+		c := checks[key]
+		if c.Severity != app.PreflightBlock || c.Fix == "" {
+			t.Fatalf("%s: want a blocking issue with a fix, got %#v", key, c)
+		}
+	}
+	if c := checks["remote wireguard interface"]; c.Severity != app.PreflightPass {
+		t.Fatalf("the server has no %s yet: %#v", n.Interface, c)
+	}
+}
+
+func TestEvaluatePreflight_AcceptsEarlierArcRun(t *testing.T) {
+	n := defaultWGNetwork()
+	facts := parsePreflightFacts(preflightFreshServer + `@@arc-preflight link
+5: wg0: <POINTOPOINT,NOARP,UP,LOWER_UP> mtu 1420
+@@arc-preflight addr
+5: wg0    inet ` + n.ServerCIDR() + ` scope global wg0
+@@arc-preflight udp
+UNCONN 0 0 0.0.0.0:51820 0.0.0.0:*
+@@arc-preflight home-arc
+` + nfsServerExportSource(n) + ` nfs4
+`)
+	report := app.PreflightReport{Checks: evaluatePreflight(n, true, facts, facts)}
+	if issues := report.Issues(); len(issues) != 0 {
+		t.Fatalf("ARC's own interface, port and mount must not block a re-run, got %#v", issues)
+	}
+	if report := (app.PreflightReport{Checks: evaluatePreflight(n, false, facts, facts)}); !report.Blocked() {
+		t.Fatalf("an interface from outside ARC must block")
+	}
+}
+
+func TestEvaluatePreflight_ChecksIPv6Subnet(t *testing.T) {
+	f := parsePreflightFacts(preflightFreshServer + `@@arc-preflight addr
+2: eth0    inet6 2001:db8::7/64 scope global\       valid_lft forever preferred_lft forever
+3: tun0    inet6 fd12:3456:789a::9/64 scope global\       valid_lft forever preferred_lft forever
+@@arc-preflight route
+2001:db8::/64 dev eth0 proto kernel metric 256 pref medium
+fd12:3456:789a::9 dev tun0 metric 1024 pref medium
+multicast ff00::/8 dev eth0 table local proto kernel metric 256 pref medium
+`)
+	if len(f.Addrs) != 4 || f.Addrs[3].Prefix.String() != "fd12:3456:789a::9/64" {
+		t.Fatalf("unexpected IPv6 addresses: %#v", f.Addrs)
+	}
+	if len(f.Routes) != 3 || f.Routes[2].Prefix.String() != "fd12:3456:789a::9/128" {
+		t.Fatalf("unexpected IPv6 routes: %#v", f.Routes)
+	}
+
+	n := defaultWGNetwork()
+	if c := checkPreflightSubnet(statusLocal, n, false, f); c.Severity != app.PreflightPass {
+		t.Fatalf("an IPv4-only tunnel ignores IPv6 addresses: %#v", c)
+	}
+	n.Subnet6 = "fd12:3456:789a::/64"
+	c := checkPreflightSubnet(statusLocal, n, false, f)
+	if c.Severity != app.PreflightBlock || !strings.Contains(c.Detail, "tun0") || strings.Contains(c.Detail, "eth0") {
+		t.Fatalf("want the ULA clash on tun0 to block, got %#v", c)
+	}
+}
+
+func TestEvaluatePreflight_UserspaceForwardPorts(t *testing.T) {
+	n := defaultWGNetwork()
+	n.Mode = wgModeUserspace
+	f := parsePreflightFacts(preflightFreshServer + `@@arc-preflight tcp
+LISTEN 0      128        127.0.0.1:631        0.0.0.0:*
+LISTEN 0      128        127.0.0.1:2222       0.0.0.0:*
+`)
+	checks := preflightChecksByKey(evaluatePreflight(n, false, f, f))
+	if c, ok := checks[statusLocal+" userspace tunnel ports"]; !ok || c.Severity != app.PreflightPass {
+		t.Fatalf("a loopback-only listener leaves %s:2222 free, got %#v", userspaceWGForwardIP, c)
+	}
+	if _, ok := checks[statusRemote+" userspace tunnel ports"]; ok {
+		t.Fatalf("the forwards are only on this machine")
+	}
+
+	f = parsePreflightFacts(preflightFreshServer + `@@arc-preflight tcp
+LISTEN 0      128          0.0.0.0:2222       0.0.0.0:*
+LISTEN 0      128             [::]:2049          [::]:*
+`)
+	c := checkPreflightForwards(n, false, f)
+	if c.Severity != app.PreflightBlock || !strings.Contains(c.Detail, "0.0.0.0:2222") || !strings.Contains(c.Detail, "[::]:2049") {
+		t.Fatalf("wildcard listeners must block, got %#v", c)
+	}
+	if c := checkPreflightForwards(n, true, parsePreflightFacts(preflightFreshServer+"@@arc-preflight tcp\nLISTEN 0 128 127.0.80.1:2222 0.0.0.0:*\n")); c.Severity != app.PreflightPass {
+		t.Fatalf("ARC's own forward must not block a re-run, got %#v", c)
+	}
+}
+
+func TestEvaluatePreflight_RelayPort(t *testing.T) {
+	n := defaultWGNetwork()
+	n.Relay = "tcp:443"
+	f := parsePreflightFacts(preflightFreshServer + `@@arc-preflight tcp
+LISTEN 0      128          0.0.0.0:22         0.0.0.0:*
+LISTEN 0      511        127.0.0.1:8443       0.0.0.0:*
+`)
+	checks := preflightChecksByKey(evaluatePreflight(n, false, f, f))
+	if c := checks[statusRemote+" relay port"]; c.Severity != app.PreflightPass {
+		t.Fatalf("TCP 443 is free, got %#v", c)
+	}
+	if _, ok := checks[statusLocal+" relay port"]; ok {
+		t.Fatalf("the relay only listens on the server")
+	}
+
+	f = parsePreflightFacts(preflightFreshServer + `@@arc-preflight tcp
+LISTEN 0      511             [::]:443           [::]:*
+`)
+	if c := checkPreflightRelayPort(n, false, f); c.Severity != app.PreflightBlock || !strings.Contains(c.Fix, "--wg-relay tcp:PORT") {
+		t.Fatalf("a web server on 443 must block, got %#v", c)
+	}
+	if c := checkPreflightRelayPort(n, true, f); c.Severity != app.PreflightPass {
+		t.Fatalf("ARC's own relay must not block a re-run, got %#v", c)
+	}
+}
+
+func TestEvaluatePreflight_RendezvousPortIsLocal(t *testing.T) {
+	n := defaultWGNetwork()
+	n.Rendezvous = "desk.example.net:51820"
+	busy := parsePreflightFacts(strings.Replace(preflightFreshServer, "@@arc-preflight df", "UNCONN 0      0                  0.0.0.0:51820      0.0.0.0:*\n@@arc-preflight df", 1))
+	checks := preflightChecksByKey(evaluatePreflight(n, false, busy, busy))
+	if _, ok := checks[statusRemote+" wireguard port"]; ok {
+		t.Fatalf("a server dialing a rendezvous listens on no port")
+	}
+	if c := checks[statusLocal+" wireguard port"]; c.Severity != app.PreflightBlock {
+		t.Fatalf("the desktop listens for the server, got %#v", c)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"arc/internal/wgconf"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// runRelayCLI runs `arc relay serve` on the server and `arc relay connect IFACE` locally: the
+// two ends of the UDP-over-TCP fallback. The arc-relay units run them after a setup with
+// --wg-relay.
+func runRelayCLI(args []string, stdout, stderr io.Writer) int {
+	if len(args) == 0 {
+		fmt.Fprintln(stderr, "arc relay: want a subcommand: serve or connect")
+		return 2
+	}
+	var listen, server string
+	var webSocket bool
+	var wgPortFlag int
+	var stall time.Duration
+	fs := flag.NewFlagSet("arc relay "+args[0], flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.BoolVar(&webSocket, "websocket", false, "carry the datagrams as WebSocket messages")
+	switch args[0] {
+	case "serve":
+		fs.StringVar(&listen, "listen", ":"+strconv.Itoa(wgRelayPort), "TCP address to accept relay connections on")
+		fs.IntVar(&wgPortFlag, "wg-port", wgPort, "the WireGuard UDP port to hand the datagrams to")
+	case "connect":
+		fs.StringVar(&server, "server", "", "the relay server, HOST:PORT")
+		fs.DurationVar(&stall, "stall", relayDefaultStall, "switch transports after this long without a handshake")
+	default:
+		fmt.Fprintf(stderr, "arc relay: unknown subcommand %q (want serve or connect)\n", args[0])
+		return 2
+	}
+	if err := fs.Parse(args[1:]); err != nil {
+		if !errors.Is(err, flag.ErrHelp) {
+			fmt.Fprintf(stderr, "arc relay: %v\n", err)
+		}
+		return 2
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	logf := func(format string, a ...any) { fmt.Fprintf(stderr, "arc relay: "+format+"\n", a...) }
+
+	if args[0] == "serve" {
+		if fs.NArg() != 0 {
+			fmt.Fprintln(stderr, "arc relay: usage: arc relay serve [--listen ADDR] [--websocket] [--wg-port PORT]")
+			return 2
+		}
+		ln, err := net.Listen("tcp", listen)
+		if err != nil {
+			logf("%v", err)
+			return 1
+		}
+		fmt.Fprintf(stdout, "arc relay: relaying %s to WireGuard on UDP %d\n", ln.Addr(), wgPortFlag)
+		if err := serveRelay(ctx, ln, webSocket, net.JoinHostPort("127.0.0.1", strconv.Itoa(wgPortFlag)), logf); err != nil {
+			logf("%v", err)
+			return 1
+		}
+		return 0
+	}
+
+	if fs.NArg() != 1 || server == "" {
+		fmt.Fprintln(stderr, "arc relay: usage: arc relay connect --server HOST:PORT [--websocket] [--stall DURATION] IFACE")
+		return 2
+	}
+	iface := fs.Arg(0)
+	if !wgInterfacePattern.MatchString(iface) {
+		fmt.Fprintf(stderr, "arc relay: invalid interface name %q\n", iface)
+		return 2
+	}
+	if stall <= 0 {
+		fmt.Fprintln(stderr, "arc relay: --stall must be positive")
+		return 2
+	}
+	loadPeer := func() (wgconf.Peer, error) {
+		conf, err := loadWGQuickConf(iface)
+		if err != nil {
+			return wgconf.Peer{}, err
+		}
+		return relayServerPeer(conf)
+	}
+	if _, err := loadPeer(); err != nil {
+		logf("%v", err)
+		return 1
+	}
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		logf("%v", err)
+		return 1
+	}
+	client := &relayClient{pc: pc, dial: relayDialer(server, webSocket), logf: logf}
+	watchdog := &relayWatchdog{
+		iface:    iface,
+		loadPeer: loadPeer,
+		relay:    pc.LocalAddr().String(),
+		stall:    stall,
+		wg:       runWG,
+		logf:     logf,
+		now:      time.Now,
+	}
+	go watchdog.run(ctx)
+	fmt.Fprintf(stdout, "arc relay: %s falls back to %s through %s after %s without a handshake\n", iface, server, pc.LocalAddr(), stall)
+	if err := client.run(ctx); err != nil {
+		logf("%v", err)
+		return 1
+	}
+	return 0
+}
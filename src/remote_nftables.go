@@ -1,6 +1,8 @@
 package main
 
 import (
+	"arc/internal/workflow"
+	"context"
 	"fmt"
 	"strings"
 
@@ -14,12 +16,15 @@ const (
 	lhRedirectSysctlConfPath = "/etc/sysctl.d/99-arc-route-localnet.conf"
 )
 
-const lhRedirectNftContentTpl = `table ip lh_redirect {
+// The redirect lives in an inet table so it sits next to the dual-stack lockdown rules. It
+// only rewrites IPv4: Linux has no route_localnet for IPv6, so a tunnel IPv6 address reaches
+// only services listening on it or on ::.
+const lhRedirectNftContentTpl = `table inet lh_redirect {
   chain prerouting {
     type nat hook prerouting priority dstnat; policy accept;
 
     # Expose localhost services over WireGuard by DNATing wg destination to loopback.
-    iifname "%s" ip daddr %s dnat to 127.0.0.1
+    iifname "%s" ip daddr %s dnat ip to 127.0.0.1
   }
 }
 `
@@ -31,8 +36,9 @@ Wants=network-online.target
 
 [Service]
 Type=oneshot
-ExecStartPre=-%s delete table ip lh_redirect
-ExecStart=%s -f /etc/nftables.d/lh_redirect.nft
+ExecStartPre=-%[1]s delete table ip lh_redirect
+ExecStartPre=-%[1]s delete table inet lh_redirect
+ExecStart=%[2]s -f /etc/nftables.d/lh_redirect.nft
 RemainAfterExit=yes
 
 [Install]
@@ -44,39 +50,44 @@ net.ipv4.conf.%s.route_localnet=1
 `
 
 func ensureRemoteLHRedirectNftablesService(ctx infraRunContext) error {
-	client, err := dialArcWithKey(ctx.Addr)
+	client, release, err := arcClientFor(ctx)
 	if err != nil {
 		return err
 	}
-	defer client.Close()
+	defer release()
 
-	out, err := runRemoteCommand(client, "cat /etc/os-release", false, "")
+	out, err := runRemoteCommand(ctx, client, "cat /etc/os-release", false, "")
 	if err != nil {
 		return err
 	}
 	id := strings.TrimSpace(parseOSRelease(out)["ID"])
 	installCmd := ""
+	pkgs := strings.Join(stepPackages[workflow.StepApplyServerNFTables].forOS(id), " ")
 	switch id {
 	case "ubuntu", "debian":
-		installCmd = "apt-get update\napt-get install -y nftables"
+		installCmd = "apt-get update\napt-get install -y " + pkgs
 	case "arch", "manjaro":
-		installCmd = "pacman -Sy --noconfirm nftables"
+		installCmd = "pacman -Sy --noconfirm " + pkgs
 	default:
 		return fmt.Errorf("unsupported remote OS ID=%q (supported: ubuntu, debian, arch, manjaro)", id)
 	}
 
-	if _, err := runRemoteCommand(client, "sudo -n sh -lc "+shSingleQuote("set -eu\n"+installCmd), false, ""); err != nil {
+	if _, err := runRemoteCommand(ctx, client, "sudo -n sh -lc "+shSingleQuote("set -eu\n"+installCmd), false, ""); err != nil {
 		return err
 	}
 
-	nftBin, err := detectRemoteNFTBinary(client)
+	nftBin, err := detectRemoteNFTBinary(ctx, client)
 	if err != nil {
 		return err
 	}
 
-	nftContent := fmt.Sprintf(lhRedirectNftContentTpl, wgInterface, wgServerIP)
+	n := ctx.WG.Net
+	nftContent := fmt.Sprintf(lhRedirectNftContentTpl, n.Interface, n.ServerIP)
 	serviceContent := fmt.Sprintf(lhRedirectServiceContentTpl, nftBin, nftBin)
-	sysctlContent := fmt.Sprintf(lhRedirectSysctlContentTpl, wgInterface)
+	sysctlContent := fmt.Sprintf(lhRedirectSysctlContentTpl, n.Interface)
+	if err := backupRemoteFiles(ctx, client, lhRedirectSysctlConfPath, lhRedirectNftPath, lhRedirectServicePath); err != nil {
+		return err
+	}
 
 	script := fmt.Sprintf(
 		"set -eu\n"+
@@ -91,22 +102,22 @@ func ensureRemoteLHRedirectNftablesService(ctx infraRunContext) error {
 			"rm -f /etc/systemd/system/arc-lh-redirect-nftables.service\n"+
 			"cat > %s <<'EOF'\n%sEOF\n"+
 			"chmod 0644 %s\n",
-		lhRedirectSysctlConfPath, sysctlContent, lhRedirectSysctlConfPath, wgInterface,
+		lhRedirectSysctlConfPath, sysctlContent, lhRedirectSysctlConfPath, n.Interface,
 		lhRedirectNftPath, nftContent, lhRedirectNftPath,
 		lhRedirectServicePath, serviceContent, lhRedirectServicePath,
 	)
-	if _, err := runRemoteCommand(client, "sudo -n sh -lc "+shSingleQuote(script), false, ""); err != nil {
+	if _, err := runRemoteCommand(ctx, client, "sudo -n sh -lc "+shSingleQuote(script), false, ""); err != nil {
 		return err
 	}
-	if _, err := runRemoteCommand(client, "sudo -n systemctl daemon-reload", false, ""); err != nil {
+	if _, err := runRemoteCommand(ctx, client, "sudo -n systemctl daemon-reload", false, ""); err != nil {
 		return err
 	}
-	if _, err := runRemoteCommand(client, "sudo -n systemctl enable --now "+lhRedirectServiceName, false, ""); err != nil {
+	if _, err := runRemoteCommand(ctx, client, "sudo -n systemctl enable --now "+lhRedirectServiceName, false, ""); err != nil {
 		return err
 	}
-	if _, err := runRemoteCommand(client, "sudo -n systemctl is-active --quiet "+lhRedirectServiceName, false, ""); err != nil {
-		status, _ := runRemoteCommand(client, "sudo -n systemctl status --no-pager -l "+lhRedirectServiceName, false, "")
-		journal, _ := runRemoteCommand(client, "sudo -n journalctl -u "+lhRedirectServiceName+" -b --no-pager -n 120", false, "")
+	if _, err := runRemoteCommand(ctx, client, "sudo -n systemctl is-active --quiet "+lhRedirectServiceName, false, ""); err != nil {
+		status, _ := runRemoteCommand(ctx, client, "sudo -n systemctl status --no-pager -l "+lhRedirectServiceName, false, "")
+		journal, _ := runRemoteCommand(ctx, client, "sudo -n journalctl -u "+lhRedirectServiceName+" -b --no-pager -n 120", false, "")
 		if status != "" {
 			if journal != "" {
 				return fmt.Errorf("%v; status:\n%s\n\njournal:\n%s", err, status, journal)
@@ -118,7 +129,25 @@ func ensureRemoteLHRedirectNftablesService(ctx infraRunContext) error {
 	return nil
 }
 
-func detectRemoteNFTBinary(client *ssh.Client) (string, error) {
+// removeRemoteLHRedirectNftablesService stops the redirect, drops its table and turns
+// route_localnet back off.
+func removeRemoteLHRedirectNftablesService(ctx infraRunContext) error {
+	backup, err := remoteBackupCommand(ctx, lhRedirectSysctlConfPath, lhRedirectNftPath, lhRedirectServicePath)
+	if err != nil {
+		return err
+	}
+	script := "set -eu\n" +
+		disableUnitScript("systemctl", lhRedirectServiceName) +
+		fmt.Sprintf("rm -f %s %s %s\n", lhRedirectServicePath, lhRedirectNftPath, lhRedirectSysctlConfPath) +
+		"nft delete table inet lh_redirect 2>/dev/null || true\n" +
+		"nft delete table ip lh_redirect 2>/dev/null || true\n" +
+		"sysctl -w net.ipv4.conf.all.route_localnet=0 >/dev/null\n" +
+		fmt.Sprintf("sysctl -w net.ipv4.conf.%s.route_localnet=0 >/dev/null 2>&1 || true\n", ctx.WG.Net.Interface) +
+		"systemctl daemon-reload\n"
+	return runRemoteUndoScript(ctx, backup+"sudo -n sh -lc "+shSingleQuote(script))
+}
+
+func detectRemoteNFTBinary(ctx context.Context, client *ssh.Client) (string, error) {
 	script := `set -eu
 p="$(command -v nft || true)"
 if [ -z "$p" ]; then
@@ -129,7 +158,7 @@ fi
 [ -x "$p" ] || { echo "nft binary not found"; exit 1; }
 printf '%s' "$p"
 `
-	out, err := runRemoteCommand(client, "sh -lc "+shSingleQuote(script), false, "")
+	out, err := runRemoteCommand(ctx, client, "sh -lc "+shSingleQuote(script), false, "")
 	if err != nil {
 		return "", fmt.Errorf("detect remote nft binary: %w", err)
 	}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"runtime"
@@ -9,19 +10,24 @@ import (
 	"golang.org/x/crypto/ssh"
 )
 
-func syncRemoteArcHelper(addr, host string, wg wgConfig) error {
-	payload, err := buildMobilePayload(host, wg)
-	if err != nil {
-		return err
+func syncRemoteArcHelper(ctx infraRunContext) error {
+	// Without a mobile peer there is nothing to pair, and a payload from an earlier run would
+	// pair a phone with keys the server no longer has.
+	var payload string
+	if !ctx.WG.Net.Reverse() {
+		var err error
+		if payload, err = buildMobilePayload(ctx.Host, ctx.WG); err != nil {
+			return err
+		}
 	}
 
-	client, err := dialArcWithKey(addr)
+	client, release, err := arcClientFor(ctx)
 	if err != nil {
 		return fmt.Errorf("cannot connect as %s: %w", arcUser, err)
 	}
-	defer client.Close()
+	defer release()
 
-	binary, err := currentArcHelperBinaryForRemote(client)
+	binary, err := currentArcHelperBinaryForRemote(ctx, client)
 	if err != nil {
 		return err
 	}
@@ -29,14 +35,22 @@ func syncRemoteArcHelper(addr, host string, wg wgConfig) error {
 	if err := uploadRemoteFile(client, arcPairingBinaryPath, binary, arcPairingBinaryPerm); err != nil {
 		return fmt.Errorf("install remote arc helper: %w", err)
 	}
+	if payload == "" {
+		_, err := runRemoteCommand(ctx, client, fmt.Sprintf(`rm -f "$HOME/%s"`, arcPairingPayloadPath), false, "")
+		return err
+	}
 	if err := uploadRemoteFile(client, arcPairingPayloadPath, append([]byte(payload), '\n'), arcPairingPayloadPerm); err != nil {
 		return fmt.Errorf("install remote pairing payload: %w", err)
 	}
 	return nil
 }
 
-func currentArcHelperBinaryForRemote(client *ssh.Client) ([]byte, error) {
-	goos, goarch, err := detectRemoteGoTarget(client)
+func removeRemoteArcHelper(ctx infraRunContext) error {
+	return runRemoteUndoScript(ctx, fmt.Sprintf(`rm -f "$HOME/%s" "$HOME/%s"`, arcPairingBinaryPath, arcPairingPayloadPath))
+}
+
+func currentArcHelperBinaryForRemote(ctx context.Context, client *ssh.Client) ([]byte, error) {
+	goos, goarch, err := detectRemoteGoTarget(ctx, client)
 	if err != nil {
 		return nil, err
 	}
@@ -61,8 +75,8 @@ func currentArcHelperBinaryForRemote(client *ssh.Client) ([]byte, error) {
 	return binary, nil
 }
 
-func detectRemoteGoTarget(client *ssh.Client) (goos, goarch string, err error) {
-	out, err := runRemoteCommand(client, "printf '%s %s' \"$(uname -s)\" \"$(uname -m)\"", false, "")
+func detectRemoteGoTarget(ctx context.Context, client *ssh.Client) (goos, goarch string, err error) {
+	out, err := runRemoteCommand(ctx, client, "printf '%s %s' \"$(uname -s)\" \"$(uname -m)\"", false, "")
 	if err != nil {
 		return "", "", fmt.Errorf("detect remote platform: %w", err)
 	}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// restoreTimeout bounds a whole `arc restore` run.
+const restoreTimeout = 5 * time.Minute
+
+type restoreOptions struct {
+	RunID  string
+	Local  bool
+	Remote bool
+	Yes    bool
+}
+
+// parseRestoreOptions accepts flags before or after the run ID. Without a run ID the
+// recorded backups are listed.
+func parseRestoreOptions(args []string, stderr io.Writer) (restoreOptions, error) {
+	var opts restoreOptions
+	fs := flag.NewFlagSet("arc restore", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.BoolVar(&opts.Local, "local", false, "only restore files on this machine")
+	fs.BoolVar(&opts.Remote, "remote", false, "only restore files on the server")
+	fs.BoolVar(&opts.Yes, "yes", false, "do not ask for confirmation")
+	if err := fs.Parse(args); err != nil {
+		return opts, err
+	}
+	if fs.NArg() > 0 {
+		opts.RunID = fs.Arg(0)
+		if err := fs.Parse(fs.Args()[1:]); err != nil {
+			return opts, err
+		}
+		if fs.NArg() > 0 {
+			return opts, fmt.Errorf("unexpected arguments after run ID: %v", fs.Args())
+		}
+		if err := validBackupRunID(opts.RunID); err != nil {
+			return opts, err
+		}
+	}
+	if !opts.Local && !opts.Remote {
+		opts.Local, opts.Remote = true, true
+	}
+	return opts, nil
+}
+
+func runRestoreCLI(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	opts, err := parseRestoreOptions(args, stderr)
+	if err != nil {
+		if !errors.Is(err, flag.ErrHelp) {
+			fmt.Fprintf(stderr, "arc restore: %v\n", err)
+		}
+		return 2
+	}
+	if opts.RunID == "" {
+		backups, err := listBackups()
+		if err != nil {
+			fmt.Fprintf(stderr, "arc restore: %v\n", err)
+			return 1
+		}
+		printBackups(stdout, backups)
+		return 0
+	}
+
+	dir, err := localBackupDir(opts.RunID)
+	if err != nil {
+		fmt.Fprintf(stderr, "arc restore: %v\n", err)
+		return 1
+	}
+	manifest, err := readBackupManifest(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			fmt.Fprintf(stderr, "arc restore: no backups recorded for run %s; run `arc restore` to list them\n", opts.RunID)
+		} else {
+			fmt.Fprintf(stderr, "arc restore: %v\n", err)
+		}
+		return 1
+	}
+	local := opts.Local && len(manifest.Files) > 0
+	remote := opts.Remote && manifest.Remote
+	if !local && !remote {
+		fmt.Fprintf(stdout, "run %s has no backed-up files to restore here\n", opts.RunID)
+		return 0
+	}
+
+	if !opts.Yes && !promptConfirmation(stdin, stderr, "Restore "+restoreSummary(manifest, local, remote)+"?") {
+		fmt.Fprintln(stderr, "arc restore: aborted")
+		return 1
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	ctx, cancel := context.WithTimeout(ctx, restoreTimeout)
+	defer cancel()
+
+	failed := false
+	if local {
+		lines, err := restoreLocalBackup(ctx, opts.RunID)
+		printRestored(stdout, statusLocal, lines)
+		if err != nil {
+			fmt.Fprintf(stderr, "arc restore: local: %v\n", err)
+			failed = true
+		}
+	}
+	if remote {
+		sessions := newSSHSessionManager()
+		defer func() { _ = sessions.Close() }()
+		runCtx := infraRunContext{Context: ctx, Addr: manifest.Addr, Host: manifest.Host, WG: wgConfig{Net: manifest.wgNetwork()}, SSH: sessions, RunID: opts.RunID}
+		lines, err := restoreRemoteBackupVia(&runCtx)
+		printRestored(stdout, statusRemote, lines)
+		if err != nil {
+			fmt.Fprintf(stderr, "arc restore: remote: %v\n", err)
+			failed = true
+		}
+	}
+	if failed {
+		return 1
+	}
+	fmt.Fprintln(stdout, "restored; restart affected services (e.g. "+manifest.wgNetwork().LocalUnit()+") or reboot to apply")
+	return 0
+}
+
+func restoreRemoteBackupVia(ctx *infraRunContext) ([]string, error) {
+	if ctx.Addr == "" {
+		return nil, fmt.Errorf("backup does not record the server address")
+	}
+	if err := pickServerRoute(ctx); err != nil {
+		return nil, err
+	}
+	return restoreRemoteBackup(*ctx)
+}
+
+func restoreSummary(m backupManifest, local, remote bool) string {
+	target := arcUser + "@" + m.Host
+	switch {
+	case local && remote:
+		return fmt.Sprintf("files on this machine and %s to their state before run %s", target, m.RunID)
+	case remote:
+		return fmt.Sprintf("files on %s to their state before run %s", target, m.RunID)
+	default:
+		return fmt.Sprintf("files on this machine to their state before run %s", m.RunID)
+	}
+}
+
+func printBackups(w io.Writer, backups []backupManifest) {
+	if len(backups) == 0 {
+		fmt.Fprintln(w, "no backups recorded")
+		return
+	}
+	for _, m := range backups {
+		where := fmt.Sprintf("%d local file(s)", len(m.Files))
+		if m.Remote {
+			where += " + server files on " + m.Host
+		}
+		fmt.Fprintf(w, "%s  %s\n", m.RunID, where)
+	}
+}
+
+func printRestored(w io.Writer, where string, lines []string) {
+	for _, ln := range lines {
+		fmt.Fprintf(w, "%s: %s\n", where, ln)
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"io"
+	"testing"
+)
+
+func TestParseRestoreOptions(t *testing.T) {
+	opts, err := parseRestoreOptions([]string{"20261017T101500Z-a1b2c3", "--local", "--yes"}, io.Discard)
+	if err != nil {
+		t.Fatalf("parseRestoreOptions: %v", err)
+	}
+	if opts.RunID != "20261017T101500Z-a1b2c3" || !opts.Local || opts.Remote || !opts.Yes {
+		t.Fatalf("unexpected options: %+v", opts)
+	}
+
+	opts, err = parseRestoreOptions(nil, io.Discard)
+	if err != nil || opts.RunID != "" || !opts.Local || !opts.Remote {
+		t.Fatalf("no arguments: got %+v, %v", opts, err)
+	}
+
+	for _, bad := range [][]string{{"../state"}, {"a/b"}, {"run", "extra"}} {
+		if _, err := parseRestoreOptions(bad, io.Discard); err == nil {
+			t.Fatalf("parseRestoreOptions(%q) accepted", bad)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// rotateTimeout bounds `arc rotate wireguard`, including the wait for the phone to re-pair.
+const rotateTimeout = rotateMobileWindow + 2*time.Minute
+
+func runRotateCLI(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	if len(args) == 0 || args[0] != "wireguard" {
+		fmt.Fprintln(stderr, "arc rotate: usage: arc rotate wireguard [--device NAME] [--yes]")
+		return 2
+	}
+	var device string
+	var yes bool
+	fs := flag.NewFlagSet("arc rotate wireguard", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.StringVar(&device, "device", "", "device whose keys to rotate: this machine (default) or mobile")
+	fs.BoolVar(&yes, "yes", false, "do not ask for confirmation")
+	if err := fs.Parse(args[1:]); err != nil {
+		if !errors.Is(err, flag.ErrHelp) {
+			fmt.Fprintf(stderr, "arc rotate: %v\n", err)
+		}
+		return 2
+	}
+	if fs.NArg() > 0 {
+		fmt.Fprintf(stderr, "arc rotate: unexpected arguments: %s\n", strings.Join(fs.Args(), " "))
+		return 2
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	ctx, cancel := context.WithTimeout(ctx, rotateTimeout)
+	defer cancel()
+
+	sessions := newSSHSessionManager()
+	defer func() { _ = sessions.Close() }()
+
+	runCtx, err := latestRunContext(ctx, sessions)
+	if err != nil {
+		fmt.Fprintf(stderr, "arc rotate: %v\n", err)
+		return 1
+	}
+	target, err := resolveRotateTarget(device, runCtx)
+	if err != nil {
+		fmt.Fprintf(stderr, "arc rotate: %v\n", err)
+		return 1
+	}
+	if _, err := execLocal(ctx, "sudo", "-n", "true"); err != nil {
+		fmt.Fprintf(stderr, "arc rotate: local sudo is required (run `sudo -v` first): %v\n", err)
+		return 1
+	}
+	question := fmt.Sprintf("Rotate the WireGuard keys of %s on %s? The tunnel drops for a few seconds.", target.Name, runCtx.Host)
+	if target.Mobile {
+		question = fmt.Sprintf("Rotate the WireGuard keys of the phone on %s? It has to be paired again.", runCtx.Host)
+	}
+	if !yes && !promptConfirmation(stdin, stderr, question) {
+		fmt.Fprintln(stderr, "arc rotate: aborted")
+		return 1
+	}
+	if err := pickServerRoute(&runCtx); err != nil {
+		fmt.Fprintf(stderr, "arc rotate: %v\n", err)
+		return 1
+	}
+
+	rot, err := rotateWireGuard(runCtx, device, func(msg string) { fmt.Fprintln(stdout, msg) })
+	if err != nil {
+		fmt.Fprintf(stderr, "arc rotate: %v\n", err)
+		return 1
+	}
+	fmt.Fprintf(stdout, "rotated %s: WireGuard public key is now %s\n", rot.Target.Name, rot.NewPub)
+	return 0
+}
@@ -0,0 +1,455 @@
+package main
+
+import (
+	"arc/internal/wgconf"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// A rotation swaps the peer on the server from a transient unit that keeps the old key for a
+// while: it commits once the new key has completed a handshake, and puts the old key back
+// otherwise. The server rolls itself back even when the tunnel to it is gone.
+const (
+	rotateUnit       = "arc-wg-rotate"
+	rotateStateFile  = "/run/arc-wg-rotate.state"
+	rotatePSKFile    = "/run/arc-wg-rotate.psk"
+	rotateOldPSKFile = "/run/arc-wg-rotate.old-psk"
+
+	rotatePending    = "pending"
+	rotateCommitted  = "committed"
+	rotateRolledBack = "rolled-back"
+
+	// rotateWindow is how long the server waits for this machine's new key.
+	rotateWindow = time.Minute
+	// rotateMobileWindow leaves time to scan the new pairing code on the phone.
+	rotateMobileWindow = 5 * time.Minute
+)
+
+// rotateTarget is the peer whose keys a rotation replaces.
+type rotateTarget struct {
+	Name   string
+	CIDR   string
+	Mobile bool
+}
+
+// wgRotation is a planned key rotation of one peer.
+type wgRotation struct {
+	Target     rotateTarget
+	OldPub     string
+	NewPriv    string
+	NewPub     string
+	OldPSK     string
+	NewPSK     string
+	AllowedIPs []string
+	// DeviceConf is the rotated peer's own config with the new private key.
+	DeviceConf string
+	// ServerConf is the server config with the peer's new public key.
+	ServerConf string
+	// Registry is the device registry with the new key; empty when the server has none yet.
+	Registry string
+}
+
+// resolveRotateTarget maps --device to a peer whose private key this machine holds: itself,
+// or the phone on the machine that ran setup.
+func resolveRotateTarget(device string, ctx infraRunContext) (rotateTarget, error) {
+	n := ctx.WG.Net
+	self := ctx.Device
+	if self == "" {
+		self = deviceDesktop
+	}
+	switch strings.TrimSpace(device) {
+	case "", self:
+		return rotateTarget{Name: self, CIDR: n.DesktopCIDR()}, nil
+	case deviceMobile:
+		if ctx.Device != "" {
+			return rotateTarget{}, fmt.Errorf("the mobile config is kept by the machine that ran `arc setup`; rotate it there")
+		}
+		if strings.TrimSpace(ctx.WG.MobileClientConf) == "" {
+			return rotateTarget{}, fmt.Errorf("the latest setup run has no mobile WireGuard config")
+		}
+		return rotateTarget{Name: deviceMobile, CIDR: n.MobileCIDR(), Mobile: true}, nil
+	default:
+		return rotateTarget{}, fmt.Errorf("this machine does not hold the keys of %q; run `arc rotate wireguard` on it", device)
+	}
+}
+
+// planWGRotation gives the peer's own config the new private key and patches its [Peer] on the
+// server with the new public key. The link gets a new PresharedKey on both sides as well.
+func planWGRotation(deviceConf, serverConf string, reg deviceRegistry, t rotateTarget, newPriv, newPSK string) (wgRotation, error) {
+	dev, err := wgconf.Parse(deviceConf)
+	if err != nil {
+		return wgRotation{}, fmt.Errorf("parse %s wg config: %w", t.Name, err)
+	}
+	server, err := wgconf.Parse(serverConf)
+	if err != nil {
+		return wgRotation{}, fmt.Errorf("parse server wg config: %w", err)
+	}
+	newPub, err := wgPublicKeyFromPrivateKeyB64(newPriv)
+	if err != nil {
+		return wgRotation{}, err
+	}
+	// patchWGPeer falls back to the first peer, which would hand another device's address to
+	// the new key; a rotation only ever touches the peer that routes the target's address.
+	i := server.PeerRouting(t.CIDR)
+	if i < 0 {
+		return wgRotation{}, fmt.Errorf("server wg config has no peer for %s (%s)", t.Name, t.CIDR)
+	}
+	oldPub, oldPSK := server.Peers[i].PublicKey, server.Peers[i].PresharedKey
+	if oldPub == newPub {
+		return wgRotation{}, fmt.Errorf("new key equals the current key of %s", t.Name)
+	}
+	allowed := append([]string(nil), server.Peers[i].AllowedIPs...)
+
+	dev.Interface.PrivateKey = newPriv
+	// The only peer of a device config is the server.
+	patchWGPeerPSK(dev, "", newPSK)
+	if err := dev.Validate(); err != nil {
+		return wgRotation{}, fmt.Errorf("%s wg config would be invalid: %w", t.Name, err)
+	}
+	if _, err := patchWGPeer(server, t.CIDR, newPub, "", 0); err != nil {
+		return wgRotation{}, fmt.Errorf("patch server wg peer: %w", err)
+	}
+	patchWGPeerPSK(server, t.CIDR, newPSK)
+	if err := server.Validate(); err != nil {
+		return wgRotation{}, fmt.Errorf("server wg config would be invalid: %w", err)
+	}
+
+	rot := wgRotation{
+		Target:     t,
+		OldPub:     oldPub,
+		NewPriv:    newPriv,
+		NewPub:     newPub,
+		OldPSK:     oldPSK,
+		NewPSK:     newPSK,
+		AllowedIPs: allowed,
+		DeviceConf: dev.String(),
+		ServerConf: server.String(),
+	}
+	if len(reg.Devices) > 0 {
+		ip, _, _ := strings.Cut(t.CIDR, "/")
+		for i, d := range reg.Devices {
+			if d.IP == ip || d.WGPublicKey == oldPub {
+				reg.Devices[i].WGPublicKey = newPub
+			}
+		}
+		raw, err := json.MarshalIndent(reg, "", "  ")
+		if err != nil {
+			return wgRotation{}, fmt.Errorf("marshal device registry: %w", err)
+		}
+		rot.Registry = string(raw)
+	}
+	return rot, nil
+}
+
+// rotateServerScript stages the new server files and starts the unit that swaps the peer,
+// waits up to window for a handshake with the new key, and rolls back without one. Only the
+// rotated peer changes on the running interface, so other peers keep their sessions.
+func rotateServerScript(rot wgRotation, n wgNetwork, window time.Duration) string {
+	allowed := strings.Join(rot.AllowedIPs, ",")
+	conf := n.ConfPath()
+	swap := fmt.Sprintf("mv %[1]s %[1]s.arc.rotate-old\nmv %[1]s.arc.rotate %[1]s\n", conf)
+	restore := fmt.Sprintf("mv %[1]s.arc.rotate-old %[1]s\n", conf)
+	commit := fmt.Sprintf("rm -f %s.arc.rotate-old\n", conf)
+	stage := fmt.Sprintf("cat > %s.arc.rotate <<'EOF'\n%sEOF\ncat > %s <<'EOF'\n%s\nEOF\n", conf, rot.ServerConf, rotatePSKFile, rot.NewPSK)
+	oldPSK := ""
+	if rot.OldPSK != "" {
+		stage += fmt.Sprintf("cat > %s <<'EOF'\n%s\nEOF\n", rotateOldPSKFile, rot.OldPSK)
+		oldPSK = " preshared-key " + rotateOldPSKFile
+	}
+	if rot.Registry != "" {
+		swap += fmt.Sprintf("if [ -f %[1]s ]; then cp -p %[1]s %[1]s.arc.rotate-old; fi\nmv %[1]s.arc.rotate %[1]s\n", deviceRegistryPath)
+		restore += fmt.Sprintf("if [ -f %[1]s.arc.rotate-old ]; then mv %[1]s.arc.rotate-old %[1]s; else rm -f %[1]s; fi\n", deviceRegistryPath)
+		commit += fmt.Sprintf("rm -f %s.arc.rotate-old\n", deviceRegistryPath)
+		stage += fmt.Sprintf("install -d -m 0755 /etc/arc\ncat > %s.arc.rotate <<'EOF'\n%s\nEOF\n", deviceRegistryPath, rot.Registry)
+	}
+
+	swapper := fmt.Sprintf(`set -u
+umask 077
+# Let the command that started this unit return before the peer changes.
+sleep 2
+%[1]swg set %[2]s peer %[3]s remove
+wg set %[2]s peer %[4]s allowed-ips %[5]s preshared-key %[12]s
+i=0
+while [ "$i" -lt %[6]d ]; do
+	hs="$(wg show %[2]s latest-handshakes | awk -v k=%[4]s '$1 == k { print $2 }')"
+	if [ -n "$hs" ] && [ "$hs" != 0 ]; then
+		%[7]srm -f %[12]s %[13]s
+		echo %[8]s > %[9]s
+		exit 0
+	fi
+	sleep 1
+	i=$((i + 1))
+done
+%[10]swg set %[2]s peer %[4]s remove
+wg set %[2]s peer %[3]s allowed-ips %[5]s%[14]s
+rm -f %[12]s %[13]s
+echo %[11]s > %[9]s
+`, swap, n.Interface, rot.OldPub, rot.NewPub, allowed, int(window/time.Second),
+		strings.ReplaceAll(commit, "\n", "\n\t\t"), rotateCommitted, rotateStateFile, restore, rotateRolledBack,
+		rotatePSKFile, rotateOldPSKFile, oldPSK)
+
+	return fmt.Sprintf(`set -eu
+umask 077
+if systemctl is-active --quiet %[1]s; then
+	echo "another WireGuard key rotation is still running" >&2
+	exit 1
+fi
+%[2]secho %[3]s > %[4]s
+systemd-run --quiet --collect --unit=%[1]s sh -c %[5]s
+`, rotateUnit, stage, rotatePending, rotateStateFile, shSingleQuote(swapper))
+}
+
+// rotateWireGuard replaces the WireGuard keys of one peer on both sides. For this machine it
+// restarts only the local interface and checks the tunnel; for the phone it waits for the
+// phone to connect with the new pairing code. Either side goes back to the old keys when the
+// new ones do not come up.
+func rotateWireGuard(ctx infraRunContext, device string, progress func(string)) (wgRotation, error) {
+	n := ctx.WG.Net
+	t, err := resolveRotateTarget(device, ctx)
+	if err != nil {
+		return wgRotation{}, err
+	}
+	deviceConf := ctx.WG.MobileClientConf
+	if !t.Mobile {
+		if deviceConf, err = readLocalWGConf(ctx, n); err != nil {
+			return wgRotation{}, fmt.Errorf("read local wg config: %w", err)
+		}
+	}
+	newPriv, _, err := genWGKeyPair()
+	if err != nil {
+		return wgRotation{}, err
+	}
+	newPSK, err := genWGPresharedKey()
+	if err != nil {
+		return wgRotation{}, err
+	}
+
+	var rot wgRotation
+	window := rotateWindow
+	if t.Mobile {
+		window = rotateMobileWindow
+	}
+	err = withArcClient(ctx, func(client *ssh.Client) error {
+		conf, reg, err := readServerDevices(ctx, client)
+		if err != nil {
+			return err
+		}
+		if rot, err = planWGRotation(deviceConf, conf.String(), reg, t, newPriv, newPSK); err != nil {
+			return err
+		}
+		if err := backupRemoteFiles(ctx, client, n.ConfPath(), deviceRegistryPath); err != nil {
+			return err
+		}
+		script := rotateServerScript(rot, n, window)
+		if _, err := runRemoteCommand(ctx, client, "sudo -n sh -c "+shSingleQuote(script), false, ""); err != nil {
+			return fmt.Errorf("start key rotation on server: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return wgRotation{}, err
+	}
+
+	if t.Mobile {
+		err = rotateMobileKeys(ctx, rot, window, progress)
+	} else {
+		err = rotateLocalKeys(ctx, rot, window, progress)
+	}
+	if err != nil {
+		return rot, err
+	}
+	return rot, saveRotatedWGConfig(ctx, rot)
+}
+
+func rotateLocalKeys(ctx infraRunContext, rot wgRotation, window time.Duration, progress func(string)) error {
+	n := ctx.WG.Net
+	oldConf, err := readLocalWGConf(ctx, n)
+	if err != nil {
+		return fmt.Errorf("read local wg config: %w", err)
+	}
+	// Sessions over the tunnel stall while the keys change; redial them afterwards.
+	if ctx.SSH != nil {
+		_ = ctx.SSH.Close()
+	}
+
+	progress(fmt.Sprintf("restarting %s with the new key", n.QuickUnit()))
+	deadline := time.Now().Add(window)
+	upErr := restartLocalWireGuardWith(ctx, rot.DeviceConf)
+	if upErr == nil {
+		progress("waiting for a handshake with the server")
+		upErr = waitForTunnel(ctx, deadline)
+	}
+	if upErr == nil {
+		// Only a committed rotation is kept: until its window has passed the server may still
+		// go back to the old key, so a state that cannot be read counts as a failure.
+		state, err := waitRotateState(ctx, deadline.Add(10*time.Second))
+		switch {
+		case err != nil:
+			upErr = fmt.Errorf("server rotation state unknown: %w", err)
+		case state == rotateCommitted:
+			return nil
+		default:
+			upErr = fmt.Errorf("server reports %s", state)
+		}
+	}
+
+	progress("new keys did not come up; rolling back")
+	if err := restartLocalWireGuardWith(ctx, oldConf); err != nil {
+		return fmt.Errorf("key rotation failed (%v); restoring the local config also failed: %w", upErr, err)
+	}
+	// The server puts the old key back once its window has passed without a handshake.
+	if err := waitForTunnel(ctx, time.Now().Add(time.Until(deadline)+30*time.Second)); err != nil {
+		return fmt.Errorf("key rotation failed (%v); the tunnel is still down after rolling back: %w", upErr, err)
+	}
+	return fmt.Errorf("key rotation failed, rolled back to the old keys: %w", upErr)
+}
+
+func rotateMobileKeys(ctx infraRunContext, rot wgRotation, window time.Duration, progress func(string)) error {
+	rotated := ctx.WG
+	rotated.MobileClientConf = rot.DeviceConf
+	newPayload, err := buildMobilePayload(ctx.Host, rotated)
+	if err != nil {
+		return err
+	}
+	oldPayload, err := buildMobilePayload(ctx.Host, ctx.WG)
+	if err != nil {
+		return err
+	}
+	if err := withArcClient(ctx, func(client *ssh.Client) error {
+		return uploadRemoteFile(client, arcPairingPayloadPath, append([]byte(newPayload), '\n'), arcPairingPayloadPerm)
+	}); err != nil {
+		return fmt.Errorf("install remote pairing payload: %w", err)
+	}
+
+	progress(fmt.Sprintf("re-pair the phone within %s: run `~/%s pair-mobile` on the server as %s and scan the new code", window, arcPairingBinaryPath, arcUser))
+	state, err := waitRotateState(ctx, time.Now().Add(window+10*time.Second))
+	if err == nil && state == rotateCommitted {
+		return nil
+	}
+	if err == nil {
+		err = fmt.Errorf("the phone did not connect with the new key")
+	}
+	_ = withArcClient(ctx, func(client *ssh.Client) error {
+		return uploadRemoteFile(client, arcPairingPayloadPath, append([]byte(oldPayload), '\n'), arcPairingPayloadPerm)
+	})
+	return fmt.Errorf("key rotation failed, rolled back to the old keys: %w", err)
+}
+
+func restartLocalWireGuardWith(ctx infraRunContext, conf string) error {
+	n := ctx.WG.Net
+	path, err := localWGConfPath(n)
+	if err != nil {
+		return err
+	}
+	if err := installLocalManagedFile(ctx, path, []byte(conf), 0o600); err != nil {
+		return fmt.Errorf("install local wg conf: %w", err)
+	}
+	if _, err := localWGSystemctl(ctx, n, "restart", n.LocalUnit()); err != nil {
+		return localWGUnitError(ctx, n, err)
+	}
+	return nil
+}
+
+// waitForTunnel probes the server's tunnel address until it answers or deadline passes.
+func waitForTunnel(ctx infraRunContext, deadline time.Time) error {
+	var err error
+	for {
+		if err = probeTunnel(ctx); err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("no handshake with %s: %w", ctx.WG.Net.ServerIP, err)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// waitRotateState polls the server until the rotation unit committed or rolled back.
+func waitRotateState(ctx infraRunContext, deadline time.Time) (string, error) {
+	for {
+		var state string
+		err := withArcClient(ctx, func(client *ssh.Client) error {
+			out, err := runRemoteCommand(ctx, client, "sudo -n cat "+rotateStateFile, false, "")
+			state = strings.TrimSpace(out)
+			return err
+		})
+		if err == nil && state != rotatePending {
+			return state, nil
+		}
+		if time.Now().After(deadline) {
+			if err != nil {
+				return "", fmt.Errorf("read rotation state on server: %w", err)
+			}
+			return "", fmt.Errorf("server rotation did not finish in time")
+		}
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(2 * time.Second):
+		}
+	}
+}
+
+// rotatedWGConfig records the new keys in the run's WireGuard settings, so later steps and
+// `arc doctor --fix` do not bring the old ones back.
+func rotatedWGConfig(wg wgConfig, rot wgRotation) wgConfig {
+	if rot.Target.Mobile {
+		wg.MobileClientPriv, wg.MobileClientPub, wg.MobileClientConf = rot.NewPriv, rot.NewPub, rot.DeviceConf
+	} else {
+		wg.ClientPriv, wg.ClientPub, wg.ClientConf = rot.NewPriv, rot.NewPub, rot.DeviceConf
+	}
+	if wg.ServerConf != "" {
+		if server, err := wgconf.Parse(wg.ServerConf); err == nil && server.PeerRouting(rot.Target.CIDR) >= 0 {
+			changed, err := patchWGPeer(server, rot.Target.CIDR, rot.NewPub, "", 0)
+			if patchWGPeerPSK(server, rot.Target.CIDR, rot.NewPSK) {
+				changed = true
+			}
+			if err == nil && changed {
+				wg.ServerConf = server.String()
+			}
+		}
+	}
+	return wg
+}
+
+func saveRotatedWGConfig(ctx infraRunContext, rot wgRotation) error {
+	wg := rotatedWGConfig(ctx.WG, rot)
+	run, ok, err := latestSetupRun("")
+	if err != nil {
+		return err
+	}
+	if ok && run.ID == ctx.RunID {
+		run.WG = toAppWG(wg)
+		if err := saveSetupRun(run); err != nil {
+			return err
+		}
+	}
+	home, err := os.UserHomeDir()
+	if err != nil || home == "" {
+		return fmt.Errorf("cannot resolve home dir")
+	}
+	dir := filepath.Join(home, ".arc", "wireguard")
+	if err := ensureDir0700(dir); err != nil {
+		return err
+	}
+	n := ctx.WG.Net
+	if wg.ServerConf != "" {
+		if err := writeFile0600(filepath.Join(dir, "server-"+n.Interface+".conf"), []byte(wg.ServerConf)); err != nil {
+			return err
+		}
+	}
+	if rot.Target.Mobile {
+		return nil
+	}
+	return writeFile0600(filepath.Join(dir, "client-"+n.Interface+".conf"), []byte(wg.ClientConf))
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResolveRotateTarget(t *testing.T) {
+	wg, err := buildWGConfig("example.com", defaultWGNetwork())
+	if err != nil {
+		t.Fatalf("buildWGConfig: %v", err)
+	}
+	setup := infraRunContext{WG: wg}
+	if got, err := resolveRotateTarget("", setup); err != nil || got.Name != deviceDesktop || got.CIDR != defaultWGNetwork().DesktopCIDR() || got.Mobile {
+		t.Fatalf("unexpected default target %+v (%v)", got, err)
+	}
+	if got, err := resolveRotateTarget("mobile", setup); err != nil || got.CIDR != defaultWGNetwork().MobileCIDR() || !got.Mobile {
+		t.Fatalf("unexpected mobile target %+v (%v)", got, err)
+	}
+	if _, err := resolveRotateTarget("laptop", setup); err == nil {
+		t.Fatalf("expected another device to be refused")
+	}
+
+	joined := infraRunContext{WG: wg, Device: "laptop"}
+	joined.WG.Net.DesktopIP = "10.0.0.4"
+	if got, err := resolveRotateTarget("laptop", joined); err != nil || got.Name != "laptop" || got.CIDR != "10.0.0.4/32" {
+		t.Fatalf("unexpected joined target %+v (%v)", got, err)
+	}
+	if _, err := resolveRotateTarget("mobile", joined); err == nil {
+		t.Fatalf("a joined device does not hold the mobile keys")
+	}
+}
+
+func TestPlanWGRotation_PatchesOnlyTheTargetPeer(t *testing.T) {
+	wg, err := buildWGConfig("example.com", defaultWGNetwork())
+	if err != nil {
+		t.Fatalf("buildWGConfig: %v", err)
+	}
+	conf, n := testServerConf(t)
+	conf.Peers[0].PublicKey, conf.Peers[1].PublicKey = wg.ClientPub, wg.MobileClientPub
+	reg := seedDeviceRegistry(conf, n)
+	newPriv, newPub, _ := genWGKeyPair()
+	newPSK, _ := genWGPresharedKey()
+
+	rot, err := planWGRotation(wg.ClientConf, conf.String(), reg, rotateTarget{Name: deviceDesktop, CIDR: n.DesktopCIDR()}, newPriv, newPSK)
+	if err != nil {
+		t.Fatalf("planWGRotation: %v", err)
+	}
+	if rot.OldPub != wg.ClientPub || rot.NewPub != newPub || strings.Join(rot.AllowedIPs, ",") != defaultWGNetwork().DesktopCIDR() {
+		t.Fatalf("unexpected rotation: %+v", rot)
+	}
+	if !strings.Contains(rot.DeviceConf, "PrivateKey = "+newPriv) || strings.Contains(rot.DeviceConf, wg.ClientPriv) {
+		t.Fatalf("device config keeps the old key:\n%s", rot.DeviceConf)
+	}
+	if !strings.Contains(rot.ServerConf, newPub) || strings.Contains(rot.ServerConf, wg.ClientPub) || !strings.Contains(rot.ServerConf, wg.MobileClientPub) {
+		t.Fatalf("server config should swap only the desktop peer:\n%s", rot.ServerConf)
+	}
+	if !strings.Contains(rot.DeviceConf, "PresharedKey = "+newPSK) || strings.Count(rot.ServerConf, "PresharedKey = "+newPSK) != 1 {
+		t.Fatalf("the link should get the new preshared key on both sides:\n%s\n%s", rot.DeviceConf, rot.ServerConf)
+	}
+	if rot.OldPSK != conf.Peers[0].PresharedKey || rot.OldPSK == "" {
+		t.Fatalf("old preshared key not kept for rollback: %q", rot.OldPSK)
+	}
+	if !strings.Contains(rot.Registry, newPub) || !strings.Contains(rot.Registry, wg.MobileClientPub) {
+		t.Fatalf("registry not updated:\n%s", rot.Registry)
+	}
+
+	if _, err := planWGRotation(wg.ClientConf, conf.String(), reg, rotateTarget{Name: "laptop", CIDR: "10.0.0.9/32"}, newPriv, newPSK); err == nil {
+		t.Fatalf("expected a peer missing from the server config to be refused")
+	}
+	if rot, err := planWGRotation(wg.ClientConf, conf.String(), deviceRegistry{}, rotateTarget{Name: deviceDesktop, CIDR: n.DesktopCIDR()}, newPriv, newPSK); err != nil || rot.Registry != "" {
+		t.Fatalf("a server without a registry should not get one: %q (%v)", rot.Registry, err)
+	}
+}
+
+func TestRotateServerScript_RollsBackWithoutHandshake(t *testing.T) {
+	conf, n := testServerConf(t)
+	rot := wgRotation{OldPub: "OLD", NewPub: "NEW", OldPSK: "OLDPSK", NewPSK: "NEWPSK", AllowedIPs: []string{defaultWGNetwork().DesktopCIDR()}, ServerConf: conf.String(), Registry: `{"devices":[]}`}
+	script := rotateServerScript(rot, n, time.Minute)
+	for _, want := range []string{
+		"systemd-run --quiet --collect --unit=" + rotateUnit,
+		"wg set wg0 peer OLD remove",
+		"wg set wg0 peer NEW allowed-ips " + defaultWGNetwork().DesktopCIDR() + " preshared-key " + rotatePSKFile,
+		"-lt 60 ]",
+		"wg set wg0 peer NEW remove",
+		"wg set wg0 peer OLD allowed-ips " + defaultWGNetwork().DesktopCIDR() + " preshared-key " + rotateOldPSKFile,
+		"NEWPSK\nEOF",
+		rotateRolledBack,
+		deviceRegistryPath + ".arc.rotate-old",
+	} {
+		if !strings.Contains(script, want) {
+			t.Fatalf("script missing %q:\n%s", want, script)
+		}
+	}
+	if strings.Contains(script, "systemctl restart") {
+		t.Fatalf("the server interface must not be restarted:\n%s", script)
+	}
+}
+
+func TestRotatedWGConfig_RecordsNewKeys(t *testing.T) {
+	wg, err := buildWGConfig("example.com", defaultWGNetwork())
+	if err != nil {
+		t.Fatalf("buildWGConfig: %v", err)
+	}
+	newPriv, newPub, _ := genWGKeyPair()
+	rot := wgRotation{Target: rotateTarget{Name: deviceMobile, CIDR: defaultWGNetwork().MobileCIDR(), Mobile: true}, NewPriv: newPriv, NewPub: newPub, DeviceConf: "mobile conf"}
+	got := rotatedWGConfig(wg, rot)
+	if got.MobileClientPriv != newPriv || got.MobileClientPub != newPub || got.MobileClientConf != "mobile conf" {
+		t.Fatalf("mobile keys not recorded: %+v", got)
+	}
+	if got.ClientPriv != wg.ClientPriv || !strings.Contains(got.ServerConf, newPub) || strings.Contains(got.ServerConf, wg.MobileClientPub) {
+		t.Fatalf("unexpected config after rotating the phone:\n%s", got.ServerConf)
+	}
+}
@@ -0,0 +1,441 @@
+package main
+
+import (
+	"arc/internal/app"
+	"arc/internal/workflow"
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+type setupCLIOptions struct {
+	Target       string
+	PasswordFile string
+	Yes          bool
+	JSON         bool
+	Resume       bool
+	Jobs         int
+	Plan         bool
+	WG           app.WGSettings
+
+	SkipPreflight bool
+}
+
+// setupEvent is one line of `arc setup --json` output.
+type setupEvent struct {
+	Event       string    `json:"event"`
+	Time        time.Time `json:"time"`
+	Target      string    `json:"target,omitempty"`
+	Run         string    `json:"run,omitempty"`
+	Step        string    `json:"step,omitempty"`
+	Label       string    `json:"label,omitempty"`
+	Index       int       `json:"index,omitempty"`
+	Total       int       `json:"total,omitempty"`
+	Fingerprint string    `json:"fingerprint,omitempty"`
+	DurationMS  int64     `json:"durationMs,omitempty"`
+	ReadyAs     string    `json:"readyAs,omitempty"`
+	Error       string    `json:"error,omitempty"`
+
+	// Preflight findings; Label names the check.
+	Where    string `json:"where,omitempty"`
+	Severity string `json:"severity,omitempty"`
+	Detail   string `json:"detail,omitempty"`
+	Fix      string `json:"fix,omitempty"`
+}
+
+const (
+	setupEventStart      = "start"
+	setupEventHostKey    = "host_key"
+	setupEventPreflight  = "preflight"
+	setupEventStepStart  = "step_start"
+	setupEventStepDone   = "step_done"
+	setupEventStepFailed = "step_failed"
+	setupEventStepCancel = "step_cancelled"
+	setupEventDone       = "done"
+	setupEventError      = "error"
+)
+
+var errHostKeyNotConfirmed = errors.New("host key not confirmed; re-run with --yes to trust it non-interactively")
+
+func parseSetupCLIOptions(args []string, stderr io.Writer) (setupCLIOptions, error) {
+	var opts setupCLIOptions
+	fs := flag.NewFlagSet("arc setup", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.StringVar(&opts.Target, "target", "", "SSH target, ssh://user@host[:port] or user@host[:port]")
+	fs.StringVar(&opts.PasswordFile, "password-file", "", "file containing the bootstrap SSH/sudo password")
+	fs.BoolVar(&opts.Yes, "yes", false, "trust an unpinned server host key without prompting")
+	fs.BoolVar(&opts.JSON, "json", false, "print progress as JSON lines")
+	fs.BoolVar(&opts.Resume, "resume", false, "continue the latest setup run from its failed step")
+	fs.IntVar(&opts.Jobs, "jobs", 0, "maximum number of setup steps to run at once (default ARC_SETUP_JOBS or 2)")
+	fs.StringVar(&opts.WG.Interface, "wg-interface", "", "WireGuard interface name on both machines (default "+wgInterface+")")
+	fs.IntVar(&opts.WG.Port, "wg-port", 0, fmt.Sprintf("WireGuard UDP port on the server (default %d)", wgPort))
+	fs.StringVar(&opts.WG.Subnet, "wg-subnet", "", "tunnel subnet; the server, desktop and mobile get .1, .2 and .3 (default "+wgSubnet+")")
+	fs.StringVar(&opts.WG.ServerIP, "wg-server-ip", "", "server tunnel address (default .1 of the subnet)")
+	fs.StringVar(&opts.WG.DesktopIP, "wg-desktop-ip", "", "desktop tunnel address (default .2 of the subnet)")
+	fs.StringVar(&opts.WG.MobileIP, "wg-mobile-ip", "", "mobile tunnel address (default .3 of the subnet)")
+	fs.StringVar(&opts.WG.Mode, "wg-mode", "", "how this machine runs the tunnel: "+wgModeKernel+" (wg-quick, default) or "+wgModeUserspace+" (built-in wireguard-go, no kernel module)")
+	fs.StringVar(&opts.WG.Relay, "wg-relay", "", fmt.Sprintf("UDP-over-TCP fallback for networks that block WireGuard: %s[:PORT] or %s[:PORT] (WebSocket), port %d by default (default none)", wgRelayTCP, wgRelayWebSocket, wgRelayPort))
+	fs.StringVar(&opts.WG.Rendezvous, "wg-rendezvous", "", "for a server behind NAT: HOST[:PORT] the server dials to reach this machine, which listens on --wg-port (default none; the desktop dials the server)")
+	fs.StringVar(&opts.WG.Subnet6, "wg-subnet6", "", "IPv6 ULA prefix for dual-stack tunnel addresses, or "+wgSubnet6Auto+" (default IPv4 only)")
+	fs.BoolVar(&opts.Plan, "plan", false, "show the files, packages and services setup would change, without changing anything")
+	fs.BoolVar(&opts.SkipPreflight, "skip-preflight", false, "start setup even when the preflight checks find blocking issues")
+	if err := fs.Parse(args); err != nil {
+		return opts, err
+	}
+	if fs.NArg() > 0 {
+		return opts, fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+	if strings.TrimSpace(opts.Target) == "" && !opts.Resume {
+		return opts, fmt.Errorf("--target is required")
+	}
+	if opts.Resume && opts.WG != (app.WGSettings{}) {
+		return opts, fmt.Errorf("--wg-* flags cannot change the network of a resumed run")
+	}
+	if opts.Plan && opts.JSON {
+		return opts, fmt.Errorf("--plan cannot be combined with --json")
+	}
+	return opts, nil
+}
+
+func runSetupCLI(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	opts, err := parseSetupCLIOptions(args, stderr)
+	if err != nil {
+		if !errors.Is(err, flag.ErrHelp) {
+			fmt.Fprintf(stderr, "arc setup: %v\n", err)
+		}
+		return 2
+	}
+
+	password := ""
+	if opts.PasswordFile != "" {
+		raw, err := os.ReadFile(opts.PasswordFile)
+		if err != nil {
+			fmt.Fprintf(stderr, "arc setup: read password file: %v\n", err)
+			return 2
+		}
+		password = strings.TrimRight(string(raw), "\r\n")
+	}
+
+	emit := newSetupEventPrinter(stdout, opts.JSON)
+	confirm := func(key app.HostKey) bool {
+		if opts.Yes {
+			return true
+		}
+		return promptHostKeyConfirmation(stdin, stderr, key)
+	}
+
+	// The first interrupt cancels running steps; they report back as cancelled and the run
+	// stays resumable.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if opts.Plan {
+		if err := runSetupPlan(ctx, newRuntimeServices(), opts, password, confirm, stdout); err != nil {
+			fmt.Fprintf(stderr, "arc setup: %v\n", err)
+			return 1
+		}
+		return 0
+	}
+
+	if err := runHeadlessSetup(ctx, newRuntimeServices(), opts, password, confirm, emit); err != nil {
+		if !opts.JSON {
+			fmt.Fprintf(stderr, "arc setup: %v\n", err)
+		}
+		return 1
+	}
+	return 0
+}
+
+func promptHostKeyConfirmation(stdin io.Reader, w io.Writer, key app.HostKey) bool {
+	fmt.Fprintf(w, "Host key for %s is %s\n", key.Addr, key.Fingerprint)
+	fmt.Fprint(w, "Trust this key and pin it? [y/N] ")
+	answer, _ := bufio.NewReader(stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+func newSetupEventPrinter(w io.Writer, asJSON bool) func(setupEvent) {
+	if asJSON {
+		enc := json.NewEncoder(w)
+		return func(ev setupEvent) {
+			_ = enc.Encode(ev)
+		}
+	}
+	return func(ev setupEvent) {
+		switch ev.Event {
+		case setupEventStart:
+			fmt.Fprintf(w, "ARC setup for %s\n", ev.Target)
+		case setupEventHostKey:
+			fmt.Fprintf(w, "Host key: %s\n", ev.Fingerprint)
+		case setupEventPreflight:
+			fmt.Fprintf(w, "preflight: %s %s %s: %s\n", strings.ToUpper(ev.Severity), ev.Where, ev.Label, ev.Detail)
+			if ev.Fix != "" {
+				fmt.Fprintf(w, "  fix: %s\n", ev.Fix)
+			}
+		case setupEventStepStart:
+			fmt.Fprintf(w, "[%d/%d] %s\n", ev.Index, ev.Total, ev.Label)
+		case setupEventStepDone:
+			fmt.Fprintf(w, "[%d/%d] done in %s\n", ev.Index, ev.Total, time.Duration(ev.DurationMS)*time.Millisecond)
+		case setupEventStepFailed:
+			fmt.Fprintf(w, "[%d/%d] FAILED: %s\n", ev.Index, ev.Total, ev.Error)
+		case setupEventStepCancel:
+			fmt.Fprintf(w, "[%d/%d] cancelled\n", ev.Index, ev.Total)
+		case setupEventDone:
+			fmt.Fprintf(w, "ARC ready as %s\n", ev.ReadyAs)
+		}
+	}
+}
+
+// runHeadlessSetup drives the same step definitions and scheduler as the TUI, threading step
+// results (sudo mode, WireGuard config) into later requests. After the first failure no new
+// step starts; steps already running are allowed to finish. Cancelling ctx stops the running
+// steps, which are recorded as cancelled rather than failed.
+// Progress is persisted after every step so a failed run can be continued with --resume.
+func runHeadlessSetup(ctx context.Context, svc app.Services, opts setupCLIOptions, password string, confirm func(app.HostKey) bool, emit func(setupEvent)) error {
+	fail := func(err error) error {
+		emit(setupEvent{Event: setupEventError, Time: time.Now(), Error: err.Error()})
+		return err
+	}
+
+	target := opts.Target
+	var run app.SetupRun
+	if opts.Resume {
+		resumeAddr := ""
+		if strings.TrimSpace(target) != "" {
+			_, _, addr, err := svc.ParseSSHDeviceTarget(target)
+			if err != nil {
+				return fail(err)
+			}
+			resumeAddr = addr
+		}
+		latest, ok, err := svc.LatestSetupRun(resumeAddr)
+		if err != nil {
+			return fail(err)
+		}
+		if !ok {
+			return fail(errors.New("no setup run to resume"))
+		}
+		if latest.Device != "" {
+			return fail(fmt.Errorf("run %s joined the server as device %q; repeat `arc join --accept` instead", latest.ID, latest.Device))
+		}
+		run = latest
+		target = run.Target
+	}
+
+	emit(setupEvent{Event: setupEventStart, Time: time.Now(), Target: target, Run: run.ID})
+
+	if err := svc.CheckLocalSudo(); err != nil {
+		return fail(fmt.Errorf("local sudo is required (run `sudo -v` first): %w", err))
+	}
+
+	user, host, addr, err := svc.ParseSSHDeviceTarget(target)
+	if err != nil {
+		return fail(err)
+	}
+
+	key, err := svc.ScanHostKey(addr)
+	if err != nil {
+		return fail(err)
+	}
+	emit(setupEvent{Event: setupEventHostKey, Time: time.Now(), Target: addr, Fingerprint: key.Fingerprint})
+	if !key.Pinned {
+		if !confirm(key) {
+			return fail(errHostKeyNotConfirmed)
+		}
+		if err := svc.TrustHostKey(key); err != nil {
+			return fail(err)
+		}
+	}
+
+	steps := svc.SetupDefinition()
+	for _, step := range steps {
+		if step.State == workflow.StepFailed {
+			return fail(errors.New(step.Err))
+		}
+	}
+
+	if err := headlessPreflight(ctx, svc, opts, app.PreflightRequest{
+		BootstrapUser: user,
+		Host:          host,
+		Addr:          addr,
+		Password:      password,
+		WG:            wgSettingsForRun(opts, run),
+	}, emit); err != nil {
+		return fail(err)
+	}
+
+	if opts.Resume {
+		run.Steps = resumeSteps(steps, run)
+		if pendingSetupSteps(run.Steps) == 0 {
+			return fail(fmt.Errorf("setup run %s already completed", run.ID))
+		}
+	} else {
+		run, err = svc.BeginSetupRun(app.SetupRun{
+			Target:        target,
+			BootstrapUser: user,
+			Host:          host,
+			Addr:          addr,
+			WG:            app.WGConfig{Net: opts.WG},
+			Steps:         steps,
+		})
+		if err != nil {
+			return fail(err)
+		}
+	}
+
+	defer func() { _ = svc.CloseConnections() }()
+
+	jobs := opts.Jobs
+	if jobs < 1 {
+		jobs = svc.SetupConcurrency()
+	}
+
+	type stepOutcome struct {
+		index   int
+		started time.Time
+		res     app.SetupStepResult
+		err     error
+	}
+	outcomes := make(chan stepOutcome)
+	useSudo := run.UseSudo
+	wg := run.WG
+	readyAs := ""
+	total := len(run.Steps)
+	running := 0
+	var firstErr error
+	for {
+		if firstErr == nil && ctx.Err() == nil {
+			for _, i := range workflow.RunnableSteps(run.Steps, jobs) {
+				step := &run.Steps[i]
+				step.State = workflow.StepRunning
+				step.Err = ""
+				emit(setupEvent{Event: setupEventStepStart, Time: time.Now(), Step: string(step.ID), Label: step.Label, Index: i + 1, Total: total})
+
+				req := app.SetupStepRequest{
+					RunID:         run.ID,
+					BootstrapUser: user,
+					Host:          host,
+					Addr:          addr,
+					Password:      password,
+					UseSudo:       useSudo,
+					WG:            wg,
+					StepID:        step.ID,
+					Timeout:       step.Timeout,
+				}
+				running++
+				go func(index int, req app.SetupStepRequest) {
+					started := time.Now()
+					res, err := svc.RunSetupStep(ctx, req)
+					outcomes <- stepOutcome{index: index, started: started, res: res, err: err}
+				}(i, req)
+			}
+			_ = svc.SaveSetupRun(run)
+		}
+		if running == 0 {
+			break
+		}
+
+		out := <-outcomes
+		running--
+		step := &run.Steps[out.index]
+		if errors.Is(out.err, context.Canceled) {
+			step.State = workflow.StepCancelled
+			step.Err = "cancelled"
+			_ = svc.SaveSetupRun(run)
+			emit(setupEvent{Event: setupEventStepCancel, Time: time.Now(), Step: string(step.ID), Label: step.Label, Index: out.index + 1, Total: total, DurationMS: time.Since(out.started).Milliseconds()})
+			if firstErr == nil {
+				firstErr = fmt.Errorf("setup cancelled at step %d (%s); continue with `arc setup --resume`", out.index+1, step.Label)
+			}
+			continue
+		}
+		if out.err != nil {
+			step.State = workflow.StepFailed
+			step.Err = out.err.Error()
+			_ = svc.SaveSetupRun(run)
+			emit(setupEvent{Event: setupEventStepFailed, Time: time.Now(), Step: string(step.ID), Label: step.Label, Index: out.index + 1, Total: total, DurationMS: time.Since(out.started).Milliseconds(), Error: out.err.Error()})
+			if firstErr == nil {
+				firstErr = fmt.Errorf("step %d (%s) failed: %w; continue with `arc setup --resume`", out.index+1, step.Label, out.err)
+			}
+			continue
+		}
+		if out.res.UseSudo != nil {
+			useSudo = *out.res.UseSudo
+			run.UseSudo = useSudo
+		}
+		if out.res.WG != nil {
+			wg = *out.res.WG
+			run.WG = wg
+		}
+		if out.res.ReadyAs != "" {
+			readyAs = out.res.ReadyAs
+		}
+		step.State = workflow.StepDone
+		_ = svc.SaveSetupRun(run)
+		emit(setupEvent{Event: setupEventStepDone, Time: time.Now(), Step: string(step.ID), Label: step.Label, Index: out.index + 1, Total: total, DurationMS: time.Since(out.started).Milliseconds()})
+	}
+	if firstErr != nil {
+		return firstErr
+	}
+	if err := ctx.Err(); err != nil {
+		return fail(fmt.Errorf("setup cancelled; continue with `arc setup --resume`: %w", err))
+	}
+	if pendingSetupSteps(run.Steps) > 0 {
+		return fail(errors.New("no runnable setup steps left; check step dependencies"))
+	}
+
+	emit(setupEvent{Event: setupEventDone, Time: time.Now(), ReadyAs: readyAs})
+	return nil
+}
+
+// headlessPreflight reports every issue the preflight checks find and refuses to start setup
+// while any of them blocks, unless --skip-preflight is set.
+func headlessPreflight(ctx context.Context, svc app.Services, opts setupCLIOptions, req app.PreflightRequest, emit func(setupEvent)) error {
+	report, err := svc.RunPreflight(ctx, req)
+	if err != nil {
+		if opts.SkipPreflight {
+			return nil
+		}
+		return fmt.Errorf("preflight: %w (re-run with --skip-preflight to start anyway)", err)
+	}
+	issues := report.Issues()
+	for _, c := range issues {
+		emit(setupEvent{Event: setupEventPreflight, Time: time.Now(), Label: c.Name, Where: c.Where, Severity: string(c.Severity), Detail: c.Detail, Fix: c.Fix})
+	}
+	if !report.Blocked() || opts.SkipPreflight {
+		return nil
+	}
+	blocking := 0
+	for _, c := range issues {
+		if c.Severity == app.PreflightBlock {
+			blocking++
+		}
+	}
+	return fmt.Errorf("preflight found %d blocking issue(s); fix them or re-run with --skip-preflight", blocking)
+}
+
+// wgSettingsForRun is the tunnel network a run uses: the resumed run's, or the flags'.
+func wgSettingsForRun(opts setupCLIOptions, run app.SetupRun) app.WGSettings {
+	if opts.Resume {
+		return run.WG.Net
+	}
+	return opts.WG
+}
+
+func pendingSetupSteps(steps []workflow.Step) int {
+	n := 0
+	for _, step := range steps {
+		if step.State != workflow.StepDone {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"arc/internal/app"
+	"arc/internal/workflow"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type headlessFakeServices struct {
+	mu       sync.Mutex
+	steps    []workflow.Step
+	failAt   workflow.StepID
+	blockAt  workflow.StepID
+	pinned   bool
+	trusted  bool
+	closed   int
+	requests []app.SetupStepRequest
+
+	preflight     app.PreflightReport
+	preflightReqs []app.PreflightRequest
+}
+
+func (f *headlessFakeServices) CheckLocalSudo() error { return nil }
+
+func (f *headlessFakeServices) ParseSSHDeviceTarget(target string) (string, string, string, error) {
+	return parseSSHDeviceTarget(target)
+}
+
+func (f *headlessFakeServices) ScanHostKey(addr string) (app.HostKey, error) {
+	return app.HostKey{Addr: addr, Fingerprint: "SHA256:test", Pinned: f.pinned}, nil
+}
+
+func (f *headlessFakeServices) TrustHostKey(app.HostKey) error {
+	f.trusted = true
+	return nil
+}
+
+func (f *headlessFakeServices) SetupDefinition() []workflow.Step {
+	return append([]workflow.Step(nil), f.steps...)
+}
+
+func (f *headlessFakeServices) RunPreflight(_ context.Context, req app.PreflightRequest) (app.PreflightReport, error) {
+	f.preflightReqs = append(f.preflightReqs, req)
+	return f.preflight, nil
+}
+
+func (f *headlessFakeServices) BeginSetupRun(run app.SetupRun) (app.SetupRun, error) {
+	return beginSetupRun(run)
+}
+
+func (f *headlessFakeServices) SaveSetupRun(run app.SetupRun) error {
+	return saveSetupRun(run)
+}
+
+func (f *headlessFakeServices) LatestSetupRun(addr string) (app.SetupRun, bool, error) {
+	return latestSetupRun(addr)
+}
+
+func (f *headlessFakeServices) SetupConcurrency() int { return workflow.DefaultSetupConcurrency }
+
+func (f *headlessFakeServices) RunSetupStep(ctx context.Context, req app.SetupStepRequest) (app.SetupStepResult, error) {
+	f.mu.Lock()
+	f.requests = append(f.requests, req)
+	f.mu.Unlock()
+	if req.StepID == f.failAt {
+		return app.SetupStepResult{}, errors.New("boom")
+	}
+	if req.StepID == f.blockAt {
+		<-ctx.Done()
+		return app.SetupStepResult{}, ctx.Err()
+	}
+	res := app.SetupStepResult{}
+	switch req.StepID {
+	case workflow.StepDetectPrivilegedMode:
+		sudo := true
+		res.UseSudo = &sudo
+	case workflow.StepCreateArcUser:
+		res.WG = &app.WGConfig{Endpoint: "example.com:51820"}
+		res.ReadyAs = "arc@example.com"
+	}
+	return res, nil
+}
+
+func (f *headlessFakeServices) CloseConnections() error {
+	f.closed++
+	return nil
+}
+
+func (f *headlessFakeServices) CollectStatus(context.Context) (app.StatusReport, error) {
+	return app.StatusReport{}, nil
+}
+
+func (f *headlessFakeServices) BuildMobilePayload(string, app.WGConfig) (string, error) {
+	return "", nil
+}
+
+func headlessTestSteps() []workflow.Step {
+	return []workflow.Step{
+		{ID: workflow.StepDetectPrivilegedMode, Label: "detect", Scope: workflow.ScopeRemote},
+		{ID: workflow.StepCreateArcUser, Label: "create", Scope: workflow.ScopeRemote,
+			Requires: []workflow.StepID{workflow.StepDetectPrivilegedMode}},
+		{ID: workflow.StepAddArcToSudoers, Label: "sudoers", Scope: workflow.ScopeRemote,
+			Requires: []workflow.StepID{workflow.StepCreateArcUser}},
+	}
+}
+
+func TestRunHeadlessSetup_ThreadsResultsAndEmitsJSON(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	fake := &headlessFakeServices{steps: headlessTestSteps()}
+	var out bytes.Buffer
+	confirm := func(app.HostKey) bool { return true }
+
+	if err := runHeadlessSetup(context.Background(), fake, setupCLIOptions{Target: "root@example.com"}, "pw", confirm, newSetupEventPrinter(&out, true)); err != nil {
+		t.Fatalf("runHeadlessSetup: %v", err)
+	}
+	if !fake.trusted {
+		t.Fatalf("expected unpinned host key to be trusted after confirmation")
+	}
+	if fake.closed != 1 {
+		t.Fatalf("expected shared SSH connections to be closed once, got %d", fake.closed)
+	}
+	if len(fake.requests) != 3 {
+		t.Fatalf("expected 3 step requests, got %d", len(fake.requests))
+	}
+	last := fake.requests[2]
+	if !last.UseSudo || last.WG.Endpoint != "example.com:51820" || last.Password != "pw" {
+		t.Fatalf("step results not threaded into later requests: %#v", last)
+	}
+
+	var events []setupEvent
+	for _, ln := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		var ev setupEvent
+		if err := json.Unmarshal([]byte(ln), &ev); err != nil {
+			t.Fatalf("invalid JSON event %q: %v", ln, err)
+		}
+		events = append(events, ev)
+	}
+	if events[0].Event != setupEventStart || events[len(events)-1].Event != setupEventDone {
+		t.Fatalf("unexpected event sequence: %#v", events)
+	}
+	if events[len(events)-1].ReadyAs != "arc@example.com" {
+		t.Fatalf("unexpected readyAs: %q", events[len(events)-1].ReadyAs)
+	}
+}
+
+func TestRunHeadlessSetup_StopsAtFirstFailure(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	fake := &headlessFakeServices{steps: headlessTestSteps(), failAt: workflow.StepCreateArcUser, pinned: true}
+	var out bytes.Buffer
+
+	err := runHeadlessSetup(context.Background(), fake, setupCLIOptions{Target: "root@example.com"}, "", func(app.HostKey) bool { return false }, newSetupEventPrinter(&out, false))
+	if err == nil || !strings.Contains(err.Error(), "step 2") {
+		t.Fatalf("expected step 2 failure, got %v", err)
+	}
+	if len(fake.requests) != 2 {
+		t.Fatalf("expected setup to stop after failed step, got %d requests", len(fake.requests))
+	}
+	if !strings.Contains(out.String(), "[2/3] FAILED: boom") {
+		t.Fatalf("missing failure line in output: %q", out.String())
+	}
+}
+
+func TestRunHeadlessSetup_RequiresHostKeyConfirmation(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	fake := &headlessFakeServices{steps: headlessTestSteps()}
+	var out bytes.Buffer
+
+	err := runHeadlessSetup(context.Background(), fake, setupCLIOptions{Target: "root@example.com"}, "", func(app.HostKey) bool { return false }, newSetupEventPrinter(&out, false))
+	if !errors.Is(err, errHostKeyNotConfirmed) {
+		t.Fatalf("expected host key confirmation error, got %v", err)
+	}
+	if len(fake.requests) != 0 || fake.trusted {
+		t.Fatalf("no step may run before the host key is trusted")
+	}
+}
+
+func TestRunHeadlessSetup_ResumesFromFailedStepWithSameWireGuardKeys(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	fake := &headlessFakeServices{steps: headlessTestSteps(), failAt: workflow.StepCreateArcUser, pinned: true}
+	var out bytes.Buffer
+	confirm := func(app.HostKey) bool { return true }
+
+	if err := runHeadlessSetup(context.Background(), fake, setupCLIOptions{Target: "root@example.com"}, "pw", confirm, newSetupEventPrinter(&out, false)); err == nil {
+		t.Fatalf("expected first run to fail")
+	}
+	firstWG := fake.requests[1].WG
+	if firstWG.ServerPriv == "" {
+		t.Fatalf("expected WireGuard keys to be generated when the run begins")
+	}
+
+	run, ok, err := latestSetupRun("example.com:22")
+	if err != nil || !ok {
+		t.Fatalf("latestSetupRun: ok=%v err=%v", ok, err)
+	}
+	if !run.UseSudo || run.Steps[0].State != workflow.StepDone || run.Steps[1].State != workflow.StepFailed || run.Steps[1].Err != "boom" {
+		t.Fatalf("unexpected persisted run: %#v", run)
+	}
+
+	fake.failAt = ""
+	fake.requests = nil
+	if err := runHeadlessSetup(context.Background(), fake, setupCLIOptions{Resume: true}, "pw", confirm, newSetupEventPrinter(&out, false)); err != nil {
+		t.Fatalf("resume: %v", err)
+	}
+	if len(fake.requests) != 2 || fake.requests[0].StepID != workflow.StepCreateArcUser {
+		t.Fatalf("expected resume to start at the failed step, got %#v", fake.requests)
+	}
+	if fake.requests[0].WG.ServerPriv != firstWG.ServerPriv || !fake.requests[0].UseSudo {
+		t.Fatalf("resume must reuse persisted WireGuard keys and sudo mode")
+	}
+
+	err = runHeadlessSetup(context.Background(), fake, setupCLIOptions{Resume: true}, "pw", confirm, newSetupEventPrinter(&out, false))
+	if err == nil || !strings.Contains(err.Error(), "already completed") {
+		t.Fatalf("expected completed run to be rejected, got %v", err)
+	}
+}
+
+func TestRunHeadlessSetup_UsesConfiguredWireGuardNetwork(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	fake := &headlessFakeServices{steps: headlessTestSteps(), pinned: true}
+	var out bytes.Buffer
+	confirm := func(app.HostKey) bool { return true }
+
+	opts := setupCLIOptions{Target: "root@example.com", WG: app.WGSettings{Interface: "wg-arc", Port: 51821, Subnet: "10.8.0.0/24"}}
+	if err := runHeadlessSetup(context.Background(), fake, opts, "", confirm, newSetupEventPrinter(&out, false)); err != nil {
+		t.Fatalf("runHeadlessSetup: %v", err)
+	}
+	got := fake.requests[0].WG
+	want := app.WGSettings{Interface: "wg-arc", Port: 51821, Subnet: "10.8.0.0/24", ServerIP: "10.8.0.1", DesktopIP: "10.8.0.2", MobileIP: "10.8.0.3"}
+	if got.Net != want || got.Endpoint != "example.com:51821" {
+		t.Fatalf("configured network not threaded into steps: %#v", got)
+	}
+
+	fake.requests = nil
+	opts.WG = app.WGSettings{Subnet: "10.8.0.0/30"}
+	if err := runHeadlessSetup(context.Background(), fake, opts, "", confirm, newSetupEventPrinter(&out, false)); err == nil || !strings.Contains(err.Error(), "too small") {
+		t.Fatalf("expected an invalid subnet to be rejected, got %v", err)
+	}
+	if len(fake.requests) != 0 {
+		t.Fatalf("no step may run with an invalid network")
+	}
+}
+
+func TestRunHeadlessSetup_BlockingPreflightStopsBeforeAnyStep(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	fake := &headlessFakeServices{steps: headlessTestSteps(), pinned: true}
+	fake.preflight = app.PreflightReport{Checks: []app.PreflightCheck{
+		{Name: "free disk space", Where: statusLocal, Severity: app.PreflightWarn, Detail: "only 900 MiB free on /"},
+		{Name: "wireguard port", Where: statusRemote, Severity: app.PreflightBlock, Detail: "UDP 51820 is already bound", Fix: "choose another port"},
+	}}
+	var out bytes.Buffer
+	confirm := func(app.HostKey) bool { return true }
+
+	opts := setupCLIOptions{Target: "root@example.com", WG: app.WGSettings{Port: 51820}}
+	err := runHeadlessSetup(context.Background(), fake, opts, "pw", confirm, newSetupEventPrinter(&out, false))
+	if err == nil || !strings.Contains(err.Error(), "1 blocking issue") {
+		t.Fatalf("expected blocking preflight to stop setup, got %v", err)
+	}
+	if len(fake.requests) != 0 {
+		t.Fatalf("no step may run after a blocking preflight, got %d requests", len(fake.requests))
+	}
+	if len(fake.preflightReqs) != 1 || fake.preflightReqs[0].Password != "pw" || fake.preflightReqs[0].WG.Port != 51820 {
+		t.Fatalf("unexpected preflight requests: %#v", fake.preflightReqs)
+	}
+	text := out.String()
+	if !strings.Contains(text, "preflight: BLOCK remote wireguard port: UDP 51820 is already bound\n  fix: choose another port") {
+		t.Fatalf("missing blocking issue in output: %q", text)
+	}
+	if strings.Index(text, "BLOCK") > strings.Index(text, "WARN") {
+		t.Fatalf("blocking issues must be listed before warnings: %q", text)
+	}
+
+	opts.SkipPreflight = true
+	if err := runHeadlessSetup(context.Background(), fake, opts, "pw", confirm, newSetupEventPrinter(&out, false)); err != nil {
+		t.Fatalf("--skip-preflight should start setup anyway: %v", err)
+	}
+	if len(fake.requests) != 3 {
+		t.Fatalf("expected all steps to run with --skip-preflight, got %d", len(fake.requests))
+	}
+}
+
+func TestParseSetupCLIOptions_RejectsNetworkFlagsOnResume(t *testing.T) {
+	var stderr bytes.Buffer
+	opts, err := parseSetupCLIOptions([]string{"--target", "root@example.com", "--wg-interface", "wg-arc", "--wg-port", "51821"}, &stderr)
+	if err != nil {
+		t.Fatalf("parseSetupCLIOptions: %v", err)
+	}
+	if opts.WG.Interface != "wg-arc" || opts.WG.Port != 51821 {
+		t.Fatalf("unexpected network settings: %#v", opts.WG)
+	}
+	if _, err := parseSetupCLIOptions([]string{"--resume", "--wg-subnet", "10.8.0.0/24"}, &stderr); err == nil {
+		t.Fatalf("expected --wg-* with --resume to be rejected")
+	}
+}
+
+func TestRunHeadlessSetup_CancelMarksRunningStepCancelled(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	fake := &headlessFakeServices{steps: headlessTestSteps(), blockAt: workflow.StepCreateArcUser, pinned: true}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var out bytes.Buffer
+	printer := newSetupEventPrinter(&out, true)
+	emit := func(ev setupEvent) {
+		printer(ev)
+		if ev.Event == setupEventStepStart && ev.Step == string(workflow.StepCreateArcUser) {
+			cancel()
+		}
+	}
+
+	err := runHeadlessSetup(ctx, fake, setupCLIOptions{Target: "root@example.com"}, "pw", func(app.HostKey) bool { return true }, emit)
+	if err == nil || !strings.Contains(err.Error(), "cancelled") {
+		t.Fatalf("expected cancellation error, got %v", err)
+	}
+	if !strings.Contains(out.String(), `"event":"step_cancelled"`) {
+		t.Fatalf("expected step_cancelled event:\n%s", out.String())
+	}
+	if len(fake.requests) != 2 {
+		t.Fatalf("no step may start after cancellation, got %d requests", len(fake.requests))
+	}
+
+	run, ok, err := latestSetupRun("example.com:22")
+	if err != nil || !ok {
+		t.Fatalf("latestSetupRun: ok=%v err=%v", ok, err)
+	}
+	if run.Steps[1].State != workflow.StepCancelled || run.Steps[2].State != workflow.StepPending {
+		t.Fatalf("unexpected persisted steps: %#v", run.Steps)
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"arc/internal/app"
+	"arc/internal/workflow"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const setupRunStateDir = "state"
+
+// setupRunState is the on-disk form of app.SetupRun under ~/.arc/state/<run-id>.json.
+// The bootstrap password is never persisted.
+type setupRunState struct {
+	ID            string              `json:"id"`
+	Target        string              `json:"target"`
+	BootstrapUser string              `json:"bootstrapUser"`
+	Host          string              `json:"host"`
+	Addr          string              `json:"addr"`
+	UseSudo       bool                `json:"useSudo"`
+	WG            app.WGConfig        `json:"wg"`
+	Steps         []setupRunStepState `json:"steps"`
+	Device        string              `json:"device,omitempty"`
+	CreatedAt     time.Time           `json:"createdAt"`
+	UpdatedAt     time.Time           `json:"updatedAt"`
+}
+
+type setupRunStepState struct {
+	ID    string `json:"id"`
+	Label string `json:"label"`
+	State string `json:"state"`
+	Err   string `json:"error,omitempty"`
+}
+
+var stepStateNames = map[workflow.StepState]string{
+	workflow.StepPending:   "pending",
+	workflow.StepRunning:   "running",
+	workflow.StepDone:      "done",
+	workflow.StepFailed:    "failed",
+	workflow.StepCancelled: "cancelled",
+}
+
+func setupRunsDir() (string, error) {
+	dir, err := arcHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, setupRunStateDir), nil
+}
+
+func newSetupRunID() (string, error) {
+	var suffix [3]byte
+	if _, err := rand.Read(suffix[:]); err != nil {
+		return "", fmt.Errorf("generate run ID: %w", err)
+	}
+	return time.Now().UTC().Format("20060102T150405Z") + "-" + hex.EncodeToString(suffix[:]), nil
+}
+
+func beginSetupRun(run app.SetupRun) (app.SetupRun, error) {
+	id, err := newSetupRunID()
+	if err != nil {
+		return app.SetupRun{}, err
+	}
+	run.ID = id
+	if run.WG.Endpoint == "" {
+		wg, err := buildWGConfig(run.Host, wgNetworkFromSettings(run.WG.Net))
+		if err != nil {
+			return app.SetupRun{}, err
+		}
+		run.WG = toAppWG(wg)
+	}
+	if err := saveSetupRun(run); err != nil {
+		return app.SetupRun{}, err
+	}
+	return run, nil
+}
+
+func saveSetupRun(run app.SetupRun) error {
+	if strings.TrimSpace(run.ID) == "" {
+		return fmt.Errorf("setup run has no ID")
+	}
+	dir, err := setupRunsDir()
+	if err != nil {
+		return err
+	}
+	if err := ensureDir0700(dir); err != nil {
+		return err
+	}
+	path := filepath.Join(dir, run.ID+".json")
+
+	state := toSetupRunState(run)
+	state.UpdatedAt = time.Now().UTC()
+	state.CreatedAt = state.UpdatedAt
+	if prev, err := readSetupRunState(path); err == nil {
+		state.CreatedAt = prev.CreatedAt
+	}
+
+	raw, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal setup run state: %w", err)
+	}
+	if err := atomicWriteFile(path, append(raw, '\n'), 0o600); err != nil {
+		return fmt.Errorf("write %s: %w", path, err)
+	}
+	return nil
+}
+
+func readSetupRunState(path string) (setupRunState, error) {
+	var state setupRunState
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return state, err
+	}
+	if err := json.Unmarshal(raw, &state); err != nil {
+		return state, fmt.Errorf("parse %s: %w", path, err)
+	}
+	return state, nil
+}
+
+// latestSetupRun returns the most recent run for addr, or for any target when addr is empty.
+func latestSetupRun(addr string) (app.SetupRun, bool, error) {
+	dir, err := setupRunsDir()
+	if err != nil {
+		return app.SetupRun{}, false, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return app.SetupRun{}, false, nil
+		}
+		return app.SetupRun{}, false, fmt.Errorf("list %s: %w", dir, err)
+	}
+
+	var names []string
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasSuffix(e.Name(), ".json") {
+			names = append(names, e.Name())
+		}
+	}
+	// Run IDs start with a UTC timestamp, so lexical order is chronological.
+	sort.Sort(sort.Reverse(sort.StringSlice(names)))
+
+	for _, name := range names {
+		state, err := readSetupRunState(filepath.Join(dir, name))
+		if err != nil {
+			continue
+		}
+		if addr != "" && state.Addr != addr {
+			continue
+		}
+		return fromSetupRunState(state), true, nil
+	}
+	return app.SetupRun{}, false, nil
+}
+
+// forgetSetupRuns deletes every recorded run for addr, so a later `arc setup --resume` does not
+// skip steps that have since been undone.
+func forgetSetupRuns(addr string) error {
+	dir, err := setupRunsDir()
+	if err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("list %s: %w", dir, err)
+	}
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+		path := filepath.Join(dir, e.Name())
+		state, err := readSetupRunState(path)
+		if err != nil || state.Addr != addr {
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			return fmt.Errorf("remove %s: %w", path, err)
+		}
+	}
+	return nil
+}
+
+func toSetupRunState(run app.SetupRun) setupRunState {
+	state := setupRunState{
+		ID:            run.ID,
+		Target:        run.Target,
+		BootstrapUser: run.BootstrapUser,
+		Host:          run.Host,
+		Addr:          run.Addr,
+		UseSudo:       run.UseSudo,
+		WG:            run.WG,
+		Device:        run.Device,
+	}
+	for _, step := range run.Steps {
+		state.Steps = append(state.Steps, setupRunStepState{
+			ID:    string(step.ID),
+			Label: step.Label,
+			State: stepStateNames[step.State],
+			Err:   step.Err,
+		})
+	}
+	return state
+}
+
+func fromSetupRunState(state setupRunState) app.SetupRun {
+	run := app.SetupRun{
+		ID:            state.ID,
+		Target:        state.Target,
+		BootstrapUser: state.BootstrapUser,
+		Host:          state.Host,
+		Addr:          state.Addr,
+		UseSudo:       state.UseSudo,
+		WG:            state.WG,
+		Device:        state.Device,
+	}
+	for _, step := range state.Steps {
+		s := workflow.Step{ID: workflow.StepID(step.ID), Label: step.Label, Err: step.Err}
+		for st, name := range stepStateNames {
+			if name == step.State {
+				s.State = st
+			}
+		}
+		run.Steps = append(run.Steps, s)
+	}
+	return run
+}
+
+// resumeSteps maps a persisted run onto the current step definitions: steps recorded as done
+// stay done, everything else (including the failed step) is pending again.
+func resumeSteps(defs []workflow.Step, run app.SetupRun) []workflow.Step {
+	done := map[workflow.StepID]bool{}
+	for _, step := range run.Steps {
+		if step.State == workflow.StepDone {
+			done[step.ID] = true
+		}
+	}
+	out := make([]workflow.Step, len(defs))
+	for i, def := range defs {
+		out[i] = def
+		out[i].State = workflow.StepPending
+		out[i].Err = ""
+		if done[def.ID] {
+			out[i].State = workflow.StepDone
+		}
+	}
+	return out
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+const (
+	arcSSHConfigStart = "### ARC_SSH_CONFIG_START"
+	arcSSHConfigEnd   = "### ARC_SSH_CONFIG_END"
+)
+
+// renderArcSSHConfigBlock points the tunnel-side names at the port n publishes the server's
+// sshd on. A kernel tunnel reaches sshd at port 22 and needs no block.
+func renderArcSSHConfigBlock(n wgNetwork) string {
+	if !n.Userspace() {
+		return ""
+	}
+	return fmt.Sprintf("%s\nHost remotehost rh\n\tPort %d\n%s", arcSSHConfigStart, userspaceWGSSHPort, arcSSHConfigEnd)
+}
+
+// withArcSSHConfig is the ssh config raw with the managed block of n, or without one when n
+// needs none.
+func withArcSSHConfig(raw []byte, n wgNetwork) []byte {
+	block := renderArcSSHConfigBlock(n)
+	if block == "" && !bytes.Contains(raw, []byte(arcSSHConfigStart)) {
+		return raw
+	}
+	out := bytes.TrimRight(stripManagedBlock(raw, arcSSHConfigStart, arcSSHConfigEnd), "\n")
+	if len(out) > 0 {
+		out = append(out, '\n')
+	}
+	if block != "" {
+		return withManagedBlock(out, arcSSHConfigStart, arcSSHConfigEnd, block, true)
+	}
+	return out
+}
+
+func localSSHConfigPath() string {
+	return filepath.Join(userSSHDir(), "config")
+}
+
+func readLocalSSHConfig() ([]byte, error) {
+	raw, err := os.ReadFile(localSSHConfigPath())
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("read ssh config: %w", err)
+	}
+	return raw, nil
+}
+
+// syncLocalSSHConfigForArcRemote makes `ssh remotehost` use the port n publishes sshd on.
+func syncLocalSSHConfigForArcRemote(n wgNetwork) error {
+	raw, err := readLocalSSHConfig()
+	if err != nil {
+		return err
+	}
+	out := withArcSSHConfig(raw, n)
+	if bytes.Equal(out, raw) {
+		return nil
+	}
+	if err := ensureDir0700(userSSHDir()); err != nil {
+		return err
+	}
+	return atomicWriteFile(localSSHConfigPath(), out, 0o600)
+}
+
+// arcSSHConfigDrift reports a missing or stale managed block in ~/.ssh/config.
+func arcSSHConfigDrift(n wgNetwork) ([]string, error) {
+	raw, err := readLocalSSHConfig()
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(withArcSSHConfig(raw, n), raw) {
+		return []string{"remotehost port missing or stale in ~/.ssh/config"}, nil
+	}
+	return nil, nil
+}
+
+// removeLocalSSHConfigForArcRemote drops the block syncLocalSSHConfigForArcRemote wrote. The
+// default network is a kernel tunnel, which needs none.
+func removeLocalSSHConfigForArcRemote() error {
+	return syncLocalSSHConfigForArcRemote(defaultWGNetwork())
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWithArcSSHConfig(t *testing.T) {
+	userspace := defaultWGNetwork()
+	userspace.Mode = wgModeUserspace
+	user := "Host work\n\tUser me\n\n"
+
+	got := withArcSSHConfig([]byte(user), userspace)
+	if !strings.HasPrefix(string(got), "Host work\n\tUser me\n\n"+arcSSHConfigStart+"\nHost remotehost rh\n\tPort 2222\n") {
+		t.Fatalf("unexpected config:\n%s", got)
+	}
+	if again := withArcSSHConfig(got, userspace); string(again) != string(got) {
+		t.Fatalf("not idempotent:\n%s", again)
+	}
+	if back := withArcSSHConfig(got, defaultWGNetwork()); string(back) != "Host work\n\tUser me\n" {
+		t.Fatalf("a kernel tunnel must drop the block, got:\n%s", back)
+	}
+	if same := withArcSSHConfig([]byte(user), defaultWGNetwork()); string(same) != user {
+		t.Fatalf("a config without the block must be left alone, got:\n%s", same)
+	}
+}
+
+func TestSyncLocalSSHConfigForArcRemote(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	n := defaultWGNetwork()
+	n.Mode = wgModeUserspace
+
+	if drift, err := arcSSHConfigDrift(n); err != nil || len(drift) != 1 {
+		t.Fatalf("missing block: drift = %v, %v", drift, err)
+	}
+	if err := syncLocalSSHConfigForArcRemote(n); err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+	if drift, err := arcSSHConfigDrift(n); err != nil || len(drift) != 0 {
+		t.Fatalf("after sync: drift = %v, %v", drift, err)
+	}
+	path := filepath.Join(home, ".ssh", "config")
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0o600 {
+		t.Fatalf("stat %s: %v, %v", path, info, err)
+	}
+	if err := removeLocalSSHConfigForArcRemote(); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	if raw, err := os.ReadFile(path); err != nil || len(raw) != 0 {
+		t.Fatalf("after remove %s = %q, %v", path, raw, err)
+	}
+}
@@ -6,16 +6,85 @@ import (
 	"golang.org/x/crypto/ssh"
 )
 
+// Files the hardening templates install on the server.
+const (
+	sshHardeningConfPath      = "/etc/ssh/sshd_config.d/90-arc-hardening.conf"
+	publicLockdownNftPath     = "/etc/nftables.d/arc-public-lockdown.nft"
+	publicLockdownServicePath = "/etc/systemd/system/arc-public-lockdown.service"
+)
+
+var sshHardeningConf = mustTemplateFile("templates/sshd_arc_hardening.conf")
+
+// detectPublicIfCommand prints the interface of the server's default route, falling back to
+// the IPv6 default route on an IPv6-only server; the lockdown applies to it.
+const detectPublicIfCommand = `ip route get 1.1.1.1 2>/dev/null | sed -n 's/.* dev \([^ ]*\) .*/\1/p' | head -n1 | grep . || ` +
+	`ip -6 route get 2606:4700:4700::1111 2>/dev/null | sed -n 's/.* dev \([^ ]*\) .*/\1/p' | head -n1`
+
+// renderPublicLockdown renders the nftables rules and unit of the public lockdown for the
+// WireGuard network n, the server's public interface and its nft binary.
+func renderPublicLockdown(n wgNetwork, publicIf, nftBin string) (nft, service string, err error) {
+	nft, err = renderTemplateFile("templates/arc_public_lockdown.nft.tmpl", map[string]string{
+		"WGInterface": n.Interface,
+		"WGPort":      serverWGPortValue(n),
+		"PublicIf":    publicIf,
+		"RelayPort":   relayPortValue(n),
+	})
+	if err != nil {
+		return "", "", err
+	}
+	service, err = renderTemplateFile("templates/arc_public_lockdown.service.tmpl", map[string]string{
+		"NFTBin": nftBin,
+	})
+	if err != nil {
+		return "", "", err
+	}
+	return nft, service, nil
+}
+
+// serverWGPortValue is the WireGuard port the server listens on as a template value, empty
+// when it dials a rendezvous instead.
+func serverWGPortValue(n wgNetwork) string {
+	if n.Reverse() {
+		return ""
+	}
+	return fmt.Sprintf("%d", n.Port)
+}
+
+// relayPortValue is the relay port as a template value, empty without a relay.
+func relayPortValue(n wgNetwork) string {
+	if port := n.RelayPort(); port > 0 {
+		return fmt.Sprintf("%d", port)
+	}
+	return ""
+}
+
+// renderHardeningScript renders the remote hardening script. The lockdown files it installs
+// refer to the public interface and nft binary the script detects on the server.
+func renderHardeningScript(n wgNetwork) (string, error) {
+	nft, service, err := renderPublicLockdown(n, "$public_if", "$nft_bin")
+	if err != nil {
+		return "", err
+	}
+	return renderTemplateFile("templates/ssh_harden_server_access.sh.tmpl", map[string]string{
+		"WGInterface":     n.Interface,
+		"WGPort":          serverWGPortValue(n),
+		"DetectPublicIf":  detectPublicIfCommand,
+		"HardeningConf":   sshHardeningConf,
+		"LockdownNft":     nft,
+		"LockdownService": service,
+	})
+}
+
 func hardenServerSSH(ctx infraRunContext) error {
-	if err := withArcClient(ctx.Addr, func(client *ssh.Client) error {
-		script, err := renderTemplateFile("templates/ssh_harden_server_access.sh.tmpl", map[string]string{
-			"WGInterface": wgInterface,
-			"WGPort":      fmt.Sprintf("%d", wgPort),
-		})
+	if err := withArcClient(ctx, func(client *ssh.Client) error {
+		if err := backupRemoteFiles(ctx, client, sshHardeningConfPath, publicLockdownNftPath, publicLockdownServicePath); err != nil {
+			return err
+		}
+		script, err := renderHardeningScript(ctx.WG.Net)
 		if err != nil {
 			return err
 		}
-		if _, err := runRemoteCommand(client, script, false, ""); err != nil {
+		if _, err := runRemoteCommand(ctx, client, script, false, ""); err != nil {
 			return fmt.Errorf("apply remote SSH hardening: %w", err)
 		}
 		return nil
@@ -23,11 +92,10 @@ func hardenServerSSH(ctx infraRunContext) error {
 		return err
 	}
 
-	if _, err := execLocal(
+	if _, err := execLocal(ctx,
 		"ssh",
 		"-o", "BatchMode=yes",
-		"-o", "StrictHostKeyChecking=no",
-		"-o", "UserKnownHostsFile=/dev/null",
+		"-o", "StrictHostKeyChecking=yes",
 		"-o", "ConnectTimeout=5",
 		arcUser+"@remotehost",
 		"true",
@@ -37,3 +105,23 @@ func hardenServerSSH(ctx infraRunContext) error {
 
 	return nil
 }
+
+// unhardenServerSSH removes the sshd drop-in, the public lockdown and the ufw rules that
+// hardenServerSSH added, so the server is reachable on its public address again.
+func unhardenServerSSH(ctx infraRunContext) error {
+	script, err := renderTemplateFile("templates/ssh_unharden_server_access.sh.tmpl", map[string]string{
+		"WGInterface": ctx.WG.Net.Interface,
+		"WGPort":      fmt.Sprintf("%d", ctx.WG.Net.Port),
+	})
+	if err != nil {
+		return err
+	}
+	backup, err := remoteBackupCommand(ctx, sshHardeningConfPath, publicLockdownNftPath, publicLockdownServicePath)
+	if err != nil {
+		return err
+	}
+	if err := runRemoteUndoScript(ctx, backup+script); err != nil {
+		return fmt.Errorf("remove remote SSH hardening: %w", err)
+	}
+	return nil
+}
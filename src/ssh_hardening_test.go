@@ -6,10 +6,7 @@ import (
 )
 
 func TestSSHHardeningTemplate_ContainsExpectedRestrictions(t *testing.T) {
-	script, err := renderTemplateFile("templates/ssh_harden_server_access.sh.tmpl", map[string]string{
-		"WGInterface": wgInterface,
-		"WGPort":      "51820",
-	})
+	script, err := renderHardeningScript(defaultWGNetwork())
 	if err != nil {
 		t.Fatalf("render ssh hardening template: %v", err)
 	}
@@ -23,6 +20,8 @@ func TestSSHHardeningTemplate_ContainsExpectedRestrictions(t *testing.T) {
 		"X11Forwarding no",
 		"AllowAgentForwarding no",
 		`public_if="$(ip route get 1.1.1.1`,
+		"ip -6 route get 2606:4700:4700::1111",
+		`iifname "$public_if" icmpv6 type { nd-neighbor-solicit`,
 		`iifname "wg0" accept`,
 		`iifname "$public_if" udp dport 51820 accept`,
 		`iifname "$public_if" drop`,
@@ -36,3 +35,42 @@ func TestSSHHardeningTemplate_ContainsExpectedRestrictions(t *testing.T) {
 		}
 	}
 }
+
+func TestPublicLockdown_OpensRelayPort(t *testing.T) {
+	n := defaultWGNetwork()
+	nft, _, err := renderPublicLockdown(n, "eth0", "/usr/sbin/nft")
+	if err != nil {
+		t.Fatalf("renderPublicLockdown: %v", err)
+	}
+	if strings.Contains(nft, "tcp dport") {
+		t.Fatalf("no TCP port is open without a relay:\n%s", nft)
+	}
+	n.Relay = "ws:8443"
+	nft, _, err = renderPublicLockdown(n, "eth0", "/usr/sbin/nft")
+	if err != nil {
+		t.Fatalf("renderPublicLockdown: %v", err)
+	}
+	want := "    iifname \"eth0\" udp dport 51820 accept\n    iifname \"eth0\" tcp dport 8443 accept\n    iifname \"eth0\" icmpv6"
+	if !strings.Contains(nft, want) {
+		t.Fatalf("relay port missing from the lockdown:\n%s", nft)
+	}
+}
+
+func TestPublicLockdown_RendezvousOpensNoPort(t *testing.T) {
+	n := defaultWGNetwork()
+	n.Rendezvous = "desk.example.net:51820"
+	nft, _, err := renderPublicLockdown(n, "eth0", "/usr/sbin/nft")
+	if err != nil {
+		t.Fatalf("renderPublicLockdown: %v", err)
+	}
+	if strings.Contains(nft, "dport") || !strings.Contains(nft, "ct state established,related accept") {
+		t.Fatalf("a server dialing a rendezvous should only accept replies:\n%s", nft)
+	}
+	script, err := renderHardeningScript(n)
+	if err != nil {
+		t.Fatalf("renderHardeningScript: %v", err)
+	}
+	if strings.Contains(script, "/udp") {
+		t.Fatalf("a server dialing a rendezvous should open no UDP port:\n%s", script)
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const arcPinnedHostKeysFile = "known_hosts"
+
+var errHostKeyScanned = errors.New("host key captured")
+
+func arcHomeDir() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil || home == "" {
+		return "", fmt.Errorf("cannot resolve home dir")
+	}
+	return filepath.Join(home, ".arc"), nil
+}
+
+func pinnedHostKeysPath() (string, error) {
+	dir, err := arcHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, arcPinnedHostKeysFile), nil
+}
+
+// scanSSHHostKey performs a key exchange with addr and returns the presented host key
+// without authenticating.
+func scanSSHHostKey(addr string) (ssh.PublicKey, error) {
+	var captured ssh.PublicKey
+	cfg := &ssh.ClientConfig{
+		User: "arc-hostkey-scan",
+		HostKeyCallback: func(_ string, _ net.Addr, key ssh.PublicKey) error {
+			captured = key
+			return errHostKeyScanned
+		},
+		Timeout: 10 * time.Second,
+	}
+	client, err := ssh.Dial("tcp", addr, cfg)
+	if client != nil {
+		_ = client.Close()
+	}
+	if captured != nil {
+		return captured, nil
+	}
+	if err == nil {
+		err = fmt.Errorf("server did not present a host key")
+	}
+	return nil, fmt.Errorf("scan SSH host key for %s: %w", addr, err)
+}
+
+func sshHostKeyFingerprint(key ssh.PublicKey) string {
+	return ssh.FingerprintSHA256(key)
+}
+
+func readPinnedHostKeys() ([]byte, error) {
+	path, err := pinnedHostKeysPath()
+	if err != nil {
+		return nil, err
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("read %s: %w", path, err)
+	}
+	return raw, nil
+}
+
+// lookupPinnedHostKey returns the pinned key for addr, or nil when nothing is pinned yet.
+func lookupPinnedHostKey(addr string) (ssh.PublicKey, error) {
+	raw, err := readPinnedHostKeys()
+	if err != nil {
+		return nil, err
+	}
+	return findPinnedHostKey(raw, addr)
+}
+
+func findPinnedHostKey(raw []byte, addr string) (ssh.PublicKey, error) {
+	want := knownhosts.Normalize(addr)
+	rest := raw
+	for len(bytes.TrimSpace(rest)) > 0 {
+		_, hosts, key, _, next, err := ssh.ParseKnownHosts(rest)
+		if err != nil {
+			return nil, fmt.Errorf("parse pinned host keys: %w", err)
+		}
+		for _, h := range hosts {
+			if h == want {
+				return key, nil
+			}
+		}
+		rest = next
+	}
+	return nil, nil
+}
+
+func requirePinnedHostKey(addr string) (ssh.PublicKey, error) {
+	key, err := lookupPinnedHostKey(addr)
+	if err != nil {
+		return nil, err
+	}
+	if key == nil {
+		return nil, fmt.Errorf("host key for %s is not pinned", addr)
+	}
+	return key, nil
+}
+
+// pinHostKey records key as the only trusted host key for addr, replacing any earlier pin.
+func pinHostKey(addr string, key ssh.PublicKey) error {
+	path, err := pinnedHostKeysPath()
+	if err != nil {
+		return err
+	}
+	raw, err := readPinnedHostKeys()
+	if err != nil {
+		return err
+	}
+	updated := upsertPinnedHostKey(string(raw), addr, key)
+	if err := ensureDir0700(filepath.Dir(path)); err != nil {
+		return err
+	}
+	if err := atomicWriteFile(path, []byte(updated), 0o600); err != nil {
+		return fmt.Errorf("write %s: %w", path, err)
+	}
+	return nil
+}
+
+func upsertPinnedHostKey(content, addr string, key ssh.PublicKey) string {
+	want := knownhosts.Normalize(addr)
+	var out []string
+	for _, ln := range strings.Split(content, "\n") {
+		trim := strings.TrimSpace(ln)
+		if trim == "" {
+			continue
+		}
+		fields := strings.Fields(trim)
+		keep := true
+		for _, h := range strings.Split(fields[0], ",") {
+			if h == want {
+				keep = false
+				break
+			}
+		}
+		if keep {
+			out = append(out, trim)
+		}
+	}
+	out = append(out, knownhosts.Line([]string{want}, key))
+	return strings.Join(out, "\n") + "\n"
+}
+
+// hostKeyAlgorithmsFor lists the signature algorithms accepted for the pinned key. An RSA
+// pin only takes SHA-2 signatures; a server that can only sign with SHA-1 fails the handshake.
+func hostKeyAlgorithmsFor(key ssh.PublicKey) []string {
+	switch key.Type() {
+	case ssh.KeyAlgoRSA:
+		return []string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256}
+	default:
+		return []string{key.Type()}
+	}
+}
+
+// pinnedHostKeyConfig returns a HostKeyCallback that only accepts the key pinned for addr,
+// together with the matching host key algorithms so the server presents that key type.
+func pinnedHostKeyConfig(addr string) (ssh.HostKeyCallback, []string, error) {
+	pinned, err := lookupPinnedHostKey(addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	if pinned == nil {
+		return nil, nil, fmt.Errorf("host key for %s is not pinned; confirm its fingerprint before connecting", addr)
+	}
+	callback := func(_ string, _ net.Addr, key ssh.PublicKey) error {
+		if bytes.Equal(key.Marshal(), pinned.Marshal()) {
+			return nil
+		}
+		return hostKeyMismatchError(addr, pinned, key)
+	}
+	return callback, hostKeyAlgorithmsFor(pinned), nil
+}
+
+func hostKeyMismatchError(addr string, pinned, got ssh.PublicKey) error {
+	path, _ := pinnedHostKeysPath()
+	return fmt.Errorf(
+		"host key mismatch for %s: server presented %s, pinned %s; if the server was reinstalled, remove its entry from %s and confirm the new key",
+		addr, sshHostKeyFingerprint(got), sshHostKeyFingerprint(pinned), path,
+	)
+}
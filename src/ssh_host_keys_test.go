@@ -0,0 +1,107 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"slices"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func testHostKey(t *testing.T) ssh.PublicKey {
+	t.Helper()
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	key, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatalf("encode key: %v", err)
+	}
+	return key
+}
+
+func TestPinHostKey_RoundTripAndReplace(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+
+	first := testHostKey(t)
+	second := testHostKey(t)
+	other := testHostKey(t)
+
+	if err := pinHostKey("example.com:22", first); err != nil {
+		t.Fatalf("pinHostKey: %v", err)
+	}
+	if err := pinHostKey("[2001:db8::7]:2222", other); err != nil {
+		t.Fatalf("pinHostKey: %v", err)
+	}
+	if err := pinHostKey("example.com:22", second); err != nil {
+		t.Fatalf("pinHostKey replace: %v", err)
+	}
+
+	got, err := lookupPinnedHostKey("example.com:22")
+	if err != nil {
+		t.Fatalf("lookupPinnedHostKey: %v", err)
+	}
+	if got == nil || sshHostKeyFingerprint(got) != sshHostKeyFingerprint(second) {
+		t.Fatalf("expected replaced pin for example.com")
+	}
+	got, err = lookupPinnedHostKey("[2001:db8::7]:2222")
+	if err != nil {
+		t.Fatalf("lookupPinnedHostKey: %v", err)
+	}
+	if got == nil || sshHostKeyFingerprint(got) != sshHostKeyFingerprint(other) {
+		t.Fatalf("expected untouched pin for IPv6 host")
+	}
+
+	missing, err := lookupPinnedHostKey("unknown.example:22")
+	if err != nil {
+		t.Fatalf("lookupPinnedHostKey: %v", err)
+	}
+	if missing != nil {
+		t.Fatalf("expected no pin for unknown host")
+	}
+}
+
+func TestPinnedHostKeyConfig_RejectsUnpinnedAndMismatch(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+
+	if _, _, err := pinnedHostKeyConfig("example.com:22"); err == nil || !strings.Contains(err.Error(), "not pinned") {
+		t.Fatalf("expected not pinned error, got %v", err)
+	}
+
+	pinned := testHostKey(t)
+	if err := pinHostKey("example.com:22", pinned); err != nil {
+		t.Fatalf("pinHostKey: %v", err)
+	}
+	callback, algos, err := pinnedHostKeyConfig("example.com:22")
+	if err != nil {
+		t.Fatalf("pinnedHostKeyConfig: %v", err)
+	}
+	if len(algos) != 1 || algos[0] != ssh.KeyAlgoED25519 {
+		t.Fatalf("unexpected host key algorithms: %#v", algos)
+	}
+	if err := callback("example.com:22", nil, pinned); err != nil {
+		t.Fatalf("pinned key rejected: %v", err)
+	}
+	if err := callback("example.com:22", nil, testHostKey(t)); err == nil || !strings.Contains(err.Error(), "host key mismatch") {
+		t.Fatalf("expected mismatch error, got %v", err)
+	}
+}
+
+func TestHostKeyAlgorithmsFor_RSAPinRefusesSHA1(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	key, err := ssh.NewPublicKey(&priv.PublicKey)
+	if err != nil {
+		t.Fatalf("encode key: %v", err)
+	}
+	algos := hostKeyAlgorithmsFor(key)
+	if slices.Contains(algos, ssh.KeyAlgoRSA) || !slices.Contains(algos, ssh.KeyAlgoRSASHA256) {
+		t.Fatalf("unexpected host key algorithms for an RSA pin: %#v", algos)
+	}
+}
@@ -1,11 +1,16 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"net"
 	"os"
 	"path/filepath"
 	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
 )
 
 type knownHostTarget struct {
@@ -13,27 +18,90 @@ type knownHostTarget struct {
 	Port string
 }
 
-func syncLocalKnownHostsForBootstrap(host, addr string) error {
+func syncLocalKnownHostsForBootstrap(ctx context.Context, host, addr string) error {
+	key, err := requirePinnedHostKey(addr)
+	if err != nil {
+		return err
+	}
 	targets := knownHostTargetsForAddr(addr, host)
-	return syncLocalKnownHosts(execLocal, targets...)
+	return syncLocalKnownHosts(ctx, execLocal, key, targets...)
 }
 
-func syncLocalKnownHostsForArcRemote() error {
-	targets := knownHostTargetsForAddr(net.JoinHostPort(wgServerIP, "22"), "remotehost", "rh")
-	return syncLocalKnownHosts(execLocal, targets...)
+// syncLocalKnownHostsForArcRemote reuses the host key pinned for the bootstrap address for the
+// WireGuard-side names of n, since both reach the same sshd.
+func syncLocalKnownHostsForArcRemote(ctx context.Context, addr string, n wgNetwork) error {
+	key, err := requirePinnedHostKey(addr)
+	if err != nil {
+		return err
+	}
+	wgAddr := n.LocalSSHAddr()
+	if err := pinHostKey(wgAddr, key); err != nil {
+		return err
+	}
+	targets := knownHostTargetsForAddr(wgAddr, "remotehost", "rh")
+	return syncLocalKnownHosts(ctx, execLocal, key, targets...)
 }
 
-func syncLocalKnownHosts(execFn localExecFunc, targets ...knownHostTarget) error {
-	knownHostsPath, err := ensureLocalKnownHostsFile()
+// arcRemoteKnownHostsDrift lists what syncLocalKnownHostsForArcRemote would change: a missing
+// tunnel pin and known_hosts names without an entry for the pinned key.
+func arcRemoteKnownHostsDrift(addr string, n wgNetwork) ([]string, error) {
+	key, err := requirePinnedHostKey(addr)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	var drift []string
+	wgAddr := n.LocalSSHAddr()
+	pinned, err := lookupPinnedHostKey(wgAddr)
+	if err != nil {
+		return nil, err
+	}
+	if pinned == nil || !bytes.Equal(pinned.Marshal(), key.Marshal()) {
+		drift = append(drift, "host key not pinned for "+wgAddr)
+	}
+
+	raw, err := os.ReadFile(filepath.Join(userSSHDir(), "known_hosts"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("read known_hosts: %w", err)
+	}
+	for _, target := range knownHostsMissing(raw, key, knownHostTargetsForAddr(wgAddr, "remotehost", "rh")...) {
+		drift = append(drift, "known_hosts has no entry for "+knownhosts.Normalize(net.JoinHostPort(target.Host, target.Port)))
+	}
+	return drift, nil
+}
+
+// knownHostsMissing returns the targets that have no plain known_hosts entry for key. Lines
+// that do not parse are ignored.
+func knownHostsMissing(raw []byte, key ssh.PublicKey, targets ...knownHostTarget) []knownHostTarget {
+	found := map[string]bool{}
+	for _, ln := range strings.Split(string(raw), "\n") {
+		if strings.TrimSpace(ln) == "" {
+			continue
+		}
+		_, hosts, lineKey, _, _, err := ssh.ParseKnownHosts([]byte(ln))
+		if err != nil || !bytes.Equal(lineKey.Marshal(), key.Marshal()) {
+			continue
+		}
+		for _, h := range hosts {
+			found[h] = true
+		}
 	}
 
+	var missing []knownHostTarget
 	for _, target := range targets {
-		for _, stale := range knownHostRemovalKeys(target) {
-			_, _ = execFn("ssh-keygen", "-R", stale, "-f", knownHostsPath)
+		if !found[knownhosts.Normalize(net.JoinHostPort(target.Host, target.Port))] {
+			missing = append(missing, target)
 		}
 	}
+	return missing
+}
+
+func syncLocalKnownHosts(ctx context.Context, execFn localExecFunc, key ssh.PublicKey, targets ...knownHostTarget) error {
+	knownHostsPath, err := ensureLocalKnownHostsFile()
+	if err != nil {
+		return err
+	}
+
+	removeKnownHosts(ctx, execFn, knownHostsPath, targets...)
 
 	f, err := os.OpenFile(knownHostsPath, os.O_APPEND|os.O_WRONLY, 0o600)
 	if err != nil {
@@ -42,26 +110,47 @@ func syncLocalKnownHosts(execFn localExecFunc, targets ...knownHostTarget) error
 	defer f.Close()
 
 	for _, target := range targets {
-		args := []string{"-T", "5"}
-		if target.Port != "" && target.Port != "22" {
-			args = append(args, "-p", target.Port)
+		line := knownhosts.Line([]string{knownhosts.Normalize(net.JoinHostPort(target.Host, target.Port))}, key)
+		if _, err := f.WriteString(line + "\n"); err != nil {
+			return fmt.Errorf("append known_hosts entry for %s: %w", target.Host, err)
 		}
-		args = append(args, target.Host)
+	}
 
-		out, err := execFn("ssh-keyscan", args...)
-		if err != nil {
-			return fmt.Errorf("scan SSH host key for %s: %w", target.Host, err)
-		}
+	return nil
+}
 
-		out = strings.TrimSpace(out)
-		if out == "" {
-			return fmt.Errorf("scan SSH host key for %s returned no keys", target.Host)
-		}
-		if _, err := f.WriteString(out + "\n"); err != nil {
-			return fmt.Errorf("append known_hosts entry for %s: %w", target.Host, err)
+func removeKnownHosts(ctx context.Context, execFn localExecFunc, knownHostsPath string, targets ...knownHostTarget) {
+	for _, target := range targets {
+		for _, stale := range knownHostRemovalKeys(target) {
+			_, _ = execFn(ctx, "ssh-keygen", "-R", stale, "-f", knownHostsPath)
 		}
 	}
+}
+
+// removeLocalKnownHostsForBootstrap drops the known_hosts entries syncLocalKnownHostsForBootstrap
+// wrote for the server's public name.
+func removeLocalKnownHostsForBootstrap(ctx infraRunContext) error {
+	return removeLocalKnownHostTargets(ctx, knownHostTargetsForAddr(ctx.Addr, ctx.Host)...)
+}
+
+// removeLocalKnownHostsForArcRemote drops the tunnel-side names syncLocalKnownHostsForArcRemote
+// wrote, and the ssh config block that gives them the userspace tunnel's port.
+func removeLocalKnownHostsForArcRemote(ctx infraRunContext) error {
+	if err := removeLocalSSHConfigForArcRemote(); err != nil {
+		return err
+	}
+	return removeLocalKnownHostTargets(ctx, knownHostTargetsForAddr(ctx.WG.Net.LocalSSHAddr(), "remotehost", "rh")...)
+}
 
+func removeLocalKnownHostTargets(ctx context.Context, targets ...knownHostTarget) error {
+	knownHostsPath := filepath.Join(userSSHDir(), "known_hosts")
+	if _, err := os.Stat(knownHostsPath); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	removeKnownHosts(ctx, execLocal, knownHostsPath, targets...)
 	return nil
 }
 
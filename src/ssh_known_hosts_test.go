@@ -1,11 +1,14 @@
 package main
 
 import (
+	"context"
 	"os"
 	"path/filepath"
 	"reflect"
 	"strings"
 	"testing"
+
+	"golang.org/x/crypto/ssh"
 )
 
 func TestKnownHostTargetsForAddr_DeduplicatesAndKeepsPort(t *testing.T) {
@@ -35,7 +38,7 @@ func TestKnownHostRemovalKeys_DefaultAndCustomPort(t *testing.T) {
 	}
 }
 
-func TestSyncLocalKnownHosts_ReplacesEntriesAndAppendsScannedKeys(t *testing.T) {
+func TestSyncLocalKnownHosts_ReplacesEntriesAndAppendsPinnedKey(t *testing.T) {
 	home := t.TempDir()
 	t.Setenv("HOME", home)
 
@@ -45,20 +48,18 @@ func TestSyncLocalKnownHosts_ReplacesEntriesAndAppendsScannedKeys(t *testing.T)
 	}
 	var calls []call
 
-	execFn := func(name string, args ...string) (string, error) {
+	execFn := func(_ context.Context, name string, args ...string) (string, error) {
 		calls = append(calls, call{name: name, args: append([]string(nil), args...)})
-		if name == "ssh-keyscan" {
-			host := args[len(args)-1]
-			return host + " ssh-ed25519 AAAATEST", nil
-		}
 		return "", nil
 	}
+	key := testHostKey(t)
+	keyText := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
 
 	targets := []knownHostTarget{
 		{Host: "example.com", Port: "2222"},
 		{Host: "remotehost", Port: "22"},
 	}
-	if err := syncLocalKnownHosts(execFn, targets...); err != nil {
+	if err := syncLocalKnownHosts(context.Background(), execFn, key, targets...); err != nil {
 		t.Fatalf("syncLocalKnownHosts returned error: %v", err)
 	}
 
@@ -68,11 +69,11 @@ func TestSyncLocalKnownHosts_ReplacesEntriesAndAppendsScannedKeys(t *testing.T)
 		t.Fatalf("read known_hosts: %v", err)
 	}
 	text := string(raw)
-	if !strings.Contains(text, "example.com ssh-ed25519 AAAATEST") {
-		t.Fatalf("missing scanned key for example.com: %q", text)
+	if !strings.Contains(text, "[example.com]:2222 "+keyText) {
+		t.Fatalf("missing pinned key for example.com: %q", text)
 	}
-	if !strings.Contains(text, "remotehost ssh-ed25519 AAAATEST") {
-		t.Fatalf("missing scanned key for remotehost: %q", text)
+	if !strings.Contains(text, "remotehost "+keyText) {
+		t.Fatalf("missing pinned key for remotehost: %q", text)
 	}
 
 	var got []string
@@ -84,8 +85,6 @@ func TestSyncLocalKnownHosts_ReplacesEntriesAndAppendsScannedKeys(t *testing.T)
 		"ssh-keygen -R [example.com]:2222 -f " + knownHostsPath,
 		"ssh-keygen -R remotehost -f " + knownHostsPath,
 		"ssh-keygen -R [remotehost]:22 -f " + knownHostsPath,
-		"ssh-keyscan -T 5 -p 2222 example.com",
-		"ssh-keyscan -T 5 remotehost",
 	}
 	for _, want := range wantPrefixes {
 		found := false
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+type sshSessionKey struct {
+	user string
+	addr string
+}
+
+// sshSessionManager keeps one authenticated client per (user, addr) for the duration of a
+// setup workflow. Cached clients are probed before reuse and redialed when the server has
+// dropped them (e.g. after sshd was restarted by a step).
+type sshSessionManager struct {
+	mu      sync.Mutex
+	clients map[sshSessionKey]*ssh.Client
+	// pending holds the probe or dial in flight for a key. Callers for the same key wait
+	// for it; other keys go ahead, so one slow host does not hold up the others.
+	pending map[sshSessionKey]*sshSessionDial
+}
+
+type sshSessionDial struct {
+	done   chan struct{}
+	client *ssh.Client
+	err    error
+}
+
+func newSSHSessionManager() *sshSessionManager {
+	return &sshSessionManager{clients: map[sshSessionKey]*ssh.Client{}, pending: map[sshSessionKey]*sshSessionDial{}}
+}
+
+func (m *sshSessionManager) client(user, addr string, dial func() (*ssh.Client, error)) (*ssh.Client, error) {
+	key := sshSessionKey{user: user, addr: addr}
+
+	m.mu.Lock()
+	if d, ok := m.pending[key]; ok {
+		m.mu.Unlock()
+		<-d.done
+		return d.client, d.err
+	}
+	cached := m.clients[key]
+	d := &sshSessionDial{done: make(chan struct{})}
+	m.pending[key] = d
+	m.mu.Unlock()
+
+	if cached != nil && sshClientAlive(cached) {
+		d.client = cached
+	} else {
+		if cached != nil {
+			_ = cached.Close()
+		}
+		d.client, d.err = dial()
+	}
+
+	m.mu.Lock()
+	delete(m.pending, key)
+	if d.err != nil {
+		delete(m.clients, key)
+	} else {
+		m.clients[key] = d.client
+	}
+	m.mu.Unlock()
+	close(d.done)
+	return d.client, d.err
+}
+
+func (m *sshSessionManager) arcClient(addr string) (*ssh.Client, error) {
+	return m.client(arcUser, addr, func() (*ssh.Client, error) { return dialArcWithKey(addr) })
+}
+
+// tunnelClient connects as arc over the WireGuard tunnel to tunnelAddr (see
+// wgNetwork.TunnelSSHAddr), checking the key pinned for addr.
+func (m *sshSessionManager) tunnelClient(addr, tunnelAddr string) (*ssh.Client, error) {
+	return m.client(arcUser, tunnelAddr, func() (*ssh.Client, error) { return dialArcWithKeyVia(tunnelAddr, addr) })
+}
+
+func (m *sshSessionManager) bootstrapClient(user, addr, password string) (*ssh.Client, error) {
+	return m.client(user, addr, func() (*ssh.Client, error) { return dialWithPassword(user, addr, password) })
+}
+
+// Close closes every cached client. The manager stays usable and redials on next use.
+func (m *sshSessionManager) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var errs []error
+	for key, client := range m.clients {
+		if err := client.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+			errs = append(errs, err)
+		}
+		delete(m.clients, key)
+	}
+	return errors.Join(errs...)
+}
+
+func sshClientAlive(client *ssh.Client) bool {
+	_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+	return err == nil
+}
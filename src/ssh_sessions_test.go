@@ -0,0 +1,170 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// startTestSSHServer accepts unauthenticated connections and answers keepalives. Channels
+// go to handle, or are rejected when handle is nil. The returned func drops every
+// connection accepted so far.
+func startTestSSHServer(t *testing.T, handle func(ssh.NewChannel)) (string, func()) {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatalf("NewSignerFromKey: %v", err)
+	}
+	cfg := &ssh.ServerConfig{NoClientAuth: true}
+	cfg.AddHostKey(signer)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+
+	var mu sync.Mutex
+	var conns []net.Conn
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns = append(conns, conn)
+			mu.Unlock()
+			go func() {
+				_, chans, reqs, err := ssh.NewServerConn(conn, cfg)
+				if err != nil {
+					return
+				}
+				go func() {
+					for ch := range chans {
+						if handle == nil {
+							_ = ch.Reject(ssh.Prohibited, "no channels")
+							continue
+						}
+						go handle(ch)
+					}
+				}()
+				for req := range reqs {
+					if req.WantReply {
+						_ = req.Reply(true, nil)
+					}
+				}
+			}()
+		}
+	}()
+
+	drop := func() {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, c := range conns {
+			_ = c.Close()
+		}
+		conns = nil
+	}
+	return ln.Addr().String(), drop
+}
+
+func TestSSHSessionManager_ReusesAndRedialsClients(t *testing.T) {
+	addr, drop := startTestSSHServer(t, nil)
+	dials := 0
+	dial := func() (*ssh.Client, error) {
+		dials++
+		return ssh.Dial("tcp", addr, &ssh.ClientConfig{User: "arc", HostKeyCallback: ssh.InsecureIgnoreHostKey()})
+	}
+
+	m := newSSHSessionManager()
+	defer m.Close()
+
+	first, err := m.client("arc", addr, dial)
+	if err != nil {
+		t.Fatalf("client: %v", err)
+	}
+	second, err := m.client("arc", addr, dial)
+	if err != nil {
+		t.Fatalf("client: %v", err)
+	}
+	if first != second || dials != 1 {
+		t.Fatalf("expected the cached client to be reused, dials=%d", dials)
+	}
+
+	drop()
+	_ = first.Wait()
+	third, err := m.client("arc", addr, dial)
+	if err != nil {
+		t.Fatalf("client after drop: %v", err)
+	}
+	if third == first || dials != 2 {
+		t.Fatalf("expected a redial after the server dropped the connection, dials=%d", dials)
+	}
+
+	if err := m.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if _, err := m.client("arc", addr, dial); err != nil || dials != 3 {
+		t.Fatalf("expected manager to redial after Close, dials=%d err=%v", dials, err)
+	}
+}
+
+func TestSSHSessionManager_DialsOutsideTheLock(t *testing.T) {
+	addr, _ := startTestSSHServer(t, nil)
+	m := newSSHSessionManager()
+	defer m.Close()
+
+	// A dial to a slow host must not hold up a client for another address.
+	release := make(chan struct{})
+	slowDone := make(chan error, 1)
+	var slowDials int
+	slow := func() (*ssh.Client, error) {
+		slowDials++
+		<-release
+		return ssh.Dial("tcp", addr, &ssh.ClientConfig{User: "arc", HostKeyCallback: ssh.InsecureIgnoreHostKey()})
+	}
+	go func() {
+		_, err := m.client("arc", "slow.example:22", slow)
+		slowDone <- err
+	}()
+	for {
+		m.mu.Lock()
+		_, dialing := m.pending[sshSessionKey{user: "arc", addr: "slow.example:22"}]
+		m.mu.Unlock()
+		if dialing {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	fast := func() (*ssh.Client, error) {
+		return ssh.Dial("tcp", addr, &ssh.ClientConfig{User: "arc", HostKeyCallback: ssh.InsecureIgnoreHostKey()})
+	}
+	if _, err := m.client("arc", addr, fast); err != nil {
+		t.Fatalf("client: %v", err)
+	}
+
+	// A second caller for the slow key waits for the dial in flight instead of dialing again.
+	waiter := make(chan *ssh.Client, 1)
+	go func() {
+		c, _ := m.client("arc", "slow.example:22", slow)
+		waiter <- c
+	}()
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	if err := <-slowDone; err != nil {
+		t.Fatalf("slow client: %v", err)
+	}
+	if c := <-waiter; c == nil || slowDials != 1 {
+		t.Fatalf("expected one shared dial, dials=%d", slowDials)
+	}
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"crypto/ed25519"
 	"crypto/rand"
 	"crypto/rsa"
@@ -12,6 +14,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"golang.org/x/crypto/ssh"
@@ -19,6 +22,12 @@ import (
 
 const arcUser = "arc"
 
+// arcSudoersPath holds arcSudoersRule, which gives arc passwordless sudo.
+const (
+	arcSudoersPath = "/etc/sudoers.d/90-arc"
+	arcSudoersRule = arcUser + " ALL=(ALL) NOPASSWD:ALL"
+)
+
 func parseSSHDeviceTarget(target string) (user, host, addr string, err error) {
 	raw := strings.TrimSpace(target)
 	if raw == "" {
@@ -93,11 +102,17 @@ func dialWithPassword(user, addr, password string) (*ssh.Client, error) {
 		return nil, fmt.Errorf("bootstrap auth failed for %s@%s: no usable SSH key and no password provided", user, addr)
 	}
 
+	hostKeyCallback, hostKeyAlgos, err := pinnedHostKeyConfig(addr)
+	if err != nil {
+		return nil, err
+	}
+
 	cfg := &ssh.ClientConfig{
-		User:            user,
-		Auth:            auth,
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-		Timeout:         10 * time.Second,
+		User:              user,
+		Auth:              auth,
+		HostKeyCallback:   hostKeyCallback,
+		HostKeyAlgorithms: hostKeyAlgos,
+		Timeout:           10 * time.Second,
 	}
 	client, err := ssh.Dial("tcp", addr, cfg)
 	if err != nil {
@@ -144,17 +159,17 @@ func bootstrapKeySigners() []ssh.Signer {
 	return signers
 }
 
-func canRunPrivileged(bootstrapUser string, client *ssh.Client, password string) (bool, error) {
+func canRunPrivileged(ctx context.Context, bootstrapUser string, client *ssh.Client, password string) (bool, error) {
 	if bootstrapUser == "root" {
 		return false, nil
 	}
-	if _, err := runRemoteCommand(client, "true", true, password); err != nil {
+	if _, err := runRemoteCommand(ctx, client, "true", true, password); err != nil {
 		return false, fmt.Errorf("bootstrap user %q is not root and sudo failed: %w", bootstrapUser, err)
 	}
 	return true, nil
 }
 
-func ensureArcUser(client *ssh.Client, useSudo bool, sudoPassword string) error {
+func ensureArcUser(ctx context.Context, client *ssh.Client, useSudo bool, sudoPassword string) error {
 	script, err := renderTemplateFile("templates/ssh_ensure_arc_user.sh.tmpl", map[string]string{
 		"ArcUser": arcUser,
 	})
@@ -162,13 +177,13 @@ func ensureArcUser(client *ssh.Client, useSudo bool, sudoPassword string) error
 		return err
 	}
 
-	if _, err := runRemoteCommand(client, script, useSudo, sudoPassword); err != nil {
+	if _, err := runRemoteCommand(ctx, client, script, useSudo, sudoPassword); err != nil {
 		return fmt.Errorf("create user %q failed: %w", arcUser, err)
 	}
 	return nil
 }
 
-func ensureArcAuthorizedKey(client *ssh.Client, useSudo bool, sudoPassword, pubKeyLine string) error {
+func ensureArcAuthorizedKey(ctx context.Context, client *ssh.Client, useSudo bool, sudoPassword, pubKeyLine string) error {
 	if strings.TrimSpace(pubKeyLine) == "" {
 		return fmt.Errorf("public key line is empty")
 	}
@@ -181,27 +196,28 @@ func ensureArcAuthorizedKey(client *ssh.Client, useSudo bool, sudoPassword, pubK
 		return err
 	}
 
-	if _, err := runRemoteCommand(client, script, useSudo, sudoPassword); err != nil {
+	if _, err := runRemoteCommand(ctx, client, script, useSudo, sudoPassword); err != nil {
 		return fmt.Errorf("install authorized_keys failed: %w", err)
 	}
 	return nil
 }
 
-func ensureArcSudoers(client *ssh.Client, useSudo bool, sudoPassword string) error {
+func ensureArcSudoers(ctx context.Context, client *ssh.Client, useSudo bool, sudoPassword string) error {
 	script, err := renderTemplateFile("templates/ssh_ensure_arc_sudoers.sh.tmpl", map[string]string{
-		"ArcUser": arcUser,
+		"SudoersPath": arcSudoersPath,
+		"SudoersRule": shSingleQuote(arcSudoersRule),
 	})
 	if err != nil {
 		return err
 	}
 
-	if _, err := runRemoteCommand(client, script, useSudo, sudoPassword); err != nil {
+	if _, err := runRemoteCommand(ctx, client, script, useSudo, sudoPassword); err != nil {
 		return fmt.Errorf("install sudoers failed: %w", err)
 	}
 	return nil
 }
 
-func ensureArcHushLogin(client *ssh.Client, useSudo bool, sudoPassword string) error {
+func ensureArcHushLogin(ctx context.Context, client *ssh.Client, useSudo bool, sudoPassword string) error {
 	script, err := renderTemplateFile("templates/ssh_ensure_arc_hushlogin.sh.tmpl", map[string]string{
 		"ArcUser": arcUser,
 	})
@@ -209,76 +225,148 @@ func ensureArcHushLogin(client *ssh.Client, useSudo bool, sudoPassword string) e
 		return err
 	}
 
-	if _, err := runRemoteCommand(client, script, useSudo, sudoPassword); err != nil {
+	if _, err := runRemoteCommand(ctx, client, script, useSudo, sudoPassword); err != nil {
 		return fmt.Errorf("install hushlogin failed: %w", err)
 	}
 	return nil
 }
 
-func verifyArcKeyLogin(host, addr string) error {
-	client, err := dialArcWithKey(addr)
+// remoteArcCleanupDelay gives the uninstall time to finish and close its arc sessions before
+// a scheduled root job removes the account those sessions belong to.
+const remoteArcCleanupDelay = 20 * time.Second
+
+// scheduleRemoteRootCleanup runs script as root once remoteArcCleanupDelay has passed. The
+// uninstall is logged in as arc, so it cannot remove the account or its sudo rights inline.
+func scheduleRemoteRootCleanup(ctx infraRunContext, unit, script string) error {
+	cmd := fmt.Sprintf(
+		"sudo -n systemctl stop %s.timer >/dev/null 2>&1 || true\nsudo -n systemd-run --quiet --collect --unit=%s --on-active=%d /bin/sh -c %s",
+		unit, unit, int(remoteArcCleanupDelay.Seconds()), shSingleQuote(script),
+	)
+	if err := runRemoteUndoScript(ctx, cmd); err != nil {
+		return fmt.Errorf("schedule %s: %w", unit, err)
+	}
+	return nil
+}
+
+// removeArcUser deletes the arc account but keeps its home directory, which is the exported
+// /home/arc share.
+func removeArcUser(ctx infraRunContext) error {
+	return scheduleRemoteRootCleanup(ctx, "arc-uninstall-user",
+		fmt.Sprintf("pkill -KILL -u %s || true; userdel %s", arcUser, arcUser))
+}
+
+func removeArcSudoers(ctx infraRunContext) error {
+	return scheduleRemoteRootCleanup(ctx, "arc-uninstall-sudoers", "rm -f "+arcSudoersPath)
+}
+
+func removeArcHushLogin(ctx infraRunContext) error {
+	return runRemoteUndoScript(ctx, `rm -f "$HOME/.hushlogin"`)
+}
+
+// removeArcAuthorizedKeys drops the desktop and mobile keys setup added for arc.
+func removeArcAuthorizedKeys(ctx infraRunContext) error {
+	var patterns []string
+	for _, path := range []string{userSSHPublicKeyPath(), userMobileSSHPublicKeyPath()} {
+		line, err := readPublicKeyLine(path)
+		if err != nil {
+			continue
+		}
+		patterns = append(patterns, "-e "+shSingleQuote(line))
+	}
+	if len(patterns) == 0 {
+		return nil
+	}
+	script := fmt.Sprintf(`set -eu
+f="$HOME/.ssh/authorized_keys"
+[ -f "$f" ] || exit 0
+grep -vxF %s "$f" > "$f.arc.tmp" || true
+chmod 600 "$f.arc.tmp"
+mv "$f.arc.tmp" "$f"
+`, strings.Join(patterns, " "))
+	return runRemoteUndoScript(ctx, script)
+}
+
+func verifyArcKeyLogin(ctx infraRunContext) error {
+	client, release, err := arcClientFor(ctx)
 	if err != nil {
-		return fmt.Errorf("arc key login failed for %s@%s: %w", arcUser, host, err)
+		return fmt.Errorf("arc key login failed for %s@%s: %w", arcUser, ctx.Host, err)
 	}
-	defer client.Close()
+	defer release()
 
-	if _, err := runRemoteCommand(client, "true", false, ""); err != nil {
+	if _, err := runRemoteCommand(ctx, client, "true", false, ""); err != nil {
 		return fmt.Errorf("arc login verification command failed: %w", err)
 	}
-	if _, err := runRemoteCommand(client, "sudo -n true", false, ""); err != nil {
+	if _, err := runRemoteCommand(ctx, client, "sudo -n true", false, ""); err != nil {
 		return fmt.Errorf("arc sudo verification failed: %w", err)
 	}
 	return nil
 }
 
 func dialArcWithKey(addr string) (*ssh.Client, error) {
+	return dialArcWithKeyVia(addr, addr)
+}
+
+// dialArcWithKeyVia connects to dialAddr as arc but verifies the host key pinned for pinAddr.
+// Once public SSH is locked down the server is only reachable over the tunnel, under a
+// different address than the one its key was pinned for.
+func dialArcWithKeyVia(dialAddr, pinAddr string) (*ssh.Client, error) {
 	privPath := filepath.Join(userSSHDir(), "id_ed25519")
 	signer, err := readPrivateKeySigner(privPath)
 	if err != nil {
 		return nil, err
 	}
 
+	hostKeyCallback, hostKeyAlgos, err := pinnedHostKeyConfig(pinAddr)
+	if err != nil {
+		return nil, err
+	}
+
 	cfg := &ssh.ClientConfig{
-		User:            arcUser,
-		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-		Timeout:         8 * time.Second,
+		User:              arcUser,
+		Auth:              []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback:   hostKeyCallback,
+		HostKeyAlgorithms: hostKeyAlgos,
+		Timeout:           8 * time.Second,
 	}
 
-	client, err := ssh.Dial("tcp", addr, cfg)
+	client, err := ssh.Dial("tcp", dialAddr, cfg)
 	if err != nil {
 		return nil, err
 	}
 	return client, nil
 }
 
-func ensureArcZshPrompt(addr string) error {
-	client, err := dialArcWithKey(addr)
+func ensureArcZshPrompt(ctx infraRunContext) error {
+	client, release, err := arcClientFor(ctx)
 	if err != nil {
 		return fmt.Errorf("cannot connect as %s: %w", arcUser, err)
 	}
-	defer client.Close()
+	defer release()
 
 	// Install/replace a dedicated ARC prompt block in ~/.zshrc.
+	block, err := renderArcPromptBlock(arcPromptRemoteTemplate, ctx.WG.Net)
+	if err != nil {
+		return err
+	}
 	script, err := renderTemplateFile("templates/ssh_ensure_arc_zsh_prompt.sh.tmpl", map[string]string{
-		"ArcPromptBlockRemote": arcPromptBlockRemote,
+		"ArcPromptBlockRemote": block,
 	})
 	if err != nil {
 		return err
 	}
 
-	if _, err := runRemoteCommand(client, script, false, ""); err != nil {
+	if _, err := runRemoteCommand(ctx, client, script, false, ""); err != nil {
 		return err
 	}
 	return nil
 }
 
-func ensureArcTmuxConfig(addr string) error {
-	client, err := dialArcWithKey(addr)
+func ensureArcTmuxConfig(ctx infraRunContext) error {
+	client, release, err := arcClientFor(ctx)
 	if err != nil {
 		return fmt.Errorf("cannot connect as %s: %w", arcUser, err)
 	}
-	defer client.Close()
+	defer release()
 
 	script, err := renderTemplateFile("templates/ssh_ensure_arc_tmux_conf.sh.tmpl", map[string]string{
 		"ArcTmuxBlockRemote": arcTmuxBlockRemote,
@@ -287,13 +375,63 @@ func ensureArcTmuxConfig(addr string) error {
 		return err
 	}
 
-	if _, err := runRemoteCommand(client, script, false, ""); err != nil {
+	if _, err := runRemoteCommand(ctx, client, script, false, ""); err != nil {
 		return fmt.Errorf("install tmux config failed: %w", err)
 	}
 	return nil
 }
 
-func runRemoteCommand(client *ssh.Client, command string, useSudo bool, sudoPassword string) (string, error) {
+// removeArcHelperAndPrompt undoes the extras verifyArcSSHLogin installs for arc: the remote
+// arc helper and the zsh prompt block.
+func removeArcHelperAndPrompt(ctx infraRunContext) error {
+	if err := removeRemoteArcHelper(ctx); err != nil {
+		return err
+	}
+	return removeArcZshPrompt(ctx)
+}
+
+func removeArcZshPrompt(ctx infraRunContext) error {
+	return runRemoteUndoScript(ctx, stripRemoteBlockScript(".zshrc", arcPromptStart, arcPromptEnd))
+}
+
+func removeArcTmuxConfig(ctx infraRunContext) error {
+	return runRemoteUndoScript(ctx, stripRemoteBlockScript(".tmux.conf", arcTmuxStart, arcTmuxEnd))
+}
+
+// stripRemoteBlockScript removes the managed start..end block from a file in arc's home.
+func stripRemoteBlockScript(file, start, end string) string {
+	return fmt.Sprintf(`set -eu
+f="$HOME/%s"
+[ -f "$f" ] || exit 0
+awk -v s=%s -v e=%s '
+BEGIN{skip=0}
+$0==s{skip=1; next}
+$0==e{skip=0; next}
+skip==0{print}
+' "$f" > "$f.arc.tmp"
+chmod 600 "$f.arc.tmp"
+mv "$f.arc.tmp" "$f"
+`, file, shSingleQuote(start), shSingleQuote(end))
+}
+
+// arcTunnelAddr is the server's SSH address inside the WireGuard tunnel at serverIP, on the
+// same port as its public addr.
+func arcTunnelAddr(addr, serverIP string) string {
+	port := "22"
+	if _, p, err := net.SplitHostPort(addr); err == nil && p != "" {
+		port = p
+	}
+	return net.JoinHostPort(serverIP, port)
+}
+
+// remoteCancelGrace is how long a cancelled remote command gets to exit after SIGTERM before
+// its session is closed.
+const remoteCancelGrace = 5 * time.Second
+
+// runRemoteCommand runs command in a new session on client, streaming its output to the step
+// sink on ctx if there is one. When ctx is cancelled the remote process is sent SIGTERM and
+// the session is closed after remoteCancelGrace.
+func runRemoteCommand(ctx context.Context, client *ssh.Client, command string, useSudo bool, sudoPassword string) (string, error) {
 	session, err := client.NewSession()
 	if err != nil {
 		return "", fmt.Errorf("cannot open ssh session: %w", err)
@@ -306,11 +444,52 @@ func runRemoteCommand(client *ssh.Client, command string, useSudo bool, sudoPass
 		session.Stdin = strings.NewReader(sudoPassword + "\n")
 	}
 
-	out, err := session.CombinedOutput(remoteCmd)
+	var buf lockedBuffer
+	w, flush := teeStepOutput(ctx, &buf)
+	session.Stdout = w
+	session.Stderr = w
+	if err := session.Start(remoteCmd); err != nil {
+		return "", fmt.Errorf("cannot start remote command: %w", err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- session.Wait() }()
+	defer flush()
+
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		_ = session.Signal(ssh.SIGTERM)
+		select {
+		case <-done:
+		case <-time.After(remoteCancelGrace):
+			_ = session.Close()
+		}
+		return strings.TrimSpace(buf.String()), fmt.Errorf("remote command interrupted: %w", ctx.Err())
+	}
+
+	out := strings.TrimSpace(buf.String())
 	if err != nil {
-		return strings.TrimSpace(string(out)), fmt.Errorf("%w (%s)", err, strings.TrimSpace(string(out)))
+		return out, fmt.Errorf("%w (%s)", err, out)
 	}
-	return strings.TrimSpace(string(out)), nil
+	return out, nil
+}
+
+// lockedBuffer lets a session write stdout and stderr into one buffer.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
 }
 
 func userSSHDir() string {
@@ -1,6 +1,13 @@
 package main
 
-import "testing"
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
 
 func TestParseSSHDeviceTarget_UserHostPort(t *testing.T) {
 	user, host, addr, err := parseSSHDeviceTarget("root@example.com:2202")
@@ -56,3 +63,54 @@ func TestParseSSHDeviceTarget_RejectsMissingUser(t *testing.T) {
 		t.Fatal("expected error for missing user")
 	}
 }
+
+func TestRunRemoteCommand_CancelSignalsRemoteSession(t *testing.T) {
+	signals := make(chan string, 1)
+	addr, _ := startTestSSHServer(t, func(nc ssh.NewChannel) {
+		ch, reqs, err := nc.Accept()
+		if err != nil {
+			return
+		}
+		defer ch.Close()
+		for req := range reqs {
+			switch req.Type {
+			case "exec":
+				_ = req.Reply(true, nil)
+			case "signal":
+				var msg struct{ Signal string }
+				_ = ssh.Unmarshal(req.Payload, &msg)
+				signals <- msg.Signal
+				_, _ = ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{143}))
+				return
+			default:
+				if req.WantReply {
+					_ = req.Reply(false, nil)
+				}
+			}
+		}
+	})
+	client, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{User: "arc", HostKeyCallback: ssh.InsecureIgnoreHostKey()})
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = runRemoteCommand(ctx, client, "sleep 600", false, "")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed >= remoteCancelGrace {
+		t.Fatalf("command did not stop promptly: %s", elapsed)
+	}
+	select {
+	case sig := <-signals:
+		if sig != string(ssh.SIGTERM) {
+			t.Fatalf("unexpected signal: %q", sig)
+		}
+	default:
+		t.Fatalf("expected the remote session to be signalled")
+	}
+}
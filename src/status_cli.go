@@ -0,0 +1,135 @@
+package main
+
+import (
+	"arc/internal/app"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// statusCollectTimeout bounds one `arc status --json` collection; the NFS check alone may
+// wait for the automount timeout.
+const statusCollectTimeout = 30 * time.Second
+
+// statusJSON is the `arc status --json` document.
+type statusJSON struct {
+	Target      string                `json:"target,omitempty"`
+	CollectedAt time.Time             `json:"collectedAt"`
+	Healthy     bool                  `json:"healthy"`
+	Components  []statusComponentJSON `json:"components"`
+	Peers       []statusPeerJSON      `json:"wireguardPeers"`
+}
+
+type statusComponentJSON struct {
+	Name   string `json:"name"`
+	Where  string `json:"where"`
+	State  string `json:"state"`
+	Detail string `json:"detail,omitempty"`
+}
+
+type statusPeerJSON struct {
+	PublicKey       string     `json:"publicKey"`
+	Endpoint        string     `json:"endpoint,omitempty"`
+	LatestHandshake *time.Time `json:"latestHandshake,omitempty"`
+	HandshakeAgeSec *int64     `json:"handshakeAgeSec,omitempty"`
+	RxBytes         int64      `json:"rxBytes"`
+	TxBytes         int64      `json:"txBytes"`
+}
+
+func runStatusCLI(args []string, stdout, stderr io.Writer) int {
+	var asJSON bool
+	fs := flag.NewFlagSet("arc status", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.BoolVar(&asJSON, "json", false, "print one status report as JSON and exit")
+	if err := fs.Parse(args); err != nil {
+		if !errors.Is(err, flag.ErrHelp) {
+			fmt.Fprintf(stderr, "arc status: %v\n", err)
+		}
+		return 2
+	}
+	if fs.NArg() > 0 {
+		fmt.Fprintf(stderr, "arc status: unexpected arguments: %s\n", strings.Join(fs.Args(), " "))
+		return 2
+	}
+
+	svc := newRuntimeServices()
+	defer func() { _ = svc.CloseConnections() }()
+
+	if !asJSON {
+		p := tea.NewProgram(app.NewStatusModel(svc), tea.WithAltScreen())
+		if _, err := p.Run(); err != nil {
+			fmt.Fprintln(stderr, "error:", err)
+			return 1
+		}
+		return 0
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	ctx, cancel := context.WithTimeout(ctx, statusCollectTimeout)
+	defer cancel()
+
+	report, err := svc.CollectStatus(ctx)
+	if err != nil {
+		fmt.Fprintf(stderr, "arc status: %v\n", err)
+		return 1
+	}
+	doc := toStatusJSON(report)
+	enc := json.NewEncoder(stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(doc); err != nil {
+		fmt.Fprintf(stderr, "arc status: %v\n", err)
+		return 1
+	}
+	if !doc.Healthy {
+		return 1
+	}
+	return 0
+}
+
+func toStatusJSON(report app.StatusReport) statusJSON {
+	doc := statusJSON{
+		Target:      report.Target,
+		CollectedAt: report.Collected.UTC(),
+		Healthy:     true,
+		Components:  []statusComponentJSON{},
+		Peers:       []statusPeerJSON{},
+	}
+	for _, c := range report.Components {
+		if c.State != app.HealthOK {
+			doc.Healthy = false
+		}
+		doc.Components = append(doc.Components, statusComponentJSON{
+			Name:   c.Name,
+			Where:  c.Where,
+			State:  string(c.State),
+			Detail: c.Detail,
+		})
+	}
+	for _, p := range report.Peers {
+		peer := statusPeerJSON{
+			PublicKey: p.PublicKey,
+			Endpoint:  p.Endpoint,
+			RxBytes:   p.RxBytes,
+			TxBytes:   p.TxBytes,
+		}
+		if !p.LatestHandshake.IsZero() {
+			handshake := p.LatestHandshake.UTC()
+			age := int64(report.Collected.Sub(p.LatestHandshake).Seconds())
+			peer.LatestHandshake = &handshake
+			peer.HandshakeAgeSec = &age
+		}
+		doc.Peers = append(doc.Peers, peer)
+	}
+	return doc
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"arc/internal/app"
+	"testing"
+	"time"
+)
+
+func TestToStatusJSON_FlagsUnhealthyComponentsAndHandshakeAge(t *testing.T) {
+	collected := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	doc := toStatusJSON(app.StatusReport{
+		Target:    "arc@example.com",
+		Collected: collected,
+		Components: []app.ComponentStatus{
+			{Name: wgQuickUnit, Where: statusLocal, State: app.HealthOK},
+			{Name: remoteClipdUnit, Where: statusRemote, State: app.HealthDown, Detail: "failed"},
+		},
+		Peers: []app.WGPeerStatus{
+			{PublicKey: "peerA", LatestHandshake: collected.Add(-42 * time.Second)},
+			{PublicKey: "peerB"},
+		},
+	})
+	if doc.Healthy {
+		t.Fatalf("a down component must make the report unhealthy")
+	}
+	if len(doc.Components) != 2 || doc.Components[1].State != "down" {
+		t.Fatalf("unexpected components: %#v", doc.Components)
+	}
+	if doc.Peers[0].HandshakeAgeSec == nil || *doc.Peers[0].HandshakeAgeSec != 42 {
+		t.Fatalf("unexpected handshake age: %#v", doc.Peers[0])
+	}
+	if doc.Peers[1].LatestHandshake != nil {
+		t.Fatalf("a peer without handshake must omit it: %#v", doc.Peers[1])
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"arc/internal/app"
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	statusLocal  = "local"
+	statusRemote = "remote"
+
+	// wgHandshakeStale is how old the latest handshake may be before the tunnel counts as
+	// degraded. WireGuard rekeys every two minutes while traffic flows.
+	wgHandshakeStale = 3 * time.Minute
+)
+
+const (
+	// wgQuickUnit is the wg-quick unit of the default network; see wgNetwork.QuickUnit.
+	wgQuickUnit          = "wg-quick@" + wgInterface
+	homeArcAutomountUnit = "home-arc.automount"
+	waypipeUnit          = "arc-waypipe.service"
+	clipboardSyncUnit    = "arc-clipboard-sync.service"
+	remoteClipdUnit      = "arc-clipd.service"
+	publicLockdownUnit   = "arc-public-lockdown.service"
+)
+
+// collectArcStatus checks every ARC component on this machine and, over the tunnel, on the
+// server of the latest setup run. Checks never fail the report; a component that cannot be
+// inspected is reported as unknown.
+func collectArcStatus(ctx context.Context, sessions *sshSessionManager) (app.StatusReport, error) {
+	report := app.StatusReport{Collected: time.Now()}
+
+	run, ok, err := latestSetupRun("")
+	if err != nil {
+		return report, err
+	}
+	// Without a recorded run the components are looked up under the default network.
+	n := defaultWGNetwork()
+	if ok {
+		n = fromAppWG(run.WG).Net
+	}
+
+	wg, peers := localWireGuardStatus(ctx, n)
+	report.Components = append(report.Components, wg, localNFSStatus(ctx, n))
+	report.Peers = peers
+	if n.Relay != "" {
+		unit := localRelayUnit(n)
+		states := localUnitStates(ctx, false, unit)
+		report.Components = append(report.Components, unitComponent(unit, statusLocal, states[unit]))
+	}
+	if ok && endpointHostname(fromAppWG(run.WG)) != "" {
+		unit := localEndpointTimer(n)
+		states := localUnitStates(ctx, false, unit)
+		report.Components = append(report.Components, unitComponent(unit, statusLocal, states[unit]))
+	}
+	for _, unit := range []string{waypipeUnit, clipboardSyncUnit} {
+		states := localUnitStates(ctx, true, unit)
+		report.Components = append(report.Components, unitComponent(unit, statusLocal, states[unit]))
+	}
+
+	remoteUnits := []string{remoteClipdUnit, lhRedirectServiceName, publicLockdownUnit}
+	if n.Relay != "" {
+		remoteUnits = append(remoteUnits, arcRelayServerUnit)
+	}
+	if !ok {
+		report.Components = append(report.Components, unknownComponents(remoteUnits, "no setup run recorded")...)
+		return report, nil
+	}
+	report.Target = arcUser + "@" + run.Host
+	report.Components = append(report.Components, remoteUnitStatus(ctx, sessions, run.Addr, n.TunnelSSHAddr(run.Addr), remoteUnits)...)
+	return report, nil
+}
+
+func localWireGuardStatus(ctx context.Context, n wgNetwork) (app.ComponentStatus, []app.WGPeerStatus) {
+	unit := n.LocalUnit()
+	states := localUnitStates(ctx, n.Userspace(), unit)
+	comp := unitComponent(unit, statusLocal, states[unit])
+	if comp.State != app.HealthOK {
+		return comp, nil
+	}
+
+	peers, err := localWGPeers(ctx, n)
+	if err != nil {
+		comp.State = app.HealthDegraded
+		comp.Detail = fmt.Sprintf("read %s peers: %v", n.Interface, err)
+		return comp, nil
+	}
+	comp.State, comp.Detail = wgPeerHealth(peers, time.Now())
+	return comp, peers
+}
+
+// localWGPeers reads the peers of n's local tunnel: from `wg show` for a kernel interface, or
+// from the userspace tunnel's control socket.
+func localWGPeers(ctx context.Context, n wgNetwork) ([]app.WGPeerStatus, error) {
+	if n.Userspace() {
+		return userspaceWGPeers(ctx, n.Interface)
+	}
+	dump, err := execLocal(ctx, "sudo", "-n", "wg", "show", n.Interface, "dump")
+	if err != nil {
+		return nil, err
+	}
+	return parseWGDump(dump), nil
+}
+
+// wgPeerHealth is ok while the freshest peer handshake is recent.
+func wgPeerHealth(peers []app.WGPeerStatus, now time.Time) (app.HealthState, string) {
+	if len(peers) == 0 {
+		return app.HealthDegraded, "no peers configured"
+	}
+	var latest time.Time
+	for _, p := range peers {
+		if p.LatestHandshake.After(latest) {
+			latest = p.LatestHandshake
+		}
+	}
+	if latest.IsZero() {
+		return app.HealthDegraded, "no handshake yet"
+	}
+	age := now.Sub(latest).Round(time.Second)
+	if age > wgHandshakeStale {
+		return app.HealthDegraded, fmt.Sprintf("latest handshake %s ago", age)
+	}
+	return app.HealthOK, fmt.Sprintf("latest handshake %s ago", age)
+}
+
+// parseWGDump reads the peer lines of `wg show <iface> dump`. The first line describes the
+// interface itself and is skipped.
+func parseWGDump(dump string) []app.WGPeerStatus {
+	var peers []app.WGPeerStatus
+	for i, ln := range strings.Split(strings.TrimSpace(dump), "\n") {
+		fields := strings.Split(strings.TrimSpace(ln), "\t")
+		if i == 0 || len(fields) < 7 {
+			continue
+		}
+		peer := app.WGPeerStatus{PublicKey: fields[0], Endpoint: fields[2]}
+		if peer.Endpoint == "(none)" {
+			peer.Endpoint = ""
+		}
+		if ts, err := strconv.ParseInt(fields[4], 10, 64); err == nil && ts > 0 {
+			peer.LatestHandshake = time.Unix(ts, 0)
+		}
+		peer.RxBytes, _ = strconv.ParseInt(fields[5], 10, 64)
+		peer.TxBytes, _ = strconv.ParseInt(fields[6], 10, 64)
+		peers = append(peers, peer)
+	}
+	return peers
+}
+
+func localNFSStatus(ctx context.Context, n wgNetwork) app.ComponentStatus {
+	states := localUnitStates(ctx, false, homeArcAutomountUnit)
+	comp := unitComponent(homeArcAutomountUnit, statusLocal, states[homeArcAutomountUnit])
+	if comp.State != app.HealthOK {
+		return comp
+	}
+	if err := checkLocalArcNFSMount(ctx, n); err != nil {
+		comp.State = app.HealthDegraded
+		comp.Detail = err.Error()
+		return comp
+	}
+	comp.Detail = nfsServerExportSource(n) + " mounted on " + nfsMountTarget
+	return comp
+}
+
+// localUnitStates returns `systemctl is-active` for each unit. is-active exits non-zero for
+// inactive units but still prints their state, so the output is used either way.
+func localUnitStates(ctx context.Context, user bool, units ...string) map[string]string {
+	args := []string{"is-active"}
+	if user {
+		args = []string{"--user", "is-active"}
+	}
+	out, _ := execLocal(ctx, "systemctl", append(args, units...)...)
+	return zipUnitStates(units, out)
+}
+
+func zipUnitStates(units []string, out string) map[string]string {
+	states := map[string]string{}
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	for i, unit := range units {
+		if i < len(lines) {
+			states[unit] = strings.TrimSpace(lines[i])
+		}
+	}
+	return states
+}
+
+func remoteUnitStatus(ctx context.Context, sessions *sshSessionManager, addr, tunnelAddr string, units []string) []app.ComponentStatus {
+	client, err := sessions.tunnelClient(addr, tunnelAddr)
+	if err != nil {
+		return unknownComponents(units, fmt.Sprintf("cannot reach server over the tunnel: %v", err))
+	}
+	states, err := readRemoteUnitStates(ctx, client, units)
+	if err != nil {
+		return unknownComponents(units, err.Error())
+	}
+	var out []app.ComponentStatus
+	for _, unit := range units {
+		out = append(out, unitComponent(unit, statusRemote, states[unit]))
+	}
+	return out
+}
+
+// readRemoteUnitStates asks the server for arc-clipd (a user service of arc) and the system
+// units in one round trip.
+func readRemoteUnitStates(ctx context.Context, client *ssh.Client, units []string) (map[string]string, error) {
+	var script strings.Builder
+	for _, unit := range units {
+		scope := ""
+		if unit == remoteClipdUnit {
+			scope = "--user "
+		}
+		fmt.Fprintf(&script, "systemctl %sis-active %s 2>/dev/null || true\n", scope, shSingleQuote(unit))
+	}
+	out, err := runRemoteCommand(ctx, client, script.String(), false, "")
+	if err != nil {
+		return nil, fmt.Errorf("read remote unit states: %w", err)
+	}
+	return zipUnitStates(units, out), nil
+}
+
+func unitComponent(unit, where, state string) app.ComponentStatus {
+	comp := app.ComponentStatus{Name: unit, Where: where, Detail: state}
+	switch state {
+	case "active":
+		comp.State = app.HealthOK
+		comp.Detail = ""
+	case "activating", "reloading", "deactivating":
+		comp.State = app.HealthDegraded
+	case "":
+		comp.State = app.HealthUnknown
+		comp.Detail = "state unavailable"
+	default:
+		comp.State = app.HealthDown
+	}
+	return comp
+}
+
+func unknownComponents(units []string, detail string) []app.ComponentStatus {
+	out := make([]app.ComponentStatus, 0, len(units))
+	for _, unit := range units {
+		out = append(out, app.ComponentStatus{Name: unit, Where: statusRemote, State: app.HealthUnknown, Detail: detail})
+	}
+	return out
+}
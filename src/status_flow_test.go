@@ -0,0 +1,56 @@
+package main
+
+import (
+	"arc/internal/app"
+	"testing"
+	"time"
+)
+
+func TestParseWGDump_ReadsPeersAndSkipsInterfaceLine(t *testing.T) {
+	dump := "privkey\tserverpub\t51820\toff\n" +
+		"peerA\t(none)\t203.0.113.7:51820\t10.0.0.2/32\t1700000000\t1024\t2048\t25\n" +
+		"peerB\t(none)\t(none)\t10.0.0.3/32\t0\t0\t0\toff\n"
+
+	peers := parseWGDump(dump)
+	if len(peers) != 2 {
+		t.Fatalf("expected 2 peers, got %#v", peers)
+	}
+	if peers[0].PublicKey != "peerA" || peers[0].Endpoint != "203.0.113.7:51820" || peers[0].RxBytes != 1024 || peers[0].TxBytes != 2048 {
+		t.Fatalf("unexpected first peer: %#v", peers[0])
+	}
+	if !peers[0].LatestHandshake.Equal(time.Unix(1700000000, 0)) {
+		t.Fatalf("unexpected handshake: %v", peers[0].LatestHandshake)
+	}
+	if peers[1].Endpoint != "" || !peers[1].LatestHandshake.IsZero() {
+		t.Fatalf("peer without endpoint or handshake must stay empty: %#v", peers[1])
+	}
+}
+
+func TestWGPeerHealth_StaleHandshakeIsDegraded(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	fresh := []app.WGPeerStatus{{PublicKey: "a", LatestHandshake: now.Add(-30 * time.Second)}}
+	if state, _ := wgPeerHealth(fresh, now); state != app.HealthOK {
+		t.Fatalf("fresh handshake: got %s", state)
+	}
+	stale := []app.WGPeerStatus{{PublicKey: "a", LatestHandshake: now.Add(-10 * time.Minute)}}
+	if state, detail := wgPeerHealth(stale, now); state != app.HealthDegraded || detail != "latest handshake 10m0s ago" {
+		t.Fatalf("stale handshake: got %s %q", state, detail)
+	}
+	if state, _ := wgPeerHealth([]app.WGPeerStatus{{PublicKey: "a"}}, now); state != app.HealthDegraded {
+		t.Fatalf("missing handshake: got %s", state)
+	}
+}
+
+func TestUnitComponent_MapsSystemdStates(t *testing.T) {
+	states := zipUnitStates([]string{"a.service", "b.service", "c.service"}, "active\nfailed\n")
+	cases := map[string]app.HealthState{
+		"a.service": app.HealthOK,
+		"b.service": app.HealthDown,
+		"c.service": app.HealthUnknown,
+	}
+	for unit, want := range cases {
+		if got := unitComponent(unit, statusLocal, states[unit]).State; got != want {
+			t.Fatalf("%s: got %s want %s", unit, got, want)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+type stepOutputKey struct{}
+
+// withStepOutput attaches a per-step output sink to ctx. Local and remote commands run under
+// ctx copy their stdout/stderr to it line by line while they run.
+func withStepOutput(ctx context.Context, sink func(line string)) context.Context {
+	if sink == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, stepOutputKey{}, sink)
+}
+
+// withoutStepOutput keeps commands run under the returned context out of the step's sink, for
+// reads of key material such as WireGuard configs and file snapshots.
+func withoutStepOutput(ctx context.Context) context.Context {
+	return context.WithValue(ctx, stepOutputKey{}, (func(string))(nil))
+}
+
+// stepOutputWriter returns a writer feeding the step's sink, or nil when ctx has none.
+// Callers flush it once the command exits so a trailing partial line is not lost.
+func stepOutputWriter(ctx context.Context) *lineWriter {
+	sink, ok := ctx.Value(stepOutputKey{}).(func(string))
+	if !ok || sink == nil {
+		return nil
+	}
+	return &lineWriter{sink: sink}
+}
+
+// teeStepOutput returns w, also copying into the step's output sink when ctx has one. The
+// returned flush must be called after the command exits.
+func teeStepOutput(ctx context.Context, w io.Writer) (io.Writer, func()) {
+	lw := stepOutputWriter(ctx)
+	if lw == nil {
+		return w, func() {}
+	}
+	return io.MultiWriter(w, lw), lw.Flush
+}
+
+// lineWriter splits a byte stream into lines. Carriage returns end a line too, so progress
+// bars from apt or dkms show up as they redraw. WireGuard keys are redacted from every line.
+type lineWriter struct {
+	mu   sync.Mutex
+	sink func(string)
+	buf  []byte
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, c := range p {
+		if c == '\n' || c == '\r' {
+			w.emit()
+			continue
+		}
+		w.buf = append(w.buf, c)
+	}
+	return len(p), nil
+}
+
+func (w *lineWriter) Flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.emit()
+}
+
+var wgSecretLine = regexp.MustCompile(`(?m)^(\s*(?:PrivateKey|PresharedKey)\s*=\s*).*$`)
+
+// redactWGSecrets hides private and preshared keys, so output that shows a config can be
+// shared.
+func redactWGSecrets(conf string) string {
+	return wgSecretLine.ReplaceAllString(conf, "${1}<redacted>")
+}
+
+func (w *lineWriter) emit() {
+	line := strings.TrimSpace(string(w.buf))
+	w.buf = w.buf[:0]
+	if line != "" {
+		w.sink(redactWGSecrets(line))
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestLineWriter_SplitsLinesAndFlushesPartialLine(t *testing.T) {
+	var got []string
+	w := &lineWriter{sink: func(line string) { got = append(got, line) }}
+
+	_, _ = w.Write([]byte("Reading package lists...\nProgress: 10%\rProgress: 50%\r"))
+	_, _ = w.Write([]byte("\n\nBuilding module"))
+	if want := []string{"Reading package lists...", "Progress: 10%", "Progress: 50%"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected lines before flush: %#v", got)
+	}
+	w.Flush()
+	if got[len(got)-1] != "Building module" {
+		t.Fatalf("flush must emit the trailing partial line: %#v", got)
+	}
+}
+
+func TestExecLocal_StreamsOutputToStepSink(t *testing.T) {
+	var got []string
+	ctx := withStepOutput(context.Background(), func(line string) { got = append(got, line) })
+
+	out, err := execLocal(ctx, "sh", "-c", "echo one; echo two >&2; printf three")
+	if err != nil {
+		t.Fatalf("execLocal: %v", err)
+	}
+	if out != "one\ntwo\nthree" {
+		t.Fatalf("unexpected combined output: %q", out)
+	}
+	if want := []string{"one", "two", "three"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected streamed lines: %#v", got)
+	}
+}
+
+func TestStepOutput_KeepsWireGuardKeysOutOfSink(t *testing.T) {
+	const conf = "[Interface]\nPrivateKey = cHJpdmF0ZS1rZXk=\n[Peer]\nPublicKey = cHVibGljLWtleQ==\nPresharedKey = cHJlc2hhcmVk\n"
+	path := filepath.Join(t.TempDir(), "wg0.conf")
+	if err := os.WriteFile(path, []byte(conf), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	ctx := withStepOutput(context.Background(), func(line string) { got = append(got, line) })
+
+	out, err := execLocal(withoutStepOutput(ctx), "cat", path)
+	if err != nil {
+		t.Fatalf("execLocal: %v", err)
+	}
+	if out != strings.TrimSpace(conf) || len(got) != 0 {
+		t.Fatalf("a conf read must return the keys but stream nothing: %q, streamed %#v", out, got)
+	}
+
+	// Anything else that prints a key is redacted on its way to the sink.
+	if _, err := execLocal(ctx, "cat", path); err != nil {
+		t.Fatalf("execLocal: %v", err)
+	}
+	for _, line := range got {
+		if strings.Contains(line, "cHJpdmF0ZS1rZXk=") || strings.Contains(line, "cHJlc2hhcmVk") {
+			t.Fatalf("key material reached the sink: %#v", got)
+		}
+	}
+	if !slices.Contains(got, "PrivateKey = <redacted>") || !slices.Contains(got, "PublicKey = cHVibGljLWtleQ==") {
+		t.Fatalf("unexpected streamed lines: %#v", got)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"arc/internal/wgconf"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+)
+
+// runTunnelCLI runs `arc tunnel IFACE`: the userspace end of the tunnel, from the config of
+// IFACE in ~/.arc/wireguard, in the foreground and without root. The arc-wg-userspace user
+// unit runs it after a setup with --wg-mode userspace; it can also be started by hand where
+// there is no systemd.
+func runTunnelCLI(args []string, stdout, stderr io.Writer) int {
+	var serverIP, confPath string
+	var sshPort int
+	fs := flag.NewFlagSet("arc tunnel", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.StringVar(&serverIP, "server-ip", wgServerIP, "the server's tunnel address")
+	fs.IntVar(&sshPort, "ssh-port", 22, fmt.Sprintf("the server's SSH port, published on %s:%d", userspaceWGForwardIP, userspaceWGSSHPort))
+	fs.StringVar(&confPath, "conf", "", "the wg-quick style config to run (default ~/.arc/wireguard/IFACE.conf)")
+	if err := fs.Parse(args); err != nil {
+		if !errors.Is(err, flag.ErrHelp) {
+			fmt.Fprintf(stderr, "arc tunnel: %v\n", err)
+		}
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fmt.Fprintln(stderr, "arc tunnel: usage: arc tunnel [--server-ip IP] [--ssh-port PORT] [--conf PATH] IFACE")
+		return 2
+	}
+	iface := fs.Arg(0)
+	if !wgInterfacePattern.MatchString(iface) {
+		fmt.Fprintf(stderr, "arc tunnel: invalid interface name %q\n", iface)
+		return 2
+	}
+	if _, err := netip.ParseAddr(serverIP); err != nil {
+		fmt.Fprintf(stderr, "arc tunnel: invalid --server-ip %q\n", serverIP)
+		return 2
+	}
+
+	if confPath == "" {
+		path, err := userspaceWGConfPath(iface)
+		if err != nil {
+			fmt.Fprintf(stderr, "arc tunnel: %v\n", err)
+			return 1
+		}
+		confPath = path
+	}
+	conf, err := loadWGConf(confPath)
+	if err != nil {
+		fmt.Fprintf(stderr, "arc tunnel: %v\n", err)
+		return 1
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	logf := func(format string, a ...any) { fmt.Fprintf(stderr, "arc tunnel: "+format+"\n", a...) }
+	fmt.Fprintf(stdout, "arc tunnel: %s is up; %s is published on %s\n", iface, serverIP, userspaceWGForwardIP)
+	if err := runUserspaceTunnel(ctx, iface, conf, serverIP, sshPort, logf); err != nil {
+		logf("%v", err)
+		return 1
+	}
+	return 0
+}
+
+// loadWGQuickConf reads and validates the wg-quick config of iface.
+func loadWGQuickConf(iface string) (*wgconf.Config, error) {
+	return loadWGConf(filepath.Join("/etc/wireguard", iface+".conf"))
+}
+
+// loadWGConf reads and validates the wg-quick style config at path.
+func loadWGConf(path string) (*wgconf.Config, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	conf, err := wgconf.Parse(string(raw))
+	if err == nil {
+		err = conf.Validate()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return conf, nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// uninstallTimeout bounds a whole `arc uninstall` run.
+const uninstallTimeout = 10 * time.Minute
+
+func parseUninstallOptions(args []string, stderr io.Writer) (uninstallOptions, bool, error) {
+	var opts uninstallOptions
+	var yes bool
+	fs := flag.NewFlagSet("arc uninstall", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.BoolVar(&opts.Local, "local", false, "only undo changes on this machine")
+	fs.BoolVar(&opts.Remote, "remote", false, "only undo changes on the server")
+	fs.BoolVar(&opts.KeepUser, "keep-user", false, "keep the arc user, its sudoers entry and SSH keys on the server")
+	fs.BoolVar(&yes, "yes", false, "do not ask for confirmation")
+	if err := fs.Parse(args); err != nil {
+		return opts, false, err
+	}
+	if fs.NArg() > 0 {
+		return opts, false, fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+	if !opts.Local && !opts.Remote {
+		opts.Local, opts.Remote = true, true
+	}
+	return opts, yes, nil
+}
+
+func runUninstallCLI(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	opts, yes, err := parseUninstallOptions(args, stderr)
+	if err != nil {
+		if !errors.Is(err, flag.ErrHelp) {
+			fmt.Fprintf(stderr, "arc uninstall: %v\n", err)
+		}
+		return 2
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	ctx, cancel := context.WithTimeout(ctx, uninstallTimeout)
+	defer cancel()
+
+	sessions := newSSHSessionManager()
+	defer func() { _ = sessions.Close() }()
+
+	runCtx, err := latestRunContext(ctx, sessions)
+	if err != nil {
+		fmt.Fprintf(stderr, "arc uninstall: %v\n", err)
+		return 1
+	}
+	if opts, err = joinedUninstallOptions(opts, runCtx.Device); err != nil {
+		fmt.Fprintf(stderr, "arc uninstall: %v\n", err)
+		return 1
+	}
+	actions, err := planUninstall(opts)
+	if err != nil {
+		fmt.Fprintf(stderr, "arc uninstall: %v\n", err)
+		return 1
+	}
+
+	target := arcUser + "@" + runCtx.Host
+	if !yes && !promptConfirmation(stdin, stderr, "Remove ARC from "+uninstallSummary(opts, target)+"?") {
+		fmt.Fprintln(stderr, "arc uninstall: aborted")
+		return 1
+	}
+
+	var remoteErr error
+	if opts.Remote {
+		remoteErr = pickServerRoute(&runCtx)
+	}
+	results := runUninstall(runCtx, actions, remoteErr, newUninstallPrinter(stdout))
+
+	failed := 0
+	for _, res := range results {
+		if res.Err != nil {
+			failed++
+		}
+	}
+	if ctx.Err() != nil {
+		fmt.Fprintf(stderr, "arc uninstall: stopped: %v\n", ctx.Err())
+		return 1
+	}
+	if failed > 0 {
+		fmt.Fprintf(stderr, "arc uninstall: %d step(s) failed; fix the cause and run it again\n", failed)
+		return 1
+	}
+	// Recorded runs are kept after a partial uninstall so the other side can still be found.
+	if opts.Local && opts.Remote {
+		if err := forgetSetupRuns(runCtx.Addr); err != nil {
+			fmt.Fprintf(stderr, "arc uninstall: %v\n", err)
+			return 1
+		}
+	}
+	fmt.Fprintf(stdout, "ARC removed from %s\n", uninstallSummary(opts, target))
+	return 0
+}
+
+func uninstallSummary(opts uninstallOptions, target string) string {
+	switch {
+	case opts.Local && opts.Remote:
+		return "this machine and " + target
+	case opts.Remote:
+		return target
+	default:
+		return "this machine"
+	}
+}
+
+// promptConfirmation asks a yes/no question that defaults to no.
+func promptConfirmation(stdin io.Reader, w io.Writer, question string) bool {
+	fmt.Fprintf(w, "%s [y/N] ", question)
+	answer, _ := bufio.NewReader(stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+func newUninstallPrinter(w io.Writer) func(uninstallEvent) {
+	return func(ev uninstallEvent) {
+		switch {
+		case !ev.Done:
+			fmt.Fprintf(w, "[%d/%d] undo %s\n", ev.Index, ev.Total, ev.Label)
+		case ev.Err != nil:
+			fmt.Fprintf(w, "[%d/%d] FAILED: %v\n", ev.Index, ev.Total, ev.Err)
+		default:
+			fmt.Fprintf(w, "[%d/%d] done\n", ev.Index, ev.Total)
+		}
+	}
+}
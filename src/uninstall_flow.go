@@ -0,0 +1,156 @@
+package main
+
+import (
+	"arc/internal/workflow"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+)
+
+type uninstallOptions struct {
+	Local    bool
+	Remote   bool
+	KeepUser bool
+}
+
+// uninstallAction is one side of one step's undo handler.
+type uninstallAction struct {
+	Step  workflow.StepID
+	Label string
+	Scope workflow.StepScope // ScopeLocal or ScopeRemote
+	Run   infraStepFunc
+}
+
+// planUninstall lists the undo actions for opts in reverse dependency order, so a step is
+// undone only after everything that was built on top of it. Within a step the server side
+// goes first, while the tunnel it may need is still up.
+func planUninstall(opts uninstallOptions) ([]uninstallAction, error) {
+	defs, err := workflow.OrderStepDefinitions(workflow.SetupStepDefinitions())
+	if err != nil {
+		return nil, err
+	}
+	var actions []uninstallAction
+	for i := len(defs) - 1; i >= 0; i-- {
+		def := defs[i]
+		undo, ok := infraUndoHandlers[def.ID]
+		if !ok {
+			continue
+		}
+		if opts.KeepUser && arcUserSteps[def.ID] {
+			continue
+		}
+		if opts.Remote && undo.Remote != nil {
+			actions = append(actions, uninstallAction{Step: def.ID, Label: undoLabel(def, statusRemote), Scope: workflow.ScopeRemote, Run: undo.Remote})
+		}
+		if opts.Local && undo.Local != nil {
+			actions = append(actions, uninstallAction{Step: def.ID, Label: undoLabel(def, statusLocal), Scope: workflow.ScopeLocal, Run: undo.Local})
+		}
+	}
+	return actions, nil
+}
+
+// joinedUninstallOptions keeps the uninstall of a joined device to this machine: the server
+// was set up by another device and stays in use by it.
+func joinedUninstallOptions(opts uninstallOptions, device string) (uninstallOptions, error) {
+	if device == "" {
+		return opts, nil
+	}
+	if !opts.Local {
+		return opts, fmt.Errorf("this machine joined the server as device %q and cannot undo the server setup; run `arc uninstall --remote` on the machine that ran `arc setup`", device)
+	}
+	opts.Remote = false
+	return opts, nil
+}
+
+// undoLabel names the machine for verify steps, whose undo may touch either side.
+func undoLabel(def workflow.StepDef, where string) string {
+	if def.Scope == workflow.ScopeVerify {
+		return def.Label + " (" + where + ")"
+	}
+	return def.Label
+}
+
+// uninstallEvent reports an action starting, or finishing when Done is set.
+type uninstallEvent struct {
+	Index int
+	Total int
+	Label string
+	Done  bool
+	Err   error
+}
+
+type uninstallResult struct {
+	Action uninstallAction
+	Err    error
+}
+
+// runUninstall runs every action, continuing past failures so as much as possible is removed.
+// Remote actions fail up front when remoteErr is set. Until SSH hardening is undone the server
+// is only reachable over the tunnel; afterwards the public address is used, since later steps
+// take the tunnel down.
+func runUninstall(ctx infraRunContext, actions []uninstallAction, remoteErr error, emit func(uninstallEvent)) []uninstallResult {
+	results := make([]uninstallResult, 0, len(actions))
+	for i, action := range actions {
+		if ctx.Err() != nil {
+			break
+		}
+		emit(uninstallEvent{Index: i + 1, Total: len(actions), Label: action.Label})
+		res := uninstallResult{Action: action}
+		if action.Scope == workflow.ScopeRemote && remoteErr != nil {
+			res.Err = remoteErr
+		} else {
+			res.Err = action.Run(ctx)
+		}
+		if res.Err == nil && action.Step == workflow.StepHardenServerSSH && action.Scope == workflow.ScopeRemote {
+			ctx.Tunnel = false
+		}
+		emit(uninstallEvent{Index: i + 1, Total: len(actions), Label: action.Label, Done: true, Err: res.Err})
+		results = append(results, res)
+	}
+	return results
+}
+
+// disableUnitScript stops and disables unit when it is installed. A unit that does not exist
+// is not an error, so undo handlers can run more than once.
+func disableUnitScript(systemctl, unit string) string {
+	q := shSingleQuote(unit)
+	return fmt.Sprintf("if %s cat %s >/dev/null 2>&1; then %s disable --now %s; fi\n", systemctl, q, systemctl, q)
+}
+
+func runRemoteUndoScript(ctx infraRunContext, script string) error {
+	client, release, err := arcClientFor(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	_, err = runRemoteCommand(ctx, client, script, false, "")
+	return err
+}
+
+// removeLocalUserService disables a local user unit and removes its unit file and helpers.
+func removeLocalUserService(ctx context.Context, unit string, paths ...string) error {
+	if _, err := execLocal(ctx, "sh", "-c", disableUnitScript("systemctl --user", unit)); err != nil {
+		return fmt.Errorf("disable %s: %w", unit, err)
+	}
+	if err := removeLocalFiles(paths...); err != nil {
+		return err
+	}
+	if _, err := execLocal(ctx, "systemctl", "--user", "daemon-reload"); err != nil {
+		return err
+	}
+	return nil
+}
+
+func removeLocalFiles(paths ...string) error {
+	var failed []string
+	for _, path := range paths {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			failed = append(failed, err.Error())
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("remove files: %s", strings.Join(failed, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"arc/internal/workflow"
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestPlanUninstall_UndoesDependentsFirst(t *testing.T) {
+	actions, err := planUninstall(uninstallOptions{Local: true, Remote: true})
+	if err != nil {
+		t.Fatalf("planUninstall: %v", err)
+	}
+	pos := map[workflow.StepID]int{}
+	for i, a := range actions {
+		if _, ok := pos[a.Step]; !ok {
+			pos[a.Step] = i
+		}
+	}
+	for _, def := range workflow.SetupStepDefinitions() {
+		at, ok := pos[def.ID]
+		if !ok {
+			continue
+		}
+		for _, req := range def.Requires {
+			if reqAt, ok := pos[req]; ok && reqAt < at {
+				t.Fatalf("%q is undone before %q, which depends on it", req, def.ID)
+			}
+		}
+	}
+	if pos[workflow.StepHardenServerSSH] > pos[workflow.StepEnableServerWG] {
+		t.Fatalf("SSH hardening must be undone before the server tunnel goes down")
+	}
+}
+
+func TestPlanUninstall_FiltersByScopeAndKeepUser(t *testing.T) {
+	local, err := planUninstall(uninstallOptions{Local: true})
+	if err != nil {
+		t.Fatalf("planUninstall: %v", err)
+	}
+	for _, a := range local {
+		if a.Scope != workflow.ScopeLocal {
+			t.Fatalf("--local planned a %s action: %s", a.Scope, a.Label)
+		}
+	}
+
+	kept, err := planUninstall(uninstallOptions{Remote: true, KeepUser: true})
+	if err != nil {
+		t.Fatalf("planUninstall: %v", err)
+	}
+	for _, a := range kept {
+		if a.Scope != workflow.ScopeRemote {
+			t.Fatalf("--remote planned a %s action: %s", a.Scope, a.Label)
+		}
+		if arcUserSteps[a.Step] {
+			t.Fatalf("--keep-user planned %s", a.Step)
+		}
+	}
+}
+
+func TestRunUninstall_ContinuesPastFailuresAndLeavesTunnelAfterUnhardening(t *testing.T) {
+	var routes []bool
+	record := func(ctx infraRunContext) error {
+		routes = append(routes, ctx.Tunnel)
+		return nil
+	}
+	actions := []uninstallAction{
+		{Step: workflow.StepConfigureImageClipboard, Label: "clipboard", Scope: workflow.ScopeLocal, Run: func(infraRunContext) error {
+			return errors.New("boom")
+		}},
+		{Step: workflow.StepHardenServerSSH, Label: "harden", Scope: workflow.ScopeRemote, Run: record},
+		{Step: workflow.StepEnableServerWG, Label: "wg", Scope: workflow.ScopeRemote, Run: record},
+	}
+	var events []uninstallEvent
+	ctx := infraRunContext{Context: context.Background(), Tunnel: true}
+
+	results := runUninstall(ctx, actions, nil, func(ev uninstallEvent) { events = append(events, ev) })
+	if len(results) != 3 || results[0].Err == nil || results[1].Err != nil || results[2].Err != nil {
+		t.Fatalf("unexpected results: %#v", results)
+	}
+	if len(routes) != 2 || !routes[0] || routes[1] {
+		t.Fatalf("expected tunnel for unhardening then public address, got %v", routes)
+	}
+	if len(events) != 6 || events[1].Err == nil || !events[1].Done {
+		t.Fatalf("unexpected events: %#v", events)
+	}
+}
+
+func TestRunUninstall_FailsRemoteActionsWhenServerUnreachable(t *testing.T) {
+	called := false
+	actions := []uninstallAction{
+		{Step: workflow.StepEnableServerWG, Label: "wg", Scope: workflow.ScopeRemote, Run: func(infraRunContext) error {
+			called = true
+			return nil
+		}},
+	}
+	unreachable := errors.New("server unreachable")
+	results := runUninstall(infraRunContext{Context: context.Background()}, actions, unreachable, func(uninstallEvent) {})
+	if called || len(results) != 1 || !errors.Is(results[0].Err, unreachable) {
+		t.Fatalf("remote action should fail without running: called=%v results=%#v", called, results)
+	}
+}
@@ -1,27 +1,364 @@
 package main
 
 import (
+	"arc/internal/wgconf"
 	"crypto/rand"
 	"encoding/base64"
+	"encoding/binary"
 	"fmt"
 	"io"
+	"net"
+	"net/netip"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
 
 	"golang.org/x/crypto/curve25519"
 )
 
+// Default tunnel addressing, used for settings left empty and for runs recorded before the
+// network was configurable.
 const (
 	wgInterface = "wg0"
 	wgPort      = 51820
+	wgSubnet    = "10.0.0.0/24"
 
-	wgServerCIDR  = "10.0.0.1/32"
-	wgDesktopCIDR = "10.0.0.2/32"
-	wgMobileCIDR  = "10.0.0.3/32"
-	wgServerIP    = "10.0.0.1"
-	wgDesktopIP   = "10.0.0.2"
-	wgMobileIP    = "10.0.0.3"
+	wgServerIP  = "10.0.0.1"
+	wgDesktopIP = "10.0.0.2"
+	wgMobileIP  = "10.0.0.3"
+
+	// wgKeepalive keeps the NAT mapping of a client peer open, in seconds.
+	wgKeepalive = 25
+
+	// wgSubnet6Auto asks for a random IPv6 ULA /64 next to the IPv4 subnet.
+	wgSubnet6Auto = "auto"
+
+	// Local WireGuard transports: wg-quick on the kernel module (the default, also recorded
+	// as ""), or arc's embedded wireguard-go on a userspace network stack.
+	wgModeKernel    = "kernel"
+	wgModeUserspace = "userspace"
+
+	// Relay transports that carry WireGuard over TCP where UDP is blocked: length-prefixed
+	// datagrams, or WebSocket messages for proxies that only pass HTTP.
+	wgRelayTCP       = "tcp"
+	wgRelayWebSocket = "ws"
+	wgRelayPort      = 443
 )
 
+// wgNetwork is the tunnel addressing of a setup run. Every handler and template takes the
+// interface, port and peer addresses from it.
+type wgNetwork struct {
+	Interface string
+	Port      int
+	Subnet    string
+	ServerIP  string
+	DesktopIP string
+	MobileIP  string
+	// Subnet6 makes the tunnel dual-stack: each peer also gets the address at its IPv4 host
+	// offset in this IPv6 ULA prefix. Empty keeps the tunnel IPv4-only.
+	Subnet6 string
+	// Mode is how this machine runs its end of the tunnel: "" for the kernel module, or
+	// wgModeUserspace. The server always uses the kernel module.
+	Mode string
+	// Relay is the UDP-over-TCP fallback, "tcp:PORT" or "ws:PORT", or empty for none.
+	Relay string
+	// Rendezvous reverses the tunnel for a server behind NAT: the server dials this
+	// HOST:PORT, which reaches the desktop listening on Port, and opens no port of its own.
+	// Empty keeps the desktop dialing the server.
+	Rendezvous string
+}
+
+func defaultWGNetwork() wgNetwork {
+	return wgNetwork{
+		Interface: wgInterface,
+		Port:      wgPort,
+		Subnet:    wgSubnet,
+		ServerIP:  wgServerIP,
+		DesktopIP: wgDesktopIP,
+		MobileIP:  wgMobileIP,
+	}
+}
+
+// wgInterfacePattern matches names wg-quick accepts for an interface (at most 15 bytes).
+var wgInterfacePattern = regexp.MustCompile(`^[a-zA-Z0-9_=+.-]{1,15}$`)
+
+// resolveWGNetwork fills empty fields of n: the defaults, and peer addresses .1, .2 and .3
+// of a custom subnet. It rejects names and addresses the tunnel cannot use.
+func resolveWGNetwork(n wgNetwork) (wgNetwork, error) {
+	n.Interface = strings.TrimSpace(n.Interface)
+	if n.Interface == "" {
+		n.Interface = wgInterface
+	}
+	if !wgInterfacePattern.MatchString(n.Interface) {
+		return n, fmt.Errorf("invalid WireGuard interface name %q (1-15 of a-z, 0-9, _=+.-)", n.Interface)
+	}
+	if n.Port == 0 {
+		n.Port = wgPort
+	}
+	if n.Port < 1 || n.Port > 65535 {
+		return n, fmt.Errorf("invalid WireGuard port %d", n.Port)
+	}
+	switch n.Mode = strings.TrimSpace(n.Mode); n.Mode {
+	case "", wgModeKernel:
+		n.Mode = ""
+	case wgModeUserspace:
+	default:
+		return n, fmt.Errorf("invalid WireGuard mode %q (%s or %s)", n.Mode, wgModeKernel, wgModeUserspace)
+	}
+
+	relay, err := resolveWGRelay(strings.TrimSpace(n.Relay))
+	if err != nil {
+		return n, err
+	}
+	n.Relay = relay
+	if n.Rendezvous, err = resolveWGRendezvous(strings.TrimSpace(n.Rendezvous), n.Port); err != nil {
+		return n, err
+	}
+	if n.Rendezvous != "" && n.Relay != "" {
+		return n, fmt.Errorf("a WireGuard relay needs the server to listen; it cannot be combined with a rendezvous")
+	}
+	// The relay client steers the tunnel with `wg` as root; the userspace tunnel has neither.
+	if n.Userspace() && n.Relay != "" {
+		return n, fmt.Errorf("a WireGuard relay cannot be combined with --wg-mode %s", wgModeUserspace)
+	}
+
+	n.Subnet = strings.TrimSpace(n.Subnet)
+	if n.Subnet == "" {
+		n.Subnet = wgSubnet
+	}
+	prefix, err := netip.ParsePrefix(n.Subnet)
+	if err != nil || !prefix.Addr().Is4() {
+		return n, fmt.Errorf("invalid WireGuard subnet %q (want an IPv4 CIDR such as %s)", n.Subnet, wgSubnet)
+	}
+	prefix = prefix.Masked()
+	if prefix.Bits() > 29 {
+		return n, fmt.Errorf("WireGuard subnet %s is too small for the server and two peers", prefix)
+	}
+	n.Subnet = prefix.String()
+
+	seen := map[string]string{}
+	host := prefix.Addr()
+	for _, peer := range []struct {
+		name string
+		ip   *string
+	}{
+		{"server", &n.ServerIP},
+		{"desktop", &n.DesktopIP},
+		{"mobile", &n.MobileIP},
+	} {
+		host = host.Next()
+		raw := strings.TrimSpace(*peer.ip)
+		if raw == "" {
+			raw = host.String()
+		}
+		addr, err := netip.ParseAddr(raw)
+		if err != nil || !addr.Is4() {
+			return n, fmt.Errorf("invalid WireGuard %s address %q", peer.name, raw)
+		}
+		if !prefix.Contains(addr) || addr == prefix.Addr() || addr == lastAddr(prefix) {
+			return n, fmt.Errorf("WireGuard %s address %s is not a host address in %s", peer.name, addr, prefix)
+		}
+		if other, ok := seen[addr.String()]; ok {
+			return n, fmt.Errorf("WireGuard %s and %s addresses are both %s", other, peer.name, addr)
+		}
+		seen[addr.String()] = peer.name
+		*peer.ip = addr.String()
+	}
+
+	n.Subnet6, err = resolveWGSubnet6(strings.TrimSpace(n.Subnet6), prefix)
+	if err != nil {
+		return n, err
+	}
+	return n, nil
+}
+
+// resolveWGRelay normalizes a relay setting to PROTO:PORT; the port defaults to 443.
+func resolveWGRelay(raw string) (string, error) {
+	if raw == "" {
+		return "", nil
+	}
+	proto, portStr, hasPort := strings.Cut(raw, ":")
+	port := wgRelayPort
+	if hasPort {
+		var err error
+		if port, err = strconv.Atoi(portStr); err != nil || port < 1 || port > 65535 {
+			return "", fmt.Errorf("invalid WireGuard relay port %q", portStr)
+		}
+	}
+	if proto != wgRelayTCP && proto != wgRelayWebSocket {
+		return "", fmt.Errorf("invalid WireGuard relay %q (want %s[:PORT] or %s[:PORT])", raw, wgRelayTCP, wgRelayWebSocket)
+	}
+	return fmt.Sprintf("%s:%d", proto, port), nil
+}
+
+// resolveWGRendezvous normalizes a rendezvous to HOST:PORT, with the tunnel's port by default.
+func resolveWGRendezvous(raw string, port int) (string, error) {
+	if raw == "" {
+		return "", nil
+	}
+	host, portStr, err := net.SplitHostPort(raw)
+	if err != nil {
+		host, portStr = raw, strconv.Itoa(port)
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	p, err := strconv.Atoi(portStr)
+	if err != nil || p < 1 || p > 65535 {
+		return "", fmt.Errorf("invalid WireGuard rendezvous port %q", portStr)
+	}
+	if host == "" || strings.ContainsAny(host, " \t/[]") {
+		return "", fmt.Errorf("invalid WireGuard rendezvous %q (want HOST[:PORT])", raw)
+	}
+	return wgEndpoint(host, p), nil
+}
+
+// ulaPrefix holds the IPv6 unique local addresses (RFC 4193).
+var ulaPrefix = netip.MustParsePrefix("fc00::/7")
+
+// resolveWGSubnet6 checks the IPv6 tunnel prefix against the IPv4 subnet whose host offsets
+// it has to hold; "auto" picks a random fd00::/8 /64.
+func resolveWGSubnet6(raw string, subnet netip.Prefix) (string, error) {
+	switch raw {
+	case "":
+		return "", nil
+	case wgSubnet6Auto:
+		var b [16]byte
+		b[0] = 0xfd
+		if _, err := io.ReadFull(rand.Reader, b[1:8]); err != nil {
+			return "", err
+		}
+		return netip.PrefixFrom(netip.AddrFrom16(b), 64).String(), nil
+	}
+	prefix, err := netip.ParsePrefix(raw)
+	if err != nil || !prefix.Addr().Is6() || prefix.Addr().Is4In6() || !ulaPrefix.Contains(prefix.Addr()) {
+		return "", fmt.Errorf("invalid WireGuard IPv6 subnet %q (want a ULA prefix such as fd12:3456:789a::/64, or %s)", raw, wgSubnet6Auto)
+	}
+	if hostBits := 32 - subnet.Bits(); 128-prefix.Bits() < hostBits {
+		return "", fmt.Errorf("WireGuard IPv6 subnet %s is too small for the hosts of %s", prefix, subnet)
+	}
+	return prefix.Masked().String(), nil
+}
+
+// withDefaults resolves n, falling back to the defaults when it is invalid. Settings are
+// validated when a run begins, so this only matters for hand-edited run state.
+func (n wgNetwork) withDefaults() wgNetwork {
+	resolved, err := resolveWGNetwork(n)
+	if err != nil {
+		return defaultWGNetwork()
+	}
+	return resolved
+}
+
+func lastAddr(p netip.Prefix) netip.Addr {
+	a := p.Addr().As4()
+	hostBits := 32 - p.Bits()
+	for i := 3; i >= 0 && hostBits > 0; i-- {
+		n := min(hostBits, 8)
+		a[i] |= byte(1<<n - 1)
+		hostBits -= n
+	}
+	return netip.AddrFrom4(a)
+}
+
+// ConfPath is the wg-quick config on both machines.
+func (n wgNetwork) ConfPath() string {
+	return "/etc/wireguard/" + n.Interface + ".conf"
+}
+
+// QuickUnit is the wg-quick systemd unit of the interface.
+func (n wgNetwork) QuickUnit() string {
+	return "wg-quick@" + n.Interface
+}
+
+func (n wgNetwork) ServerCIDR() string  { return n.ServerIP + "/32" }
+func (n wgNetwork) DesktopCIDR() string { return n.DesktopIP + "/32" }
+func (n wgNetwork) MobileCIDR() string  { return n.MobileIP + "/32" }
+
+// IP6 is the IPv6 tunnel address of the peer at IPv4 tunnel address ip: its host offset in
+// Subnet but in Subnet6. It is empty when the tunnel is IPv4-only.
+func (n wgNetwork) IP6(ip string) string {
+	if n.Subnet6 == "" {
+		return ""
+	}
+	subnet, err4 := netip.ParsePrefix(n.Subnet)
+	subnet6, err6 := netip.ParsePrefix(n.Subnet6)
+	addr, errIP := netip.ParseAddr(ip)
+	if err4 != nil || err6 != nil || errIP != nil || !subnet.Contains(addr) {
+		return ""
+	}
+	a, base := addr.As4(), subnet.Masked().Addr().As4()
+	offset := binary.BigEndian.Uint32(a[:]) - binary.BigEndian.Uint32(base[:])
+	b := subnet6.Masked().Addr().As16()
+	binary.BigEndian.PutUint32(b[12:], binary.BigEndian.Uint32(b[12:])+offset)
+	return netip.AddrFrom16(b).String()
+}
+
+// Userspace reports whether this machine runs the tunnel in arc's embedded wireguard-go
+// instead of the kernel module.
+func (n wgNetwork) Userspace() bool { return n.Mode == wgModeUserspace }
+
+// Reverse reports whether the server dials the desktop through Rendezvous.
+func (n wgNetwork) Reverse() bool { return n.Rendezvous != "" }
+
+// RelayPort is the server's TCP port of the relay, 0 without one.
+func (n wgNetwork) RelayPort() int {
+	_, port, ok := strings.Cut(n.Relay, ":")
+	if !ok {
+		return 0
+	}
+	p, _ := strconv.Atoi(port)
+	return p
+}
+
+// RelayWebSocket reports whether the relay carries datagrams as WebSocket messages.
+func (n wgNetwork) RelayWebSocket() bool {
+	return strings.HasPrefix(n.Relay, wgRelayWebSocket+":")
+}
+
+// LocalUnit is the service that brings up this machine's end of the tunnel.
+func (n wgNetwork) LocalUnit() string {
+	if n.Userspace() {
+		return userspaceWGUnitPrefix + n.Interface + ".service"
+	}
+	return n.QuickUnit()
+}
+
+// LocalServerIP is where local tools reach the server's tunnel address: the address itself
+// over the kernel interface, or the loopback address the userspace tunnel forwards from.
+func (n wgNetwork) LocalServerIP() string {
+	if n.Userspace() {
+		return userspaceWGForwardIP
+	}
+	return n.ServerIP
+}
+
+// TunnelSSHAddr is where arc dials the server's sshd, published at addr, over the tunnel. The
+// userspace tunnel forwards it to userspaceWGSSHPort of LocalServerIP whatever its public port.
+func (n wgNetwork) TunnelSSHAddr(addr string) string {
+	if n.Userspace() {
+		return net.JoinHostPort(userspaceWGForwardIP, strconv.Itoa(userspaceWGSSHPort))
+	}
+	return arcTunnelAddr(addr, n.ServerIP)
+}
+
+// LocalSSHAddr is where `ssh remotehost` reaches the server's sshd from this machine.
+func (n wgNetwork) LocalSSHAddr() string {
+	if n.Userspace() {
+		return n.TunnelSSHAddr("")
+	}
+	return net.JoinHostPort(n.ServerIP, "22")
+}
+
+// CIDRs are the Address or AllowedIPs of the peer at IPv4 tunnel address ip: its /32 and, on
+// a dual-stack tunnel, its /128.
+func (n wgNetwork) CIDRs(ip string) []string {
+	out := []string{ip + "/32"}
+	if ip6 := n.IP6(ip); ip6 != "" {
+		out = append(out, ip6+"/128")
+	}
+	return out
+}
+
 type wgConfig struct {
 	ServerPriv       string
 	ServerPub        string
@@ -34,9 +371,11 @@ type wgConfig struct {
 	ClientConf       string
 	MobileClientConf string
 	Endpoint         string
+
+	Net wgNetwork
 }
 
-func buildWGConfig(endpointHost string) (wgConfig, error) {
+func buildWGConfig(endpointHost string, n wgNetwork) (wgConfig, error) {
 	host := strings.TrimSpace(endpointHost)
 	if host == "" {
 		return wgConfig{}, fmt.Errorf("missing host for WireGuard endpoint")
@@ -54,49 +393,48 @@ func buildWGConfig(endpointHost string) (wgConfig, error) {
 	if err != nil {
 		return wgConfig{}, err
 	}
+	// Each peer gets its own PresharedKey, so the links do not rest on Curve25519 alone.
+	cPSK, err := genWGPresharedKey()
+	if err != nil {
+		return wgConfig{}, err
+	}
+	mPSK, err := genWGPresharedKey()
+	if err != nil {
+		return wgConfig{}, err
+	}
 
-	endpoint := fmt.Sprintf("%s:%d", host, wgPort)
-	serverConf := strings.Join([]string{
-		"[Interface]",
-		"Address = " + wgServerCIDR,
-		fmt.Sprintf("ListenPort = %d", wgPort),
-		"PrivateKey = " + sPriv,
-		"",
-		"[Peer]",
-		"PublicKey = " + cPub,
-		"AllowedIPs = " + wgDesktopIP + "/32",
-		"",
-		"[Peer]",
-		"PublicKey = " + mPub,
-		"AllowedIPs = " + wgMobileIP + "/32",
-		"",
-	}, "\n")
-
-	clientConf := strings.Join([]string{
-		"[Interface]",
-		"Address = " + wgDesktopCIDR,
-		"PrivateKey = " + cPriv,
-		"",
-		"[Peer]",
-		"PublicKey = " + sPub,
-		"Endpoint = " + endpoint,
-		"AllowedIPs = " + wgServerIP + "/32",
-		"PersistentKeepalive = 25",
-		"",
-	}, "\n")
-
-	mobileClientConf := strings.Join([]string{
-		"[Interface]",
-		"Address = " + wgMobileCIDR,
-		"PrivateKey = " + mPriv,
-		"",
-		"[Peer]",
-		"PublicKey = " + sPub,
-		"Endpoint = " + endpoint,
-		"AllowedIPs = " + wgServerIP + "/32",
-		"PersistentKeepalive = 25",
-		"",
-	}, "\n")
+	n, err = resolveWGNetwork(n)
+	if err != nil {
+		return wgConfig{}, err
+	}
+
+	endpoint := wgEndpoint(host, n.Port)
+	serverConf := &wgconf.Config{
+		Interface: wgconf.Interface{Address: n.CIDRs(n.ServerIP), ListenPort: n.Port, PrivateKey: sPriv},
+		Peers: []wgconf.Peer{
+			{PublicKey: cPub, PresharedKey: cPSK, AllowedIPs: n.CIDRs(n.DesktopIP)},
+			{PublicKey: mPub, PresharedKey: mPSK, AllowedIPs: n.CIDRs(n.MobileIP)},
+		},
+	}
+	clientConf := wgClientConf(n.DesktopIP, cPriv, sPub, cPSK, endpoint, n)
+	mobileConf := wgClientConf(n.MobileIP, mPriv, sPub, mPSK, endpoint, n).String()
+	if n.Reverse() {
+		// The server dials out from a port of the kernel's choosing and keeps the NAT
+		// mapping open; the desktop listens and learns the server's address from it. Only
+		// the desktop is reachable, so there is no mobile peer.
+		serverConf.Interface.ListenPort = 0
+		serverConf.Peers = []wgconf.Peer{{
+			PublicKey:           cPub,
+			PresharedKey:        cPSK,
+			Endpoint:            n.Rendezvous,
+			AllowedIPs:          n.CIDRs(n.DesktopIP),
+			PersistentKeepalive: wgKeepalive,
+		}}
+		clientConf.Interface.ListenPort = n.Port
+		clientConf.Peers[0].Endpoint = ""
+		clientConf.Peers[0].PersistentKeepalive = 0
+		mPriv, mPub, mobileConf = "", "", ""
+	}
 
 	return wgConfig{
 		ServerPriv:       sPriv,
@@ -105,13 +443,36 @@ func buildWGConfig(endpointHost string) (wgConfig, error) {
 		ClientPub:        cPub,
 		MobileClientPriv: mPriv,
 		MobileClientPub:  mPub,
-		ServerConf:       serverConf,
-		ClientConf:       clientConf,
-		MobileClientConf: mobileClientConf,
+		ServerConf:       serverConf.String(),
+		ClientConf:       clientConf.String(),
+		MobileClientConf: mobileConf,
 		Endpoint:         endpoint,
+		Net:              n,
 	}, nil
 }
 
+// wgEndpoint is the Endpoint of the server at host, which may be an IPv6 literal with or
+// without brackets.
+func wgEndpoint(host string, port int) string {
+	host = strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(host), "["), "]")
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+// wgClientConf is the config of the peer at IPv4 tunnel address ip that reaches the server
+// through endpoint, with the PresharedKey of its server peer stanza.
+func wgClientConf(ip, priv, serverPub, psk, endpoint string, n wgNetwork) *wgconf.Config {
+	return &wgconf.Config{
+		Interface: wgconf.Interface{Address: n.CIDRs(ip), PrivateKey: priv},
+		Peers: []wgconf.Peer{{
+			PublicKey:           serverPub,
+			PresharedKey:        psk,
+			Endpoint:            endpoint,
+			AllowedIPs:          n.CIDRs(n.ServerIP),
+			PersistentKeepalive: wgKeepalive,
+		}},
+	}
+}
+
 func genWGKeyPair() (privB64, pubB64 string, err error) {
 	var priv [32]byte
 	if _, err := io.ReadFull(rand.Reader, priv[:]); err != nil {
@@ -129,6 +490,15 @@ func genWGKeyPair() (privB64, pubB64 string, err error) {
 	return base64.StdEncoding.EncodeToString(priv[:]), base64.StdEncoding.EncodeToString(pub), nil
 }
 
+// genWGPresharedKey is a PresharedKey for one server-peer pair, as `wg genpsk` makes it.
+func genWGPresharedKey() (string, error) {
+	var psk [32]byte
+	if _, err := io.ReadFull(rand.Reader, psk[:]); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(psk[:]), nil
+}
+
 func wgPublicKeyFromPrivateKeyB64(privB64 string) (string, error) {
 	privRaw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(privB64))
 	if err != nil {
@@ -151,220 +521,53 @@ func wgPublicKeyFromPrivateKeyB64(privB64 string) (string, error) {
 	return base64.StdEncoding.EncodeToString(pub), nil
 }
 
-func parseWGPrivateKeyFromConf(conf string) (string, error) {
-	section := ""
-	for _, ln := range strings.Split(conf, "\n") {
-		ln = strings.TrimSpace(ln)
-		if ln == "" || strings.HasPrefix(ln, "#") || strings.HasPrefix(ln, ";") {
-			continue
-		}
-		if strings.HasPrefix(ln, "[") && strings.HasSuffix(ln, "]") {
-			section = strings.TrimSuffix(strings.TrimPrefix(ln, "["), "]")
-			section = strings.TrimSpace(section)
-			continue
-		}
-		if !strings.EqualFold(section, "Interface") {
-			continue
-		}
-		k, v, ok := strings.Cut(ln, "=")
-		if !ok {
-			continue
-		}
-		k = strings.TrimSpace(k)
-		v = strings.TrimSpace(v)
-		if strings.EqualFold(k, "PrivateKey") && v != "" {
-			return v, nil
-		}
+// wgPeerIndex is the peer that routes matchAllowedIPs, or the first peer. c has at least one.
+func wgPeerIndex(c *wgconf.Config, matchAllowedIPs string) int {
+	i := c.PeerRouting(strings.TrimSpace(matchAllowedIPs))
+	if i < 0 {
+		// Fallback: patch the first peer (common for arc-generated configs).
+		i = 0
 	}
-	return "", fmt.Errorf("wg conf missing [Interface] PrivateKey")
+	return i
 }
 
-func patchWGPeerInConf(conf string, matchAllowedIPs string, setPeerPublicKey string, ensureEndpoint string, ensureKeepalive string) (string, bool, error) {
-	lines := strings.Split(conf, "\n")
-
-	allowedContains := func(allowedRaw, want string) bool {
-		want = strings.TrimSpace(want)
-		if want == "" {
-			return false
-		}
-		// AllowedIPs may be a comma-separated list.
-		for _, part := range strings.Split(allowedRaw, ",") {
-			if strings.TrimSpace(part) == want {
-				return true
-			}
-		}
+// patchWGPeerPSK sets the PresharedKey of the peer patchWGPeer would patch. It reports whether
+// the key changed.
+func patchWGPeerPSK(c *wgconf.Config, matchAllowedIPs, psk string) bool {
+	if len(c.Peers) == 0 || psk == "" {
 		return false
 	}
-
-	type peerBlock struct {
-		startIdx int
-		endIdx   int // exclusive
-		pubIdx   int
-		allowIdx int
-		endpIdx  int
-		keepIdx  int
-		allowed  string
-	}
-
-	section := ""
-	var blocks []peerBlock
-	var cur *peerBlock
-
-	flushCur := func(end int) {
-		if cur == nil {
-			return
-		}
-		cur.endIdx = end
-		blocks = append(blocks, *cur)
-		cur = nil
-	}
-
-	for i := 0; i <= len(lines); i++ {
-		ln := ""
-		if i < len(lines) {
-			ln = strings.TrimSpace(lines[i])
-		}
-
-		if i == len(lines) {
-			flushCur(i)
-			break
-		}
-
-		if strings.HasPrefix(ln, "[") && strings.HasSuffix(ln, "]") {
-			flushCur(i)
-			section = strings.TrimSpace(strings.TrimSuffix(strings.TrimPrefix(ln, "["), "]"))
-			if strings.EqualFold(section, "Peer") {
-				cur = &peerBlock{
-					startIdx: i,
-					endIdx:   -1,
-					pubIdx:   -1,
-					allowIdx: -1,
-					endpIdx:  -1,
-					keepIdx:  -1,
-				}
-			}
-			continue
-		}
-
-		if cur == nil || !strings.EqualFold(section, "Peer") {
-			continue
-		}
-
-		k, v, ok := strings.Cut(ln, "=")
-		if !ok {
-			continue
-		}
-		k = strings.TrimSpace(k)
-		v = strings.TrimSpace(v)
-		switch {
-		case strings.EqualFold(k, "PublicKey"):
-			cur.pubIdx = i
-		case strings.EqualFold(k, "AllowedIPs"):
-			cur.allowIdx = i
-			cur.allowed = v
-		case strings.EqualFold(k, "Endpoint"):
-			cur.endpIdx = i
-		case strings.EqualFold(k, "PersistentKeepalive"):
-			cur.keepIdx = i
-		}
-	}
-
-	if len(blocks) == 0 {
-		return conf, false, fmt.Errorf("wg conf missing [Peer] section")
+	p := &c.Peers[wgPeerIndex(c, matchAllowedIPs)]
+	if p.PresharedKey == psk {
+		return false
 	}
+	p.PresharedKey = psk
+	return true
+}
 
-	// Pick the peer that routes the address we care about.
-	targetIdx := -1
-	want := strings.TrimSpace(matchAllowedIPs)
-	for i, b := range blocks {
-		if allowedContains(b.allowed, want) {
-			targetIdx = i
-			break
-		}
+// patchWGPeer points the peer that routes matchAllowedIPs (or the first peer) at publicKey,
+// and sets its endpoint and keepalive when given. It reports whether anything changed.
+func patchWGPeer(c *wgconf.Config, matchAllowedIPs, publicKey, endpoint string, keepalive int) (bool, error) {
+	if len(c.Peers) == 0 {
+		return false, fmt.Errorf("wg conf missing [Peer] section")
 	}
-	if targetIdx == -1 {
-		// Fallback: patch the first peer (common for arc-generated configs).
-		targetIdx = 0
-	}
-	b := blocks[targetIdx]
-
+	p := &c.Peers[wgPeerIndex(c, matchAllowedIPs)]
 	changed := false
-	insertAt := b.startIdx + 1
-
-	// Ensure PublicKey
-	pubLine := "PublicKey = " + strings.TrimSpace(setPeerPublicKey)
-	if b.pubIdx >= 0 {
-		if strings.TrimSpace(lines[b.pubIdx]) != pubLine {
-			lines[b.pubIdx] = pubLine
-			changed = true
-		}
-	} else {
-		lines = append(lines[:insertAt], append([]string{pubLine}, lines[insertAt:]...)...)
-		changed = true
-		// Adjust indices after insertion.
-		if b.allowIdx >= insertAt {
-			b.allowIdx++
-		}
-		if b.endpIdx >= insertAt {
-			b.endpIdx++
-		}
-		if b.keepIdx >= insertAt {
-			b.keepIdx++
-		}
-	}
-
-	// Ensure AllowedIPs
-	if want != "" {
-		allowLine := "AllowedIPs = " + want
-		if b.allowIdx >= 0 {
-			if strings.TrimSpace(lines[b.allowIdx]) != allowLine {
-				lines[b.allowIdx] = allowLine
-				changed = true
-			}
-		} else {
-			lines = append(lines[:insertAt], append([]string{allowLine}, lines[insertAt:]...)...)
+	set := func(field *string, value string) {
+		if value != "" && *field != value {
+			*field = value
 			changed = true
-			if b.endpIdx >= insertAt {
-				b.endpIdx++
-			}
-			if b.keepIdx >= insertAt {
-				b.keepIdx++
-			}
 		}
 	}
-
-	// Ensure Endpoint (client)
-	if strings.TrimSpace(ensureEndpoint) != "" {
-		endpLine := "Endpoint = " + strings.TrimSpace(ensureEndpoint)
-		if b.endpIdx >= 0 {
-			if strings.TrimSpace(lines[b.endpIdx]) != endpLine {
-				lines[b.endpIdx] = endpLine
-				changed = true
-			}
-		} else {
-			lines = append(lines[:insertAt], append([]string{endpLine}, lines[insertAt:]...)...)
-			changed = true
-			if b.keepIdx >= insertAt {
-				b.keepIdx++
-			}
-		}
+	set(&p.PublicKey, strings.TrimSpace(publicKey))
+	set(&p.Endpoint, strings.TrimSpace(endpoint))
+	if want := strings.TrimSpace(matchAllowedIPs); want != "" && !slices.Contains(p.AllowedIPs, want) {
+		p.AllowedIPs = []string{want}
+		changed = true
 	}
-
-	// Ensure PersistentKeepalive (client)
-	if strings.TrimSpace(ensureKeepalive) != "" {
-		keepLine := "PersistentKeepalive = " + strings.TrimSpace(ensureKeepalive)
-		if b.keepIdx >= 0 {
-			if strings.TrimSpace(lines[b.keepIdx]) != keepLine {
-				lines[b.keepIdx] = keepLine
-				changed = true
-			}
-		} else {
-			lines = append(lines[:insertAt], append([]string{keepLine}, lines[insertAt:]...)...)
-			changed = true
-		}
+	if keepalive > 0 && p.PersistentKeepalive != keepalive {
+		p.PersistentKeepalive = keepalive
+		changed = true
 	}
-
-	// Keep trailing newline behavior stable (arc-generated configs end with blank line).
-	out := strings.Join(lines, "\n")
-	return out, changed, nil
+	return changed, nil
 }
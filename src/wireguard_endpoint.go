@@ -0,0 +1,276 @@
+package main
+
+import (
+	"arc/internal/wgconf"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// arcEndpointBinPath is the copy of arc the endpoint timer runs.
+const arcEndpointBinPath = "/usr/local/libexec/arc-endpoint"
+
+// endpointTracker follows a server whose public address changes under a DNS name (DDNS, a
+// re-created VM): it re-resolves the name and moves the server peer of iface to the address
+// it resolves to now.
+type endpointTracker struct {
+	iface string
+	// host is the server's DNS name; empty takes the name from the peer's Endpoint.
+	host     string
+	loadConf func() (*wgconf.Config, error)
+	saveConf func(*wgconf.Config) error
+	resolve  func(ctx context.Context, host string) ([]netip.Addr, error)
+	wg       func(ctx context.Context, stdin string, args ...string) (string, error)
+	logf     func(string, ...any)
+}
+
+// check updates the live peer when its endpoint is not an address of the name, and the
+// config when it holds such a stale address. A config that holds the name is left alone;
+// wg-quick resolves it again whenever the interface comes up.
+func (t *endpointTracker) check(ctx context.Context) error {
+	conf, err := t.loadConf()
+	if err != nil {
+		return err
+	}
+	i := slices.IndexFunc(conf.Peers, func(p wgconf.Peer) bool { return p.Endpoint != "" })
+	if i < 0 {
+		return errors.New("no peer with an Endpoint to track")
+	}
+	peer := conf.Peers[i]
+	confHost, portStr, err := net.SplitHostPort(peer.Endpoint)
+	if err != nil {
+		return fmt.Errorf("peer endpoint %q: %w", peer.Endpoint, err)
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return fmt.Errorf("peer endpoint %q: invalid port", peer.Endpoint)
+	}
+	host := t.host
+	if host == "" {
+		host = confHost
+	}
+	if _, err := netip.ParseAddr(host); err == nil {
+		// An address has nothing to re-resolve.
+		return nil
+	}
+	addrs, err := t.resolve(ctx, host)
+	if err != nil {
+		return fmt.Errorf("resolve %s: %w", host, err)
+	}
+	if len(addrs) == 0 {
+		return fmt.Errorf("resolve %s: no addresses", host)
+	}
+
+	endpoints, err := t.wg(ctx, "", "show", t.iface, "endpoints")
+	if err != nil {
+		return err
+	}
+	live := wgShowValue(endpoints, peer.PublicKey)
+	want := pickEndpoint(addrs, live, uint16(port))
+	switch liveAP, err := netip.ParseAddrPort(live); {
+	case err == nil && liveAP.Addr().IsLoopback():
+		// The relay carries the tunnel; its watchdog returns to the endpoint in the config.
+	case live != want:
+		if _, err := t.wg(ctx, "", "set", t.iface, "peer", peer.PublicKey, "endpoint", want); err != nil {
+			return err
+		}
+		t.logf("%s now resolves to %s; moved the server peer of %s from %s", host, want, t.iface, orNone(live))
+	}
+
+	if _, err := netip.ParseAddr(confHost); err == nil && peer.Endpoint != want {
+		conf.Peers[i].Endpoint = want
+		if err := t.saveConf(conf); err != nil {
+			return err
+		}
+		t.logf("wrote endpoint %s for %s to the %s config (was %s)", want, host, t.iface, peer.Endpoint)
+	}
+	return nil
+}
+
+// pickEndpoint is the endpoint at one of addrs: the live one while the name still resolves
+// to it, so a name with several addresses does not move the peer on every check, or else the
+// first.
+func pickEndpoint(addrs []netip.Addr, live string, port uint16) string {
+	if ap, err := netip.ParseAddrPort(live); err == nil && ap.Port() == port {
+		for _, a := range addrs {
+			if a.Unmap() == ap.Addr().Unmap() {
+				return live
+			}
+		}
+	}
+	return netip.AddrPortFrom(addrs[0].Unmap(), port).String()
+}
+
+// saveWGQuickConf replaces the wg-quick config of iface, atomically, as root does. The
+// previous config is backed up first, so `arc restore` can put it back.
+func saveWGQuickConf(iface string, conf *wgconf.Config) error {
+	path := filepath.Join("/etc/wireguard", iface+".conf")
+	if err := backupWGQuickConf(path); err != nil {
+		return fmt.Errorf("back up %s: %w", path, err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+iface+".conf-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := tmp.Chmod(0o600); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if _, err := tmp.WriteString(conf.String()); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// backupWGQuickConf records path in a backup run of its own under ~/.arc/backups, as setup
+// records the files it changes. The endpoint unit sets HOME to the home of the user who ran
+// setup, whose `arc restore` lists the run.
+func backupWGQuickConf(path string) error {
+	runID, err := newSetupRunID()
+	if err != nil {
+		return err
+	}
+	snap := fileSnapshot{Path: path}
+	switch info, err := os.Stat(path); {
+	case err == nil:
+		if snap.Content, err = os.ReadFile(path); err != nil {
+			return err
+		}
+		snap.Existed, snap.Mode = true, info.Mode()
+	case !os.IsNotExist(err):
+		return err
+	}
+	if err := storeLocalBackup(infraRunContext{Context: context.Background(), RunID: runID}, snap); err != nil {
+		return err
+	}
+	return chownBackupToHome(runID)
+}
+
+// chownBackupToHome hands a backup taken as root to the owner of HOME, so their `arc restore`
+// can read it.
+func chownBackupToHome(runID string) error {
+	if os.Geteuid() != 0 {
+		return nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(home)
+	if err != nil {
+		return err
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+	uid, gid := int(st.Uid), int(st.Gid)
+	arcDir, err := arcHomeDir()
+	if err != nil {
+		return err
+	}
+	for _, dir := range []string{arcDir, filepath.Join(arcDir, backupsDirName)} {
+		if err := os.Lchown(dir, uid, gid); err != nil {
+			return err
+		}
+	}
+	dir, err := localBackupDir(runID)
+	if err != nil {
+		return err
+	}
+	return filepath.WalkDir(dir, func(p string, _ fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		return os.Lchown(p, uid, gid)
+	})
+}
+
+// dnsNamePattern matches the host names the endpoint timer takes on its command line.
+var dnsNamePattern = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9.-]*[A-Za-z0-9])?$`)
+
+// endpointHostname is the DNS name of wg's server endpoint, or empty when there is nothing
+// to track: the endpoint is an address, the server dials a rendezvous, or the userspace
+// tunnel, which has no `wg` interface to update, resolves it each time it starts.
+func endpointHostname(wg wgConfig) string {
+	if wg.Net.Reverse() || wg.Net.Userspace() {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(wg.Endpoint)
+	if err != nil {
+		return ""
+	}
+	if _, err := netip.ParseAddr(host); err == nil || !dnsNamePattern.MatchString(host) {
+		return ""
+	}
+	return host
+}
+
+// localEndpointUnit re-resolves the server's name for n's interface; its timer runs it.
+func localEndpointUnit(n wgNetwork) string {
+	return "arc-endpoint-" + n.Interface + ".service"
+}
+
+func localEndpointTimer(n wgNetwork) string {
+	return "arc-endpoint-" + n.Interface + ".timer"
+}
+
+func localEndpointUnitPath(n wgNetwork) string {
+	return "/etc/systemd/system/" + localEndpointUnit(n)
+}
+
+func localEndpointTimerPath(n wgNetwork) string {
+	return "/etc/systemd/system/" + localEndpointTimer(n)
+}
+
+func renderLocalEndpointUnits(wg wgConfig) (unit, timer string, err error) {
+	host := endpointHostname(wg)
+	if host == "" {
+		return "", "", fmt.Errorf("WireGuard endpoint %q has no DNS name to track", wg.Endpoint)
+	}
+	// The timer backs up the config it rewrites to the ~/.arc of the user running setup.
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", "", err
+	}
+	if strings.ContainsAny(home, "\"\\%$\n") {
+		return "", "", fmt.Errorf("home directory %q cannot be passed to a systemd unit", home)
+	}
+	n := wg.Net
+	wgUnit := n.LocalUnit()
+	if !strings.HasSuffix(wgUnit, ".service") {
+		wgUnit += ".service"
+	}
+	unit, err = renderTemplateFile("templates/arc_endpoint.service.tmpl", map[string]string{
+		"Bin":       arcEndpointBinPath,
+		"Home":      home,
+		"Host":      host,
+		"Interface": n.Interface,
+		"WGUnit":    wgUnit,
+	})
+	if err != nil {
+		return "", "", err
+	}
+	timer, err = renderTemplateFile("templates/arc_endpoint.timer.tmpl", map[string]string{
+		"Interface": n.Interface,
+	})
+	if err != nil {
+		return "", "", err
+	}
+	return unit, timer, nil
+}
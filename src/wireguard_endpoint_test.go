@@ -0,0 +1,163 @@
+package main
+
+import (
+	"arc/internal/wgconf"
+	"context"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEndpointTracker_FollowsDNS(t *testing.T) {
+	const pub = "c2VydmVyLXB1YmxpYy1rZXktZm9yLXRlc3RzLi4uLi4="
+	var confEndpoint, live string
+	var resolved []netip.Addr
+	var calls []string
+	var saved *wgconf.Config
+	tr := &endpointTracker{
+		iface: "wg0",
+		host:  "vps.example.com",
+		loadConf: func() (*wgconf.Config, error) {
+			return &wgconf.Config{Peers: []wgconf.Peer{{PublicKey: pub, Endpoint: confEndpoint, AllowedIPs: []string{defaultWGNetwork().ServerCIDR()}}}}, nil
+		},
+		saveConf: func(c *wgconf.Config) error {
+			saved = c
+			return nil
+		},
+		resolve: func(_ context.Context, host string) ([]netip.Addr, error) {
+			if host != "vps.example.com" {
+				t.Fatalf("resolved %q", host)
+			}
+			return resolved, nil
+		},
+		wg: func(_ context.Context, _ string, args ...string) (string, error) {
+			if strings.Join(args, " ") == "show wg0 endpoints" {
+				return pub + "\t" + live + "\n", nil
+			}
+			calls = append(calls, strings.Join(args, " "))
+			return "", nil
+		},
+		logf: t.Logf,
+	}
+	check := func() {
+		t.Helper()
+		calls, saved = nil, nil
+		if err := tr.check(context.Background()); err != nil {
+			t.Fatalf("check: %v", err)
+		}
+	}
+
+	// The config holds the name, so only the live peer moves.
+	confEndpoint, live = "vps.example.com:51820", "203.0.113.7:51820"
+	resolved = []netip.Addr{netip.MustParseAddr("198.51.100.4")}
+	check()
+	if len(calls) != 1 || calls[0] != "set wg0 peer "+pub+" endpoint 198.51.100.4:51820" || saved != nil {
+		t.Fatalf("unexpected update: %v, saved %v", calls, saved != nil)
+	}
+
+	// While the name still resolves to the live address among others, nothing moves.
+	live = "198.51.100.4:51820"
+	resolved = []netip.Addr{netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("198.51.100.4")}
+	check()
+	if len(calls) != 0 || saved != nil {
+		t.Fatalf("a current endpoint should stay: %v", calls)
+	}
+
+	// A stale address in the config is replaced there too.
+	confEndpoint, live = "203.0.113.7:51820", "203.0.113.7:51820"
+	resolved = []netip.Addr{netip.MustParseAddr("2001:db8::4")}
+	check()
+	if len(calls) != 1 || !strings.HasSuffix(calls[0], " endpoint [2001:db8::4]:51820") {
+		t.Fatalf("unexpected update: %v", calls)
+	}
+	if saved == nil || saved.Peers[0].Endpoint != "[2001:db8::4]:51820" {
+		t.Fatalf("expected the new endpoint in the config, got %+v", saved)
+	}
+
+	// The relay's loopback endpoint is left to its watchdog.
+	live = "127.0.0.1:40000"
+	check()
+	if len(calls) != 0 || saved == nil {
+		t.Fatalf("the relay endpoint should stay while the config is updated: %v", calls)
+	}
+
+	// A server set up by address has nothing to follow.
+	tr.host = ""
+	resolved = nil
+	check()
+	if len(calls) != 0 || saved != nil {
+		t.Fatalf("an address endpoint should be left alone: %v", calls)
+	}
+}
+
+func TestEndpointHostname(t *testing.T) {
+	for endpoint, want := range map[string]string{
+		"vps.example.com:51820": "vps.example.com",
+		"203.0.113.7:51820":     "",
+		"[2001:db8::7]:51820":   "",
+		"bad;name:51820":        "",
+		"":                      "",
+	} {
+		if got := endpointHostname(wgConfig{Endpoint: endpoint, Net: defaultWGNetwork()}); got != want {
+			t.Fatalf("endpointHostname(%q) = %q, want %q", endpoint, got, want)
+		}
+	}
+	wg := wgConfig{Endpoint: "vps.example.com:51820", Net: defaultWGNetwork()}
+	wg.Net.Rendezvous = "desk.example.net:51820"
+	if got := endpointHostname(wg); got != "" {
+		t.Fatalf("a server dialing a rendezvous has no endpoint to follow, got %q", got)
+	}
+	wg.Net = defaultWGNetwork()
+	wg.Net.Mode = wgModeUserspace
+	if got := endpointHostname(wg); got != "" {
+		t.Fatalf("the userspace tunnel resolves its endpoint itself, got %q", got)
+	}
+}
+
+func TestBackupWGQuickConf(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	path := filepath.Join(t.TempDir(), "wg0.conf")
+	if err := os.WriteFile(path, []byte("[Interface]\nPrivateKey = a2V5\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := backupWGQuickConf(path); err != nil {
+		t.Fatalf("backupWGQuickConf: %v", err)
+	}
+	backups, err := listBackups()
+	if err != nil || len(backups) != 1 {
+		t.Fatalf("expected one backup run, got %+v (%v)", backups, err)
+	}
+	m := backups[0]
+	if len(m.Files) != 1 || m.Files[0].Path != path || !m.Files[0].Existed || m.Files[0].Mode != "0600" {
+		t.Fatalf("unexpected manifest: %+v", m)
+	}
+	dir, err := localBackupDir(m.RunID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved, err := os.ReadFile(filepath.Join(dir, "files", path)); err != nil || string(saved) != "[Interface]\nPrivateKey = a2V5\n" {
+		t.Fatalf("unexpected saved config %q (%v)", saved, err)
+	}
+}
+
+func TestRenderLocalEndpointUnits(t *testing.T) {
+	t.Setenv("HOME", "/home/alice")
+	wg := wgConfig{Endpoint: "vps.example.com:51820", Net: defaultWGNetwork()}
+	unit, timer, err := renderLocalEndpointUnits(wg)
+	if err != nil {
+		t.Fatalf("renderLocalEndpointUnits: %v", err)
+	}
+	if !strings.Contains(unit, "ExecStart="+arcEndpointBinPath+" endpoint --host vps.example.com wg0\n") ||
+		!strings.Contains(unit, "After=network-online.target wg-quick@wg0.service\n") ||
+		!strings.Contains(unit, "Environment=\"HOME=/home/alice\"\n") {
+		t.Fatalf("unexpected unit:\n%s", unit)
+	}
+	if !strings.Contains(timer, "OnUnitActiveSec=1min\n") {
+		t.Fatalf("unexpected timer:\n%s", timer)
+	}
+	if localEndpointTimer(wg.Net) != "arc-endpoint-wg0.timer" {
+		t.Fatalf("unexpected timer name %q", localEndpointTimer(wg.Net))
+	}
+}
@@ -1,17 +1,21 @@
 package main
 
 import (
-	"errors"
+	"arc/internal/wgconf"
+	"context"
 	"fmt"
-	"os"
-	"path/filepath"
 	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
 )
 
-func wgDiagLocal() (string, error) {
+func wgDiagLocal(ctx infraRunContext) (string, error) {
+	n := ctx.WG.Net
+	iface := n.Interface
 	var parts []string
 	add := func(label string, cmd ...string) {
-		out, err := execLocal(cmd[0], cmd[1:]...)
+		out, err := execLocal(ctx, cmd[0], cmd[1:]...)
 		if err != nil && out == "" {
 			parts = append(parts, fmt.Sprintf("%s: (error: %v)", label, err))
 			return
@@ -21,23 +25,55 @@ func wgDiagLocal() (string, error) {
 		}
 		parts = append(parts, fmt.Sprintf("%s:\n%s", label, out))
 	}
-	add("wg show", "sudo", "-n", "wg", "show", wgInterface)
-	add("latest-handshakes", "sudo", "-n", "wg", "show", wgInterface, "latest-handshakes")
-	add("endpoints", "sudo", "-n", "wg", "show", wgInterface, "endpoints")
-	add("transfer", "sudo", "-n", "wg", "show", wgInterface, "transfer")
+	if n.Userspace() {
+		parts = append(parts, userspaceWGPeersDiag(ctx, iface))
+	} else {
+		add("wg show", "sudo", "-n", "wg", "show", iface)
+		add("latest-handshakes", "sudo", "-n", "wg", "show", iface, "latest-handshakes")
+		add("endpoints", "sudo", "-n", "wg", "show", iface, "endpoints")
+		add("transfer", "sudo", "-n", "wg", "show", iface, "transfer")
+	}
+	path, err := localWGConfPath(n)
+	if err != nil {
+		return "", err
+	}
+	raw, err := readLocalWGConf(ctx, n)
+	parts = append(parts, wgConfDiag(path, raw, err))
 	return strings.Join(parts, "\n\n"), nil
 }
 
+// userspaceWGPeersDiag lists the peers the userspace tunnel iface reports on its control
+// socket, in place of `wg show`.
+func userspaceWGPeersDiag(ctx context.Context, iface string) string {
+	peers, err := userspaceWGPeers(ctx, iface)
+	if err != nil {
+		return fmt.Sprintf("peers: (error: %v)", err)
+	}
+	lines := []string{"peers:"}
+	for _, p := range peers {
+		handshake := "never"
+		if !p.LatestHandshake.IsZero() {
+			handshake = p.LatestHandshake.Format(time.RFC3339)
+		}
+		lines = append(lines, fmt.Sprintf("peer %s endpoint=%s latest-handshake=%s rx=%d tx=%d", p.PublicKey, p.Endpoint, handshake, p.RxBytes, p.TxBytes))
+	}
+	if len(peers) == 0 {
+		lines = append(lines, "(empty)")
+	}
+	return strings.Join(lines, "\n")
+}
+
 func wgDiagRemote(ctx infraRunContext) (string, error) {
-	client, err := dialArcWithKey(ctx.Addr)
+	client, release, err := arcClientFor(ctx)
 	if err != nil {
 		return "", err
 	}
-	defer client.Close()
+	defer release()
 
+	iface := ctx.WG.Net.Interface
 	var parts []string
 	add := func(label, cmd string) {
-		out, err := runRemoteCommand(client, "sudo -n "+cmd, false, "")
+		out, err := runRemoteCommand(ctx, client, "sudo -n "+cmd, false, "")
 		if err != nil && strings.TrimSpace(out) == "" {
 			parts = append(parts, fmt.Sprintf("%s: (error: %v)", label, err))
 			return
@@ -48,113 +84,213 @@ func wgDiagRemote(ctx infraRunContext) (string, error) {
 		}
 		parts = append(parts, fmt.Sprintf("%s:\n%s", label, out))
 	}
-	add("wg show", "wg show "+wgInterface)
-	add("latest-handshakes", "wg show "+wgInterface+" latest-handshakes")
-	add("endpoints", "wg show "+wgInterface+" endpoints")
-	add("transfer", "wg show "+wgInterface+" transfer")
+	add("wg show", "wg show "+iface)
+	add("latest-handshakes", "wg show "+iface+" latest-handshakes")
+	add("endpoints", "wg show "+iface+" endpoints")
+	add("transfer", "wg show "+iface+" transfer")
+	raw, err := runRemoteCommand(withoutStepOutput(ctx), client, "sudo -n cat "+ctx.WG.Net.ConfPath(), false, "")
+	parts = append(parts, wgConfDiag(ctx.WG.Net.ConfPath(), raw, err))
 	return strings.Join(parts, "\n\n"), nil
 }
 
-func autoSyncWireGuardPeerKeys(ctx infraRunContext) (bool, error) {
-	// Read local+remote wg0.conf, derive interface public keys from PrivateKey, and ensure each side's
-	// peer PublicKey references the other side. This only touches the relevant [Peer] stanza.
+// wgPSKDiag confirms that every peer of c has a PresharedKey, or names those that do not.
+func wgPSKDiag(c *wgconf.Config) string {
+	var missing []string
+	for _, p := range c.Peers {
+		if p.PresharedKey == "" {
+			missing = append(missing, strings.Join(p.AllowedIPs, ","))
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Sprintf("preshared keys: MISSING for %d of %d peers (%s)", len(missing), len(c.Peers), strings.Join(missing, "; "))
+	}
+	return fmt.Sprintf("preshared keys: present for all %d peers", len(c.Peers))
+}
 
-	localConf, err := execLocal("sudo", "-n", "cat", "/etc/wireguard/"+wgInterface+".conf")
+// wgConfDiag summarizes a wg-quick config without its secrets: addresses, peers and what
+// Validate objects to.
+func wgConfDiag(path, raw string, readErr error) string {
+	if readErr != nil {
+		return fmt.Sprintf("%s: (error: %v)", path, readErr)
+	}
+	c, err := wgconf.Parse(raw)
 	if err != nil {
-		// Fallback: pull live config.
-		localConf, err = execLocal("sudo", "-n", "wg", "showconf", wgInterface)
-		if err != nil {
-			return false, fmt.Errorf("read local wg config: %v", err)
+		return fmt.Sprintf("%s: (unparseable: %v)", path, err)
+	}
+	lines := []string{fmt.Sprintf("%s:", path), fmt.Sprintf("interface address=%s listen-port=%d", strings.Join(c.Interface.Address, ","), c.Interface.ListenPort)}
+	for _, p := range c.Peers {
+		ln := fmt.Sprintf("peer %s allowed-ips=%s", p.PublicKey, strings.Join(p.AllowedIPs, ","))
+		if p.Endpoint != "" {
+			ln += " endpoint=" + p.Endpoint
 		}
+		if p.PresharedKey != "" {
+			ln += " psk=yes"
+		}
+		lines = append(lines, ln)
+	}
+	lines = append(lines, wgPSKDiag(c))
+	if err := c.Validate(); err != nil {
+		lines = append(lines, "invalid: "+err.Error())
 	}
+	return strings.Join(lines, "\n")
+}
 
-	client, err := dialArcWithKey(ctx.Addr)
+func autoSyncWireGuardPeerKeys(ctx infraRunContext) (bool, error) {
+	client, release, err := arcClientFor(ctx)
 	if err != nil {
 		return false, fmt.Errorf("dial remote for wg sync: %w", err)
 	}
-	defer client.Close()
+	defer release()
+
+	plan, err := planWireGuardPeerSync(ctx, client)
+	if err != nil {
+		return false, err
+	}
+	if !plan.changed() {
+		return false, nil
+	}
+	if err := applyWireGuardPeerSync(ctx, client, plan); err != nil {
+		return false, err
+	}
+	return true, nil
+}
 
-	remoteConf, err := runRemoteCommand(client, "sudo -n cat /etc/wireguard/"+wgInterface+".conf", false, "")
+// wgPeerSync holds both wg0.conf files patched so that each side's peer PublicKey references
+// the other side's interface key.
+type wgPeerSync struct {
+	LocalConf     string
+	LocalChanged  bool
+	RemoteConf    string
+	RemoteChanged bool
+}
+
+func (p wgPeerSync) changed() bool {
+	return p.LocalChanged || p.RemoteChanged
+}
+
+func planWireGuardPeerSync(ctx infraRunContext, client *ssh.Client) (wgPeerSync, error) {
+	// Read local+remote wg0.conf, derive interface public keys from PrivateKey, and ensure each side's
+	// peer PublicKey references the other side. This only touches the relevant [Peer] stanza.
+
+	n := ctx.WG.Net
+	localConf, err := readLocalWGConf(ctx, n)
+	if err != nil && !n.Userspace() {
+		// Fallback: pull live config.
+		localConf, err = execLocal(withoutStepOutput(ctx), "sudo", "-n", "wg", "showconf", n.Interface)
+	}
 	if err != nil {
-		remoteConf, err = runRemoteCommand(client, "sudo -n wg showconf "+wgInterface, false, "")
+		return wgPeerSync{}, fmt.Errorf("read local wg config: %v", err)
+	}
+
+	remoteConf, err := runRemoteCommand(withoutStepOutput(ctx), client, "sudo -n cat "+n.ConfPath(), false, "")
+	if err != nil {
+		remoteConf, err = runRemoteCommand(withoutStepOutput(ctx), client, "sudo -n wg showconf "+n.Interface, false, "")
 		if err != nil {
-			return false, fmt.Errorf("read remote wg config: %v", err)
+			return wgPeerSync{}, fmt.Errorf("read remote wg config: %v", err)
 		}
 	}
+	return computeWGPeerSync(localConf, remoteConf, ctx.WG.Endpoint, n)
+}
 
-	localPriv, err := parseWGPrivateKeyFromConf(localConf)
+// computeWGPeerSync patches each side's peer PublicKey to the other side's interface key, the
+// local peer's endpoint to endpoint, and both PresharedKeys to the same key. Peers are matched
+// by their tunnel addresses in n.
+func computeWGPeerSync(localConf, remoteConf, endpoint string, n wgNetwork) (wgPeerSync, error) {
+	local, err := wgconf.Parse(localConf)
 	if err != nil {
-		return false, fmt.Errorf("parse local wg private key: %w", err)
+		return wgPeerSync{}, fmt.Errorf("parse local wg config: %w", err)
 	}
-	remotePriv, err := parseWGPrivateKeyFromConf(remoteConf)
+	remote, err := wgconf.Parse(remoteConf)
 	if err != nil {
-		return false, fmt.Errorf("parse remote wg private key: %w", err)
+		return wgPeerSync{}, fmt.Errorf("parse remote wg config: %w", err)
 	}
 
-	localPub, err := wgPublicKeyFromPrivateKeyB64(localPriv)
+	localPub, err := wgPublicKeyFromPrivateKeyB64(local.Interface.PrivateKey)
 	if err != nil {
-		return false, fmt.Errorf("derive local wg public key: %w", err)
+		return wgPeerSync{}, fmt.Errorf("derive local wg public key: %w", err)
 	}
-	remotePub, err := wgPublicKeyFromPrivateKeyB64(remotePriv)
+	remotePub, err := wgPublicKeyFromPrivateKeyB64(remote.Interface.PrivateKey)
 	if err != nil {
-		return false, fmt.Errorf("derive remote wg public key: %w", err)
+		return wgPeerSync{}, fmt.Errorf("derive remote wg public key: %w", err)
 	}
 
+	plan := wgPeerSync{LocalConf: localConf, RemoteConf: remoteConf}
+	// The dialing side gets the endpoint and keepalive: the local peer, or the server's peer
+	// through a rendezvous.
+	localEndpoint, localKeepalive, remoteEndpoint, remoteKeepalive := endpoint, wgKeepalive, "", 0
+	if n.Reverse() {
+		localEndpoint, localKeepalive, remoteEndpoint, remoteKeepalive = "", 0, n.Rendezvous, wgKeepalive
+		if local.Interface.ListenPort != n.Port {
+			local.Interface.ListenPort = n.Port
+			plan.LocalChanged = true
+		}
+	}
 	// Patch local peer (routes to server IP) to use remote's pubkey.
-	localPatched, localChanged, lerr := patchWGPeerInConf(localConf, wgServerIP+"/32", remotePub, ctx.WG.Endpoint, "25")
-	if lerr != nil {
-		return false, fmt.Errorf("patch local wg peer: %w", lerr)
+	localChanged, err := patchWGPeer(local, n.ServerCIDR(), remotePub, localEndpoint, localKeepalive)
+	if err != nil {
+		return wgPeerSync{}, fmt.Errorf("patch local wg peer: %w", err)
 	}
+	plan.LocalChanged = plan.LocalChanged || localChanged
 	// Patch remote peer (routes to client IP) to use local's pubkey.
-	remotePatched, remoteChanged, rerr := patchWGPeerInConf(remoteConf, wgDesktopIP+"/32", localPub, "", "")
-	if rerr != nil {
-		return false, fmt.Errorf("patch remote wg peer: %w", rerr)
+	if plan.RemoteChanged, err = patchWGPeer(remote, n.DesktopCIDR(), localPub, remoteEndpoint, remoteKeepalive); err != nil {
+		return wgPeerSync{}, fmt.Errorf("patch remote wg peer: %w", err)
 	}
-
-	if !localChanged && !remoteChanged {
-		return false, nil
+	// Both sides use the local peer's PresharedKey; a link set up before arc used them gets one.
+	psk := local.Peers[wgPeerIndex(local, n.ServerCIDR())].PresharedKey
+	if psk == "" {
+		if psk, err = genWGPresharedKey(); err != nil {
+			return wgPeerSync{}, fmt.Errorf("generate preshared key: %w", err)
+		}
 	}
-
-	home, herr := os.UserHomeDir()
-	if herr != nil || home == "" {
-		return false, errors.New("cannot resolve home dir")
+	if patchWGPeerPSK(local, n.ServerCIDR(), psk) {
+		plan.LocalChanged = true
 	}
-	dir := filepath.Join(home, ".arc", "wireguard")
-	if err := ensureDir0700(dir); err != nil {
-		return false, err
+	if patchWGPeerPSK(remote, n.DesktopCIDR(), psk) {
+		plan.RemoteChanged = true
 	}
+	if plan.LocalChanged {
+		plan.LocalConf = local.String()
+	}
+	if plan.RemoteChanged {
+		plan.RemoteConf = remote.String()
+	}
+	return plan, nil
+}
 
+func applyWireGuardPeerSync(ctx infraRunContext, client *ssh.Client, plan wgPeerSync) error {
+	n := ctx.WG.Net
 	// Local: install updated config.
-	tmp := filepath.Join(dir, "."+wgInterface+".conf.sync.tmp")
-	if err := writeFile0600(tmp, []byte(localPatched)); err != nil {
-		return false, err
+	localPath, err := localWGConfPath(n)
+	if err != nil {
+		return err
 	}
-	if _, err := execLocal("sudo", "-n", "install", "-m", "0600", tmp, "/etc/wireguard/"+wgInterface+".conf"); err != nil {
-		return false, fmt.Errorf("install local wg conf: %w", err)
+	if err := installLocalManagedFile(ctx, localPath, []byte(plan.LocalConf), 0o600); err != nil {
+		return fmt.Errorf("install local wg conf: %w", err)
 	}
-	_ = os.Remove(tmp)
 
 	// Remote: install updated config.
+	if err := backupRemoteFiles(ctx, client, n.ConfPath()); err != nil {
+		return err
+	}
 	script := fmt.Sprintf(
-		"umask 077\ninstall -d -m 0700 /etc/wireguard\ncat > /etc/wireguard/%s.conf <<'EOF'\n%sEOF\nchmod 600 /etc/wireguard/%s.conf\n",
-		wgInterface, remotePatched, wgInterface,
+		"umask 077\ninstall -d -m 0700 /etc/wireguard\ncat > %s <<'EOF'\n%sEOF\nchmod 600 %s\n",
+		n.ConfPath(), plan.RemoteConf, n.ConfPath(),
 	)
 	cmd := "sudo -n sh -lc " + shSingleQuote(script)
-	if _, err := runRemoteCommand(client, cmd, false, ""); err != nil {
-		return false, fmt.Errorf("install remote wg conf: %w", err)
+	if _, err := runRemoteCommand(ctx, client, cmd, false, ""); err != nil {
+		return fmt.Errorf("install remote wg conf: %w", err)
 	}
 
 	// Restart both ends to apply.
-	if _, err := execLocal("sudo", "-n", "systemctl", "restart", "wg-quick@"+wgInterface); err != nil {
-		return false, fmt.Errorf("restart local wg: %w", err)
+	if _, err := localWGSystemctl(ctx, n, "restart", n.LocalUnit()); err != nil {
+		return fmt.Errorf("restart local wg: %w", err)
 	}
-	if _, err := execLocal("sudo", "-n", "systemctl", "is-active", "--quiet", "wg-quick@"+wgInterface); err != nil {
-		return false, fmt.Errorf("local wg not active after restart: %w", err)
+	if _, err := localWGSystemctl(ctx, n, "is-active", "--quiet", n.LocalUnit()); err != nil {
+		return fmt.Errorf("local wg not active after restart: %w", err)
 	}
 
-	if _, err := runRemoteCommand(client, "sudo -n systemctl restart wg-quick@"+wgInterface+" && sudo -n systemctl is-active --quiet wg-quick@"+wgInterface, false, ""); err != nil {
-		return false, fmt.Errorf("restart remote wg: %w", err)
+	if _, err := runRemoteCommand(ctx, client, "sudo -n systemctl restart "+n.QuickUnit()+" && sudo -n systemctl is-active --quiet "+n.QuickUnit(), false, ""); err != nil {
+		return fmt.Errorf("restart remote wg: %w", err)
 	}
-
-	return true, nil
+	return nil
 }
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"reflect"
 	"testing"
@@ -28,13 +29,13 @@ func (s *fakeUploadSession) Close() error { return nil }
 
 func TestActivateLocalWaypipeService_CommandOrder(t *testing.T) {
 	var got [][]string
-	execFn := func(name string, args ...string) (string, error) {
+	execFn := func(_ context.Context, name string, args ...string) (string, error) {
 		cmd := append([]string{name}, args...)
 		got = append(got, cmd)
 		return "", nil
 	}
 
-	if err := activateLocalWaypipeService(execFn); err != nil {
+	if err := activateLocalWaypipeService(context.Background(), execFn); err != nil {
 		t.Fatalf("activateLocalWaypipeService: %v", err)
 	}
 
@@ -51,7 +52,7 @@ func TestActivateLocalWaypipeService_CommandOrder(t *testing.T) {
 
 func TestActivateLocalWaypipeService_IgnoresImportFailure(t *testing.T) {
 	var got [][]string
-	execFn := func(name string, args ...string) (string, error) {
+	execFn := func(_ context.Context, name string, args ...string) (string, error) {
 		cmd := append([]string{name}, args...)
 		got = append(got, cmd)
 		if len(got) == 1 {
@@ -60,7 +61,7 @@ func TestActivateLocalWaypipeService_IgnoresImportFailure(t *testing.T) {
 		return "", nil
 	}
 
-	if err := activateLocalWaypipeService(execFn); err != nil {
+	if err := activateLocalWaypipeService(context.Background(), execFn); err != nil {
 		t.Fatalf("activateLocalWaypipeService: %v", err)
 	}
 	if len(got) != 4 {
@@ -70,14 +71,14 @@ func TestActivateLocalWaypipeService_IgnoresImportFailure(t *testing.T) {
 
 func TestActivateLocalWaypipeService_ReturnsRestartError(t *testing.T) {
 	wantErr := errors.New("restart failed")
-	execFn := func(name string, args ...string) (string, error) {
+	execFn := func(_ context.Context, name string, args ...string) (string, error) {
 		if len(args) >= 2 && args[1] == "restart" {
 			return "", wantErr
 		}
 		return "", nil
 	}
 
-	err := activateLocalWaypipeService(execFn)
+	err := activateLocalWaypipeService(context.Background(), execFn)
 	if !errors.Is(err, wantErr) {
 		t.Fatalf("expected restart error, got %v", err)
 	}
@@ -85,13 +86,13 @@ func TestActivateLocalWaypipeService_ReturnsRestartError(t *testing.T) {
 
 func TestActivateLocalClipboardSyncService_CommandOrder(t *testing.T) {
 	var got [][]string
-	execFn := func(name string, args ...string) (string, error) {
+	execFn := func(_ context.Context, name string, args ...string) (string, error) {
 		cmd := append([]string{name}, args...)
 		got = append(got, cmd)
 		return "", nil
 	}
 
-	if err := activateLocalClipboardSyncService(execFn); err != nil {
+	if err := activateLocalClipboardSyncService(context.Background(), execFn); err != nil {
 		t.Fatalf("activateLocalClipboardSyncService: %v", err)
 	}
 
@@ -108,14 +109,14 @@ func TestActivateLocalClipboardSyncService_CommandOrder(t *testing.T) {
 
 func TestActivateLocalClipboardSyncService_ReturnsRestartError(t *testing.T) {
 	wantErr := errors.New("restart failed")
-	execFn := func(name string, args ...string) (string, error) {
+	execFn := func(_ context.Context, name string, args ...string) (string, error) {
 		if len(args) >= 2 && args[1] == "restart" {
 			return "", wantErr
 		}
 		return "", nil
 	}
 
-	err := activateLocalClipboardSyncService(execFn)
+	err := activateLocalClipboardSyncService(context.Background(), execFn)
 	if !errors.Is(err, wantErr) {
 		t.Fatalf("expected restart error, got %v", err)
 	}
@@ -2,12 +2,15 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"golang.org/x/crypto/ssh"
 )
@@ -46,13 +49,24 @@ func localOSID() (string, error) {
 	return id, nil
 }
 
-func execLocal(name string, args ...string) (string, error) {
-	cmd := exec.Command(name, args...)
+// localCancelGrace is how long a cancelled local command gets to exit after SIGTERM.
+const localCancelGrace = 5 * time.Second
+
+func execLocal(ctx context.Context, name string, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Cancel = func() error { return cmd.Process.Signal(syscall.SIGTERM) }
+	cmd.WaitDelay = localCancelGrace
 	var buf bytes.Buffer
-	cmd.Stdout = &buf
-	cmd.Stderr = &buf
+	// One writer for both streams, so exec shares a single pipe and keeps their order.
+	w, flush := teeStepOutput(ctx, &buf)
+	cmd.Stdout = w
+	cmd.Stderr = w
 	err := cmd.Run()
+	flush()
 	out := strings.TrimSpace(buf.String())
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return out, fmt.Errorf("%s interrupted: %w", name, ctxErr)
+	}
 	if err != nil {
 		if out == "" {
 			return "", err
@@ -62,8 +76,8 @@ func execLocal(name string, args ...string) (string, error) {
 	return out, nil
 }
 
-func kernelRel() (string, error) {
-	return execLocal("uname", "-r")
+func kernelRel(ctx context.Context) (string, error) {
+	return execLocal(ctx, "uname", "-r")
 }
 
 func kernelPkgBase(krel string) string {
@@ -100,18 +114,18 @@ func manjaroHeadersPkg(kernel string) string {
 	return fmt.Sprintf("linux%d%d-headers", maj, min)
 }
 
-func ensureWireGuardKernelLocal(osid string) error {
+func ensureWireGuardKernelLocal(ctx context.Context, osid string) error {
 	// First try loading the module (or no-op if built-in).
-	if _, err := execLocal("sudo", "-n", "modprobe", "wireguard"); err == nil {
+	if _, err := execLocal(ctx, "sudo", "-n", "modprobe", "wireguard"); err == nil {
 		return nil
 	}
 
-	krel, _ := kernelRel()
+	krel, _ := kernelRel(ctx)
 	pkgbase := kernelPkgBase(krel)
 	var installLog []string
 
 	try := func(name string, args ...string) {
-		out, err := execLocal(name, args...)
+		out, err := execLocal(ctx, name, args...)
 		if err != nil {
 			installLog = append(installLog, fmt.Sprintf("$ %s %s\n%s\nERR: %v", name, strings.Join(args, " "), out, err))
 			return
@@ -142,7 +156,7 @@ func ensureWireGuardKernelLocal(osid string) error {
 		}
 		hdrCandidates = append(hdrCandidates, "linux-headers")
 		for _, h := range hdrCandidates {
-			out, err := execLocal("sudo", "-n", "pacman", "-Sy", "--noconfirm", h)
+			out, err := execLocal(ctx, "sudo", "-n", "pacman", "-Sy", "--noconfirm", h)
 			if err != nil {
 				installLog = append(installLog, fmt.Sprintf("$ sudo -n pacman -Sy --noconfirm %s\n%s\nERR: %v", h, out, err))
 				continue
@@ -166,7 +180,7 @@ func ensureWireGuardKernelLocal(osid string) error {
 		// Explicitly try linuxXX-headers style even if pkgbase probing fails.
 		hdrCandidates = append(hdrCandidates, "linux-headers")
 		for _, h := range hdrCandidates {
-			out, err := execLocal("sudo", "-n", "pacman", "-Sy", "--noconfirm", h)
+			out, err := execLocal(ctx, "sudo", "-n", "pacman", "-Sy", "--noconfirm", h)
 			if err != nil {
 				installLog = append(installLog, fmt.Sprintf("$ sudo -n pacman -Sy --noconfirm %s\n%s\nERR: %v", h, out, err))
 				continue
@@ -182,11 +196,11 @@ func ensureWireGuardKernelLocal(osid string) error {
 		// Unsupported OS handled elsewhere.
 	}
 
-	if _, err := execLocal("sudo", "-n", "depmod", "-a"); err != nil {
+	if _, err := execLocal(ctx, "sudo", "-n", "depmod", "-a"); err != nil {
 		installLog = append(installLog, fmt.Sprintf("$ sudo -n depmod -a\nERR: %v", err))
 	}
 
-	if _, err := execLocal("sudo", "-n", "modprobe", "wireguard"); err != nil {
+	if _, err := execLocal(ctx, "sudo", "-n", "modprobe", "wireguard"); err != nil {
 		details := ""
 		if len(installLog) > 0 {
 			details = "\n\ninstall log:\n" + strings.Join(installLog, "\n\n")
@@ -196,9 +210,9 @@ func ensureWireGuardKernelLocal(osid string) error {
 	return nil
 }
 
-func ensureWireGuardKernelRemote(client *ssh.Client, osid string) error {
+func ensureWireGuardKernelRemote(ctx context.Context, client *ssh.Client, osid string) error {
 	// Remote: best-effort modprobe + dkms/headers fallback.
-	if _, err := runRemoteCommand(client, "sudo -n modprobe wireguard", false, ""); err == nil {
+	if _, err := runRemoteCommand(ctx, client, "sudo -n modprobe wireguard", false, ""); err == nil {
 		return nil
 	}
 
@@ -213,7 +227,7 @@ func ensureWireGuardKernelRemote(client *ssh.Client, osid string) error {
 		script += "sudo -n pacman -Sy --noconfirm dkms wireguard-dkms linux-headers || true\n"
 	}
 	script += "sudo -n modprobe wireguard\n"
-	if _, err := runRemoteCommand(client, script, false, ""); err != nil {
+	if _, err := runRemoteCommand(ctx, client, script, false, ""); err != nil {
 		return fmt.Errorf("wireguard kernel support missing on remote (modprobe wireguard failed): %v", err)
 	}
 	return nil
@@ -0,0 +1,541 @@
+package main
+
+import (
+	"arc/internal/wgconf"
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+const (
+	// arcRelayBinPath is the copy of arc the relay units run, on the server and locally.
+	arcRelayBinPath = "/usr/local/libexec/arc-relay"
+	// arcRelayServerUnit carries the relayed datagrams to the server's WireGuard port.
+	arcRelayServerUnit     = "arc-relay.service"
+	arcRelayServerUnitPath = "/etc/systemd/system/" + arcRelayServerUnit
+	// relayWebSocketPath is where the server accepts relay WebSockets.
+	relayWebSocketPath = "/arc-relay"
+	// relayMaxDatagram bounds one relayed datagram; the TCP framing has a 16-bit length.
+	relayMaxDatagram = 0xffff
+	// relayIdleTimeout drops a relay connection that has carried nothing for three of the
+	// client's keepalives.
+	relayIdleTimeout = 3 * wgKeepalive * time.Second
+	// relayMaxConns bounds the relay connections the server carries at once; each holds a
+	// UDP socket, two goroutines and a datagram buffer.
+	relayMaxConns = 64
+	// relayDefaultStall is how long the client waits for a handshake before it switches
+	// the peer to the other transport.
+	relayDefaultStall = 20 * time.Second
+	// relayCheckInterval is how often the client reads the peer's handshake, as often as
+	// WireGuard retries one.
+	relayCheckInterval = 5 * time.Second
+	// wgSessionRenewal is how old the latest handshake of a working tunnel gets: WireGuard
+	// rekeys after two minutes, on the next packet, which the keepalive sends at the latest.
+	wgSessionRenewal = 120*time.Second + wgKeepalive*time.Second
+)
+
+// datagramConn carries WireGuard datagrams over a stream, one message per datagram.
+type datagramConn interface {
+	ReadDatagram() ([]byte, error)
+	WriteDatagram(b []byte) error
+	SetReadDeadline(t time.Time) error
+	Close() error
+}
+
+// streamDatagrams frames datagrams on a TCP connection with a 16-bit big-endian length.
+type streamDatagrams struct {
+	c net.Conn
+	r *bufio.Reader
+}
+
+func newStreamDatagrams(c net.Conn) *streamDatagrams {
+	return &streamDatagrams{c: c, r: bufio.NewReader(c)}
+}
+
+func (s *streamDatagrams) ReadDatagram() ([]byte, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(s.r, hdr[:]); err != nil {
+		return nil, err
+	}
+	b := make([]byte, binary.BigEndian.Uint16(hdr[:]))
+	if _, err := io.ReadFull(s.r, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (s *streamDatagrams) WriteDatagram(b []byte) error {
+	if len(b) > relayMaxDatagram {
+		return fmt.Errorf("datagram of %d bytes is too large to relay", len(b))
+	}
+	buf := make([]byte, 2+len(b))
+	binary.BigEndian.PutUint16(buf, uint16(len(b)))
+	copy(buf[2:], b)
+	_, err := s.c.Write(buf)
+	return err
+}
+
+func (s *streamDatagrams) SetReadDeadline(t time.Time) error { return s.c.SetReadDeadline(t) }
+
+func (s *streamDatagrams) Close() error { return s.c.Close() }
+
+// wsDatagrams sends each datagram as one binary WebSocket message.
+type wsDatagrams struct {
+	ws *websocket.Conn
+}
+
+func (w wsDatagrams) ReadDatagram() ([]byte, error) {
+	var b []byte
+	err := websocket.Message.Receive(w.ws, &b)
+	return b, err
+}
+
+func (w wsDatagrams) WriteDatagram(b []byte) error { return websocket.Message.Send(w.ws, b) }
+
+func (w wsDatagrams) SetReadDeadline(t time.Time) error { return w.ws.SetReadDeadline(t) }
+
+func (w wsDatagrams) Close() error { return w.ws.Close() }
+
+// serveRelay accepts relay connections on ln until ctx is done, and hands each one's
+// datagrams to the WireGuard socket at wgAddr. Connections beyond relayMaxConns are closed
+// at once.
+func serveRelay(ctx context.Context, ln net.Listener, webSocket bool, wgAddr string, logf func(string, ...any)) error {
+	go func() {
+		<-ctx.Done()
+		_ = ln.Close()
+	}()
+	slots := make(chan struct{}, relayMaxConns)
+	acquire := func() bool {
+		select {
+		case slots <- struct{}{}:
+			return true
+		default:
+			return false
+		}
+	}
+	if webSocket {
+		mux := http.NewServeMux()
+		// websocket.Server without a Handshake accepts any Origin; the relay carries
+		// WireGuard packets, which authenticate themselves.
+		mux.Handle(relayWebSocketPath, websocket.Server{Handler: func(ws *websocket.Conn) {
+			if !acquire() {
+				logf("relay from %s: refused, %d connections open", ws.Request().RemoteAddr, relayMaxConns)
+				return
+			}
+			defer func() { <-slots }()
+			ws.PayloadType = websocket.BinaryFrame
+			if err := relayToWireGuard(wsDatagrams{ws: ws}, wgAddr, relayIdleTimeout); err != nil {
+				logf("relay from %s: %v", ws.Request().RemoteAddr, err)
+			}
+		}})
+		srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+		if err := srv.Serve(ln); err != nil && ctx.Err() == nil {
+			return err
+		}
+		return nil
+	}
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		if !acquire() {
+			logf("relay from %s: refused, %d connections open", c.RemoteAddr(), relayMaxConns)
+			_ = c.Close()
+			continue
+		}
+		go func() {
+			defer func() { <-slots }()
+			if err := relayToWireGuard(newStreamDatagrams(c), wgAddr, relayIdleTimeout); err != nil {
+				logf("relay from %s: %v", c.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+// relayToWireGuard exchanges c's datagrams with the WireGuard socket at wgAddr, from a UDP
+// socket of its own, until either side fails or c sends nothing for idle. WireGuard sees the
+// peer at that socket and answers there.
+func relayToWireGuard(c datagramConn, wgAddr string, idle time.Duration) error {
+	defer c.Close()
+	udp, err := net.Dial("udp", wgAddr)
+	if err != nil {
+		return err
+	}
+	defer udp.Close()
+	done := make(chan struct{}, 2)
+	go func() {
+		defer func() { done <- struct{}{} }()
+		buf := make([]byte, relayMaxDatagram)
+		for {
+			n, err := udp.Read(buf)
+			if err != nil || c.WriteDatagram(buf[:n]) != nil {
+				return
+			}
+		}
+	}()
+	go func() {
+		defer func() { done <- struct{}{} }()
+		for {
+			if err := c.SetReadDeadline(time.Now().Add(idle)); err != nil {
+				return
+			}
+			b, err := c.ReadDatagram()
+			if err != nil {
+				return
+			}
+			if _, err := udp.Write(b); err != nil {
+				return
+			}
+		}
+	}()
+	<-done
+	return nil
+}
+
+// relayDialer connects to the relay server at server, a host:port.
+func relayDialer(server string, webSocket bool) func(context.Context) (datagramConn, error) {
+	if webSocket {
+		return func(ctx context.Context) (datagramConn, error) {
+			cfg, err := websocket.NewConfig("ws://"+server+relayWebSocketPath, "http://"+server)
+			if err != nil {
+				return nil, err
+			}
+			ws, err := cfg.DialContext(ctx)
+			if err != nil {
+				return nil, err
+			}
+			ws.PayloadType = websocket.BinaryFrame
+			return wsDatagrams{ws: ws}, nil
+		}
+	}
+	return func(ctx context.Context) (datagramConn, error) {
+		var d net.Dialer
+		c, err := d.DialContext(ctx, "tcp", server)
+		if err != nil {
+			return nil, err
+		}
+		return newStreamDatagrams(c), nil
+	}
+}
+
+// relayClient is the local end of the relay: a UDP socket the WireGuard peer can use as its
+// endpoint, whose datagrams go to the relay server over one connection, dialed on the first
+// datagram and again after it breaks.
+type relayClient struct {
+	pc   net.PacketConn
+	dial func(context.Context) (datagramConn, error)
+	logf func(string, ...any)
+
+	mu      sync.Mutex
+	conn    datagramConn
+	peer    net.Addr // the local WireGuard socket
+	lastErr string
+}
+
+// run relays until ctx is done or the local socket fails.
+func (r *relayClient) run(ctx context.Context) error {
+	go func() {
+		<-ctx.Done()
+		_ = r.pc.Close()
+		r.mu.Lock()
+		if r.conn != nil {
+			_ = r.conn.Close()
+		}
+		r.mu.Unlock()
+	}()
+	buf := make([]byte, relayMaxDatagram)
+	for {
+		n, from, err := r.pc.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		r.mu.Lock()
+		r.peer = from
+		r.mu.Unlock()
+		c, err := r.connect(ctx)
+		if err != nil {
+			continue
+		}
+		if err := c.WriteDatagram(buf[:n]); err != nil {
+			r.drop(c)
+		}
+	}
+}
+
+func (r *relayClient) connect(ctx context.Context) (datagramConn, error) {
+	r.mu.Lock()
+	c := r.conn
+	r.mu.Unlock()
+	if c != nil {
+		return c, nil
+	}
+	dialCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	c, err := r.dial(dialCtx)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// Log when the relay goes away or comes back, not for every datagram in between.
+	if err != nil {
+		if msg := err.Error(); msg != r.lastErr {
+			r.logf("connect to the relay: %v", err)
+			r.lastErr = msg
+		}
+		return nil, err
+	}
+	if r.lastErr != "" {
+		r.logf("connected to the relay")
+		r.lastErr = ""
+	}
+	r.conn = c
+	go r.receive(c)
+	return c, nil
+}
+
+func (r *relayClient) receive(c datagramConn) {
+	for {
+		b, err := c.ReadDatagram()
+		if err != nil {
+			r.drop(c)
+			return
+		}
+		r.mu.Lock()
+		peer := r.peer
+		r.mu.Unlock()
+		if peer != nil {
+			_, _ = r.pc.WriteTo(b, peer)
+		}
+	}
+}
+
+func (r *relayClient) drop(c datagramConn) {
+	r.mu.Lock()
+	if r.conn == c {
+		r.conn = nil
+	}
+	r.mu.Unlock()
+	_ = c.Close()
+}
+
+// relayStalled reports whether a peer whose endpoint was set at since, and whose latest
+// handshake was at handshake (zero for none yet), has stopped handshaking for longer than
+// stall: a new endpoint gets stall for its first handshake, a working one stall beyond its
+// usual renewal.
+func relayStalled(now, since, handshake time.Time, stall time.Duration) bool {
+	if !handshake.IsZero() {
+		return now.Sub(handshake) > wgSessionRenewal+stall
+	}
+	return now.Sub(since) > stall
+}
+
+// relayWatchdog moves the server peer of iface between its direct endpoint and the relay
+// whenever the tunnel stalls on the one it uses.
+type relayWatchdog struct {
+	iface string
+	// loadPeer reads the server peer from the interface's config on every check, so keys
+	// rotated since the watchdog started are used.
+	loadPeer func() (wgconf.Peer, error)
+	relay    string // the relayClient's local address
+	stall    time.Duration
+	wg       func(ctx context.Context, stdin string, args ...string) (string, error)
+	logf     func(string, ...any)
+	now      func() time.Time
+	since    time.Time
+	seenEP   string
+}
+
+// check reads the peer's endpoint and handshake, and switches the endpoint when the tunnel
+// has stalled on it. An endpoint changed by someone else, such as wg-quick restarting the
+// interface, starts its wait anew.
+func (w *relayWatchdog) check(ctx context.Context) error {
+	peer, err := w.loadPeer()
+	if err != nil {
+		return err
+	}
+	endpoints, err := w.wg(ctx, "", "show", w.iface, "endpoints")
+	if err != nil {
+		return err
+	}
+	handshakes, err := w.wg(ctx, "", "show", w.iface, "latest-handshakes")
+	if err != nil {
+		return err
+	}
+	endpoint := wgShowValue(endpoints, peer.PublicKey)
+	now := w.now()
+	if endpoint != w.seenEP {
+		w.since, w.seenEP = now, endpoint
+	}
+	var handshake time.Time
+	if secs, err := strconv.ParseInt(wgShowValue(handshakes, peer.PublicKey), 10, 64); err == nil && secs > 0 {
+		handshake = time.Unix(secs, 0)
+	}
+	if !relayStalled(now, w.since, handshake, w.stall) {
+		return nil
+	}
+	target, via := w.relay, "the relay"
+	if endpoint == w.relay {
+		target, via = peer.Endpoint, "UDP"
+	}
+	w.logf("no handshake with the server over %s for %s; switching to %s", orNone(endpoint), w.stall, via)
+	if err := w.setEndpoint(ctx, peer, target); err != nil {
+		return err
+	}
+	w.since, w.seenEP = now, target
+	return nil
+}
+
+// setEndpoint replaces the peer with itself at endpoint. Re-adding it drops the old session,
+// so the keepalive WireGuard sends for a new peer starts a handshake right away and the
+// new endpoint is judged by its own handshake.
+func (w *relayWatchdog) setEndpoint(ctx context.Context, peer wgconf.Peer, endpoint string) error {
+	if _, err := w.wg(ctx, "", "set", w.iface, "peer", peer.PublicKey, "remove"); err != nil {
+		return err
+	}
+	keepalive := peer.PersistentKeepalive
+	if keepalive == 0 {
+		keepalive = wgKeepalive
+	}
+	args := []string{"set", w.iface, "peer", peer.PublicKey,
+		"endpoint", endpoint,
+		"allowed-ips", strings.Join(peer.AllowedIPs, ","),
+		"persistent-keepalive", strconv.Itoa(keepalive)}
+	stdin := ""
+	if peer.PresharedKey != "" {
+		args = append(args, "preshared-key", "/dev/stdin")
+		stdin = peer.PresharedKey + "\n"
+	}
+	_, err := w.wg(ctx, stdin, args...)
+	return err
+}
+
+// run checks every relayCheckInterval until ctx is done.
+func (w *relayWatchdog) run(ctx context.Context) {
+	w.since = w.now()
+	t := time.NewTicker(relayCheckInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if err := w.check(ctx); err != nil && ctx.Err() == nil {
+				w.logf("%v", err)
+			}
+		}
+	}
+}
+
+// wgShowValue is the value of peer pub in `wg show IFACE <field>` output.
+func wgShowValue(out, pub string) string {
+	for _, ln := range strings.Split(out, "\n") {
+		if fields := strings.Fields(ln); len(fields) == 2 && fields[0] == pub {
+			return fields[1]
+		}
+	}
+	return ""
+}
+
+func orNone(s string) string {
+	if s == "" || s == "(none)" {
+		return "no endpoint"
+	}
+	return s
+}
+
+// runWG runs the wg tool with stdin.
+func runWG(ctx context.Context, stdin string, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, "wg", args...)
+	cmd.Stdin = strings.NewReader(stdin)
+	var out bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &out, &out
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("wg %s: %w (%s)", strings.Join(args, " "), err, strings.TrimSpace(out.String()))
+	}
+	return out.String(), nil
+}
+
+// relayServerPeer is the peer of a client config that the relay stands in for: the one
+// with an endpoint.
+func relayServerPeer(conf *wgconf.Config) (wgconf.Peer, error) {
+	for _, p := range conf.Peers {
+		if p.Endpoint != "" {
+			return p, nil
+		}
+	}
+	return wgconf.Peer{}, errors.New("no peer with an Endpoint to relay")
+}
+
+// relayServerAddr is where this machine reaches the relay: the WireGuard endpoint's host at
+// the relay port.
+func relayServerAddr(wg wgConfig) (string, error) {
+	host, _, err := net.SplitHostPort(wg.Endpoint)
+	if err != nil {
+		return "", fmt.Errorf("WireGuard endpoint %q: %w", wg.Endpoint, err)
+	}
+	return net.JoinHostPort(host, strconv.Itoa(wg.Net.RelayPort())), nil
+}
+
+// localRelayUnit keeps `arc relay connect` up for n's interface.
+func localRelayUnit(n wgNetwork) string {
+	return "arc-relay-" + n.Interface + ".service"
+}
+
+func localRelayUnitPath(n wgNetwork) string {
+	return "/etc/systemd/system/" + localRelayUnit(n)
+}
+
+func renderServerRelayUnit(n wgNetwork) (string, error) {
+	return renderTemplateFile("templates/arc_relay.service.tmpl", map[string]string{
+		"Bin":       arcRelayBinPath,
+		"Port":      strconv.Itoa(n.RelayPort()),
+		"WebSocket": boolFlag(n.RelayWebSocket()),
+		"WGPort":    strconv.Itoa(n.Port),
+		"WGUnit":    n.QuickUnit() + ".service",
+	})
+}
+
+func renderLocalRelayUnit(wg wgConfig) (string, error) {
+	server, err := relayServerAddr(wg)
+	if err != nil {
+		return "", err
+	}
+	n := wg.Net
+	wgUnit := n.LocalUnit()
+	if !strings.HasSuffix(wgUnit, ".service") {
+		wgUnit += ".service"
+	}
+	return renderTemplateFile("templates/arc_relay_client.service.tmpl", map[string]string{
+		"Bin":       arcRelayBinPath,
+		"Server":    server,
+		"WebSocket": boolFlag(n.RelayWebSocket()),
+		"Interface": n.Interface,
+		"WGUnit":    wgUnit,
+	})
+}
+
+// boolFlag is a template value that is true when non-empty.
+func boolFlag(b bool) string {
+	if b {
+		return "yes"
+	}
+	return ""
+}
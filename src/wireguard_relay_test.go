@@ -0,0 +1,254 @@
+package main
+
+import (
+	"arc/internal/wgconf"
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStreamDatagrams_RoundTrip(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	sa, sb := newStreamDatagrams(a), newStreamDatagrams(b)
+	go func() {
+		for _, msg := range []string{"handshake", "", strings.Repeat("x", 1500)} {
+			if err := sa.WriteDatagram([]byte(msg)); err != nil {
+				return
+			}
+		}
+	}()
+	for _, want := range []string{"handshake", "", strings.Repeat("x", 1500)} {
+		got, err := sb.ReadDatagram()
+		if err != nil {
+			t.Fatalf("ReadDatagram: %v", err)
+		}
+		if string(got) != want {
+			t.Fatalf("got %d bytes, want %d", len(got), len(want))
+		}
+	}
+	if err := sa.WriteDatagram(make([]byte, relayMaxDatagram+1)); err == nil {
+		t.Fatalf("expected an oversized datagram to be rejected")
+	}
+}
+
+func TestRelay_CarriesDatagramsToWireGuard(t *testing.T) {
+	for _, webSocket := range []bool{false, true} {
+		// A stand-in for the server's WireGuard socket that answers every datagram.
+		wg, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("listen udp: %v", err)
+		}
+		defer wg.Close()
+		go func() {
+			buf := make([]byte, 2048)
+			for {
+				n, from, err := wg.ReadFrom(buf)
+				if err != nil {
+					return
+				}
+				_, _ = wg.WriteTo(append([]byte("re:"), buf[:n]...), from)
+			}
+		}()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("listen tcp: %v", err)
+		}
+		go func() { _ = serveRelay(ctx, ln, webSocket, wg.LocalAddr().String(), t.Logf) }()
+
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("listen udp: %v", err)
+		}
+		client := &relayClient{pc: pc, dial: relayDialer(ln.Addr().String(), webSocket), logf: t.Logf}
+		go func() { _ = client.run(ctx) }()
+
+		// The local WireGuard socket.
+		local, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("listen udp: %v", err)
+		}
+		defer local.Close()
+		_ = local.SetDeadline(time.Now().Add(5 * time.Second))
+		for _, msg := range []string{"initiation", "keepalive"} {
+			if _, err := local.WriteTo([]byte(msg), pc.LocalAddr()); err != nil {
+				t.Fatalf("write: %v", err)
+			}
+			buf := make([]byte, 2048)
+			n, _, err := local.ReadFrom(buf)
+			if err != nil {
+				t.Fatalf("websocket=%v: no answer through the relay: %v", webSocket, err)
+			}
+			if got := string(buf[:n]); got != "re:"+msg {
+				t.Fatalf("websocket=%v: got %q", webSocket, got)
+			}
+		}
+		cancel()
+	}
+}
+
+func TestRelayToWireGuard_DropsIdleConnection(t *testing.T) {
+	wg, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen udp: %v", err)
+	}
+	defer wg.Close()
+	a, b := net.Pipe()
+	defer b.Close()
+	done := make(chan error, 1)
+	go func() { done <- relayToWireGuard(newStreamDatagrams(a), wg.LocalAddr().String(), 200*time.Millisecond) }()
+
+	// A datagram keeps the connection open past the first deadline.
+	time.Sleep(100 * time.Millisecond)
+	if err := newStreamDatagrams(b).WriteDatagram([]byte("keepalive")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	select {
+	case <-done:
+		t.Fatalf("the relay dropped a connection that just carried a datagram")
+	case <-time.After(150 * time.Millisecond):
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the relay kept an idle connection open")
+	}
+}
+
+func TestRelayStalled(t *testing.T) {
+	start := time.Unix(1_700_000_000, 0)
+	stall := 20 * time.Second
+	for _, tc := range []struct {
+		name      string
+		now       time.Time
+		handshake time.Time
+		want      bool
+	}{
+		{"new endpoint, waiting", start.Add(15 * time.Second), time.Time{}, false},
+		{"new endpoint, no handshake", start.Add(21 * time.Second), time.Time{}, true},
+		{"session being renewed", start.Add(10 * time.Minute), start.Add(10*time.Minute - wgSessionRenewal), false},
+		{"renewal overdue", start.Add(10 * time.Minute), start.Add(10*time.Minute - wgSessionRenewal - stall - time.Second), true},
+	} {
+		if got := relayStalled(tc.now, start, tc.handshake, stall); got != tc.want {
+			t.Fatalf("%s: got %v want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestRelayWatchdog_SwitchesBetweenTransports(t *testing.T) {
+	const pub = "c2VydmVyLXB1YmxpYy1rZXktZm9yLXRlc3RzLi4uLi4="
+	endpoint := "203.0.113.7:51820"
+	var calls []string
+	var stdins []string
+	now := time.Unix(1_700_000_000, 0)
+	w := &relayWatchdog{
+		iface: "wg0",
+		loadPeer: func() (wgconf.Peer, error) {
+			return wgconf.Peer{
+				PublicKey:    pub,
+				PresharedKey: "cHNr",
+				Endpoint:     "vps.example.com:51820",
+				AllowedIPs:   []string{"10.0.0.1/32", "fd00::1/128"},
+			}, nil
+		},
+		relay: "127.0.0.1:40000",
+		stall: 20 * time.Second,
+		wg: func(_ context.Context, stdin string, args ...string) (string, error) {
+			switch strings.Join(args, " ") {
+			case "show wg0 endpoints":
+				return pub + "\t" + endpoint + "\n", nil
+			case "show wg0 latest-handshakes":
+				return pub + "\t0\n", nil
+			}
+			calls = append(calls, strings.Join(args, " "))
+			stdins = append(stdins, stdin)
+			if len(args) > 5 && args[4] == "endpoint" {
+				endpoint = args[5]
+			}
+			return "", nil
+		},
+		logf: t.Logf,
+		now:  func() time.Time { return now },
+	}
+	w.since = now
+	check := func() {
+		t.Helper()
+		if err := w.check(context.Background()); err != nil {
+			t.Fatalf("check: %v", err)
+		}
+	}
+
+	check()
+	now = now.Add(10 * time.Second)
+	check()
+	if len(calls) != 0 {
+		t.Fatalf("switched before the stall timeout: %v", calls)
+	}
+
+	now = now.Add(15 * time.Second)
+	check()
+	want := []string{
+		"set wg0 peer " + pub + " remove",
+		"set wg0 peer " + pub + " endpoint 127.0.0.1:40000 allowed-ips 10.0.0.1/32,fd00::1/128 persistent-keepalive 25 preshared-key /dev/stdin",
+	}
+	if strings.Join(calls, "\n") != strings.Join(want, "\n") || stdins[1] != "cHNr\n" {
+		t.Fatalf("unexpected switch to the relay:\n%s\nstdin %q", strings.Join(calls, "\n"), stdins)
+	}
+
+	// The relay gets its own stall timeout before the watchdog goes back to UDP.
+	calls = nil
+	now = now.Add(10 * time.Second)
+	check()
+	if len(calls) != 0 {
+		t.Fatalf("left the relay too early: %v", calls)
+	}
+	now = now.Add(15 * time.Second)
+	check()
+	if len(calls) != 2 || !strings.Contains(calls[1], "endpoint vps.example.com:51820 ") {
+		t.Fatalf("expected a switch back to the direct endpoint, got %v", calls)
+	}
+}
+
+func TestWGShowValue(t *testing.T) {
+	out := "AAA=\t203.0.113.7:51820\nBBB=\t(none)\n"
+	if got := wgShowValue(out, "AAA="); got != "203.0.113.7:51820" {
+		t.Fatalf("got %q", got)
+	}
+	if got := wgShowValue(out, "CCC="); got != "" {
+		t.Fatalf("unknown peer: got %q", got)
+	}
+}
+
+func TestGoarchOfUname(t *testing.T) {
+	for machine, want := range map[string]string{"x86_64\n": "amd64", "aarch64": "arm64", "armv7l": "arm", "riscv64": "riscv64"} {
+		if got := goarchOfUname(machine); got != want {
+			t.Fatalf("goarchOfUname(%q) = %q, want %q", machine, got, want)
+		}
+	}
+}
+
+func TestRenderRelayUnits(t *testing.T) {
+	wg := wgConfig{Endpoint: "[2001:db8::7]:51820", Net: defaultWGNetwork()}
+	wg.Net.Relay = "ws:8443"
+	server, err := renderServerRelayUnit(wg.Net)
+	if err != nil {
+		t.Fatalf("renderServerRelayUnit: %v", err)
+	}
+	if !strings.Contains(server, "ExecStart="+arcRelayBinPath+" relay serve --listen :8443 --websocket --wg-port 51820\n") {
+		t.Fatalf("unexpected server unit:\n%s", server)
+	}
+	local, err := renderLocalRelayUnit(wg)
+	if err != nil {
+		t.Fatalf("renderLocalRelayUnit: %v", err)
+	}
+	if !strings.Contains(local, "ExecStart="+arcRelayBinPath+" relay connect --server [2001:db8::7]:8443 --websocket wg0\n") ||
+		!strings.Contains(local, "After=network-online.target wg-quick@wg0.service\n") {
+		t.Fatalf("unexpected local unit:\n%s", local)
+	}
+}
@@ -1,9 +1,12 @@
 package main
 
 import (
+	"arc/internal/wgconf"
+	"context"
 	"encoding/base64"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestGenWGKeyPair_Base64AndLength(t *testing.T) {
@@ -28,7 +31,7 @@ func TestGenWGKeyPair_Base64AndLength(t *testing.T) {
 }
 
 func TestBuildWGConfig_RendersExpectedFields(t *testing.T) {
-	wg, err := buildWGConfig("example.com")
+	wg, err := buildWGConfig("example.com", defaultWGNetwork())
 	if err != nil {
 		t.Fatalf("buildWGConfig: %v", err)
 	}
@@ -47,7 +50,7 @@ func TestBuildWGConfig_RendersExpectedFields(t *testing.T) {
 	if !strings.Contains(wg.ServerConf, "AllowedIPs = "+wgMobileIP+"/32") {
 		t.Fatalf("server conf missing mobile peer")
 	}
-	if !strings.Contains(wg.ClientConf, "Address = "+wgDesktopCIDR) {
+	if !strings.Contains(wg.ClientConf, "Address = "+defaultWGNetwork().DesktopCIDR()) {
 		t.Fatalf("desktop client conf missing desktop address")
 	}
 	if !strings.Contains(wg.ClientConf, "Endpoint = example.com:51820") {
@@ -56,12 +59,276 @@ func TestBuildWGConfig_RendersExpectedFields(t *testing.T) {
 	if !strings.Contains(wg.ClientConf, "AllowedIPs = "+wgServerIP+"/32") {
 		t.Fatalf("client conf missing AllowedIPs")
 	}
-	if !strings.Contains(wg.MobileClientConf, "Address = "+wgMobileCIDR) {
+	if !strings.Contains(wg.MobileClientConf, "Address = "+defaultWGNetwork().MobileCIDR()) {
 		t.Fatalf("mobile client conf missing mobile address")
 	}
 	if !strings.Contains(wg.MobileClientConf, "Endpoint = example.com:51820") {
 		t.Fatalf("mobile client conf missing endpoint")
 	}
+	for name, raw := range map[string]string{"server": wg.ServerConf, "client": wg.ClientConf, "mobile": wg.MobileClientConf} {
+		c, err := wgconf.Parse(raw)
+		if err != nil {
+			t.Fatalf("%s conf does not parse: %v", name, err)
+		}
+		if err := c.Validate(); err != nil {
+			t.Fatalf("%s conf is invalid: %v", name, err)
+		}
+		if c.String() != raw {
+			t.Fatalf("%s conf does not round-trip:\n%s", name, raw)
+		}
+	}
+}
+
+func TestBuildWGConfig_PresharedKeyPerPeer(t *testing.T) {
+	wg, err := buildWGConfig("example.com", defaultWGNetwork())
+	if err != nil {
+		t.Fatalf("buildWGConfig: %v", err)
+	}
+	server, _ := wgconf.Parse(wg.ServerConf)
+	client, _ := wgconf.Parse(wg.ClientConf)
+	mobile, _ := wgconf.Parse(wg.MobileClientConf)
+	desktopPSK := server.Peers[server.PeerRouting(defaultWGNetwork().DesktopCIDR())].PresharedKey
+	mobilePSK := server.Peers[server.PeerRouting(defaultWGNetwork().MobileCIDR())].PresharedKey
+	if desktopPSK == "" || mobilePSK == "" || desktopPSK == mobilePSK {
+		t.Fatalf("expected a distinct preshared key per peer:\n%s", wg.ServerConf)
+	}
+	if raw, err := base64.StdEncoding.DecodeString(desktopPSK); err != nil || len(raw) != 32 {
+		t.Fatalf("preshared key is not 32 bytes of base64: %q", desktopPSK)
+	}
+	if client.Peers[0].PresharedKey != desktopPSK || mobile.Peers[0].PresharedKey != mobilePSK {
+		t.Fatalf("client configs do not match their server peer")
+	}
+	t.Setenv("HOME", t.TempDir())
+	payload, err := buildMobilePayload("example.com", wg)
+	if err != nil {
+		t.Fatalf("buildMobilePayload: %v", err)
+	}
+	if !strings.Contains(payload, mobilePSK) {
+		t.Fatalf("mobile payload is missing the mobile preshared key")
+	}
+}
+
+func TestComputeWGPeerSync_SharesPresharedKey(t *testing.T) {
+	wg, err := buildWGConfig("example.com", defaultWGNetwork())
+	if err != nil {
+		t.Fatalf("buildWGConfig: %v", err)
+	}
+	plan, err := computeWGPeerSync(wg.ClientConf, wg.ServerConf, wg.Endpoint, wg.Net)
+	if err != nil {
+		t.Fatalf("computeWGPeerSync: %v", err)
+	}
+	if plan.changed() {
+		t.Fatalf("a fresh setup should need no sync")
+	}
+
+	// A link set up before preshared keys gets one on both sides.
+	strip := func(raw string) string {
+		c, _ := wgconf.Parse(raw)
+		for i := range c.Peers {
+			c.Peers[i].PresharedKey = ""
+		}
+		return c.String()
+	}
+	plan, err = computeWGPeerSync(strip(wg.ClientConf), strip(wg.ServerConf), wg.Endpoint, wg.Net)
+	if err != nil {
+		t.Fatalf("computeWGPeerSync: %v", err)
+	}
+	local, _ := wgconf.Parse(plan.LocalConf)
+	remote, _ := wgconf.Parse(plan.RemoteConf)
+	psk := local.Peers[0].PresharedKey
+	if !plan.LocalChanged || !plan.RemoteChanged || psk == "" || remote.Peers[remote.PeerRouting(defaultWGNetwork().DesktopCIDR())].PresharedKey != psk {
+		t.Fatalf("expected a shared preshared key on both sides:\n%s\n%s", plan.LocalConf, plan.RemoteConf)
+	}
+	if remote.Peers[remote.PeerRouting(defaultWGNetwork().MobileCIDR())].PresharedKey != "" {
+		t.Fatalf("sync must not touch the mobile peer")
+	}
+	if diag := wgPSKDiag(remote); !strings.Contains(diag, "MISSING for 1 of 2 peers ("+defaultWGNetwork().MobileCIDR()+")") {
+		t.Fatalf("unexpected diag %q", diag)
+	}
+	if diag := wgPSKDiag(local); diag != "preshared keys: present for all 1 peers" {
+		t.Fatalf("unexpected diag %q", diag)
+	}
+}
+
+func TestBuildWGConfig_Rendezvous(t *testing.T) {
+	wg, err := buildWGConfig("home.lan", wgNetwork{Rendezvous: "desk.example.net"})
+	if err != nil {
+		t.Fatalf("buildWGConfig: %v", err)
+	}
+	server, _ := wgconf.Parse(wg.ServerConf)
+	client, _ := wgconf.Parse(wg.ClientConf)
+	if server.Interface.ListenPort != 0 || len(server.Peers) != 1 {
+		t.Fatalf("the server should dial its only peer from any port:\n%s", wg.ServerConf)
+	}
+	if p := server.Peers[0]; p.Endpoint != "desk.example.net:51820" || p.PersistentKeepalive != wgKeepalive || p.AllowedIPs[0] != defaultWGNetwork().DesktopCIDR() {
+		t.Fatalf("unexpected server peer %+v", p)
+	}
+	if client.Interface.ListenPort != wgPort || client.Peers[0].Endpoint != "" || client.Peers[0].PersistentKeepalive != 0 {
+		t.Fatalf("the desktop should listen for the server:\n%s", wg.ClientConf)
+	}
+	if wg.MobileClientConf != "" || wg.MobileClientPriv != "" {
+		t.Fatalf("a server behind NAT has no mobile peer")
+	}
+	if _, err := buildMobilePayload("home.lan", wg); err == nil {
+		t.Fatalf("expected mobile pairing to be refused")
+	}
+
+	plan, err := computeWGPeerSync(wg.ClientConf, wg.ServerConf, wg.Endpoint, wg.Net)
+	if err != nil || plan.changed() {
+		t.Fatalf("a fresh setup should need no sync, got %+v, %v", plan, err)
+	}
+	// A desktop that had dialed the server gets the rendezvous roles back.
+	client.Interface.ListenPort = 0
+	client.Peers[0].Endpoint = wg.Endpoint
+	server.Peers[0].Endpoint = ""
+	plan, err = computeWGPeerSync(client.String(), server.String(), wg.Endpoint, wg.Net)
+	if err != nil {
+		t.Fatalf("computeWGPeerSync: %v", err)
+	}
+	local, _ := wgconf.Parse(plan.LocalConf)
+	remote, _ := wgconf.Parse(plan.RemoteConf)
+	if !plan.RemoteChanged || remote.Peers[0].Endpoint != "desk.example.net:51820" || !plan.LocalChanged || local.Interface.ListenPort != wgPort {
+		t.Fatalf("unexpected sync:\n%s\n%s", plan.LocalConf, plan.RemoteConf)
+	}
+}
+
+func TestBuildWGConfig_CustomNetwork(t *testing.T) {
+	wg, err := buildWGConfig("example.com", wgNetwork{Interface: "wg-arc", Port: 51821, Subnet: "10.8.0.0/24", MobileIP: "10.8.0.20"})
+	if err != nil {
+		t.Fatalf("buildWGConfig: %v", err)
+	}
+	if wg.Endpoint != "example.com:51821" {
+		t.Fatalf("unexpected endpoint: %q", wg.Endpoint)
+	}
+	for _, want := range []string{"Address = 10.8.0.1/32", "ListenPort = 51821", "AllowedIPs = 10.8.0.2/32", "AllowedIPs = 10.8.0.20/32"} {
+		if !strings.Contains(wg.ServerConf, want) {
+			t.Fatalf("server conf missing %q:\n%s", want, wg.ServerConf)
+		}
+	}
+	if !strings.Contains(wg.MobileClientConf, "Address = 10.8.0.20/32") {
+		t.Fatalf("mobile client conf missing mobile address:\n%s", wg.MobileClientConf)
+	}
+	if wg.Net.ConfPath() != "/etc/wireguard/wg-arc.conf" || wg.Net.QuickUnit() != "wg-quick@wg-arc" {
+		t.Fatalf("unexpected interface paths: %s %s", wg.Net.ConfPath(), wg.Net.QuickUnit())
+	}
+}
+
+func TestBuildWGConfig_DualStack(t *testing.T) {
+	wg, err := buildWGConfig("[2001:db8::7]", wgNetwork{Subnet6: "fd12:3456:789a::5/64"})
+	if err != nil {
+		t.Fatalf("buildWGConfig: %v", err)
+	}
+	if wg.Endpoint != "[2001:db8::7]:51820" || wg.Net.Subnet6 != "fd12:3456:789a::/64" {
+		t.Fatalf("unexpected endpoint or IPv6 subnet: %q %q", wg.Endpoint, wg.Net.Subnet6)
+	}
+	for _, want := range []string{
+		"Address = 10.0.0.1/32, fd12:3456:789a::1/128",
+		"AllowedIPs = 10.0.0.2/32, fd12:3456:789a::2/128",
+		"AllowedIPs = 10.0.0.3/32, fd12:3456:789a::3/128",
+	} {
+		if !strings.Contains(wg.ServerConf, want) {
+			t.Fatalf("server conf missing %q:\n%s", want, wg.ServerConf)
+		}
+	}
+	for _, want := range []string{
+		"Address = 10.0.0.2/32, fd12:3456:789a::2/128",
+		"AllowedIPs = 10.0.0.1/32, fd12:3456:789a::1/128",
+		"Endpoint = [2001:db8::7]:51820",
+	} {
+		if !strings.Contains(wg.ClientConf, want) {
+			t.Fatalf("client conf missing %q:\n%s", want, wg.ClientConf)
+		}
+	}
+	if got := wgEndpoint("2001:db8::7", 51820); got != "[2001:db8::7]:51820" {
+		t.Fatalf("bare IPv6 host not bracketed: %q", got)
+	}
+	if got := defaultWGNetwork().CIDRs(wgDesktopIP); len(got) != 1 {
+		t.Fatalf("an IPv4-only tunnel should have no IPv6 addresses: %v", got)
+	}
+}
+
+func TestResolveWGNetwork(t *testing.T) {
+	n, err := resolveWGNetwork(wgNetwork{})
+	if err != nil {
+		t.Fatalf("resolve defaults: %v", err)
+	}
+	if n != defaultWGNetwork() {
+		t.Fatalf("empty settings should resolve to the defaults, got %+v", n)
+	}
+
+	n, err = resolveWGNetwork(wgNetwork{Subnet: "172.16.5.9/28"})
+	if err != nil {
+		t.Fatalf("resolve custom subnet: %v", err)
+	}
+	if n.Subnet != "172.16.5.0/28" || n.ServerIP != "172.16.5.1" || n.DesktopIP != "172.16.5.2" || n.MobileIP != "172.16.5.3" {
+		t.Fatalf("unexpected derived addresses: %+v", n)
+	}
+
+	n, err = resolveWGNetwork(wgNetwork{Subnet6: wgSubnet6Auto})
+	if err != nil {
+		t.Fatalf("resolve auto IPv6 subnet: %v", err)
+	}
+	if !strings.HasPrefix(n.Subnet6, "fd") || !strings.HasSuffix(n.Subnet6, "::/64") || n.IP6(n.MobileIP) == "" {
+		t.Fatalf("unexpected generated IPv6 subnet: %q", n.Subnet6)
+	}
+
+	n, err = resolveWGNetwork(wgNetwork{Mode: wgModeKernel})
+	if err != nil || n.Mode != "" || n.LocalUnit() != "wg-quick@wg0" || n.LocalServerIP() != "10.0.0.1" {
+		t.Fatalf("kernel mode should resolve to the default, got %+v, %v", n, err)
+	}
+	n, err = resolveWGNetwork(wgNetwork{Mode: wgModeUserspace})
+	if err != nil {
+		t.Fatalf("resolve userspace mode: %v", err)
+	}
+	if n.LocalUnit() != "arc-wg-userspace-wg0.service" || n.LocalServerIP() != userspaceWGForwardIP || n.TunnelSSHAddr("vps:2222") != userspaceWGForwardIP+":2222" {
+		t.Fatalf("unexpected userspace endpoints: %q %q %q", n.LocalUnit(), n.LocalServerIP(), n.TunnelSSHAddr("vps:2222"))
+	}
+
+	for raw, want := range map[string]string{"tcp": "tcp:443", "ws": "ws:443", " ws:8443 ": "ws:8443"} {
+		n, err = resolveWGNetwork(wgNetwork{Relay: raw})
+		if err != nil || n.Relay != want {
+			t.Fatalf("relay %q: got %q, %v want %q", raw, n.Relay, err, want)
+		}
+	}
+	if n, _ = resolveWGNetwork(wgNetwork{Relay: "ws:8443"}); n.RelayPort() != 8443 || !n.RelayWebSocket() || defaultWGNetwork().RelayPort() != 0 {
+		t.Fatalf("unexpected relay accessors for %q", n.Relay)
+	}
+
+	for raw, want := range map[string]string{"home.example.net": "home.example.net:51820", "203.0.113.9:4500": "203.0.113.9:4500", "[2001:db8::9]": "[2001:db8::9]:51820"} {
+		n, err = resolveWGNetwork(wgNetwork{Rendezvous: raw})
+		if err != nil || n.Rendezvous != want || !n.Reverse() {
+			t.Fatalf("rendezvous %q: got %q, %v want %q", raw, n.Rendezvous, err, want)
+		}
+	}
+
+	for _, bad := range []wgNetwork{
+		{Rendezvous: "home.example.net:0"},
+		{Rendezvous: "home example"},
+		{Rendezvous: "home.example.net", Relay: "tcp"},
+		{Subnet6: "2001:db8::/64"},
+		{Mode: "bogus"},
+		{Relay: "udp:443"},
+		{Relay: "tcp:0"},
+		{Relay: "tcp:https"},
+		{Mode: wgModeUserspace, Relay: "ws"},
+		{Subnet6: "10.0.0.0/24"},
+		{Subnet6: "fd00::/124"},
+		{Subnet6: "fd00::"},
+		{Interface: "wg 0"},
+		{Interface: "an-interface-name-too-long"},
+		{Port: 70000},
+		{Subnet: "fd00::/64"},
+		{Subnet: "10.0.0.0/30"},
+		{Subnet: "10.0.0.0"},
+		{ServerIP: "10.0.1.1"},
+		{DesktopIP: "10.0.0.0"},
+		{MobileIP: "10.0.0.255"},
+		{MobileIP: "10.0.0.2"},
+	} {
+		if _, err := resolveWGNetwork(bad); err == nil {
+			t.Fatalf("expected %+v to be rejected", bad)
+		}
+	}
 }
 
 func TestWGPublicKeyFromPrivateKeyB64_MatchesGenerated(t *testing.T) {
@@ -78,7 +345,7 @@ func TestWGPublicKeyFromPrivateKeyB64_MatchesGenerated(t *testing.T) {
 	}
 }
 
-func TestPatchWGPeerInConf_UpdatesMatchingAllowedIPs(t *testing.T) {
+func TestPatchWGPeer_UpdatesMatchingAllowedIPs(t *testing.T) {
 	conf := strings.Join([]string{
 		"[Interface]",
 		"Address = 10.66.66.2/32",
@@ -91,10 +358,15 @@ func TestPatchWGPeerInConf_UpdatesMatchingAllowedIPs(t *testing.T) {
 		"",
 	}, "\n")
 
-	out, changed, err := patchWGPeerInConf(conf, "10.66.66.1/32", "NEWPUB", "example.com:51820", "25")
+	c, err := wgconf.Parse(conf)
 	if err != nil {
-		t.Fatalf("patchWGPeerInConf: %v", err)
+		t.Fatalf("wgconf.Parse: %v", err)
 	}
+	changed, err := patchWGPeer(c, "10.66.66.1/32", "NEWPUB", "example.com:51820", 25)
+	if err != nil {
+		t.Fatalf("patchWGPeer: %v", err)
+	}
+	out := c.String()
 	if !changed {
 		t.Fatalf("expected changed=true")
 	}
@@ -121,3 +393,16 @@ func TestParseOSRelease_ID(t *testing.T) {
 		t.Fatalf("expected VERSION_ID 24.04, got %q", m["VERSION_ID"])
 	}
 }
+
+func TestExecLocal_StopsWhenContextIsCancelled(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := execLocal(ctx, "sleep", "10")
+	if err == nil || !strings.Contains(err.Error(), "interrupted") {
+		t.Fatalf("expected interrupted error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed >= localCancelGrace {
+		t.Fatalf("command did not stop promptly: %s", elapsed)
+	}
+}
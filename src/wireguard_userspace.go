@@ -0,0 +1,434 @@
+package main
+
+import (
+	"arc/internal/app"
+	"arc/internal/wgconf"
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/tun/netstack"
+)
+
+const (
+	// userspaceWGUnitPrefix names the user unit that runs `arc tunnel` for an interface.
+	userspaceWGUnitPrefix = "arc-wg-userspace-"
+	// userspaceWGBinName is the copy of arc in ~/.local/bin the unit runs, so it survives the
+	// binary the user ran setup with moving or being rebuilt.
+	userspaceWGBinName = "arc-wg-userspace"
+	// userspaceWGForwardIP is the loopback address the userspace tunnel publishes the
+	// server's services on. Any 127/8 address is local on Linux without configuration.
+	userspaceWGForwardIP = "127.0.80.1"
+	// userspaceWGSSHPort is where the tunnel publishes the server's sshd. Ports above 1023
+	// can be bound without root.
+	userspaceWGSSHPort = 2222
+	// userspaceWGMTU is the tunnel MTU when the config sets none, as wg-quick's default.
+	userspaceWGMTU = 1420
+	// nfsPort is the only port NFSv4 needs.
+	nfsPort = 2049
+)
+
+// userspaceForward publishes port Remote of the server's tunnel address on port Local of
+// userspaceWGForwardIP.
+type userspaceForward struct {
+	Local  int
+	Remote int
+}
+
+// userspaceWGForwards are the services local tools reach the server on: sshd, at its public
+// port on the server but at userspaceWGSSHPort locally, and NFS.
+func userspaceWGForwards(sshPort int) []userspaceForward {
+	return []userspaceForward{{Local: userspaceWGSSHPort, Remote: sshPort}, {Local: nfsPort, Remote: nfsPort}}
+}
+
+// userspaceIPC renders conf as a wireguard-go UAPI set operation. UAPI takes keys in hex and
+// endpoints as addresses, so host names are looked up with resolve.
+func userspaceIPC(conf *wgconf.Config, resolve func(hostport string) (string, error)) (string, error) {
+	var sb strings.Builder
+	key, err := wgKeyHex(conf.Interface.PrivateKey)
+	if err != nil {
+		return "", fmt.Errorf("PrivateKey: %w", err)
+	}
+	fmt.Fprintf(&sb, "private_key=%s\n", key)
+	if conf.Interface.ListenPort > 0 {
+		fmt.Fprintf(&sb, "listen_port=%d\n", conf.Interface.ListenPort)
+	}
+	sb.WriteString("replace_peers=true\n")
+	for _, p := range conf.Peers {
+		pub, err := wgKeyHex(p.PublicKey)
+		if err != nil {
+			return "", fmt.Errorf("peer PublicKey: %w", err)
+		}
+		fmt.Fprintf(&sb, "public_key=%s\nreplace_allowed_ips=true\n", pub)
+		if p.PresharedKey != "" {
+			psk, err := wgKeyHex(p.PresharedKey)
+			if err != nil {
+				return "", fmt.Errorf("peer PresharedKey: %w", err)
+			}
+			fmt.Fprintf(&sb, "preshared_key=%s\n", psk)
+		}
+		if p.Endpoint != "" {
+			endpoint, err := resolve(p.Endpoint)
+			if err != nil {
+				return "", fmt.Errorf("resolve endpoint %s: %w", p.Endpoint, err)
+			}
+			fmt.Fprintf(&sb, "endpoint=%s\n", endpoint)
+		}
+		if p.PersistentKeepalive > 0 {
+			fmt.Fprintf(&sb, "persistent_keepalive_interval=%d\n", p.PersistentKeepalive)
+		}
+		for _, ip := range p.AllowedIPs {
+			fmt.Fprintf(&sb, "allowed_ip=%s\n", ip)
+		}
+	}
+	return sb.String(), nil
+}
+
+func wgKeyHex(b64 string) (string, error) {
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(b64))
+	if err != nil || len(raw) != 32 {
+		return "", fmt.Errorf("not a base64 WireGuard key")
+	}
+	return hex.EncodeToString(raw), nil
+}
+
+func resolveUDPEndpoint(hostport string) (string, error) {
+	addr, err := net.ResolveUDPAddr("udp", hostport)
+	if err != nil {
+		return "", err
+	}
+	// The resolver returns IPv4 addresses in their IPv6-mapped form, which wireguard-go would
+	// send from its IPv6 socket.
+	ap := addr.AddrPort()
+	return netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port()).String(), nil
+}
+
+// userspaceTunnel is one end of the tunnel in this process: wireguard-go on a gVisor network
+// stack that holds the config's addresses.
+type userspaceTunnel struct {
+	dev  *device.Device
+	net  *netstack.Net
+	uapi net.Listener
+}
+
+// startUserspaceTunnel brings up conf as interface iface.
+func startUserspaceTunnel(iface string, conf *wgconf.Config) (*userspaceTunnel, error) {
+	var addrs []netip.Addr
+	for _, a := range conf.Interface.Address {
+		p, err := netip.ParsePrefix(a)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Address %q: %w", a, err)
+		}
+		addrs = append(addrs, p.Addr())
+	}
+	mtu := conf.Interface.MTU
+	if mtu == 0 {
+		mtu = userspaceWGMTU
+	}
+	settings, err := userspaceIPC(conf, resolveUDPEndpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	tun, tnet, err := netstack.CreateNetTUN(addrs, nil, mtu)
+	if err != nil {
+		return nil, fmt.Errorf("create userspace network stack: %w", err)
+	}
+	dev := device.NewDevice(tun, conn.NewDefaultBind(), device.NewLogger(device.LogLevelError, iface+": "))
+	if err := dev.IpcSet(settings); err != nil {
+		dev.Close()
+		return nil, fmt.Errorf("configure %s: %w", iface, err)
+	}
+	if err := dev.Up(); err != nil {
+		dev.Close()
+		return nil, fmt.Errorf("bring up %s: %w", iface, err)
+	}
+	return &userspaceTunnel{dev: dev, net: tnet}, nil
+}
+
+// serveUAPI publishes the tunnel's control socket for iface in the user's runtime directory,
+// where `arc status` reads the peers. `wg` only looks in /var/run/wireguard, which needs root.
+func (t *userspaceTunnel) serveUAPI(iface string) error {
+	path := userspaceWGSocketPath(iface)
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	// A socket left by a tunnel that did not exit cleanly would fail the listen.
+	_ = os.Remove(path)
+	var err error
+	if t.uapi, err = net.Listen("unix", path); err != nil {
+		return err
+	}
+	go func() {
+		for {
+			c, err := t.uapi.Accept()
+			if err != nil {
+				return
+			}
+			go t.dev.IpcHandle(c)
+		}
+	}()
+	return nil
+}
+
+func (t *userspaceTunnel) Close() {
+	if t.uapi != nil {
+		_ = t.uapi.Close()
+	}
+	t.dev.Close()
+}
+
+// DialContext dials a TCP address through the tunnel.
+func (t *userspaceTunnel) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return t.net.DialContext(ctx, network, address)
+}
+
+// forward accepts connections on ln, which listens on port f.Local, and relays each to
+// serverIP:f.Remote through the tunnel, until ln is closed.
+func (t *userspaceTunnel) forward(ctx context.Context, ln net.Listener, serverIP string, f userspaceForward, logf func(string, ...any)) {
+	target := net.JoinHostPort(serverIP, strconv.Itoa(f.Remote))
+	for {
+		local, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			remote, err := t.DialContext(ctx, "tcp", target)
+			if err != nil {
+				logf("dial %s through the tunnel: %v", target, err)
+				_ = local.Close()
+				return
+			}
+			relayConns(local, remote)
+		}()
+	}
+}
+
+// relayConns copies both ways until each side has finished sending, then closes both.
+func relayConns(a, b net.Conn) {
+	var wg sync.WaitGroup
+	half := func(dst, src net.Conn) {
+		defer wg.Done()
+		_, _ = io.Copy(dst, src)
+		if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+			_ = cw.CloseWrite()
+		} else {
+			_ = dst.Close()
+		}
+	}
+	wg.Add(2)
+	go half(a, b)
+	go half(b, a)
+	wg.Wait()
+	_ = a.Close()
+	_ = b.Close()
+}
+
+// runUserspaceTunnel runs conf as iface in this process and publishes the server's sshd
+// (at sshPort on serverIP) and NFS on userspaceWGForwardIP until ctx is done.
+func runUserspaceTunnel(ctx context.Context, iface string, conf *wgconf.Config, serverIP string, sshPort int, logf func(string, ...any)) error {
+	t, err := startUserspaceTunnel(iface, conf)
+	if err != nil {
+		return err
+	}
+	defer t.Close()
+	if err := t.serveUAPI(iface); err != nil {
+		logf("no control socket for %s, `arc status` will not see its peers: %v", iface, err)
+	}
+
+	var listeners []net.Listener
+	defer func() {
+		for _, ln := range listeners {
+			_ = ln.Close()
+		}
+	}()
+	for _, f := range userspaceWGForwards(sshPort) {
+		addr := net.JoinHostPort(userspaceWGForwardIP, strconv.Itoa(f.Local))
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			return fmt.Errorf("listen on %s: %w", addr, err)
+		}
+		listeners = append(listeners, ln)
+		go t.forward(ctx, ln, serverIP, f, logf)
+	}
+
+	select {
+	case <-ctx.Done():
+		return nil
+	case <-t.dev.Wait():
+		return errors.New("WireGuard device stopped")
+	}
+}
+
+// renderUserspaceWGUnit is the user unit that keeps `arc tunnel` up for n. Nothing it does
+// needs root: its config is in ~/.arc and its forwards use unprivileged ports.
+func renderUserspaceWGUnit(n wgNetwork, sshPort int) (string, error) {
+	bin, err := userspaceWGBinPath()
+	if err != nil {
+		return "", err
+	}
+	return renderTemplateFile("templates/arc_wg_userspace.service.tmpl", map[string]string{
+		"Bin":       bin,
+		"Interface": n.Interface,
+		"ServerIP":  n.ServerIP,
+		"SSHPort":   strconv.Itoa(sshPort),
+	})
+}
+
+// userspaceWGUnitPath is where the user unit of n's interface is installed.
+func userspaceWGUnitPath(n wgNetwork) (string, error) {
+	_, systemdDir, _, err := arcConfigPaths()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(systemdDir, n.LocalUnit()), nil
+}
+
+func userspaceWGBinPath() (string, error) {
+	_, _, binDir, err := arcConfigPaths()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(binDir, userspaceWGBinName), nil
+}
+
+// userspaceWGConfPath is the config `arc tunnel` reads for iface, kept next to the copies
+// setup saves in ~/.arc/wireguard.
+func userspaceWGConfPath(iface string) (string, error) {
+	dir, err := arcHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "wireguard", iface+".conf"), nil
+}
+
+// userspaceWGSocketPath is the control socket of the tunnel iface, in the user's runtime
+// directory.
+func userspaceWGSocketPath(iface string) string {
+	dir := os.Getenv("XDG_RUNTIME_DIR")
+	if dir == "" {
+		dir = fmt.Sprintf("/run/user/%d", os.Getuid())
+	}
+	return filepath.Join(dir, "arc", iface+".sock")
+}
+
+// userspaceWGPeers reads the peers of the tunnel iface from its control socket, as
+// `wg show IFACE dump` does for a kernel interface.
+func userspaceWGPeers(ctx context.Context, iface string) ([]app.WGPeerStatus, error) {
+	var d net.Dialer
+	c, err := d.DialContext(ctx, "unix", userspaceWGSocketPath(iface))
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = c.SetDeadline(deadline)
+	}
+	if _, err := io.WriteString(c, "get=1\n\n"); err != nil {
+		return nil, err
+	}
+	return parseUAPIPeers(c)
+}
+
+// parseUAPIPeers reads the peers of a UAPI get reply, up to the blank line that ends it. Keys
+// come in hex there; public keys are converted to base64 as wg prints them, and the private
+// and preshared keys are skipped.
+func parseUAPIPeers(r io.Reader) ([]app.WGPeerStatus, error) {
+	var peers []app.WGPeerStatus
+	var peer *app.WGPeerStatus
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line := sc.Text()
+		if line == "" {
+			return peers, nil
+		}
+		key, value, _ := strings.Cut(line, "=")
+		switch key {
+		case "errno":
+			if value != "0" {
+				return nil, fmt.Errorf("control socket: errno %s", value)
+			}
+		case "public_key":
+			raw, err := hex.DecodeString(value)
+			if err != nil {
+				return nil, fmt.Errorf("control socket: invalid public key")
+			}
+			peers = append(peers, app.WGPeerStatus{PublicKey: base64.StdEncoding.EncodeToString(raw)})
+			peer = &peers[len(peers)-1]
+		}
+		if peer == nil {
+			continue
+		}
+		switch key {
+		case "endpoint":
+			peer.Endpoint = value
+		case "last_handshake_time_sec":
+			if ts, err := strconv.ParseInt(value, 10, 64); err == nil && ts > 0 {
+				peer.LatestHandshake = time.Unix(ts, 0)
+			}
+		case "rx_bytes":
+			peer.RxBytes, _ = strconv.ParseInt(value, 10, 64)
+		case "tx_bytes":
+			peer.TxBytes, _ = strconv.ParseInt(value, 10, 64)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return nil, io.ErrUnexpectedEOF
+}
+
+// localWGConfPath is this machine's config of n: wg-quick's, or the userspace tunnel's.
+func localWGConfPath(n wgNetwork) (string, error) {
+	if n.Userspace() {
+		return userspaceWGConfPath(n.Interface)
+	}
+	return n.ConfPath(), nil
+}
+
+// readLocalWGConf reads this machine's config of n, through sudo only for wg-quick's. The
+// read stays out of the step output, which would show its keys.
+func readLocalWGConf(ctx context.Context, n wgNetwork) (string, error) {
+	if !n.Userspace() {
+		return execLocal(withoutStepOutput(ctx), "sudo", "-n", "cat", n.ConfPath())
+	}
+	path, err := userspaceWGConfPath(n.Interface)
+	if err != nil {
+		return "", err
+	}
+	raw, err := os.ReadFile(path)
+	return string(raw), err
+}
+
+// localWGSystemctl runs systemctl for n's local tunnel unit: wg-quick's system unit through
+// sudo, or the userspace tunnel's user unit.
+func localWGSystemctl(ctx context.Context, n wgNetwork, args ...string) (string, error) {
+	if n.Userspace() {
+		return execLocal(ctx, "systemctl", append([]string{"--user"}, args...)...)
+	}
+	return execLocal(ctx, "sudo", append([]string{"-n", "systemctl"}, args...)...)
+}
+
+// sshPortOf is the port of an SSH target address, 22 when it has none.
+func sshPortOf(addr string) int {
+	if _, p, err := net.SplitHostPort(addr); err == nil {
+		if port, err := strconv.Atoi(p); err == nil && port > 0 {
+			return port
+		}
+	}
+	return 22
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"arc/internal/wgconf"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUserspaceIPC(t *testing.T) {
+	priv, pub, err := genWGKeyPair()
+	if err != nil {
+		t.Fatalf("genWGKeyPair: %v", err)
+	}
+	psk, err := genWGPresharedKey()
+	if err != nil {
+		t.Fatalf("genWGPresharedKey: %v", err)
+	}
+	conf := &wgconf.Config{
+		Interface: wgconf.Interface{PrivateKey: priv, Address: []string{"10.0.0.2/32"}},
+		Peers: []wgconf.Peer{{
+			PublicKey:           pub,
+			PresharedKey:        psk,
+			Endpoint:            "vps.example.com:51820",
+			AllowedIPs:          []string{"10.0.0.1/32", "fd00::1/128"},
+			PersistentKeepalive: 25,
+		}},
+	}
+	var resolved string
+	got, err := userspaceIPC(conf, func(hostport string) (string, error) {
+		resolved = hostport
+		return "203.0.113.7:51820", nil
+	})
+	if err != nil {
+		t.Fatalf("userspaceIPC: %v", err)
+	}
+	hexOf := func(b64 string) string {
+		raw, _ := base64.StdEncoding.DecodeString(b64)
+		return hex.EncodeToString(raw)
+	}
+	want := strings.Join([]string{
+		"private_key=" + hexOf(priv),
+		"replace_peers=true",
+		"public_key=" + hexOf(pub),
+		"replace_allowed_ips=true",
+		"preshared_key=" + hexOf(psk),
+		"endpoint=203.0.113.7:51820",
+		"persistent_keepalive_interval=25",
+		"allowed_ip=10.0.0.1/32",
+		"allowed_ip=fd00::1/128",
+	}, "\n") + "\n"
+	if got != want {
+		t.Fatalf("unexpected UAPI settings:\n got: %q\nwant: %q", got, want)
+	}
+	if resolved != "vps.example.com:51820" {
+		t.Fatalf("endpoint should be resolved, got %q", resolved)
+	}
+
+	conf.Peers[0].PublicKey = "not-a-key"
+	if _, err := userspaceIPC(conf, resolveUDPEndpoint); err == nil {
+		t.Fatalf("expected an invalid peer key to be rejected")
+	}
+}
+
+func TestUserspaceTunnel_RelaysTCP(t *testing.T) {
+	serverPriv, serverPub, err := genWGKeyPair()
+	if err != nil {
+		t.Fatalf("genWGKeyPair: %v", err)
+	}
+	clientPriv, clientPub, err := genWGKeyPair()
+	if err != nil {
+		t.Fatalf("genWGKeyPair: %v", err)
+	}
+	psk, err := genWGPresharedKey()
+	if err != nil {
+		t.Fatalf("genWGPresharedKey: %v", err)
+	}
+	probe, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("find a free UDP port: %v", err)
+	}
+	port := probe.LocalAddr().(*net.UDPAddr).Port
+	_ = probe.Close()
+
+	server, err := startUserspaceTunnel("wgtest0", &wgconf.Config{
+		Interface: wgconf.Interface{PrivateKey: serverPriv, Address: []string{"10.0.0.1/24"}, ListenPort: port},
+		Peers:     []wgconf.Peer{{PublicKey: clientPub, PresharedKey: psk, AllowedIPs: []string{"10.0.0.2/32"}}},
+	})
+	if err != nil {
+		t.Fatalf("start server tunnel: %v", err)
+	}
+	defer server.Close()
+	client, err := startUserspaceTunnel("wgtest1", &wgconf.Config{
+		Interface: wgconf.Interface{PrivateKey: clientPriv, Address: []string{"10.0.0.2/32"}},
+		Peers: []wgconf.Peer{{
+			PublicKey:    serverPub,
+			PresharedKey: psk,
+			Endpoint:     "127.0.0.1:" + strconv.Itoa(port),
+			AllowedIPs:   []string{"10.0.0.1/32"},
+		}},
+	})
+	if err != nil {
+		t.Fatalf("start client tunnel: %v", err)
+	}
+	defer client.Close()
+
+	// A stand-in for sshd on the server's tunnel address.
+	ln, err := server.net.ListenTCP(&net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 2222})
+	if err != nil {
+		t.Fatalf("listen in the server's stack: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		_, _ = io.WriteString(c, "SSH-2.0-test\r\n")
+		_, _ = io.Copy(c, c)
+	}()
+
+	// Publish it locally the way runUserspaceTunnel does, on a loopback port of our own.
+	local, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen locally: %v", err)
+	}
+	defer local.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	go client.forward(ctx, local, "10.0.0.1", userspaceForward{Local: 22, Remote: 2222}, t.Logf)
+
+	c, err := net.DialTimeout("tcp", local.Addr().String(), 5*time.Second)
+	if err != nil {
+		t.Fatalf("dial the forward: %v", err)
+	}
+	defer c.Close()
+	_ = c.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := io.WriteString(c, "ping"); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	want := "SSH-2.0-test\r\nping"
+	buf := make([]byte, len(want))
+	if _, err := io.ReadFull(c, buf); err != nil {
+		t.Fatalf("read through the tunnel: %v", err)
+	}
+	if string(buf) != want {
+		t.Fatalf("got %q want %q", buf, want)
+	}
+}
+
+func TestRenderUserspaceWGUnit(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	n := defaultWGNetwork()
+	n.Mode = wgModeUserspace
+	got, err := renderUserspaceWGUnit(n, 2222)
+	if err != nil {
+		t.Fatalf("renderUserspaceWGUnit: %v", err)
+	}
+	if !strings.Contains(got, "ExecStart="+home+"/.local/bin/arc-wg-userspace tunnel --server-ip 10.0.0.1 --ssh-port 2222 wg0\n") {
+		t.Fatalf("unexpected unit:\n%s", got)
+	}
+	if !strings.Contains(got, "WantedBy=default.target") {
+		t.Fatalf("not a user unit:\n%s", got)
+	}
+	if p, err := userspaceWGUnitPath(n); err != nil || p != home+"/.config/systemd/user/arc-wg-userspace-wg0.service" {
+		t.Fatalf("unexpected unit path %q (%v)", p, err)
+	}
+	if p, err := userspaceWGConfPath(n.Interface); err != nil || p != home+"/.arc/wireguard/wg0.conf" {
+		t.Fatalf("unexpected config path %q (%v)", p, err)
+	}
+}
+
+func TestParseUAPIPeers(t *testing.T) {
+	pub := strings.Repeat("ab", 32)
+	reply := "private_key=" + strings.Repeat("11", 32) + "\nlisten_port=51820\n" +
+		"public_key=" + pub + "\npreshared_key=" + strings.Repeat("22", 32) + "\nprotocol_version=1\n" +
+		"endpoint=203.0.113.7:51820\nlast_handshake_time_sec=1700000000\nlast_handshake_time_nsec=0\n" +
+		"tx_bytes=10\nrx_bytes=20\npersistent_keepalive_interval=25\nallowed_ip=10.0.0.1/32\n" +
+		"public_key=" + strings.Repeat("cd", 32) + "\nlast_handshake_time_sec=0\n" +
+		"errno=0\n\n"
+	peers, err := parseUAPIPeers(strings.NewReader(reply))
+	if err != nil {
+		t.Fatalf("parseUAPIPeers: %v", err)
+	}
+	raw, _ := hex.DecodeString(pub)
+	if len(peers) != 2 || peers[0].PublicKey != base64.StdEncoding.EncodeToString(raw) || peers[0].Endpoint != "203.0.113.7:51820" ||
+		peers[0].LatestHandshake.Unix() != 1700000000 || peers[0].RxBytes != 20 || peers[0].TxBytes != 10 || !peers[1].LatestHandshake.IsZero() {
+		t.Fatalf("unexpected peers %#v", peers)
+	}
+	if _, err := parseUAPIPeers(strings.NewReader("errno=1\n\n")); err == nil {
+		t.Fatal("a failed get must be an error")
+	}
+	if _, err := parseUAPIPeers(strings.NewReader("public_key=" + pub + "\n")); err == nil {
+		t.Fatal("a truncated reply must be an error")
+	}
+}
+
+func TestSSHPortOf(t *testing.T) {
+	for addr, want := range map[string]int{"vps:2222": 2222, "vps": 22, "[2001:db8::1]:22": 22, "vps:x": 22} {
+		if got := sshPortOf(addr); got != want {
+			t.Fatalf("sshPortOf(%q) = %d, want %d", addr, got, want)
+		}
+	}
+}